@@ -0,0 +1,97 @@
+package api
+
+import (
+	"time"
+
+	uuidlib "github.com/google/uuid"
+)
+
+// BackupVersion is the version of the backup format written by the server.
+const BackupVersion = 1
+
+type (
+	// Backup is a snapshot of the server state. It contains all secrets.
+	// Backups can be restored into a running server or on its start.
+	Backup struct {
+		Version int          `json:"version"`
+		Time    time.Time    `json:"time"`
+		Fifos   []FifoBackup `json:"fifos"`
+	}
+	FifoBackup struct {
+		Namespace   string       `json:"namespace"`
+		UUID        uuidlib.UUID `json:"uuid"`
+		OwnerSecret string       `json:"owner_secret"`
+		// Name is empty if the fifo has no name.
+		Name string `json:"name,omitempty"`
+		// Timeouts are given as Go durations like "5m".
+		WaitTimeout          string `json:"wait_timeout"`
+		DoneTimeout          string `json:"done_timeout"`
+		UnusedDestroyTimeout string `json:"unused_destroy_timeout"`
+		Webhook              string `json:"webhook,omitempty"`
+		// WebhookSecret is empty if the webhook is signed with the owner
+		// secret.
+		WebhookSecret string   `json:"webhook_secret,omitempty"`
+		WebhookEvents []string `json:"webhook_events,omitempty"`
+		WaiterPolicy  string   `json:"waiter_policy,omitempty"`
+		// Tickets holds the active ticket, if any, followed by the queue.
+		Tickets []TicketBackup     `json:"tickets"`
+		History []FifoHistoryEntry `json:"history,omitempty"`
+	}
+	RestoreResponse struct {
+		// Fifos is the number of restored fifos.
+		Fifos int `json:"fifos"`
+	}
+	GCResponse struct {
+		// Fifos is the number of swept fifos.
+		Fifos int `json:"fifos"`
+		// HistoryEntries is the number of dropped history entries.
+		HistoryEntries int `json:"history_entries"`
+		// Events is the number of dropped entries of the event logs.
+		Events int `json:"events"`
+	}
+	DeadlocksResponse struct {
+		Deadlocks []Deadlock `json:"deadlocks"`
+	}
+	// QuotasResponse is the usage of all clients and namespaces that hold
+	// resources.
+	QuotasResponse struct {
+		Clients    map[string]QuotaUsage `json:"clients"`
+		Namespaces map[string]QuotaUsage `json:"namespaces"`
+	}
+	// Deadlock is a cycle of clients, each waiting for a fifo held by the
+	// next one. Only tickets with a client identity are taken into account.
+	Deadlock struct {
+		Waits []DeadlockWait `json:"waits"`
+	}
+	// DeadlockWait is a client waiting with the ticket for the fifo held by
+	// another client.
+	DeadlockWait struct {
+		Identity  string       `json:"identity"`
+		Namespace string       `json:"namespace"`
+		UUID      uuidlib.UUID `json:"uuid"`
+		TicketID  uuidlib.UUID `json:"ticket"`
+		// Holder is the identity of the client holding the fifo.
+		Holder string `json:"holder"`
+	}
+	LogLevelRequest struct {
+		// Level is one of debug, info, warn, error.
+		Level string `json:"level"`
+	}
+	LogLevelResponse struct {
+		Level string `json:"level"`
+	}
+	TicketBackup struct {
+		TicketID uuidlib.UUID `json:"ticket"`
+		Secret   string       `json:"secret"`
+		Identity string       `json:"identity,omitempty"`
+		TraceID  string       `json:"trace_id,omitempty"`
+		// State is restored for accepted tickets only, others are queued
+		// and notified again.
+		State      string     `json:"state"`
+		CreatedAt  time.Time  `json:"created_at"`
+		NotifiedAt *time.Time `json:"notified_at,omitempty"`
+		AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+		// After are the tickets the ticket still waits for to end.
+		After []FifoTicketRef `json:"after,omitempty"`
+	}
+)
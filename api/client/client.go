@@ -2,68 +2,345 @@ package client
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net/http"
 	"net/url"
+	"runtime/debug"
+	"sync"
+	"time"
 
+	uuidlib "github.com/google/uuid"
 	"github.com/katexochen/sync/api"
 	ihttp "github.com/katexochen/sync/internal/http"
 )
 
 type Fifo struct {
-	endpoint   string
-	client     *ihttp.Client
-	fifoUUID   string
-	ticketUUID string
+	endpoint    string
+	client      *ihttp.Client
+	namespace   string
+	fifoUUID    string
+	ownerSecret string
+
+	heartbeatInterval time.Duration
+	clientOpts        []ihttp.Option
+	// newRequest is sent on creation of the fifo.
+	newRequest         api.FifoNewRequest
+	cancelOnDisconnect bool
+	keepTicketOnCancel bool
+	keepalive          time.Duration
+	// poll makes waits poll the state of the ticket instead of blocking.
+	poll bool
+	// waitToken identifies the waits of this Fifo to fifos with
+	// api.WaiterPolicyToken.
+	waitToken string
+
+	mux sync.Mutex
+	// ticket is the ticket taken with Ticket, see currentTicket.
+	ticket *Ticket
+}
+
+// Option configures a Fifo.
+type Option func(*Fifo)
+
+// WithHeartbeat makes the Fifo send heartbeats in the given interval
+// while it owns the ticket, which is after Wait returned and before Done
+// is called. Heartbeats extend the server-side done timeout.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(f *Fifo) {
+		f.heartbeatInterval = interval
+	}
+}
+
+// WithToken sets the bearer token used to authenticate against the server.
+func WithToken(token string) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithToken(token))
+	}
+}
+
+// WithTLSConfig sets the TLS configuration, for example to trust a private
+// CA or to present a client certificate.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithTLSConfig(cfg))
+	}
+}
+
+// WithHTTPClient sends requests with a copy of hc, for example to use a
+// custom transport. The proxy, CA and timeout options don't configure the
+// transport of hc.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithHTTPClient(hc))
+	}
+}
+
+// WithCACerts trusts the given CA certificates in addition to the system
+// roots.
+func WithCACerts(certs ...*x509.Certificate) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithCACerts(certs...))
+	}
+}
+
+// WithProxy sends requests through the proxy at proxyURL, or directly if it
+// is nil, instead of the proxy configured in the environment.
+func WithProxy(proxyURL *url.URL) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithProxy(proxyURL))
+	}
 }
 
-func NewFifo(ctx context.Context, endpoint string) (*Fifo, error) {
+// WithDialTimeout bounds the time to establish a connection to the server.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithDialTimeout(timeout))
+	}
+}
+
+// WithRequestTimeout bounds the time of each request. As Wait blocks until
+// the ticket is due, the timeout must be longer than the wait timeout of the
+// fifo.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithTimeout(timeout))
+	}
+}
+
+// WithUserAgent sets the User-Agent header, which defaults to
+// sync-go-client and the module version.
+func WithUserAgent(userAgent string) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithUserAgent(userAgent))
+	}
+}
+
+// WithRetries makes calls retry failed requests up to retries times, with
+// the delay starting at backoff and doubling with every retry. Requests are
+// only retried if that is safe. By default, requests are retried 3 times,
+// starting after a second. Wait retries until its context is done.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithRetries(ihttp.RetryPolicy{Retries: retries, Backoff: backoff}))
+	}
+}
+
+// WithIdentity sets the client identity that is recorded on tickets.
+// It is ignored if the server derives the identity from the token.
+func WithIdentity(identity string) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithHeader(api.IdentityHeader, identity))
+	}
+}
+
+// WithTraceparent links the tickets taken to a trace, given as traceparent
+// in the W3C Trace Context format. The trace ID is recorded on the events of
+// the tickets.
+func WithTraceparent(traceparent string) Option {
+	return func(f *Fifo) {
+		f.clientOpts = append(f.clientOpts, ihttp.WithHeader(api.TraceparentHeader, traceparent))
+	}
+}
+
+// WithFifoTimeouts overrides the server defaults of the timeouts of a fifo
+// created with NewFifo. Zero values keep the server default.
+func WithFifoTimeouts(wait, done, unusedDestroy time.Duration) Option {
+	return func(f *Fifo) {
+		f.newRequest.WaitTimeout = durationOrEmpty(wait)
+		f.newRequest.DoneTimeout = durationOrEmpty(done)
+		f.newRequest.UnusedDestroyTimeout = durationOrEmpty(unusedDestroy)
+	}
+}
+
+// WithFifoWebhook sets a URL that receives the events of a fifo created with
+// NewFifo. The payloads are signed with the owner secret, unless a secret is
+// given by WithFifoWebhookSecret.
+func WithFifoWebhook(url string) Option {
+	return func(f *Fifo) {
+		f.newRequest.Webhook = url
+	}
+}
+
+// WithFifoWebhookSecret sets the key the payloads of the webhook are signed
+// with.
+func WithFifoWebhookSecret(secret string) Option {
+	return func(f *Fifo) {
+		f.newRequest.WebhookSecret = secret
+	}
+}
+
+// WithFifoWebhookEvents limits the events delivered to the webhook, like
+// api.EventTicketExpired.
+func WithFifoWebhookEvents(events ...string) Option {
+	return func(f *Fifo) {
+		f.newRequest.WebhookEvents = events
+	}
+}
+
+// WithWaiterPolicy sets which of multiple waits on the same ticket of a fifo
+// created with NewFifo get its turn, like api.WaiterPolicyFirst.
+func WithWaiterPolicy(policy string) Option {
+	return func(f *Fifo) {
+		f.newRequest.WaiterPolicy = policy
+	}
+}
+
+// WithWaitToken sets the token that identifies waits to fifos with
+// api.WaiterPolicyToken, so processes sharing it can wait for the same
+// ticket. By default, each Fifo has a random token.
+func WithWaitToken(token string) Option {
+	return func(f *Fifo) {
+		f.waitToken = token
+	}
+}
+
+// WithCancelOnDisconnect makes the server drop the ticket from the queue
+// if Wait is interrupted, for example because its context is canceled.
+// Waits are not retried then, as the ticket is lost with the connection.
+func WithCancelOnDisconnect() Option {
+	return func(f *Fifo) {
+		f.cancelOnDisconnect = true
+	}
+}
+
+// WithoutAutoCancel keeps the ticket queued if the context of Wait is done
+// before it's the turn of the ticket, so waiting can be resumed later. The
+// ticket expires if it isn't waited for in time once it's its turn.
+func WithoutAutoCancel() Option {
+	return func(f *Fifo) {
+		f.keepTicketOnCancel = true
+	}
+}
+
+// WithKeepalive makes the server send keepalive bytes in the given interval
+// while Wait blocks, so proxies don't close the connection as idle.
+func WithKeepalive(interval time.Duration) Option {
+	return func(f *Fifo) {
+		f.keepalive = interval
+	}
+}
+
+// WithPolling makes Wait poll the state of the ticket in the interval the
+// server asks for, instead of holding a connection open until the turn of
+// the ticket, for clients behind proxies that cut long requests.
+func WithPolling() Option {
+	return func(f *Fifo) {
+		f.poll = true
+	}
+}
+
+// WithNamespace sets the namespace the fifo lives in.
+func WithNamespace(namespace string) Option {
+	return func(f *Fifo) {
+		f.namespace = namespace
+	}
+}
+
+// WithOwnerSecret sets the owner secret of the fifo, which is required
+// for destructive operations. Fifos created with NewFifo already know
+// their owner secret.
+func WithOwnerSecret(secret string) Option {
+	return func(f *Fifo) {
+		f.ownerSecret = secret
+	}
+}
+
+func NewFifo(ctx context.Context, endpoint string, opts ...Option) (*Fifo, error) {
 	f := &Fifo{
-		endpoint: endpoint,
-		client:   ihttp.NewClient(),
+		endpoint:   endpoint,
+		clientOpts: defaultClientOpts(),
+		waitToken:  uuidlib.NewString(),
+	}
+	for _, opt := range opts {
+		opt(f)
 	}
+	f.client = ihttp.NewClient(f.clientOpts...)
 
-	url, err := urlJoin(endpoint, "fifo", "new")
+	url, err := f.fifoURL("new")
 	if err != nil {
 		return nil, err
 	}
 	resp := &api.FifoNewResponse{}
-	if err := f.client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
+	if err := f.client.RequestJSON(ctx, url, f.newRequest, resp); err != nil {
 		return nil, err
 	}
 
 	f.fifoUUID = resp.UUID.String()
+	f.ownerSecret = resp.OwnerSecret
 	return f, nil
 }
 
-func FifoFromUUID(endpoint, uuid string) *Fifo {
+func FifoFromUUID(endpoint, uuid string, opts ...Option) *Fifo {
 	f := &Fifo{
-		endpoint: endpoint,
-		client:   ihttp.NewClient(),
-		fifoUUID: uuid,
+		endpoint:   endpoint,
+		fifoUUID:   uuid,
+		clientOpts: defaultClientOpts(),
+		waitToken:  uuidlib.NewString(),
+	}
+	for _, opt := range opts {
+		opt(f)
 	}
+	f.client = ihttp.NewClient(f.clientOpts...)
 	return f
 }
 
+// FifoUUID returns the UUID of the fifo.
+func (f *Fifo) FifoUUID() string {
+	return f.fifoUUID
+}
+
+// OwnerSecret returns the owner secret of the fifo, if known.
+func (f *Fifo) OwnerSecret() string {
+	return f.ownerSecret
+}
+
+// TicketUUID returns the ID of the ticket taken with Ticket, or an empty
+// string if there is none.
+func (f *Fifo) TicketUUID() string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.ticket == nil {
+		return ""
+	}
+	return f.ticket.ID()
+}
+
+// Ticket queues a new ticket that the Fifo remembers for Wait, Done, Cancel
+// and Heartbeat, replacing the previous one. Use TakeTicket to hold multiple
+// tickets at once.
 func (f *Fifo) Ticket(ctx context.Context) error {
-	url, err := urlJoin(f.endpoint, "fifo", f.fifoUUID, "ticket")
+	t, err := f.TakeTicket(ctx)
 	if err != nil {
 		return err
 	}
-	resp := &api.FifoTicketResponse{}
-	if err := f.client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
-		return err
-	}
-	f.ticketUUID = resp.TicketID.String()
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.ticket = t
 	return nil
 }
 
+// errNoTicket is returned by the methods operating on the ticket taken with
+// Ticket if there is none.
+var errNoTicket = errors.New("no ticket taken, call Ticket first")
+
+func (f *Fifo) currentTicket() (*Ticket, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.ticket == nil {
+		return nil, errNoTicket
+	}
+	return f.ticket, nil
+}
+
+// Wait waits for the turn of the ticket taken with Ticket, see Ticket.Wait.
 func (f *Fifo) Wait(ctx context.Context) error {
-	url, err := urlJoin(f.endpoint, "fifo", f.fifoUUID, "wait", f.ticketUUID)
+	t, err := f.currentTicket()
 	if err != nil {
 		return err
 	}
-	return f.client.Get(ctx, url)
+	return t.Wait(ctx)
 }
 
 func (f *Fifo) TicketAndWait(ctx context.Context) error {
@@ -73,18 +350,195 @@ func (f *Fifo) TicketAndWait(ctx context.Context) error {
 	return f.Wait(ctx)
 }
 
+// Done ends the turn of the ticket taken with Ticket.
 func (f *Fifo) Done(ctx context.Context) error {
-	url, err := urlJoin(f.endpoint, "fifo", f.fifoUUID, "done", f.ticketUUID)
+	t, err := f.currentTicket()
+	if err != nil {
+		return err
+	}
+	return t.Done(ctx)
+}
+
+// Cancel gives up the ticket taken with Ticket, see Ticket.Cancel.
+func (f *Fifo) Cancel(ctx context.Context) error {
+	t, err := f.currentTicket()
+	if err != nil {
+		return err
+	}
+	return t.Cancel(ctx)
+}
+
+// Heartbeat extends the done timeout of the ticket taken with Ticket.
+func (f *Fifo) Heartbeat(ctx context.Context) error {
+	t, err := f.currentTicket()
+	if err != nil {
+		return err
+	}
+	return t.Heartbeat(ctx)
+}
+
+// Retriable reports whether a failed call may succeed on retry. That's the
+// case if the connection failed or dropped, the server failed or it is rate
+// limiting. Check for specific failures with errors.Is and the errors of the
+// api package, like api.ErrNotFound.
+func Retriable(err error) bool {
+	return ihttp.Retriable(err)
+}
+
+// StatusCode returns the HTTP status code of a failed call, or 0 if the
+// request didn't get a response.
+func StatusCode(err error) int {
+	return ihttp.StatusCode(err)
+}
+
+// Delete deletes the fifo. Requires the owner secret.
+func (f *Fifo) Delete(ctx context.Context) error {
+	url, err := f.fifoURL(f.fifoUUID)
+	if err != nil {
+		return err
+	}
+	return f.client.Do(ctx, http.MethodDelete, url, api.FifoSecretRequest{Secret: f.ownerSecret}, nil)
+}
+
+// Undelete revives the fifo after it was deleted, manually or because it was
+// unused, within the deleted retention of the server. Its queue starts
+// empty. Requires the owner secret.
+func (f *Fifo) Undelete(ctx context.Context) error {
+	url, err := f.fifoURL(f.fifoUUID, "undelete")
+	if err != nil {
+		return err
+	}
+	return f.client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: f.ownerSecret}, nil)
+}
+
+// Clone creates a fifo with the settings of this one, like its timeouts
+// and webhook, in the namespace, or in the namespace of this fifo if it is
+// empty. The clone gets the name unless it is empty, and starts with an empty
+// queue. It is returned with the options of this fifo and its own owner
+// secret. Requires the owner secret.
+func (f *Fifo) Clone(ctx context.Context, namespace, name string) (*Fifo, error) {
+	url, err := f.fifoURL(f.fifoUUID, "clone")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.FifoNewResponse{}
+	req := api.FifoCloneRequest{Secret: f.ownerSecret, Namespace: namespace, Name: name}
+	if err := f.client.PostJSON(ctx, url, req, resp); err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = f.namespace
+	}
+	return &Fifo{
+		endpoint:           f.endpoint,
+		client:             f.client,
+		namespace:          namespace,
+		fifoUUID:           resp.UUID.String(),
+		ownerSecret:        resp.OwnerSecret,
+		heartbeatInterval:  f.heartbeatInterval,
+		clientOpts:         f.clientOpts,
+		newRequest:         f.newRequest,
+		cancelOnDisconnect: f.cancelOnDisconnect,
+		keepTicketOnCancel: f.keepTicketOnCancel,
+		keepalive:          f.keepalive,
+		poll:               f.poll,
+		waitToken:          f.waitToken,
+	}, nil
+}
+
+// CancelTicket removes the ticket from the queue, or ends its turn if it is
+// active. Requires the owner secret.
+func (f *Fifo) CancelTicket(ctx context.Context, ticketID string) error {
+	return f.admin(ctx, "cancel", ticketID)
+}
+
+// BumpTicket moves the queued ticket to the front of the queue. Requires the
+// owner secret.
+func (f *Fifo) BumpTicket(ctx context.Context, ticketID string) error {
+	return f.admin(ctx, "bump", ticketID)
+}
+
+// CompleteActive ends the turn of the active ticket, as if its owner called
+// Done. Requires the owner secret.
+func (f *Fifo) CompleteActive(ctx context.Context) error {
+	return f.admin(ctx, "complete")
+}
+
+func (f *Fifo) admin(ctx context.Context, action string, pathSegments ...string) error {
+	url, err := f.fifoURL(append([]string{f.fifoUUID, "admin", action}, pathSegments...)...)
 	if err != nil {
 		return err
 	}
-	return f.client.Get(ctx, url)
+	return f.client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: f.ownerSecret}, nil)
+}
+
+// Status returns the active ticket and the queue of the fifo.
+func (f *Fifo) Status(ctx context.Context) (*api.FifoStatusResponse, error) {
+	url, err := f.fifoURL(f.fifoUUID, "status")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.FifoStatusResponse{}
+	if err := f.client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
-func urlJoin(base string, pathSegments ...string) (string, error) {
-	u, err := url.Parse(base)
+// History returns the recently ended tickets of the fifo.
+func (f *Fifo) History(ctx context.Context) (*api.FifoHistoryResponse, error) {
+	url, err := f.fifoURL(f.fifoUUID, "history")
 	if err != nil {
-		return "", fmt.Errorf("parsing endpoint: %w", err)
+		return nil, err
+	}
+	resp := &api.FifoHistoryResponse{}
+	if err := f.client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fifoURL returns the URL of the fifo API, taking the namespace into account.
+func (f *Fifo) fifoURL(pathSegments ...string) (string, error) {
+	if f.namespace != "" {
+		pathSegments = append([]string{"v1", "ns", f.namespace, "fifo"}, pathSegments...)
+	} else {
+		pathSegments = append([]string{"v1", "fifo"}, pathSegments...)
+	}
+	return ihttp.JoinURL(f.endpoint, pathSegments...)
+}
+
+// durationOrEmpty formats positive durations, others are left to the server.
+func durationOrEmpty(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func defaultClientOpts() []ihttp.Option {
+	return []ihttp.Option{
+		ihttp.WithHeader(api.VersionHeader, api.Version),
+		ihttp.WithUserAgent(userAgent()),
+		ihttp.WithRetries(ihttp.RetryPolicy{Retries: 3, Backoff: time.Second}),
+	}
+}
+
+const modulePath = "github.com/katexochen/sync"
+
+// userAgent identifies the Go client and the version of the module it was
+// built from.
+func userAgent() string {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+			}
+		}
 	}
-	return u.JoinPath(pathSegments...).String(), nil
+	return "sync-go-client/" + version
 }
@@ -0,0 +1,509 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTicket(t *testing.T) {
+	ctx := context.Background()
+
+	// outcomes returns the outcomes of the ended tickets by ticket ID.
+	outcomes := func(t *testing.T, f *Fifo) map[string]string {
+		history, err := f.History(ctx)
+		require.NoError(t, err)
+		outcomes := map[string]string{}
+		for _, entry := range history.Tickets {
+			outcomes[entry.TicketID.String()] = entry.Outcome
+		}
+		return outcomes
+	}
+
+	t.Run("done after callback", func(t *testing.T) {
+		require := require.New(t)
+		f, err := NewFifo(ctx, endpoint())
+		require.NoError(err)
+
+		var ticket string
+		require.NoError(f.WithTicket(ctx, func(ctx context.Context) error {
+			ticket = activeTicket(t, f)
+			return nil
+		}))
+		require.Eventually(func() bool {
+			return outcomes(t, f)[ticket] == api.OutcomeDone
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("done after panic", func(t *testing.T) {
+		require := require.New(t)
+		f, err := NewFifo(ctx, endpoint())
+		require.NoError(err)
+
+		var ticket string
+		require.Panics(func() {
+			_ = f.WithTicket(ctx, func(ctx context.Context) error {
+				ticket = activeTicket(t, f)
+				panic("job failed")
+			})
+		})
+		require.Eventually(func() bool {
+			return outcomes(t, f)[ticket] == api.OutcomeDone
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("callback error is returned", func(t *testing.T) {
+		require := require.New(t)
+		f, err := NewFifo(ctx, endpoint())
+		require.NoError(err)
+
+		errJob := errors.New("job failed")
+		require.ErrorIs(f.WithTicket(ctx, func(ctx context.Context) error { return errJob }), errJob)
+	})
+
+	t.Run("canceled if waiting fails", func(t *testing.T) {
+		require := require.New(t)
+		f, err := NewFifo(ctx, endpoint())
+		require.NoError(err)
+		require.NoError(f.TicketAndWait(ctx))
+		holder := f.TicketUUID()
+
+		waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		called := false
+		err = f.WithTicket(waitCtx, func(ctx context.Context) error {
+			called = true
+			return nil
+		})
+		require.ErrorIs(err, context.DeadlineExceeded)
+		require.False(called)
+
+		status, err := f.Status(ctx)
+		require.NoError(err)
+		require.Empty(status.Queue)
+		require.Equal(holder, status.Active.TicketID.String())
+	})
+
+	t.Run("lease lost", func(t *testing.T) {
+		require := require.New(t)
+		f, err := NewFifo(ctx, endpoint(), WithHeartbeat(20*time.Millisecond))
+		require.NoError(err)
+
+		err = f.WithTicket(ctx, func(ctx context.Context) error {
+			require.NoError(f.CancelTicket(ctx, activeTicket(t, f)))
+			<-ctx.Done()
+			require.ErrorIs(context.Cause(ctx), ErrLeaseLost)
+			return ctx.Err()
+		})
+		require.ErrorIs(err, ErrLeaseLost)
+		require.ErrorIs(err, context.Canceled)
+	})
+}
+
+func TestHeartbeat(t *testing.T) {
+	ctx := context.Background()
+
+	// newFifo returns a fifo sending heartbeats every 100ms, and a counter
+	// of the heartbeats that reached the server.
+	newFifo := func(t *testing.T, opts ...Option) (*Fifo, *atomic.Int64) {
+		target, err := url.Parse(endpoint())
+		require.NoError(t, err)
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		heartbeats := &atomic.Int64{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/heartbeat/") {
+				heartbeats.Add(1)
+			}
+			proxy.ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		opts = append([]Option{WithHeartbeat(100 * time.Millisecond)}, opts...)
+		f, err := NewFifo(ctx, srv.URL, opts...)
+		require.NoError(t, err)
+		return f, heartbeats
+	}
+	// stopped asserts that no heartbeats are sent anymore.
+	stopped := func(t *testing.T, heartbeats *atomic.Int64) {
+		// A heartbeat may be in flight.
+		time.Sleep(50 * time.Millisecond)
+		sent := heartbeats.Load()
+		time.Sleep(300 * time.Millisecond)
+		require.Equal(t, sent, heartbeats.Load())
+	}
+
+	t.Run("sent until done", func(t *testing.T) {
+		require := require.New(t)
+		f, heartbeats := newFifo(t)
+		require.NoError(f.TicketAndWait(ctx))
+		require.Eventually(func() bool { return heartbeats.Load() > 1 }, time.Second, 10*time.Millisecond)
+
+		require.NoError(f.Done(ctx))
+		stopped(t, heartbeats)
+	})
+
+	t.Run("stops on context cancellation", func(t *testing.T) {
+		require := require.New(t)
+		f, heartbeats := newFifo(t)
+		waitCtx, cancel := context.WithCancel(ctx)
+		require.NoError(f.TicketAndWait(waitCtx))
+		require.Eventually(func() bool { return heartbeats.Load() > 0 }, time.Second, 10*time.Millisecond)
+
+		cancel()
+		stopped(t, heartbeats)
+		require.NoError(f.Done(ctx))
+	})
+
+	t.Run("keeps ticket past done timeout", func(t *testing.T) {
+		require := require.New(t)
+		f, heartbeats := newFifo(t, WithFifoTimeouts(0, time.Second, 0))
+		require.NoError(f.TicketAndWait(ctx))
+
+		time.Sleep(1500 * time.Millisecond)
+		require.Positive(heartbeats.Load())
+		require.NoError(f.Done(ctx))
+		stopped(t, heartbeats)
+	})
+}
+
+func TestMultipleTickets(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	f, err := NewFifo(ctx, endpoint())
+	require.NoError(err)
+	require.NotEmpty(f.FifoUUID())
+	require.NotEmpty(f.OwnerSecret())
+	require.Empty(f.TicketUUID())
+	require.Error(f.Done(ctx))
+
+	var tickets []*Ticket
+	for range 3 {
+		ticket, err := f.TakeTicket(ctx)
+		require.NoError(err)
+		tickets = append(tickets, ticket)
+	}
+
+	// The tickets are served in order, each once the previous one is done.
+	var wg sync.WaitGroup
+	order := make(chan string, len(tickets))
+	for _, ticket := range tickets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ticket.Wait(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- ticket.ID()
+			if err := ticket.Done(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(order)
+	var served []string
+	for id := range order {
+		served = append(served, id)
+	}
+	require.Equal([]string{tickets[0].ID(), tickets[1].ID(), tickets[2].ID()}, served)
+
+	// Tickets can be resumed from their ID and secret.
+	ticket, err := f.TakeTicket(ctx)
+	require.NoError(err)
+	resumed := FifoFromUUID(endpoint(), f.FifoUUID()).TicketFromID(ticket.ID(), ticket.Secret())
+	require.NoError(resumed.Cancel(ctx))
+}
+
+func TestWaitCancelsTicket(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := map[string]struct {
+		opts       []Option
+		wantQueued bool
+	}{
+		"canceled":     {},
+		"kept queued":  {opts: []Option{WithoutAutoCancel()}, wantQueued: true},
+		"disconnected": {opts: []Option{WithCancelOnDisconnect()}},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			f, err := NewFifo(ctx, endpoint(), tc.opts...)
+			require.NoError(err)
+			holder, err := f.TakeTicket(ctx)
+			require.NoError(err)
+			require.NoError(holder.Wait(ctx))
+
+			ticket, err := f.TakeTicket(ctx)
+			require.NoError(err)
+			waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+			defer cancel()
+			require.ErrorIs(ticket.Wait(waitCtx), context.DeadlineExceeded)
+
+			require.Eventually(func() bool {
+				status, err := f.Status(ctx)
+				require.NoError(err)
+				return (len(status.Queue) == 1) == tc.wantQueued
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestLocker(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	f, err := NewFifo(ctx, endpoint())
+	require.NoError(err)
+
+	// Increments that aren't atomic only add up if the lock is exclusive.
+	var lock sync.Locker = f.Locker(ctx, nil)
+	counter := 0
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock.Lock()
+			defer lock.Unlock()
+			n := counter
+			time.Sleep(10 * time.Millisecond)
+			counter = n + 1
+		}()
+	}
+	wg.Wait()
+	require.Equal(5, counter)
+
+	require.Panics(lock.Unlock)
+
+	var failures []error
+	lock = f.Locker(ctx, func(err error) { failures = append(failures, err) })
+	lock.Unlock()
+	require.Len(failures, 1)
+}
+
+func TestAcquireAll(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	a, err := NewFifo(ctx, endpoint())
+	require.NoError(err)
+	b, err := NewFifo(ctx, endpoint())
+	require.NoError(err)
+
+	// Acquiring the fifos in opposite orders doesn't deadlock.
+	var wg sync.WaitGroup
+	for _, fifos := range [][]*Fifo{{a, b}, {b, a}, {a, b}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tickets, err := AcquireAll(ctx, fifos...)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i, ticket := range tickets {
+				if id := activeTicket(t, fifos[i]); id != ticket.ID() {
+					t.Errorf("active ticket %s, want %s", id, ticket.ID())
+				}
+			}
+			for _, ticket := range tickets {
+				if err := ticket.Done(ctx); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, err = AcquireAll(ctx, a, a)
+	require.Equal(http.StatusBadRequest, StatusCode(err))
+}
+
+func TestTakeTicketAfter(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	db, err := NewFifo(ctx, endpoint())
+	require.NoError(err)
+	deploy, err := NewFifo(ctx, endpoint())
+	require.NoError(err)
+
+	migration, err := db.TakeTicket(ctx)
+	require.NoError(err)
+	rollout, err := deploy.TakeTicketAfter(ctx, migration)
+	require.NoError(err)
+	status, err := deploy.Status(ctx)
+	require.NoError(err)
+	require.Len(status.Queue, 1)
+	require.Len(status.Queue[0].After, 1)
+	require.Equal(migration.ID(), status.Queue[0].After[0].TicketID.String())
+
+	require.NoError(migration.Wait(ctx))
+	require.NoError(migration.Done(ctx))
+	require.NoError(rollout.Wait(ctx))
+	require.NoError(rollout.Done(ctx))
+
+	other := FifoFromUUID(endpoint(), db.FifoUUID(), WithNamespace("other"))
+	_, err = other.TakeTicketAfter(ctx, migration)
+	require.Error(err)
+}
+
+func TestWaiterPolicyToken(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	f, err := NewFifo(ctx, endpoint(), WithWaiterPolicy(api.WaiterPolicyToken))
+	require.NoError(err)
+	tick, err := f.TakeTicket(ctx)
+	require.NoError(err)
+	require.NoError(tick.Wait(ctx))
+	// Waits of the same Fifo share its token and can be repeated.
+	require.NoError(tick.Wait(ctx))
+
+	other := FifoFromUUID(endpoint(), f.FifoUUID(), WithoutAutoCancel())
+	err = other.TicketFromID(tick.ID(), tick.Secret()).Wait(ctx)
+	require.Equal(http.StatusConflict, ihttp.StatusCode(err))
+	require.NoError(tick.Done(ctx))
+}
+
+func TestPipeline(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	var stages []*Fifo
+	for range 3 {
+		f, err := NewFifo(ctx, endpoint())
+		require.NoError(err)
+		stages = append(stages, f)
+	}
+	p, err := NewPipeline(ctx, stages...)
+	require.NoError(err)
+
+	tickets, err := p.TakeTicket(ctx)
+	require.NoError(err)
+	require.Len(tickets, len(stages))
+	for _, ticket := range tickets {
+		require.NoError(ticket.Wait(ctx))
+		require.NoError(ticket.Done(ctx))
+	}
+
+	require.NoError(p.Delete(ctx))
+	_, err = p.TakeTicket(ctx)
+	require.Equal(http.StatusNotFound, StatusCode(err))
+}
+
+func TestQueue(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	q, err := NewQueue(ctx, endpoint(), 0, 2)
+	require.NoError(err)
+	item, err := q.Claim(ctx, 0)
+	require.NoError(err)
+	require.Nil(item)
+
+	for n := range 2 {
+		_, err := q.Push(ctx, map[string]int{"n": n})
+		require.NoError(err)
+	}
+	item, err = q.Claim(ctx, time.Second)
+	require.NoError(err)
+	require.JSONEq(`{"n":0}`, string(item.Payload))
+	require.NoError(item.Nack(ctx))
+	for n := range 2 {
+		item, err = q.Claim(ctx, time.Second)
+		require.NoError(err)
+		require.JSONEq(fmt.Sprintf(`{"n":%d}`, n), string(item.Payload))
+		require.NoError(item.Ack(ctx))
+	}
+	require.Equal(http.StatusConflict, StatusCode(item.Ack(ctx)))
+
+	// The item is dead once its second delivery is nacked.
+	id, err := q.Push(ctx, "last")
+	require.NoError(err)
+	for attempt := 1; attempt <= 2; attempt++ {
+		item, err = q.Claim(ctx, time.Second)
+		require.NoError(err)
+		require.Equal(attempt, item.Attempts)
+		require.NoError(item.Extend(ctx, time.Minute))
+		require.NoError(item.Nack(ctx))
+	}
+	dead, err := q.DeadItems(ctx)
+	require.NoError(err)
+	require.Len(dead, 1)
+	require.Equal(id, dead[0].ItemID.String())
+	require.NoError(q.Requeue(ctx, id))
+	item, err = q.Claim(ctx, time.Second)
+	require.NoError(err)
+	require.Equal(id, item.ID)
+
+	require.NoError(q.Delete(ctx))
+	_, err = q.Push(ctx, nil)
+	require.Equal(http.StatusNotFound, StatusCode(err))
+}
+
+func TestWaitAllAny(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	a, err := NewFifo(ctx, endpoint())
+	require.NoError(err)
+	b, err := NewFifo(ctx, endpoint())
+	require.NoError(err)
+	blocker, err := a.TakeTicket(ctx)
+	require.NoError(err)
+	require.NoError(blocker.Wait(ctx))
+
+	ta, err := a.TakeTicket(ctx)
+	require.NoError(err)
+	tb, err := b.TakeTicket(ctx)
+	require.NoError(err)
+	ready, err := WaitAny(ctx, ta, tb)
+	require.NoError(err)
+	require.Equal([]*Ticket{tb}, ready)
+
+	require.NoError(blocker.Done(ctx))
+	ready, err = WaitAll(ctx, ta, tb)
+	require.NoError(err)
+	require.Equal([]*Ticket{ta, tb}, ready)
+	require.NoError(ta.Done(ctx))
+	require.NoError(tb.Done(ctx))
+
+	tc, err := a.TakeTicket(ctx)
+	require.NoError(err)
+	require.NoError(a.Delete(ctx))
+	_, err = WaitAll(ctx, tc)
+	require.Error(err)
+}
+
+// activeTicket returns the ID of the active ticket of the fifo.
+func activeTicket(t *testing.T, f *Fifo) string {
+	status, err := f.Status(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, status.Active)
+	return status.Active.TicketID.String()
+}
+
+func endpoint() string {
+	e := os.Getenv("E2E_ENDPOINT")
+	if e == "" {
+		e = "http://localhost:8080"
+	}
+	return e
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Locker adapts a Fifo to sync.Locker, so code written against a local
+// mutex can use the fifo as distributed lock.
+type Locker struct {
+	fifo    *Fifo
+	ctx     context.Context
+	onError func(error)
+
+	mux sync.Mutex
+	// held is the ticket of the current lock holder.
+	held *Ticket
+}
+
+var _ sync.Locker = (*Locker)(nil)
+
+// Locker returns a sync.Locker that takes a ticket of the fifo and waits for
+// its turn on Lock, and marks the ticket done on Unlock. While the lock is
+// held, heartbeats are sent in the interval set with WithHeartbeat, or every
+// 10 seconds by default. The requests are made with ctx.
+//
+// As sync.Locker can't return errors, failures are passed to onError. If
+// onError returns, Lock returns without holding the lock. If onError is nil,
+// Lock and Unlock panic on failure, like sync.Mutex does on misuse.
+func (f *Fifo) Locker(ctx context.Context, onError func(error)) *Locker {
+	return &Locker{fifo: f, ctx: ctx, onError: onError}
+}
+
+// Lock blocks until the lock is held.
+func (l *Locker) Lock() {
+	t, err := l.fifo.TakeTicket(l.ctx)
+	if err != nil {
+		l.fail(err)
+		return
+	}
+	if err := t.Wait(l.ctx); err != nil {
+		l.fail(err)
+		return
+	}
+	t.startHeartbeat(l.ctx, l.fifo.leaseHeartbeat())
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.held = t
+}
+
+// Unlock releases the lock.
+func (l *Locker) Unlock() {
+	l.mux.Lock()
+	t := l.held
+	l.held = nil
+	l.mux.Unlock()
+	if t == nil {
+		l.fail(errors.New("unlock of unlocked Locker"))
+		return
+	}
+	// Release the lock even if the context is done.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(l.ctx), cleanupTimeout)
+	defer cancel()
+	if err := t.Done(ctx); err != nil {
+		l.fail(err)
+	}
+}
+
+func (l *Locker) fail(err error) {
+	if l.onError == nil {
+		panic(err)
+	}
+	l.onError(err)
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+)
+
+// Pipeline is an ordered list of fifos, like for build, sign and publish
+// stages. A ticket that is done in a stage is queued in the next stage by
+// the server.
+type Pipeline struct {
+	stages      []*Fifo
+	uuid        string
+	ownerSecret string
+}
+
+// NewPipeline creates a pipeline of the fifos. The fifos must be on the same
+// server and in the same namespace.
+func NewPipeline(ctx context.Context, stages ...*Fifo) (*Pipeline, error) {
+	if len(stages) < 2 {
+		return nil, errors.New("a pipeline needs at least two stages")
+	}
+	req := api.PipelineNewRequest{}
+	for _, f := range stages {
+		if f.endpoint != stages[0].endpoint || f.namespace != stages[0].namespace {
+			return nil, errors.New("fifos must be on the same server and in the same namespace")
+		}
+		uuid, err := uuidlib.Parse(f.fifoUUID)
+		if err != nil {
+			return nil, fmt.Errorf("parsing fifo uuid: %w", err)
+		}
+		req.Stages = append(req.Stages, uuid)
+	}
+	p := &Pipeline{stages: stages}
+	url, err := p.pipelineURL("new")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.PipelineNewResponse{}
+	if err := stages[0].client.RequestJSON(ctx, url, req, resp); err != nil {
+		return nil, err
+	}
+	p.uuid = resp.UUID.String()
+	p.ownerSecret = resp.OwnerSecret
+	return p, nil
+}
+
+// UUID returns the UUID of the pipeline.
+func (p *Pipeline) UUID() string {
+	return p.uuid
+}
+
+// OwnerSecret returns the owner secret of the pipeline.
+func (p *Pipeline) OwnerSecret() string {
+	return p.ownerSecret
+}
+
+// TakeTicket queues a ticket in the first stage and returns the ticket of
+// each stage. They share the ID and secret, but a stage's ticket is only
+// queued once the ticket of the stage before is done.
+func (p *Pipeline) TakeTicket(ctx context.Context) ([]*Ticket, error) {
+	url, err := p.pipelineURL(p.uuid, "ticket")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.PipelineTicketResponse{}
+	if err := p.stages[0].client.RequestJSON(ctx, url, api.FifoTicketRequest{}, resp); err != nil {
+		return nil, err
+	}
+	tickets := make([]*Ticket, 0, len(p.stages))
+	for _, f := range p.stages {
+		tickets = append(tickets, f.TicketFromID(resp.TicketID.String(), resp.Secret))
+	}
+	return tickets, nil
+}
+
+// Delete deletes the pipeline. Tickets in its stages aren't queued in the
+// next stage anymore. Requires the owner secret.
+func (p *Pipeline) Delete(ctx context.Context) error {
+	url, err := p.pipelineURL(p.uuid)
+	if err != nil {
+		return err
+	}
+	return p.stages[0].client.Do(ctx, http.MethodDelete, url, api.FifoSecretRequest{Secret: p.ownerSecret}, nil)
+}
+
+// pipelineURL returns the URL of the pipeline API, taking the namespace of
+// the stages into account.
+func (p *Pipeline) pipelineURL(pathSegments ...string) (string, error) {
+	f := p.stages[0]
+	if f.namespace != "" {
+		pathSegments = append([]string{"v1", "ns", f.namespace, "pipeline"}, pathSegments...)
+	} else {
+		pathSegments = append([]string{"v1", "pipeline"}, pathSegments...)
+	}
+	return ihttp.JoinURL(f.endpoint, pathSegments...)
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+)
+
+// Queue is a work queue. Producers push items with a payload, workers claim
+// them one at a time and ack them once handled. Items that are nacked or
+// not acked within the lease timeout are redelivered, until they exceed the
+// max attempts and are moved to the dead-letter list.
+type Queue struct {
+	endpoint    string
+	client      *ihttp.Client
+	namespace   string
+	uuid        string
+	ownerSecret string
+}
+
+// NewQueue creates a work queue. Claimed items must be acked within the
+// lease timeout, zero keeps the server default. Items are delivered up to
+// maxAttempts times, or without limit if it is zero. Of the options, those
+// configuring the connection, WithNamespace and WithOwnerSecret apply.
+func NewQueue(ctx context.Context, endpoint string, leaseTimeout time.Duration, maxAttempts int, opts ...Option) (*Queue, error) {
+	q := QueueFromUUID(endpoint, "", opts...)
+	url, err := q.queueURL("new")
+	if err != nil {
+		return nil, err
+	}
+	req := api.QueueNewRequest{LeaseTimeout: durationOrEmpty(leaseTimeout), MaxAttempts: maxAttempts}
+	resp := &api.QueueNewResponse{}
+	if err := q.client.RequestJSON(ctx, url, req, resp); err != nil {
+		return nil, err
+	}
+	q.uuid = resp.UUID.String()
+	q.ownerSecret = resp.OwnerSecret
+	return q, nil
+}
+
+// QueueFromUUID returns the existing work queue with the UUID.
+func QueueFromUUID(endpoint, uuid string, opts ...Option) *Queue {
+	f := FifoFromUUID(endpoint, uuid, opts...)
+	return &Queue{
+		endpoint:    endpoint,
+		client:      f.client,
+		namespace:   f.namespace,
+		uuid:        uuid,
+		ownerSecret: f.ownerSecret,
+	}
+}
+
+// UUID returns the UUID of the queue.
+func (q *Queue) UUID() string {
+	return q.uuid
+}
+
+// OwnerSecret returns the owner secret of the queue, if known.
+func (q *Queue) OwnerSecret() string {
+	return q.ownerSecret
+}
+
+// Push adds an item with the JSON encoded payload to the queue and returns
+// its ID.
+func (q *Queue) Push(ctx context.Context, payload any) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("marshaling payload: %w", err)
+	}
+	url, err := q.queueURL(q.uuid, "push")
+	if err != nil {
+		return "", err
+	}
+	resp := &api.QueuePushResponse{}
+	if err := q.client.PostJSON(ctx, url, api.QueuePushRequest{Payload: b}, resp); err != nil {
+		return "", err
+	}
+	return resp.ItemID.String(), nil
+}
+
+// Claim leases the next item of the queue. If the queue is empty, it waits
+// up to the timeout for an item and returns nil if none was pushed.
+func (q *Queue) Claim(ctx context.Context, timeout time.Duration) (*QueueItem, error) {
+	url, err := q.queueURL(q.uuid, "claim")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.QueueClaimResponse{}
+	err = q.client.PostJSON(ctx, url, api.QueueClaimRequest{Timeout: durationOrEmpty(timeout)}, resp)
+	if ihttp.StatusCode(err) == http.StatusNoContent {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &QueueItem{
+		ID:          resp.ItemID.String(),
+		Payload:     resp.Payload,
+		Attempts:    resp.Attempts,
+		LeasedUntil: resp.LeasedUntil,
+		queue:       q,
+		secret:      resp.Secret,
+	}, nil
+}
+
+// DeadItems returns the items that exceeded the max attempts, oldest first.
+func (q *Queue) DeadItems(ctx context.Context) ([]api.QueueDeadItem, error) {
+	url, err := q.queueURL(q.uuid, "dead")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.QueueDeadResponse{}
+	if err := q.client.GetJSON(ctx, url, resp); err != nil {
+		return nil, err
+	}
+	return resp.Items, nil
+}
+
+// Requeue moves the dead item to the end of the queue, with its attempts
+// reset. Requires the owner secret.
+func (q *Queue) Requeue(ctx context.Context, itemID string) error {
+	url, err := q.queueURL(q.uuid, "admin", "requeue", itemID)
+	if err != nil {
+		return err
+	}
+	return q.client.PostJSON(ctx, url, api.FifoSecretRequest{Secret: q.ownerSecret}, nil)
+}
+
+// Delete deletes the queue with its items. Requires the owner secret.
+func (q *Queue) Delete(ctx context.Context) error {
+	url, err := q.queueURL(q.uuid)
+	if err != nil {
+		return err
+	}
+	return q.client.Do(ctx, http.MethodDelete, url, api.FifoSecretRequest{Secret: q.ownerSecret}, nil)
+}
+
+// queueURL returns the URL of the queue API, taking the namespace into
+// account.
+func (q *Queue) queueURL(pathSegments ...string) (string, error) {
+	if q.namespace != "" {
+		pathSegments = append([]string{"v1", "ns", q.namespace, "queue"}, pathSegments...)
+	} else {
+		pathSegments = append([]string{"v1", "queue"}, pathSegments...)
+	}
+	return ihttp.JoinURL(q.endpoint, pathSegments...)
+}
+
+// QueueItem is an item claimed from a Queue. It must be acked or nacked
+// before LeasedUntil, otherwise it is redelivered.
+type QueueItem struct {
+	ID      string
+	Payload json.RawMessage
+	// Attempts is the number of deliveries of the item, including this one.
+	Attempts    int
+	LeasedUntil time.Time
+
+	queue  *Queue
+	secret string
+}
+
+// Ack removes the handled item from the queue.
+func (i *QueueItem) Ack(ctx context.Context) error {
+	return i.settle(ctx, "ack")
+}
+
+// Nack puts the item back at the front of the queue.
+func (i *QueueItem) Nack(ctx context.Context) error {
+	return i.settle(ctx, "nack")
+}
+
+// Extend restarts the lease of the item, so it ends after the lease timeout
+// from now. Zero uses the lease timeout of the queue. It updates
+// LeasedUntil.
+func (i *QueueItem) Extend(ctx context.Context, leaseTimeout time.Duration) error {
+	url, err := i.queue.queueURL(i.queue.uuid, "extend", i.ID)
+	if err != nil {
+		return err
+	}
+	resp := &api.QueueExtendResponse{}
+	req := api.QueueExtendRequest{Secret: i.secret, LeaseTimeout: durationOrEmpty(leaseTimeout)}
+	if err := i.queue.client.PostJSON(ctx, url, req, resp); err != nil {
+		return err
+	}
+	i.LeasedUntil = resp.LeasedUntil
+	return nil
+}
+
+func (i *QueueItem) settle(ctx context.Context, op string) error {
+	url, err := i.queue.queueURL(i.queue.uuid, op, i.ID)
+	if err != nil {
+		return err
+	}
+	return i.queue.client.PostJSON(ctx, url, api.FifoSecretRequest{Secret: i.secret}, nil)
+}
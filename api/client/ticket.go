@@ -0,0 +1,428 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+)
+
+// Ticket is a place in the queue of a fifo. A Fifo can hold any number of
+// tickets, and the methods of a Ticket can be called from multiple
+// goroutines.
+type Ticket struct {
+	fifo   *Fifo
+	id     string
+	secret string
+
+	mux sync.Mutex
+	// stopHeartbeat stops the heartbeats started by Wait, if any.
+	stopHeartbeat func()
+}
+
+// TakeTicket queues a new ticket.
+func (f *Fifo) TakeTicket(ctx context.Context) (*Ticket, error) {
+	return f.TakeTicketAfter(ctx)
+}
+
+// TakeTicketAfter queues a new ticket that isn't notified before the given
+// tickets ended, for example to order jobs across fifos. Until then, the new
+// ticket holds up the queue at its head. The tickets must be of fifos on the
+// same server and in the same namespace.
+func (f *Fifo) TakeTicketAfter(ctx context.Context, after ...*Ticket) (*Ticket, error) {
+	req := api.FifoTicketRequest{}
+	for _, t := range after {
+		if t.fifo.endpoint != f.endpoint || t.fifo.namespace != f.namespace {
+			return nil, errors.New("tickets must be of fifos on the same server and in the same namespace")
+		}
+		fifoUUID, err := uuidlib.Parse(t.fifo.fifoUUID)
+		if err != nil {
+			return nil, fmt.Errorf("parsing fifo uuid: %w", err)
+		}
+		ticketID, err := uuidlib.Parse(t.id)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ticket id: %w", err)
+		}
+		req.After = append(req.After, api.FifoTicketRef{UUID: fifoUUID, TicketID: ticketID})
+	}
+	url, err := f.fifoURL(f.fifoUUID, "ticket")
+	if err != nil {
+		return nil, err
+	}
+	// The server returns the same ticket if the request is retried.
+	resp := &api.FifoTicketResponse{}
+	if err := f.client.RequestJSON(ihttp.Idempotent(ctx), url, req, resp); err != nil {
+		return nil, err
+	}
+	return f.TicketFromID(resp.TicketID.String(), resp.Secret), nil
+}
+
+// AcquireAll takes a ticket in each of the fifos and waits for the turn of
+// all of them. The server acquires the fifos in a fixed order, so callers
+// acquiring overlapping fifos can't deadlock each other, and cancels the
+// tickets taken so far if a fifo can't be acquired. The fifos must be on the
+// same server and in the same namespace. The tickets are returned in the
+// order of the fifos, with heartbeats started like by Ticket.Wait.
+func AcquireAll(ctx context.Context, fifos ...*Fifo) ([]*Ticket, error) {
+	if len(fifos) == 0 {
+		return nil, errors.New("no fifos to acquire")
+	}
+	f := fifos[0]
+	req := api.FifoAcquireRequest{}
+	for _, fifo := range fifos {
+		if fifo.endpoint != f.endpoint || fifo.namespace != f.namespace {
+			return nil, errors.New("fifos must be on the same server and in the same namespace")
+		}
+		uuid, err := uuidlib.Parse(fifo.fifoUUID)
+		if err != nil {
+			return nil, fmt.Errorf("parsing fifo uuid: %w", err)
+		}
+		req.UUIDs = append(req.UUIDs, uuid)
+	}
+	url, err := f.fifoURL("acquire")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.FifoAcquireResponse{}
+	if err := f.client.Do(ctx, http.MethodPost, url, req, resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Tickets) != len(fifos) {
+		return nil, fmt.Errorf("server acquired %d of %d fifos", len(resp.Tickets), len(fifos))
+	}
+	tickets := make([]*Ticket, len(fifos))
+	for _, acquired := range resp.Tickets {
+		i := slices.Index(req.UUIDs, acquired.UUID)
+		if i < 0 {
+			return nil, fmt.Errorf("server acquired unknown fifo %s", acquired.UUID)
+		}
+		tickets[i] = fifos[i].TicketFromID(acquired.TicketID.String(), acquired.Secret)
+	}
+	for _, t := range tickets {
+		if t.fifo.heartbeatInterval > 0 {
+			t.startHeartbeat(ctx, t.fifo.heartbeatInterval)
+		}
+	}
+	return tickets, nil
+}
+
+// WaitAll waits for the turn of all tickets with a single request. It
+// returns the tickets whose turn came, in the order they were given, with
+// heartbeats started like by Ticket.Wait. If the turn of a ticket can't
+// come, the wait ends early with an error, and the tickets returned with it
+// must still be released with Done. The tickets must be of fifos on the same
+// server and in the same namespace.
+func WaitAll(ctx context.Context, tickets ...*Ticket) ([]*Ticket, error) {
+	return waitTickets(ctx, api.WaitAll, tickets)
+}
+
+// WaitAny is like WaitAll, but returns once the turn of any ticket came.
+// The other tickets stay queued.
+func WaitAny(ctx context.Context, tickets ...*Ticket) ([]*Ticket, error) {
+	return waitTickets(ctx, api.WaitAny, tickets)
+}
+
+func waitTickets(ctx context.Context, mode string, tickets []*Ticket) ([]*Ticket, error) {
+	if len(tickets) == 0 {
+		return nil, errors.New("no tickets to wait for")
+	}
+	f := tickets[0].fifo
+	req := api.FifoWaitAllRequest{Mode: mode}
+	for _, t := range tickets {
+		if t.fifo.endpoint != f.endpoint || t.fifo.namespace != f.namespace {
+			return nil, errors.New("tickets must be of fifos on the same server and in the same namespace")
+		}
+		fifoUUID, err := uuidlib.Parse(t.fifo.fifoUUID)
+		if err != nil {
+			return nil, fmt.Errorf("parsing fifo uuid: %w", err)
+		}
+		ticketID, err := uuidlib.Parse(t.id)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ticket id: %w", err)
+		}
+		req.Tickets = append(req.Tickets, api.FifoWaitAllTicket{UUID: fifoUUID, TicketID: ticketID, Secret: t.secret, WaitToken: t.fifo.waitToken})
+	}
+	url, err := f.fifoURL("wait")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.FifoWaitAllResponse{}
+	if err := f.client.Do(ctx, http.MethodPost, url, req, resp); err != nil {
+		return nil, err
+	}
+
+	var ready []*Ticket
+	for i, t := range tickets {
+		if slices.ContainsFunc(resp.Ready, func(r api.FifoWaitAllReady) bool {
+			return r.UUID == req.Tickets[i].UUID && r.TicketID == req.Tickets[i].TicketID
+		}) {
+			ready = append(ready, t)
+		}
+	}
+	for _, t := range ready {
+		if t.fifo.heartbeatInterval > 0 {
+			t.startHeartbeat(ctx, t.fifo.heartbeatInterval)
+		}
+	}
+	var errs []error
+	for _, failure := range resp.Failed {
+		errs = append(errs, fmt.Errorf("ticket %s: %w", failure.TicketID, &api.WaitError{Status: failure.Status, Message: failure.Error}))
+	}
+	if len(errs) > 0 && (mode == api.WaitAll || len(ready) == 0) {
+		return ready, errors.Join(errs...)
+	}
+	return ready, nil
+}
+
+// TicketFromID returns a ticket that was taken before, for example by
+// another process.
+func (f *Fifo) TicketFromID(id, secret string) *Ticket {
+	return &Ticket{fifo: f, id: id, secret: secret}
+}
+
+// ID returns the ID of the ticket.
+func (t *Ticket) ID() string {
+	return t.id
+}
+
+// Secret returns the secret of the ticket, which authorizes its holder.
+func (t *Ticket) Secret() string {
+	return t.secret
+}
+
+// Wait blocks until it's the turn of the ticket. Waiting can be resumed, so
+// if the connection drops or the server is temporarily unavailable, the wait
+// is retried with backoff until the context is done, unless
+// WithCancelOnDisconnect is set. With WithHeartbeat, heartbeats are sent
+// from then on until Done or Cancel is called.
+//
+// If the context is done before it's the turn of the ticket, the ticket is
+// canceled, so it doesn't hold up the queue until it expires. Use
+// WithoutAutoCancel to keep it queued and resume waiting later.
+func (t *Ticket) Wait(ctx context.Context) error {
+	if err := t.wait(ctx); err != nil {
+		if ctx.Err() != nil && !t.fifo.keepTicketOnCancel && !t.fifo.cancelOnDisconnect {
+			// Best effort, the ticket expires eventually anyway.
+			cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+			defer cancel()
+			_ = t.Cancel(cleanupCtx)
+		}
+		return err
+	}
+	if t.fifo.heartbeatInterval > 0 {
+		t.startHeartbeat(ctx, t.fifo.heartbeatInterval)
+	}
+	return nil
+}
+
+func (t *Ticket) wait(ctx context.Context) error {
+	f := t.fifo
+	query := url.Values{"wait_token": {f.waitToken}}
+	ctx = ihttp.WithTicketSecret(ctx, t.secret)
+	if f.poll {
+		u, err := f.fifoURL(f.fifoUUID, "ticket", t.id, "state")
+		if err != nil {
+			return err
+		}
+		waitCtx := ihttp.WithRetryPolicy(ctx, ihttp.RetryPolicy{Retries: -1, Backoff: waitBackoff})
+		return f.client.Poll(waitCtx, u+"?"+query.Encode(), &api.FifoWaitResponse{})
+	}
+	u, err := f.fifoURL(f.fifoUUID, "wait", t.id)
+	if err != nil {
+		return err
+	}
+	if f.cancelOnDisconnect {
+		query.Set("cancel_on_disconnect", "true")
+	}
+	if f.keepalive > 0 {
+		query.Set("keepalive", f.keepalive.String())
+	}
+	waitCtx := ihttp.WithRetryPolicy(ctx, ihttp.RetryPolicy{Retries: -1, Backoff: waitBackoff})
+	if f.cancelOnDisconnect {
+		waitCtx = ihttp.WithRetryPolicy(ctx, ihttp.RetryPolicy{})
+	}
+	return f.client.GetJSON(waitCtx, u+"?"+query.Encode(), &api.FifoWaitResponse{})
+}
+
+// waitBackoff is the delay before the first retry of a wait.
+const waitBackoff = time.Second
+
+// Done ends the turn of the ticket.
+func (t *Ticket) Done(ctx context.Context) error {
+	t.stopHeartbeats()
+	return t.post(ctx, "done")
+}
+
+// Cancel gives up the ticket. A queued ticket is removed from the queue, an
+// active one ends its turn like with Done.
+func (t *Ticket) Cancel(ctx context.Context) error {
+	t.stopHeartbeats()
+	return t.post(ctx, "cancel")
+}
+
+// Heartbeat extends the done timeout of the ticket.
+func (t *Ticket) Heartbeat(ctx context.Context) error {
+	return t.post(ctx, "heartbeat")
+}
+
+// Transfer takes over the ticket, for example in the replacement of a
+// restarted process. The returned ticket keeps the place in the queue or the
+// turn, but has a new secret, so t can no longer be used.
+func (t *Ticket) Transfer(ctx context.Context) (*Ticket, error) {
+	return t.fifo.transfer(ctx, t.id, t.secret)
+}
+
+// TransferTicket takes over the ticket with the given ID, like
+// Ticket.Transfer. Requires the owner secret.
+func (f *Fifo) TransferTicket(ctx context.Context, ticketID string) (*Ticket, error) {
+	return f.transfer(ctx, ticketID, f.ownerSecret)
+}
+
+func (f *Fifo) transfer(ctx context.Context, ticketID, secret string) (*Ticket, error) {
+	url, err := f.fifoURL(f.fifoUUID, "transfer", ticketID)
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.FifoTicketResponse{}
+	if err := f.client.Do(ctx, http.MethodPost, url, api.FifoTransferRequest{Secret: secret}, resp); err != nil {
+		return nil, err
+	}
+	return f.TicketFromID(resp.TicketID.String(), resp.Secret), nil
+}
+
+func (t *Ticket) post(ctx context.Context, action string) error {
+	url, err := t.fifo.fifoURL(t.fifo.fifoUUID, action, t.id)
+	if err != nil {
+		return err
+	}
+	return t.fifo.client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: t.secret}, nil)
+}
+
+// startHeartbeat sends heartbeats until the context is canceled or
+// stopHeartbeats is called. Failed heartbeats are retried in the next interval.
+func (t *Ticket) startHeartbeat(ctx context.Context, interval time.Duration) {
+	stop := t.heartbeat(ctx, interval, func(error) {})
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.stopHeartbeat != nil {
+		t.stopHeartbeat()
+	}
+	t.stopHeartbeat = stop
+}
+
+func (t *Ticket) stopHeartbeats() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.stopHeartbeat != nil {
+		t.stopHeartbeat()
+		t.stopHeartbeat = nil
+	}
+}
+
+// heartbeat sends heartbeats in the interval until the returned function is
+// called. If a heartbeat finds the ticket ended, lost is called and no
+// further heartbeats are sent.
+func (t *Ticket) heartbeat(ctx context.Context, interval time.Duration, lost func(error)) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := t.Heartbeat(ctx)
+			if errors.Is(err, api.ErrNotFound) || errors.Is(err, api.ErrGone) {
+				lost(err)
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// ErrLeaseLost is the cause of the cancellation of the context passed to the
+// callback of WithTicket if the ticket ended before the callback returned,
+// for example because the fifo owner canceled it.
+var ErrLeaseLost = errors.New("lease of the ticket lost")
+
+// defaultLeaseHeartbeat is the heartbeat interval of WithTicket if none is
+// configured with WithHeartbeat.
+const defaultLeaseHeartbeat = 10 * time.Second
+
+// leaseHeartbeat returns the heartbeat interval for tickets that are held
+// until they are released explicitly.
+func (f *Fifo) leaseHeartbeat() time.Duration {
+	if f.heartbeatInterval > 0 {
+		return f.heartbeatInterval
+	}
+	return defaultLeaseHeartbeat
+}
+
+// cleanupTimeout bounds the calls that release a ticket after its context is
+// done.
+const cleanupTimeout = 10 * time.Second
+
+// WithTicket takes a ticket, waits for its turn and runs fn. While fn runs,
+// heartbeats are sent in the interval set with WithHeartbeat, or every
+// 10 seconds by default. The context passed to fn is canceled with
+// ErrLeaseLost if the ticket ends early.
+//
+// The ticket is always released: it is canceled if waiting fails, and done
+// once fn returns, even if fn fails or panics.
+func (f *Fifo) WithTicket(ctx context.Context, fn func(ctx context.Context) error) error {
+	t, err := f.TakeTicket(ctx)
+	if err != nil {
+		return err
+	}
+	return t.hold(ctx, fn)
+}
+
+func (t *Ticket) hold(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	if err := t.wait(ctx); err != nil {
+		if t.fifo.cancelOnDisconnect {
+			// The server dropped the ticket with the connection.
+			return err
+		}
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+		return errors.Join(err, t.Cancel(cleanupCtx))
+	}
+
+	interval := t.fifo.leaseHeartbeat()
+	leaseCtx, cancelLease := context.WithCancelCause(ctx)
+	defer cancelLease(nil)
+	stopHeartbeat := t.heartbeat(leaseCtx, interval, func(err error) {
+		cancelLease(fmt.Errorf("%w: %w", ErrLeaseLost, err))
+	})
+	defer func() {
+		stopHeartbeat()
+		if leaseErr := context.Cause(leaseCtx); errors.Is(leaseErr, ErrLeaseLost) {
+			// The ticket already ended, there is nothing to release.
+			err = errors.Join(err, leaseErr)
+			return
+		}
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+		if doneErr := t.Done(cleanupCtx); doneErr != nil {
+			err = errors.Join(err, fmt.Errorf("releasing ticket: %w", doneErr))
+		}
+	}()
+	return fn(leaseCtx)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Failures of API calls match these errors with errors.Is, depending on the
+// status code of the response.
+var (
+	// ErrNotFound means the fifo or ticket doesn't exist. Expired tickets
+	// aren't found either.
+	ErrNotFound = errors.New("not found")
+	// ErrGone means the fifo was deleted or the ticket was removed by the
+	// fifo owner.
+	ErrGone = errors.New("gone")
+	// ErrTimeout means the server or a proxy in front of it timed out.
+	ErrTimeout = errors.New("timeout")
+)
+
+// ErrorResponse is the body of failed requests. Only requests to unknown
+// paths or with an unsupported method get a plain text error.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+}
+
+// ErrorForStatus returns the error of the API failures with the HTTP status
+// code, or nil if there is none.
+func ErrorForStatus(status int) error {
+	switch status {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusGone:
+		return ErrGone
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrTimeout
+	}
+	return nil
+}
@@ -1,12 +1,407 @@
 package api
 
-import uuidlib "github.com/google/uuid"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+)
+
+// Version is the version of the HTTP API, served under /v1.
+const Version = "1"
+
+// VersionHeader is set by the server to the API version it speaks. Clients
+// may set it to the version they expect, the server rejects other versions.
+const VersionHeader = "Sync-API-Version"
+
+// IdentityHeader can be set by clients to identify themselves. It is ignored
+// if the server derives the identity from the authentication token.
+const IdentityHeader = "Sync-Client-Identity"
+
+// IdempotencyKeyHeader can be set by clients on requests that create a
+// ticket. Repeated requests with the same key return the same ticket, so
+// clients can safely retry them.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// TicketSecretHeader carries the ticket secret on requests without a body,
+// like waits. The secret query parameter is still accepted, but ends up in
+// the logs of proxies.
+const TicketSecretHeader = "Sync-Ticket-Secret"
+
+// TraceparentHeader can be set by clients on requests that create a ticket,
+// in the W3C Trace Context format. The trace ID is recorded on the ticket and
+// its events, linking them to the trace of the client.
+const TraceparentHeader = "traceparent"
+
+// Ticket states as reported by the status endpoints.
+const (
+	// TicketQueued tickets wait for their turn.
+	TicketQueued = "queued"
+	// TicketNotified tickets had their turn announced, but the owner hasn't
+	// received the notification through wait yet.
+	TicketNotified = "notified"
+	// TicketAccepted tickets are owned by a client until it calls done.
+	TicketAccepted = "accepted"
+)
+
+// Outcomes of ended tickets as recorded in the history.
+const (
+	OutcomeDone             = "done"
+	OutcomeWaitTimeout      = "wait_timeout"
+	OutcomeDoneTimeout      = "done_timeout"
+	OutcomeCanceledByOwner  = "canceled_by_owner"
+	OutcomeCompletedByOwner = "completed_by_owner"
+	// OutcomeCanceled tickets were given up by the client holding them,
+	// unlike OutcomeCanceledByOwner, which the fifo owner ends.
+	OutcomeCanceled = "canceled"
+	// OutcomeDisconnected tickets were dropped as the client disconnected
+	// while waiting with cancel on disconnect.
+	OutcomeDisconnected = "disconnected"
+	// OutcomeDeadlock tickets were canceled by the server to break a cycle
+	// of clients waiting for each other.
+	OutcomeDeadlock = "deadlock"
+)
+
+// Events streamed by the events and wait stream endpoints. The ticket events
+// carry a FifoEvent as data.
+const (
+	EventTicketCreated  = "ticket_created"
+	EventTicketNotified = "ticket_notified"
+	EventTicketAccepted = "ticket_accepted"
+	EventTicketDone     = "ticket_done"
+	// EventTicketExpired is sent if the owner didn't call wait or done in time.
+	EventTicketExpired  = "ticket_expired"
+	EventTicketCanceled = "ticket_canceled"
+	// EventFifoDeleted ends the stream.
+	EventFifoDeleted = "fifo_deleted"
+	// EventPosition carries a FifoPositionEvent.
+	EventPosition = "position"
+	// EventReady carries the FifoTicketInfo once it's the ticket's turn.
+	EventReady = "ready"
+	// EventTurnClaimed ends a wait stream if the turn went to another wait,
+	// see WaiterPolicyFirst and WaiterPolicyToken.
+	EventTurnClaimed = "turn_claimed"
+	// EventFifoAlert is only delivered to webhooks, see FifoWebhook.Alert.
+	EventFifoAlert = "fifo_alert"
+)
+
+// Alerts raised by the monitor of the server.
+const (
+	// AlertTicketStuck is raised if a ticket is active longer than the
+	// threshold of the server.
+	AlertTicketStuck = "ticket_stuck"
+	// AlertQueueTooLong is raised if more tickets are queued than the limit
+	// of the server.
+	AlertQueueTooLong = "queue_too_long"
+	// AlertDeadlock is raised for the waiting tickets of clients that wait
+	// for each other in a cycle.
+	AlertDeadlock = "deadlock"
+)
+
+// Modes of waiting for multiple tickets, see FifoWaitAllRequest.
+const (
+	// WaitAll returns once the turn of all tickets came.
+	WaitAll = "all"
+	// WaitAny returns once the turn of any ticket came.
+	WaitAny = "any"
+)
+
+// Policies for multiple waits on the same ticket, see FifoNewRequest.
+const (
+	// WaiterPolicyAll returns the turn to every wait of the ticket.
+	WaiterPolicyAll = "all"
+	// WaiterPolicyFirst returns the turn to the first wait only, others
+	// fail with 409 Conflict, even repeated waits of the same client.
+	WaiterPolicyFirst = "first"
+	// WaiterPolicyToken returns the turn to the waits presenting the wait
+	// token of the first one, others fail with 409 Conflict. Waits must
+	// present a wait token.
+	WaiterPolicyToken = "token"
+)
+
+// Messages of a fifo session besides the events sent by the server, see
+// FifoSessionMessage.
+const (
+	// SessionHeartbeat extends the done timeout of the active ticket.
+	SessionHeartbeat = "heartbeat"
+	// SessionDone marks the active ticket done.
+	SessionDone = "done"
+	// SessionCancel gives up the ticket, queued or active.
+	SessionCancel = "cancel"
+	// SessionError is sent by the server with an ErrorResponse if a message
+	// of the client failed. The session ends if the server can't go on.
+	SessionError = "error"
+)
+
+// WebhookSignatureHeader carries the hex encoded HMAC-SHA256 of a webhook
+// body, prefixed with "sha256=".
+const WebhookSignatureHeader = "Sync-Signature"
 
 type (
+	// FifoNewRequest can override the server default timeouts of the fifo,
+	// given as Go durations like "5m". The server caps them.
+	FifoNewRequest struct {
+		WaitTimeout          string `json:"wait_timeout,omitempty"`
+		DoneTimeout          string `json:"done_timeout,omitempty"`
+		UnusedDestroyTimeout string `json:"unused_destroy_timeout,omitempty"`
+		// Webhook is a URL that receives the events of the fifo as
+		// FifoWebhook, signed with WebhookSecret or else the owner secret.
+		Webhook       string `json:"webhook,omitempty"`
+		WebhookSecret string `json:"webhook_secret,omitempty"`
+		// WebhookEvents limits the events delivered to Webhook, by default
+		// all are delivered.
+		WebhookEvents []string `json:"webhook_events,omitempty"`
+		// WaiterPolicy decides which of multiple waits on the same ticket
+		// get its turn, WaiterPolicyAll by default.
+		WaiterPolicy string `json:"waiter_policy,omitempty"`
+		// Name makes the fifo findable by name, unique in its namespace. If
+		// a fifo with the name exists, it is returned instead of creating
+		// one, ignoring the other settings.
+		Name string `json:"name,omitempty"`
+	}
+	FifoTicketRequest struct {
+		// Identity of the client. Ignored if the server derives the
+		// identity from the authentication token.
+		Identity string `json:"identity,omitempty"`
+		// After are tickets of fifos in the same namespace that must end
+		// before the ticket is notified. Until then, the ticket holds up the
+		// queue at its head. Tickets that already ended are ignored.
+		After []FifoTicketRef `json:"after,omitempty"`
+	}
+	// FifoTicketRef refers to a ticket of a fifo.
+	FifoTicketRef struct {
+		UUID     uuidlib.UUID `json:"uuid"`
+		TicketID uuidlib.UUID `json:"ticket"`
+	}
+	// FifoSecretRequest proves ownership on done and heartbeat with the
+	// ticket secret, and on delete with the owner secret.
+	FifoSecretRequest struct {
+		Secret string `json:"secret"`
+	}
+	// FifoCloneRequest creates a fifo with the settings of the fifo, like
+	// for a branch or environment that mirrors a canonical fifo. Secret is
+	// the owner secret of the cloned fifo.
+	FifoCloneRequest struct {
+		Secret string `json:"secret"`
+		// Namespace of the clone, by default the namespace of the fifo.
+		Namespace string `json:"namespace,omitempty"`
+		// Name of the clone, which must not be taken in its namespace. The
+		// clone has no name if it is empty.
+		Name string `json:"name,omitempty"`
+	}
+	// FifoTransferRequest hands a ticket over to the client with the
+	// identity. Secret is the ticket secret or the owner secret.
+	FifoTransferRequest struct {
+		Secret string `json:"secret"`
+		// Identity of the new owner. Ignored if the server derives the
+		// identity from the authentication token.
+		Identity string `json:"identity,omitempty"`
+	}
+	// FifoAcquireRequest takes a ticket in each of the fifos and waits for
+	// all of them. The server acquires the fifos in the order of their UUIDs.
+	FifoAcquireRequest struct {
+		UUIDs []uuidlib.UUID `json:"uuids"`
+		// Identity of the client. Ignored if the server derives the
+		// identity from the authentication token.
+		Identity string `json:"identity,omitempty"`
+	}
+	FifoAcquireResponse struct {
+		// Tickets hold the fifos, in the order they were acquired.
+		Tickets []FifoAcquiredTicket `json:"tickets"`
+	}
+	FifoAcquiredTicket struct {
+		UUID uuidlib.UUID `json:"uuid"`
+		FifoTicketResponse
+	}
+	// FifoWaitAllRequest waits for the turn of multiple tickets of fifos in
+	// the namespace.
+	FifoWaitAllRequest struct {
+		Tickets []FifoWaitAllTicket `json:"tickets"`
+		// Mode is WaitAll, the default, or WaitAny.
+		Mode string `json:"mode,omitempty"`
+		// Timeout bounds the wait, given as Go duration like "5m". The
+		// partial result is returned once it is reached.
+		Timeout string `json:"timeout,omitempty"`
+	}
+	FifoWaitAllTicket struct {
+		UUID     uuidlib.UUID `json:"uuid"`
+		TicketID uuidlib.UUID `json:"ticket"`
+		Secret   string       `json:"secret"`
+		// WaitToken identifies the waiter to fifos with WaiterPolicyToken.
+		WaitToken string `json:"wait_token,omitempty"`
+	}
+	// FifoWaitAllResponse reports each ticket as ready, waiting or failed.
+	FifoWaitAllResponse struct {
+		// Ready tickets had their turn and are held until done is called,
+		// even if the wait as a whole failed.
+		Ready []FifoWaitAllReady `json:"ready"`
+		// Waiting tickets are still queued.
+		Waiting []FifoTicketRef `json:"waiting"`
+		// Failed tickets won't get their turn.
+		Failed []FifoWaitAllFailure `json:"failed"`
+	}
+	FifoWaitAllReady struct {
+		UUID uuidlib.UUID `json:"uuid"`
+		FifoTicketInfo
+	}
+	FifoWaitAllFailure struct {
+		FifoTicketRef
+		Error string `json:"error"`
+		// Status is the HTTP status code corresponding to Error.
+		Status int `json:"status"`
+	}
 	FifoNewResponse struct {
 		UUID uuidlib.UUID `json:"uuid"`
+		// OwnerSecret must be passed on destructive operations like delete.
+		// It is empty if an existing named fifo was returned.
+		OwnerSecret string `json:"owner_secret"`
+		// Existing is set if a fifo with the requested name existed already.
+		Existing bool `json:"existing,omitempty"`
 	}
 	FifoTicketResponse struct {
 		TicketID uuidlib.UUID `json:"ticket"`
+		// Secret must be passed on wait, done and heartbeat calls
+		// to prove ownership of the ticket.
+		Secret string `json:"secret"`
+	}
+	FifoStatusResponse struct {
+		UUID uuidlib.UUID `json:"uuid"`
+		// Active is the ticket that currently holds the fifo, if any.
+		Active *FifoTicketInfo `json:"active,omitempty"`
+		// Queue are the waiting tickets, in order.
+		Queue []FifoTicketInfo `json:"queue"`
+	}
+	FifoListResponse struct {
+		Fifos []FifoStatusResponse `json:"fifos"`
+	}
+	// FifoWaitResponse is returned by wait once it's the ticket's turn.
+	FifoWaitResponse struct {
+		FifoTicketInfo
+		// Error is set if the wait failed after keepalives were sent,
+		// as the status code can't be changed anymore.
+		Error string `json:"error,omitempty"`
+		// Status is the HTTP status code corresponding to Error.
+		Status int `json:"status,omitempty"`
+	}
+	// FifoWaitPendingResponse is returned with 202 Accepted by async waits
+	// and polls of the state while the ticket waits for its turn. The
+	// client polls StatusURL with the ticket secret once the seconds of the
+	// Retry-After header passed, until it gets a FifoWaitResponse.
+	FifoWaitPendingResponse struct {
+		State string `json:"state"`
+		// Position is the number of tickets queued before the ticket, or -1
+		// if it just left the queue.
+		Position  int    `json:"position"`
+		StatusURL string `json:"status_url"`
+	}
+	FifoEvent struct {
+		// ID is the position of the event in the event log of the fifo,
+		// counting up from 1. It is the cursor to list the events after it.
+		// Events that aren't logged, like alerts, have none.
+		ID       uint64       `json:"id,omitempty"`
+		Type     string       `json:"type"`
+		TicketID uuidlib.UUID `json:"ticket"`
+		Identity string       `json:"identity,omitempty"`
+		// Renotified counts how often a notified ticket was notified again
+		// because its owner missed the wait timeout.
+		Renotified int `json:"renotified,omitempty"`
+		// TraceID is the trace the ticket was created in, if the client sent
+		// one.
+		TraceID string    `json:"trace_id,omitempty"`
+		Time    time.Time `json:"time"`
+	}
+	// FifoWebhook is posted to webhooks when a ticket is notified or
+	// expires, when a fifo is deleted or an alert is raised for it.
+	FifoWebhook struct {
+		Type      string       `json:"type"`
+		Namespace string       `json:"namespace,omitempty"`
+		UUID      uuidlib.UUID `json:"uuid"`
+		// Event is set for ticket events and alerts about a ticket.
+		Event *FifoEvent `json:"event,omitempty"`
+		// Alert is set for EventFifoAlert.
+		Alert string `json:"alert,omitempty"`
+		// Text summarizes the event for chat services like Slack.
+		Text string    `json:"text"`
+		Time time.Time `json:"time"`
+	}
+	FifoPositionEvent struct {
+		// Position is the number of tickets queued before the ticket.
+		Position int `json:"position"`
+	}
+	// FifoSessionMessage is a message of a fifo session over a WebSocket.
+	// The client sends the Session messages without data. The server sends
+	// the events of the ticket of the session with the data the event
+	// streams carry, starting with EventTicketCreated and the
+	// FifoTicketResponse. The session ends with the end event of the ticket
+	// or EventFifoDeleted.
+	FifoSessionMessage struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data,omitempty"`
+	}
+	// FifoEventsResponse is a page of the event log of a fifo, oldest first.
+	FifoEventsResponse struct {
+		Events []FifoEvent `json:"events"`
+		// Next is the cursor to list the events after this page.
+		Next uint64 `json:"next"`
+		// More is set if there are more events after this page.
+		More bool `json:"more"`
+		// Truncated is set if events after the requested cursor were already
+		// dropped from the log, because they exceeded its retention.
+		Truncated bool `json:"truncated,omitempty"`
+	}
+	FifoHistoryResponse struct {
+		UUID uuidlib.UUID `json:"uuid"`
+		// Tickets ended within the retention period, oldest first.
+		Tickets []FifoHistoryEntry `json:"tickets"`
+	}
+	FifoHistoryEntry struct {
+		TicketID   uuidlib.UUID `json:"ticket"`
+		Identity   string       `json:"identity,omitempty"`
+		Outcome    string       `json:"outcome"`
+		CreatedAt  time.Time    `json:"created_at"`
+		NotifiedAt *time.Time   `json:"notified_at,omitempty"`
+		AcceptedAt *time.Time   `json:"accepted_at,omitempty"`
+		EndedAt    time.Time    `json:"ended_at"`
+	}
+	FifoTicketInfo struct {
+		TicketID  uuidlib.UUID `json:"ticket"`
+		State     string       `json:"state"`
+		Identity  string       `json:"identity,omitempty"`
+		CreatedAt time.Time    `json:"created_at"`
+		// After are the tickets the ticket still waits for to end, see
+		// FifoTicketRequest.After.
+		After []FifoTicketRef `json:"after,omitempty"`
 	}
 )
+
+// Err returns the failure reported in the body of the wait response, if any.
+func (r *FifoWaitResponse) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	return &WaitError{Status: r.Status, Message: r.Error}
+}
+
+// WaitError is a failure of a wait that was reported in the response body.
+type WaitError struct {
+	// Status is the HTTP status code the server would have responded with.
+	Status  int
+	Message string
+}
+
+func (e *WaitError) Error() string {
+	return fmt.Sprintf("status code %d: %s", e.Status, e.Message)
+}
+
+// HTTPStatus returns the status code of the failure.
+func (e *WaitError) HTTPStatus() int {
+	return e.Status
+}
+
+// Is reports whether the failure matches the error of its status code,
+// see ErrorForStatus.
+func (e *WaitError) Is(target error) bool {
+	err := ErrorForStatus(e.Status)
+	return err != nil && err == target
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	uuidlib "github.com/google/uuid"
+)
+
+type (
+	// PipelineNewRequest creates a pipeline of fifos in the namespace. A
+	// ticket that is done in a stage is queued in the next stage.
+	PipelineNewRequest struct {
+		Stages []uuidlib.UUID `json:"stages"`
+	}
+	PipelineNewResponse struct {
+		UUID uuidlib.UUID `json:"uuid"`
+		// OwnerSecret must be passed to delete the pipeline.
+		OwnerSecret string `json:"owner_secret"`
+	}
+	// PipelineTicketResponse is the ticket queued in the first stage. The
+	// ticket keeps its ID and secret in all stages, so the ID correlates
+	// them.
+	PipelineTicketResponse struct {
+		FifoTicketResponse
+		Stages []uuidlib.UUID `json:"stages"`
+	}
+	PipelineStatusResponse struct {
+		UUID   uuidlib.UUID   `json:"uuid"`
+		Stages []uuidlib.UUID `json:"stages"`
+	}
+)
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+)
+
+type (
+	// QueueNewRequest creates a work queue. Producers push items with a
+	// payload, workers claim them one at a time and ack them once handled.
+	QueueNewRequest struct {
+		// LeaseTimeout is the time a worker has to ack or nack a claimed
+		// item before it is redelivered, given as Go duration like "5m". The
+		// server default is the done timeout of fifos.
+		LeaseTimeout string `json:"lease_timeout,omitempty"`
+		// MaxAttempts is the number of deliveries after which an item that
+		// isn't acked is moved to the dead-letter list. With 0, items are
+		// redelivered without limit.
+		MaxAttempts int `json:"max_attempts,omitempty"`
+	}
+	QueueNewResponse struct {
+		UUID uuidlib.UUID `json:"uuid"`
+		// OwnerSecret must be passed to delete the queue.
+		OwnerSecret string `json:"owner_secret"`
+	}
+	QueuePushRequest struct {
+		// Payload is any JSON value, limited to MaxQueuePayload bytes.
+		Payload json.RawMessage `json:"payload"`
+	}
+	QueuePushResponse struct {
+		ItemID uuidlib.UUID `json:"item"`
+	}
+	QueueClaimRequest struct {
+		// Timeout is the time to wait for an item if the queue is empty,
+		// given as Go duration like "30s". By default, claim returns right
+		// away.
+		Timeout string `json:"timeout,omitempty"`
+	}
+	// QueueClaimResponse is a claimed item. Secret must be passed to ack or
+	// nack the item until the lease ends.
+	QueueClaimResponse struct {
+		QueueItem
+		Secret      string    `json:"secret"`
+		LeasedUntil time.Time `json:"leased_until"`
+	}
+	QueueItem struct {
+		ItemID    uuidlib.UUID    `json:"item"`
+		Payload   json.RawMessage `json:"payload"`
+		CreatedAt time.Time       `json:"created_at"`
+		// Attempts is the number of times the item was delivered, including
+		// the current delivery of a claimed item.
+		Attempts int `json:"attempts"`
+	}
+	// QueueExtendRequest extends the lease of a claimed item, so the worker
+	// can take longer to handle it.
+	QueueExtendRequest struct {
+		Secret string `json:"secret"`
+		// LeaseTimeout is the time from now until the lease ends, given as Go
+		// duration like "5m". Defaults to the lease timeout of the queue.
+		LeaseTimeout string `json:"lease_timeout,omitempty"`
+	}
+	QueueExtendResponse struct {
+		LeasedUntil time.Time `json:"leased_until"`
+	}
+	// QueueDeadResponse lists the items that exceeded the max attempts of the
+	// queue, oldest first.
+	QueueDeadResponse struct {
+		Items []QueueDeadItem `json:"items"`
+	}
+	QueueDeadItem struct {
+		QueueItem
+		// Reason is why the last delivery failed, one of DeadReasonNacked and
+		// DeadReasonLeaseExpired.
+		Reason string    `json:"reason"`
+		DeadAt time.Time `json:"dead_at"`
+	}
+	QueueStatusResponse struct {
+		UUID uuidlib.UUID `json:"uuid"`
+		// Pending items wait to be claimed.
+		Pending int `json:"pending"`
+		// Leased items are claimed by workers.
+		Leased int `json:"leased"`
+		// Dead items exceeded the max attempts.
+		Dead int `json:"dead"`
+	}
+)
+
+// Reasons of the failed last delivery of dead items.
+const (
+	DeadReasonNacked       = "nacked"
+	DeadReasonLeaseExpired = "lease_expired"
+)
+
+// MaxQueuePayload limits the size of the payload of queue items.
+const MaxQueuePayload = 64 << 10
@@ -0,0 +1,29 @@
+package api
+
+type (
+	// QuotaUsage counts the resources a client or namespace holds.
+	QuotaUsage struct {
+		// Fifos created that still exist.
+		Fifos int `json:"fifos"`
+		// Tickets that haven't ended.
+		Tickets int `json:"tickets"`
+		// Waits are the running wait requests.
+		Waits int `json:"waits"`
+	}
+	// Quota is the usage of a client or namespace and its limits. Zero
+	// limits are unlimited.
+	Quota struct {
+		Used   QuotaUsage `json:"used"`
+		Limits QuotaUsage `json:"limits"`
+	}
+	// QuotaResponse is the quota of the calling client and of the namespace.
+	// Requests exceeding either fail with 429.
+	QuotaResponse struct {
+		// Client identifies the caller by its authenticated identity, or
+		// else its IP address.
+		Client         string `json:"client"`
+		ClientQuota    Quota  `json:"client_quota"`
+		Namespace      string `json:"namespace"`
+		NamespaceQuota Quota  `json:"namespace_quota"`
+	}
+)
@@ -0,0 +1,28 @@
+package api
+
+import "time"
+
+type (
+	// VersionResponse describes the software version of the server.
+	VersionResponse struct {
+		Version string `json:"version"`
+		// APIVersion is the version of the HTTP API, see Version.
+		APIVersion string `json:"api_version"`
+	}
+	// ServerStatusResponse describes the state of the server.
+	ServerStatusResponse struct {
+		// Backend is where the server keeps its state, currently always
+		// "memory".
+		Backend   string    `json:"backend"`
+		StartedAt time.Time `json:"started_at"`
+		// Uptime is given as Go duration like "3h2m1s".
+		Uptime string `json:"uptime"`
+		// Fifos is the number of fifos in all namespaces.
+		Fifos int `json:"fifos"`
+		// Waiters is the number of running wait requests.
+		Waiters int64 `json:"waiters"`
+		// Deadlocks is the number of cycles of clients waiting for each
+		// other.
+		Deadlocks int `json:"deadlocks"`
+	}
+)
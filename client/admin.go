@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+	"github.com/spf13/cobra"
+)
+
+func newAdminCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Administrate the sync server",
+	}
+	cmd.PersistentFlags().StringP("endpoint", "e", "http://localhost:8080", "endpoint of the sync server (env SYNC_ENDPOINT)")
+	cmd.PersistentFlags().String("token", "", "admin token of the sync server (env SYNC_ADMIN_TOKEN)")
+	cmd.PersistentFlags().String("cacert", "", "CA certificate file to verify the sync server (env SYNC_CACERT)")
+	cmd.PersistentFlags().String("cert", "", "client certificate file for mutual TLS (env SYNC_CERT)")
+	cmd.PersistentFlags().String("key", "", "client key file for mutual TLS (env SYNC_KEY)")
+	cmd.AddCommand(
+		newAdminBackupCommand(),
+		newAdminRestoreCommand(),
+		newAdminGCCommand(),
+		newAdminLogLevelCommand(),
+	)
+	return cmd
+}
+
+func newAdminBackupCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "download a backup of all fifos",
+		Long: "download a backup of all fifos\n\n" +
+			"The backup contains all secrets, a file written with --file is only readable by its owner. " +
+			"Restore it by starting the server with -restore.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseAdminFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newAdminClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			if flags.file != "" {
+				f, err := createBackupFile(flags.file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+			return RunAdminBackup(cmd.Context(), client, flags, out)
+		},
+	}
+	cmd.Flags().StringP("file", "f", "", "file to write the backup to instead of stdout")
+	return cmd
+}
+
+// createBackupFile creates the file at path for a backup, or truncates it if
+// it exists. The file is only readable by its owner, as the backup contains
+// all secrets.
+func createBackupFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// An existing file keeps its permissions.
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func RunAdminBackup(ctx context.Context, client *ihttp.Client, flags *AdminFlags, out io.Writer) error {
+	url, err := ihttp.JoinURL(flags.endpoint, "v1", "admin", "backup")
+	if err != nil {
+		return err
+	}
+	body, err := client.Stream(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if _, err := io.Copy(out, body); err != nil {
+		return fmt.Errorf("reading backup: %w", err)
+	}
+	return nil
+}
+
+func newAdminRestoreCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "restore a backup into the running server",
+		Long: "restore a backup into the running server\n\n" +
+			"Nothing is restored if any fifo of the backup already exists on the server. " +
+			"The raw output is the number of restored fifos.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseAdminFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newAdminClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunAdminRestore(cmd.Context(), client, flags)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	cmd.Flags().StringP("file", "f", "", "file to read the backup from")
+	must(cmd.MarkFlagRequired("file"))
+	return cmd
+}
+
+func RunAdminRestore(ctx context.Context, client *ihttp.Client, flags *AdminFlags) (string, error) {
+	url, err := ihttp.JoinURL(flags.endpoint, "v1", "admin", "restore")
+	if err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(flags.file)
+	if err != nil {
+		return "", fmt.Errorf("reading backup: %w", err)
+	}
+	var backup api.Backup
+	if err := json.Unmarshal(raw, &backup); err != nil {
+		return "", fmt.Errorf("decoding backup: %w", err)
+	}
+
+	resp := &api.RestoreResponse{}
+	if err := client.PostJSON(ctx, url, backup, resp); err != nil {
+		return "", err
+	}
+	if flags.output == "json" {
+		b, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return strconv.Itoa(resp.Fifos), nil
+}
+
+func newAdminGCCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "drop expired history entries of all fifos",
+		Long: "drop expired history entries of all fifos\n\n" +
+			"The server also does this periodically. The raw output is the number of dropped entries.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseAdminFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newAdminClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunAdminGC(cmd.Context(), client, flags)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func RunAdminGC(ctx context.Context, client *ihttp.Client, flags *AdminFlags) (string, error) {
+	url, err := ihttp.JoinURL(flags.endpoint, "v1", "admin", "gc")
+	if err != nil {
+		return "", err
+	}
+	resp := &api.GCResponse{}
+	if err := client.PostJSON(ctx, url, struct{}{}, resp); err != nil {
+		return "", err
+	}
+	if flags.output == "json" {
+		b, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return strconv.Itoa(resp.HistoryEntries), nil
+}
+
+func newAdminLogLevelCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:       "log-level [debug|info|warn|error]",
+		Short:     "get or change the log level of the server",
+		Long:      "get or change the log level of the server\n\nThe level is kept until the server restarts.",
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{"debug", "info", "warn", "error"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseAdminFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newAdminClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			level := ""
+			if len(args) > 0 {
+				level = args[0]
+			}
+			out, err := RunAdminLogLevel(cmd.Context(), client, flags, level)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	return cmd
+}
+
+// RunAdminLogLevel changes the log level of the server to level, or only
+// reads it if level is empty.
+func RunAdminLogLevel(ctx context.Context, client *ihttp.Client, flags *AdminFlags, level string) (string, error) {
+	url, err := ihttp.JoinURL(flags.endpoint, "v1", "admin", "log-level")
+	if err != nil {
+		return "", err
+	}
+	resp := &api.LogLevelResponse{}
+	if level == "" {
+		err = client.GetJSON(ctx, url, resp)
+	} else {
+		err = client.Do(ctx, http.MethodPut, url, api.LogLevelRequest{Level: level}, resp)
+	}
+	if err != nil {
+		return "", err
+	}
+	if flags.output == "json" {
+		b, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return resp.Level, nil
+}
+
+type AdminFlags struct {
+	endpoint string
+	output   string
+	token    string
+	cacert   string
+	cert     string
+	key      string
+	file     string
+}
+
+func parseAdminFlags(cmd *cobra.Command) (*AdminFlags, error) {
+	s, err := loadSettings(cmd)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := s.getString("endpoint", "SYNC_ENDPOINT", s.context.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.getString("output", "SYNC_OUTPUT", s.context.Output)
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.getString("token", "SYNC_ADMIN_TOKEN", s.context.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	cacert, err := s.getString("cacert", "SYNC_CACERT", s.context.CACert)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := s.getString("cert", "SYNC_CERT", s.context.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.getString("key", "SYNC_KEY", s.context.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional flags
+	file, _ := cmd.Flags().GetString("file")
+
+	return &AdminFlags{
+		endpoint: endpoint,
+		output:   output,
+		token:    token,
+		cacert:   cacert,
+		cert:     cert,
+		key:      key,
+		file:     file,
+	}, nil
+}
+
+func newAdminClient(ctx context.Context, flags *AdminFlags) (*ihttp.Client, error) {
+	opts := []ihttp.Option{
+		ihttp.WithToken(flags.token),
+		ihttp.WithHeader(api.VersionHeader, api.Version),
+		ihttp.WithUserAgent(userAgent),
+		ihttp.WithLogger(logFrom(ctx)),
+	}
+	if flags.cacert != "" || flags.cert != "" || flags.key != "" {
+		tlsConfig, err := ihttp.LoadTLSConfig(flags.cacert, flags.cert, flags.key)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, ihttp.WithTLSConfig(tlsConfig))
+	}
+	return ihttp.NewClient(opts...), nil
+}
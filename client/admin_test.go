@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateBackupFile(t *testing.T) {
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "backup.json")
+
+	f, err := createBackupFile(path)
+	require.NoError(err)
+	require.NoError(f.Close())
+	info, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0o600), info.Mode().Perm())
+
+	// An existing file readable by others is restricted and truncated.
+	require.NoError(os.WriteFile(path, []byte("old"), 0o644))
+	require.NoError(os.Chmod(path, 0o644))
+	f, err = createBackupFile(path)
+	require.NoError(err)
+	require.NoError(f.Close())
+	info, err = os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0o600), info.Mode().Perm())
+	require.Zero(info.Size())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+)
+
+// ciPositionInterval is the interval in which the queue position is polled
+// while waiting in CI mode.
+const ciPositionInterval = 10 * time.Second
+
+// githubActions emits GitHub Actions workflow commands about the ticket, so
+// waiting is visible in the workflow log and later steps can use the ticket.
+// A nil *githubActions emits nothing.
+type githubActions struct {
+	out io.Writer
+	// outputFile is the file of the step outputs, set in GITHUB_OUTPUT.
+	outputFile string
+}
+
+// newCIOutput returns the output for the CI system, or nil if ci is empty.
+func newCIOutput(ci string, out io.Writer) (*githubActions, error) {
+	switch ci {
+	case "":
+		return nil, nil
+	case "github":
+		return &githubActions{out: out, outputFile: os.Getenv("GITHUB_OUTPUT")}, nil
+	default:
+		return nil, fmt.Errorf("unknown CI system %q", ci)
+	}
+}
+
+// ticketTaken masks the secret of the ticket in the workflow log and sets the
+// ticket step output.
+func (g *githubActions) ticketTaken(resp *api.FifoTicketResponse) error {
+	if g == nil {
+		return nil
+	}
+	fmt.Fprintf(g.out, "::add-mask::%s\n", escapeWorkflowData(resp.Secret))
+	if g.outputFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(g.outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing step output: %w", err)
+	}
+	if _, err := fmt.Fprintf(f, "ticket=%s\n", resp.TicketID); err != nil {
+		f.Close()
+		return fmt.Errorf("writing step output: %w", err)
+	}
+	return f.Close()
+}
+
+// waiting groups the log of the wait and reports the queue position of the
+// ticket until the returned function is called. The first position is
+// reported as a notice.
+func (g *githubActions) waiting(ctx context.Context, client *ihttp.Client, flags *FifoFlags) func() {
+	if g == nil {
+		return func() {}
+	}
+	fmt.Fprintf(g.out, "::group::Waiting for the turn of ticket %s\n", flags.ticketID)
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ciPositionInterval)
+		defer ticker.Stop()
+		last := -1
+		for {
+			if pos := queuePosition(ctx, client, flags); pos >= 0 && pos != last {
+				if last < 0 {
+					fmt.Fprintf(g.out, "::notice title=sync::Ticket %s is queued behind %d tickets\n", flags.ticketID, pos)
+				} else {
+					fmt.Fprintf(g.out, "Queued behind %d tickets\n", pos)
+				}
+				last = pos
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+		fmt.Fprintln(g.out, "::endgroup::")
+	}
+}
+
+// waitFailed reports the failure of a wait as an error annotation.
+func (g *githubActions) waitFailed(err error) {
+	if g == nil {
+		return
+	}
+	fmt.Fprintf(g.out, "::error title=sync::%s\n", escapeWorkflowData(err.Error()))
+}
+
+// queuePosition returns the number of tickets queued before the ticket, or -1
+// if it isn't queued or the status can't be read.
+func queuePosition(ctx context.Context, client *ihttp.Client, flags *FifoFlags) int {
+	status, err := getFifoStatus(ctx, client, flags)
+	if err != nil {
+		return -1
+	}
+	for i, t := range status.Queue {
+		if t.TicketID.String() == flags.ticketID {
+			return i
+		}
+	}
+	return -1
+}
+
+// escapeWorkflowData escapes s for the message of a workflow command.
+func escapeWorkflowData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubActions(t *testing.T) {
+	require := require.New(t)
+	ticketID := uuid.New()
+
+	// The ticket expires once its position was reported.
+	var reported sync.Once
+	positionReported := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/status"):
+			_ = json.NewEncoder(w).Encode(api.FifoStatusResponse{Queue: []api.FifoTicketInfo{
+				{TicketID: uuid.New()}, {TicketID: ticketID},
+			}})
+			reported.Do(func() { close(positionReported) })
+		case strings.Contains(r.URL.Path, "/wait/"):
+			<-positionReported
+			time.Sleep(10 * time.Millisecond)
+			http.Error(w, "ticket expired", http.StatusGone)
+		default:
+			_ = json.NewEncoder(w).Encode(api.FifoTicketResponse{TicketID: ticketID, Secret: "s3cret"})
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("GITHUB_OUTPUT", filepath.Join(t.TempDir(), "output"))
+	var out strings.Builder
+	ci, err := newCIOutput("github", &out)
+	require.NoError(err)
+	flags := &FifoFlags{endpoint: srv.URL, uuid: uuid.NewString(), ci: ci}
+
+	err = RunFifoAcquire(context.Background(), ihttp.NewClient(), flags, &out)
+	require.Equal(exitGone, exitCode(err))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Equal([]string{
+		"::add-mask::s3cret",
+		ticketID.String(),
+		"::group::Waiting for the turn of ticket " + ticketID.String(),
+		"::notice title=sync::Ticket " + ticketID.String() + " is queued behind 1 tickets",
+		"::endgroup::",
+	}, lines[:5])
+	require.True(strings.HasPrefix(lines[5], "::error title=sync::"), lines[5])
+	output, err := os.ReadFile(os.Getenv("GITHUB_OUTPUT"))
+	require.NoError(err)
+	require.Equal("ticket="+ticketID.String()+"\n", string(output))
+
+	_, err = newCIOutput("jenkins", &out)
+	require.Error(err)
+}
+
+func TestEscapeWorkflowData(t *testing.T) {
+	assert.Equal(t, "100%25%0Adone%0D", escapeWorkflowData("100%\ndone\r"))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// clientConfig is the configuration file of the client. It holds named
+// contexts, each describing how to reach a sync server.
+type clientConfig struct {
+	// CurrentContext is used if no context is selected explicitly.
+	CurrentContext string                   `yaml:"currentContext"`
+	Contexts       map[string]clientContext `yaml:"contexts"`
+}
+
+type clientContext struct {
+	Endpoint   string `yaml:"endpoint"`
+	Namespace  string `yaml:"namespace"`
+	Output     string `yaml:"output"`
+	Identity   string `yaml:"identity"`
+	Token      string `yaml:"token"`
+	AdminToken string `yaml:"adminToken"`
+	CACert     string `yaml:"cacert"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+}
+
+// defaultConfigPath returns the path of the configuration file that is
+// read if none is given, ~/.config/sync/config.yaml on Linux.
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sync", "config.yaml"), nil
+}
+
+// settings resolves values that can be given as flag, environment variable
+// or in the selected context of the configuration file, in this order of
+// precedence. The flag default is used if none of them is set.
+type settings struct {
+	cmd     *cobra.Command
+	context clientContext
+}
+
+func loadSettings(cmd *cobra.Command) (*settings, error) {
+	path, _ := cmd.Flags().GetString("config")
+	if path == "" {
+		path = os.Getenv("SYNC_CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			// Without a home directory, there is no default configuration.
+			return &settings{cmd: cmd}, nil
+		}
+	}
+	name, _ := cmd.Flags().GetString("context")
+	if name == "" {
+		name = os.Getenv("SYNC_CONTEXT")
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit && name == "" {
+		return &settings{cmd: cmd}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	var cfg clientConfig
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	if name == "" {
+		name = cfg.CurrentContext
+	}
+	if name == "" {
+		return &settings{cmd: cmd}, nil
+	}
+	context, ok := cfg.Contexts[name]
+	if !ok {
+		return nil, fmt.Errorf("context %q not found in config file %s", name, path)
+	}
+	return &settings{cmd: cmd, context: context}, nil
+}
+
+// getString returns the value of the flag if it was set, else of the
+// environment variable env, else fromContext, else the flag default.
+func (s *settings) getString(flag, env, fromContext string) (string, error) {
+	if s.cmd.Flags().Changed(flag) {
+		return s.cmd.Flags().GetString(flag)
+	}
+	if v := os.Getenv(env); env != "" && v != "" {
+		return v, nil
+	}
+	if fromContext != "" {
+		return fromContext, nil
+	}
+	return s.cmd.Flags().GetString(flag)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSettings(t *testing.T) {
+	config := `
+currentContext: ci
+contexts:
+  ci:
+    endpoint: https://sync.ci.example
+    namespace: builds
+  local:
+    endpoint: http://localhost:9090
+`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+
+	testCases := map[string]struct {
+		args          []string
+		env           map[string]string
+		wantEndpoint  string
+		wantNamespace string
+		wantErr       bool
+	}{
+		"current context": {
+			args:          []string{"--config", path},
+			wantEndpoint:  "https://sync.ci.example",
+			wantNamespace: "builds",
+		},
+		"selected context": {
+			args:         []string{"--config", path, "--context", "local"},
+			wantEndpoint: "http://localhost:9090",
+		},
+		"context from env": {
+			args:         []string{"--config", path},
+			env:          map[string]string{"SYNC_CONTEXT": "local"},
+			wantEndpoint: "http://localhost:9090",
+		},
+		"env overrides context": {
+			args:          []string{"--config", path},
+			env:           map[string]string{"SYNC_ENDPOINT": "http://env.example"},
+			wantEndpoint:  "http://env.example",
+			wantNamespace: "builds",
+		},
+		"flag overrides env": {
+			args:          []string{"--config", path, "-e", "http://flag.example"},
+			env:           map[string]string{"SYNC_ENDPOINT": "http://env.example"},
+			wantEndpoint:  "http://flag.example",
+			wantNamespace: "builds",
+		},
+		"no config file": {
+			args:         []string{},
+			env:          map[string]string{"XDG_CONFIG_HOME": t.TempDir()},
+			wantEndpoint: "http://localhost:8080",
+		},
+		"missing config file": {
+			args:    []string{"--config", filepath.Join(dir, "missing.yaml")},
+			wantErr: true,
+		},
+		"unknown context": {
+			args:    []string{"--config", path, "--context", "prod"},
+			wantErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			cmd := &cobra.Command{}
+			cmd.Flags().String("config", "", "")
+			cmd.Flags().String("context", "", "")
+			cmd.Flags().StringP("endpoint", "e", "http://localhost:8080", "")
+			cmd.Flags().String("namespace", "", "")
+			require.NoError(t, cmd.ParseFlags(tc.args))
+
+			s, err := loadSettings(cmd)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(t, err)
+			endpoint, err := s.getString("endpoint", "SYNC_ENDPOINT", s.context.Endpoint)
+			assert.NoError(err)
+			assert.Equal(tc.wantEndpoint, endpoint)
+			namespace, err := s.getString("namespace", "SYNC_NAMESPACE", s.context.Namespace)
+			assert.NoError(err)
+			assert.Equal(tc.wantNamespace, namespace)
+		})
+	}
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	uuidlib "github.com/google/uuid"
 	"github.com/katexochen/sync/api"
 	ihttp "github.com/katexochen/sync/internal/http"
 	"github.com/spf13/cobra"
@@ -17,27 +28,72 @@ func newFifoCommand() *cobra.Command {
 		Use:   "fifo",
 		Short: "First-in, first-out queue",
 	}
-	cmd.PersistentFlags().StringP("endpoint", "e", "http://localhost:8080", "endpoint of the sync server")
-	cmd.PersistentFlags().StringP("output", "o", "raw", "output format: raw, json")
+	addFifoConnectionFlags(cmd)
 	cmd.AddCommand(
 		newFifoNewCommand(),
 		newFifoTicketCommand(),
 		newFifoWaitCommand(),
+		newFifoAcquireCommand(),
 		newFifoDoneCommand(),
+		newFifoTransferCommand(),
+		newFifoDeleteCommand(),
+		newFifoUndeleteCommand(),
+		newFifoCloneCommand(),
+		newFifoStatusCommand(),
+		newFifoHistoryCommand(),
+		newFifoListCommand(),
+		newFifoEventsCommand(),
+		newFifoWatchCommand(),
+		newFifoRunCommand(),
+		newFifoAdminCommand(),
 	)
 	return cmd
 }
 
+// addFifoTimeoutFlags adds the flags overriding the timeouts of a new fifo.
+func addFifoTimeoutFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("wait-timeout", 0, "time a notified ticket owner has to call wait (default server setting)")
+	cmd.Flags().Duration("done-timeout", 0, "time a ticket owner has to call done (default server setting)")
+	cmd.Flags().Duration("unused-destroy-timeout", 0, "time after which the unused fifo is deleted (default server setting)")
+}
+
+// addFifoConnectionFlags adds the flags configuring the connection to the
+// server and the client identity to the command and its subcommands.
+func addFifoConnectionFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringP("endpoint", "e", "http://localhost:8080", "endpoint of the sync server (env SYNC_ENDPOINT)")
+	cmd.PersistentFlags().StringP("namespace", "n", "", "namespace of the fifo queue (env SYNC_NAMESPACE)")
+	cmd.PersistentFlags().String("identity", "", "identity of this client recorded on tickets (env SYNC_IDENTITY)")
+	cmd.PersistentFlags().String("traceparent", "", "W3C traceparent of the trace to link tickets to (env TRACEPARENT)")
+	cmd.PersistentFlags().String("token", "", "bearer token to authenticate against the sync server (env SYNC_TOKEN)")
+	cmd.PersistentFlags().String("cacert", "", "CA certificate file to verify the sync server (env SYNC_CACERT)")
+	cmd.PersistentFlags().String("cert", "", "client certificate file for mutual TLS (env SYNC_CERT)")
+	cmd.PersistentFlags().String("key", "", "client key file for mutual TLS (env SYNC_KEY)")
+	cmd.PersistentFlags().Int("retries", 3, "number of retries of requests failing with server or connection errors")
+	cmd.PersistentFlags().Duration("retry-backoff", time.Second, "delay before the first retry, doubled on each further retry")
+	cmd.PersistentFlags().Duration("max-elapsed", 2*time.Minute, "maximum time to keep retrying after the first failure, 0 for no limit")
+	cmd.PersistentFlags().String("ci", "", "CI system to emit workflow commands for while waiting: github (env SYNC_CI)")
+	must(cmd.RegisterFlagCompletionFunc("ci", cobra.FixedCompletions([]string{"github"}, cobra.ShellCompDirectiveNoFileComp)))
+	cmd.PersistentFlags().Bool("local", false, "use a server on this machine, started in the background if it isn't running")
+	cmd.MarkFlagsMutuallyExclusive("local", "endpoint")
+}
+
 func newFifoNewCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "new",
 		Short: "create a new first-in, first-out queue",
+		Long: "create a new first-in, first-out queue\n\n" +
+			"The raw output is the fifo uuid followed by the owner secret, separated by a space.\n\n" +
+			"With --name, the fifo with the name is returned if it exists, without the owner secret.",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			flags, err := parseFifoFlags(cmd)
 			if err != nil {
 				return fmt.Errorf("parsing flags: %w", err)
 			}
-			out, err := RunFifoNew(cmd.Context(), ihttp.NewClient(), flags)
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunFifoNew(cmd.Context(), client, flags)
 			if err != nil {
 				return err
 			}
@@ -45,20 +101,32 @@ func newFifoNewCommand() *cobra.Command {
 			return nil
 		},
 	}
+	cmd.Flags().String("name", "", "name under which clients get the same fifo instead of a new one")
+	addFifoTimeoutFlags(cmd)
+	cmd.Flags().String("webhook", "", "URL that receives the events of the fifo, signed with the owner secret")
+	cmd.Flags().String("webhook-secret", "", "key to sign the webhook payloads with instead of the owner secret")
+	cmd.Flags().StringSlice("webhook-events", nil, "events delivered to the webhook: ticket_notified, ticket_expired, fifo_deleted, fifo_alert (default all)")
+	must(cmd.RegisterFlagCompletionFunc("webhook-events", cobra.FixedCompletions([]string{
+		api.EventTicketNotified, api.EventTicketExpired, api.EventFifoDeleted, api.EventFifoAlert,
+	}, cobra.ShellCompDirectiveNoFileComp)))
+	cmd.Flags().String("waiter-policy", "", "which of multiple waits on the same ticket get its turn: all, first, token (default all)")
+	must(cmd.RegisterFlagCompletionFunc("waiter-policy", cobra.FixedCompletions([]string{
+		api.WaiterPolicyAll, api.WaiterPolicyFirst, api.WaiterPolicyToken,
+	}, cobra.ShellCompDirectiveNoFileComp)))
 	return cmd
 }
 
 func RunFifoNew(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (string, error) {
-	url, err := urlJoin(flags.endpoint, "fifo", "new")
+	resp, err := createFifo(ctx, client, flags)
 	if err != nil {
 		return "", err
 	}
+	return formatNewFifo(flags, resp)
+}
 
-	resp := &api.FifoNewResponse{}
-	if err := client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
-		return "", err
-	}
-
+// formatNewFifo returns the output of a created fifo, the raw output is the
+// fifo uuid followed by the owner secret.
+func formatNewFifo(flags *FifoFlags, resp *api.FifoNewResponse) (string, error) {
 	if flags.output == "json" {
 		b, err := json.MarshalIndent(resp, "", "  ")
 		if err != nil {
@@ -66,19 +134,55 @@ func RunFifoNew(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (st
 		}
 		return string(b), nil
 	}
-	return resp.UUID.String(), nil
+	if resp.OwnerSecret == "" {
+		// Only the creator of a named fifo gets the owner secret.
+		return resp.UUID.String(), nil
+	}
+	return resp.UUID.String() + " " + resp.OwnerSecret, nil
+}
+
+// createFifo creates a fifo, or gets the fifo with the name of the flags if
+// it exists.
+func createFifo(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (*api.FifoNewResponse, error) {
+	url, err := fifoURL(flags, "new")
+	if err != nil {
+		return nil, err
+	}
+	req := api.FifoNewRequest{
+		WaitTimeout:          durationOrEmpty(flags.waitTimeout),
+		DoneTimeout:          durationOrEmpty(flags.doneTimeout),
+		UnusedDestroyTimeout: durationOrEmpty(flags.unusedDestroyTimeout),
+		Webhook:              flags.webhook,
+		WebhookSecret:        flags.webhookSecret,
+		WebhookEvents:        flags.webhookEvents,
+		WaiterPolicy:         flags.waiterPolicy,
+		Name:                 flags.name,
+	}
+
+	resp := &api.FifoNewResponse{}
+	if err := client.RequestJSON(ctx, url, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 func newFifoTicketCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "ticket",
 		Short: "request a ticket for the given fifo queue",
+		Long: "request a ticket for the given fifo queue\n\n" +
+			"The raw output is the ticket uuid. The ticket secret is part of the json output " +
+			"and can be written to a ticket file with --ticket-file.",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			flags, err := parseFifoFlags(cmd)
 			if err != nil {
 				return fmt.Errorf("parsing flags: %w", err)
 			}
-			out, err := RunFifoTicket(cmd.Context(), ihttp.NewClient(), flags)
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunFifoTicket(cmd.Context(), client, flags)
 			if err != nil {
 				return err
 			}
@@ -87,20 +191,69 @@ func newFifoTicketCommand() *cobra.Command {
 		},
 	}
 	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	addAfterFlag(cmd)
+	cmd.Flags().String("ticket-file", "", "file to write the ticket to, readable by done --from-file")
 	return cmd
 }
 
+// addAfterFlag adds the flag for tickets that must end before the ticket
+// taken by the command is notified.
+func addAfterFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("after", nil, "tickets of fifos in the same namespace that must end before this ticket is called, as <fifo uuid>/<ticket uuid>")
+}
+
+// parseTicketRefs parses tickets given as <fifo uuid>/<ticket uuid>.
+func parseTicketRefs(raw []string) ([]api.FifoTicketRef, error) {
+	var refs []api.FifoTicketRef
+	for _, r := range raw {
+		fifoUUID, ticketID, ok := strings.Cut(r, "/")
+		if !ok {
+			return nil, fmt.Errorf("ticket %q: expected <fifo uuid>/<ticket uuid>", r)
+		}
+		var ref api.FifoTicketRef
+		var err error
+		if ref.UUID, err = uuidlib.Parse(fifoUUID); err != nil {
+			return nil, fmt.Errorf("ticket %q: parsing fifo uuid: %w", r, err)
+		}
+		if ref.TicketID, err = uuidlib.Parse(ticketID); err != nil {
+			return nil, fmt.Errorf("ticket %q: parsing ticket uuid: %w", r, err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
 func RunFifoTicket(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (string, error) {
-	url, err := urlJoin(flags.endpoint, "fifo", flags.uuid, "ticket")
+	resp, err := takeTicket(ctx, client, flags)
 	if err != nil {
 		return "", err
 	}
+	if flags.ticketFile != "" {
+		if err := writeTicketFile(flags.ticketFile, flags, resp); err != nil {
+			return "", err
+		}
+	}
+	return formatTicket(flags, resp)
+}
+
+func takeTicket(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (*api.FifoTicketResponse, error) {
+	url, err := fifoURL(flags, flags.uuid, "ticket")
+	if err != nil {
+		return nil, err
+	}
 
+	// The server returns the same ticket if the request is retried.
 	resp := &api.FifoTicketResponse{}
-	if err := client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
-		return "", err
+	if err := client.RequestJSON(ihttp.Idempotent(ctx), url, api.FifoTicketRequest{After: flags.after}, resp); err != nil {
+		return nil, err
+	}
+	if err := flags.ci.ticketTaken(resp); err != nil {
+		return nil, err
 	}
+	return resp, nil
+}
 
+func formatTicket(flags *FifoFlags, resp *api.FifoTicketResponse) (string, error) {
 	if flags.output == "json" {
 		b, err := json.MarshalIndent(resp, "", "  ")
 		if err != nil {
@@ -108,35 +261,201 @@ func RunFifoTicket(ctx context.Context, client *ihttp.Client, flags *FifoFlags)
 		}
 		return string(b), nil
 	}
+	// The secret stays out of the raw output, which is often logged.
 	return resp.TicketID.String(), nil
 }
 
+func newFifoAcquireCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "acquire",
+		Short: "request a ticket and wait for it to be called",
+		Long: "request a ticket and wait for it to be called\n\n" +
+			"The ticket is printed like by the ticket command before waiting. " +
+			"It can also be written to a file, from which the done command can read it with --from-file. " +
+			"Exits with the same codes as the wait command.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return RunFifoAcquire(cmd.Context(), client, flags, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkFlagRequired("uuid"))
+	addAfterFlag(cmd)
+	cmd.Flags().String("ticket-file", "", "file to write the ticket to, readable by done --from-file")
+	cmd.Flags().Bool("cancel-on-disconnect", false, "give up the place in the queue if the wait is interrupted")
+	cmd.Flags().Duration("keepalive", 0, "interval of keepalive bytes sent by the server to keep proxies from closing the connection")
+	cmd.Flags().Duration("timeout", 0, "maximum time to wait, 0 for no limit; the ticket stays queued unless --cancel-on-disconnect is set")
+	return cmd
+}
+
+// RunFifoAcquire takes a ticket, writes it to out and the ticket file, if
+// set, and waits until it's the turn of the ticket.
+func RunFifoAcquire(ctx context.Context, client *ihttp.Client, flags *FifoFlags, out io.Writer) error {
+	resp, err := takeTicket(ctx, client, flags)
+	if err != nil {
+		return err
+	}
+	if flags.ticketFile != "" {
+		if err := writeTicketFile(flags.ticketFile, flags, resp); err != nil {
+			return err
+		}
+	}
+	ticket, err := formatTicket(flags, resp)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, ticket)
+
+	ticketFlags := *flags
+	ticketFlags.ticketID = resp.TicketID.String()
+	ticketFlags.secret = resp.Secret
+	return RunFifoWait(ctx, client, &ticketFlags)
+}
+
+// ticketFile holds everything needed to release a ticket from another
+// process.
+type ticketFile struct {
+	Namespace string `json:"namespace,omitempty"`
+	UUID      string `json:"uuid"`
+	TicketID  string `json:"ticket"`
+	Secret    string `json:"secret"`
+}
+
+func writeTicketFile(path string, flags *FifoFlags, resp *api.FifoTicketResponse) error {
+	b, err := json.Marshal(ticketFile{
+		Namespace: flags.namespace,
+		UUID:      flags.uuid,
+		TicketID:  resp.TicketID.String(),
+		Secret:    resp.Secret,
+	})
+	if err != nil {
+		return err
+	}
+	// The file contains the ticket secret.
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return fmt.Errorf("writing ticket file: %w", err)
+	}
+	return nil
+}
+
+// readTicketFile sets the fifo, ticket and secret of flags from the ticket
+// file.
+func readTicketFile(path string, flags *FifoFlags) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading ticket file: %w", err)
+	}
+	var tf ticketFile
+	if err := json.Unmarshal(b, &tf); err != nil {
+		return fmt.Errorf("decoding ticket file: %w", err)
+	}
+	if tf.Namespace != "" {
+		flags.namespace = tf.Namespace
+	}
+	flags.uuid, flags.ticketID, flags.secret = tf.UUID, tf.TicketID, tf.Secret
+	return nil
+}
+
 func newFifoWaitCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "wait",
 		Short: "wait for the ticket to be called",
+		Long: "wait for the ticket to be called\n\n" +
+			"Dropped connections are resumed. If a proxy cuts the blocking wait short, the state of the ticket " +
+			"is polled instead. Exits with 0 when it's the turn of the ticket, " +
+			"2 if the timeout is reached and 3 if the ticket expired or the fifo is gone.",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			flags, err := parseFifoFlags(cmd)
 			if err != nil {
 				return fmt.Errorf("parsing flags: %w", err)
 			}
-			return RunFifoWait(cmd.Context(), ihttp.NewClient(), flags)
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return RunFifoWait(cmd.Context(), client, flags)
 		},
 	}
 	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
 	must(cmd.MarkFlagRequired("uuid"))
 	cmd.Flags().StringP("ticket", "t", "", "uuid of the ticket")
 	must(cmd.MarkFlagRequired("ticket"))
+	cmd.Flags().StringP("secret", "s", "", "secret of the ticket")
+	must(cmd.MarkFlagRequired("secret"))
+	cmd.Flags().Bool("cancel-on-disconnect", false, "give up the place in the queue if the wait is interrupted")
+	cmd.Flags().Duration("keepalive", 0, "interval of keepalive bytes sent by the server to keep proxies from closing the connection")
+	cmd.Flags().Duration("timeout", 0, "maximum time to wait, 0 for no limit; the ticket stays queued unless --cancel-on-disconnect is set")
+	cmd.Flags().String("wait-token", "", "token identifying this waiter, required by fifos with the token waiter policy")
+	cmd.Flags().Bool("poll", false, "poll the state of the ticket instead of holding a connection open")
 	return cmd
 }
 
 func RunFifoWait(ctx context.Context, client *ihttp.Client, flags *FifoFlags) error {
-	url, err := urlJoin(flags.endpoint, "fifo", flags.uuid, "wait", flags.ticketID)
+	query := url.Values{}
+	if flags.cancelOnDisconnect {
+		query.Set("cancel_on_disconnect", "true")
+	}
+	if flags.keepalive > 0 {
+		query.Set("keepalive", flags.keepalive.String())
+	}
+	if flags.waitToken != "" {
+		query.Set("wait_token", flags.waitToken)
+	}
+	url, err := fifoURL(flags, flags.uuid, "wait", flags.ticketID)
 	if err != nil {
 		return err
 	}
+	url += "?" + query.Encode()
+	stateURL, err := fifoURL(flags, flags.uuid, "ticket", flags.ticketID, "state")
+	if err != nil {
+		return err
+	}
+	stateURL += "?" + query.Encode()
 
-	return client.Get(ctx, url)
+	waitCtx := ihttp.WithTicketSecret(ctx, flags.secret)
+	if flags.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(waitCtx, flags.timeout)
+		defer cancel()
+	}
+	if flags.cancelOnDisconnect {
+		// The ticket is lost with the connection.
+		waitCtx = ihttp.WithRetryPolicy(waitCtx, ihttp.RetryPolicy{})
+	}
+	log := logFrom(ctx).With("ticket", flags.ticketID)
+	log.Debug("waiting for turn")
+	start := time.Now()
+	stopReporting := flags.ci.waiting(ctx, client, flags)
+	if !flags.poll {
+		err = client.GetJSON(waitCtx, url, &api.FifoWaitResponse{})
+	}
+	if flags.poll || (errors.Is(err, api.ErrTimeout) && waitCtx.Err() == nil) {
+		// Proxies that cut the blocking wait let polls through.
+		log.Debug("polling for turn")
+		err = client.Poll(waitCtx, stateURL, &api.FifoWaitResponse{})
+	}
+	stopReporting()
+	if err == nil {
+		log.Debug("turn reached", "waited", time.Since(start))
+		return nil
+	}
+	if ctx.Err() == nil && errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+		err = &exitCodeError{code: exitTimeout, err: fmt.Errorf("wait timed out after %s", flags.timeout)}
+	} else if errors.Is(err, api.ErrNotFound) || errors.Is(err, api.ErrGone) {
+		// Expired tickets are removed, so they aren't found anymore.
+		err = &exitCodeError{code: exitGone, err: err}
+	}
+	if ctx.Err() == nil {
+		flags.ci.waitFailed(err)
+	}
+	return err
 }
 
 func newFifoDoneCommand() *cobra.Command {
@@ -148,58 +467,1054 @@ func newFifoDoneCommand() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("parsing flags: %w", err)
 			}
-			return RunFifoDone(cmd.Context(), ihttp.NewClient(), flags)
+			if fromFile, _ := cmd.Flags().GetString("from-file"); fromFile != "" {
+				if err := readTicketFile(fromFile, flags); err != nil {
+					return err
+				}
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return RunFifoDone(cmd.Context(), client, flags)
 		},
 	}
 	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
-	must(cmd.MarkFlagRequired("uuid"))
 	cmd.Flags().StringP("ticket", "t", "", "uuid of the ticket")
-	must(cmd.MarkFlagRequired("ticket"))
+	cmd.Flags().StringP("secret", "s", "", "secret of the ticket")
+	cmd.Flags().String("from-file", "", "ticket file written by acquire --ticket-file, instead of --uuid, --ticket and --secret")
+	cmd.MarkFlagsRequiredTogether("uuid", "ticket", "secret")
+	cmd.MarkFlagsOneRequired("uuid", "from-file")
+	cmd.MarkFlagsMutuallyExclusive("uuid", "from-file")
 	return cmd
 }
 
 func RunFifoDone(ctx context.Context, client *ihttp.Client, flags *FifoFlags) error {
-	url, err := urlJoin(flags.endpoint, "fifo", flags.uuid, "done", flags.ticketID)
+	url, err := fifoURL(flags, flags.uuid, "done", flags.ticketID)
 	if err != nil {
 		return err
 	}
 
-	return client.Get(ctx, url)
+	return client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: flags.secret}, nil)
 }
 
-type FifoFlags struct {
-	endpoint string
-	output   string
-	uuid     string
-	ticketID string
+func newFifoTransferCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "transfer",
+		Short: "take over a ticket of another client",
+		Long: "take over a ticket of another client\n\n" +
+			"The ticket keeps its place in the queue or its turn and gets a new secret, " +
+			"so the previous owner can no longer use it. The ticket is recorded with the identity of this client. " +
+			"The raw output is the ticket uuid. The new secret is part of the json output " +
+			"and can be written to a ticket file with --ticket-file.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunFifoTransfer(cmd.Context(), client, flags)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	cmd.Flags().StringP("ticket", "t", "", "uuid of the ticket")
+	cmd.Flags().StringP("secret", "s", "", "secret of the ticket")
+	cmd.Flags().String("owner-secret", "", "owner secret of the fifo, instead of the ticket secret")
+	must(cmd.MarkFlagRequired("uuid"))
+	must(cmd.MarkFlagRequired("ticket"))
+	cmd.MarkFlagsOneRequired("secret", "owner-secret")
+	cmd.MarkFlagsMutuallyExclusive("secret", "owner-secret")
+	cmd.Flags().String("ticket-file", "", "file to write the ticket to, readable by done --from-file")
+	return cmd
 }
 
-func parseFifoFlags(cmd *cobra.Command) (*FifoFlags, error) {
-	endpoint, err := cmd.Flags().GetString("endpoint")
+func RunFifoTransfer(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (string, error) {
+	url, err := fifoURL(flags, flags.uuid, "transfer", flags.ticketID)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	secret := flags.secret
+	if secret == "" {
+		secret = flags.ownerSecret
+	}
+	resp := &api.FifoTicketResponse{}
+	if err := client.Do(ctx, http.MethodPost, url, api.FifoTransferRequest{Secret: secret}, resp); err != nil {
+		return "", err
+	}
+	if flags.ticketFile != "" {
+		if err := writeTicketFile(flags.ticketFile, flags, resp); err != nil {
+			return "", err
+		}
+	}
+	return formatTicket(flags, resp)
+}
+
+func newFifoDeleteCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete",
+		Short: "delete the fifo queue",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return RunFifoDelete(cmd.Context(), client, flags)
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkFlagRequired("uuid"))
+	cmd.Flags().String("owner-secret", "", "owner secret of the fifo queue")
+	must(cmd.MarkFlagRequired("owner-secret"))
+	return cmd
+}
+
+func RunFifoDelete(ctx context.Context, client *ihttp.Client, flags *FifoFlags) error {
+	url, err := fifoURL(flags, flags.uuid)
+	if err != nil {
+		return err
+	}
+
+	return client.Do(ctx, http.MethodDelete, url, api.FifoSecretRequest{Secret: flags.ownerSecret}, nil)
+}
+
+func newFifoUndeleteCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "undelete",
+		Short: "revive a deleted fifo queue",
+		Long: "revive a deleted fifo queue\n\n" +
+			"Fifos deleted manually or because they were unused can be undeleted within the deleted retention of the server. " +
+			"The fifo keeps its uuid, settings and history, its queue starts empty.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return RunFifoUndelete(cmd.Context(), client, flags)
+		},
 	}
-	output, err := cmd.Flags().GetString("output")
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkFlagRequired("uuid"))
+	cmd.Flags().String("owner-secret", "", "owner secret of the fifo queue")
+	must(cmd.MarkFlagRequired("owner-secret"))
+	return cmd
+}
+
+func RunFifoUndelete(ctx context.Context, client *ihttp.Client, flags *FifoFlags) error {
+	url, err := fifoURL(flags, flags.uuid, "undelete")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Optional flags
-	uuid, _ := cmd.Flags().GetString("uuid")
-	ticketID, _ := cmd.Flags().GetString("ticket")
+	return client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: flags.ownerSecret}, nil)
+}
 
-	return &FifoFlags{
-		endpoint: endpoint,
-		output:   output,
-		uuid:     uuid,
-		ticketID: ticketID,
-	}, nil
+func newFifoCloneCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "clone",
+		Short: "create a fifo queue with the settings of another one",
+		Long: "create a fifo queue with the settings of another one\n\n" +
+			"The clone gets the timeouts and webhook of the fifo, but starts with an empty queue and history. " +
+			"The raw output is the uuid of the clone followed by its owner secret, separated by a space.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunFifoClone(cmd.Context(), client, flags)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue to clone")
+	must(cmd.MarkFlagRequired("uuid"))
+	cmd.Flags().String("owner-secret", "", "owner secret of the fifo queue to clone")
+	must(cmd.MarkFlagRequired("owner-secret"))
+	cmd.Flags().String("to-namespace", "", "namespace of the clone (default the namespace of the fifo)")
+	cmd.Flags().String("name", "", "name of the clone, must not be taken in its namespace")
+	return cmd
+}
+
+func RunFifoClone(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (string, error) {
+	url, err := fifoURL(flags, flags.uuid, "clone")
+	if err != nil {
+		return "", err
+	}
+	req := api.FifoCloneRequest{Secret: flags.ownerSecret, Namespace: flags.toNamespace, Name: flags.name}
+	resp := &api.FifoNewResponse{}
+	if err := client.PostJSON(ctx, url, req, resp); err != nil {
+		return "", err
+	}
+	return formatNewFifo(flags, resp)
+}
+
+func newFifoAdminCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "manage the tickets of a fifo queue as its owner",
+	}
+	cmd.PersistentFlags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkPersistentFlagRequired("uuid"))
+	cmd.PersistentFlags().String("owner-secret", "", "owner secret of the fifo queue")
+	must(cmd.MarkPersistentFlagRequired("owner-secret"))
+
+	cancel := newFifoAdminSubcommand("cancel", "remove a ticket from the queue or end its turn", RunFifoAdminCancel)
+	cancel.Flags().StringP("ticket", "t", "", "uuid of the ticket")
+	must(cancel.MarkFlagRequired("ticket"))
+	bump := newFifoAdminSubcommand("bump", "move a queued ticket to the front of the queue", RunFifoAdminBump)
+	bump.Flags().StringP("ticket", "t", "", "uuid of the ticket")
+	must(bump.MarkFlagRequired("ticket"))
+	complete := newFifoAdminSubcommand("complete", "end the turn of the active ticket as if it was done", RunFifoAdminComplete)
+
+	cmd.AddCommand(cancel, bump, complete)
+	return cmd
+}
+
+func newFifoAdminSubcommand(use, short string, run func(context.Context, *ihttp.Client, *FifoFlags) error) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return run(cmd.Context(), client, flags)
+		},
+	}
+}
+
+func RunFifoAdminCancel(ctx context.Context, client *ihttp.Client, flags *FifoFlags) error {
+	url, err := fifoURL(flags, flags.uuid, "admin", "cancel", flags.ticketID)
+	if err != nil {
+		return err
+	}
+
+	return client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: flags.ownerSecret}, nil)
+}
+
+func RunFifoAdminBump(ctx context.Context, client *ihttp.Client, flags *FifoFlags) error {
+	url, err := fifoURL(flags, flags.uuid, "admin", "bump", flags.ticketID)
+	if err != nil {
+		return err
+	}
+
+	return client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: flags.ownerSecret}, nil)
 }
 
-func urlJoin(base string, pathSegments ...string) (string, error) {
-	u, err := url.Parse(base)
+func RunFifoAdminComplete(ctx context.Context, client *ihttp.Client, flags *FifoFlags) error {
+	url, err := fifoURL(flags, flags.uuid, "admin", "complete")
 	if err != nil {
-		return "", fmt.Errorf("parsing endpoint: %w", err)
+		return err
+	}
+
+	return client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: flags.ownerSecret}, nil)
+}
+
+func newFifoStatusCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "show the active ticket and the queue of the fifo",
+		Long: "show the active ticket and the queue of the fifo\n\n" +
+			"The raw output lists one ticket per line with its state and the identity of its owner.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunFifoStatus(cmd.Context(), client, flags)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkFlagRequired("uuid"))
+	return cmd
+}
+
+func RunFifoStatus(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (string, error) {
+	resp, err := getFifoStatus(ctx, client, flags)
+	if err != nil {
+		return "", err
+	}
+
+	if flags.output == "json" {
+		b, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return formatFifoStatus(resp), nil
+}
+
+func getFifoStatus(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (*api.FifoStatusResponse, error) {
+	url, err := fifoURL(flags, flags.uuid, "status")
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.FifoStatusResponse{}
+	if err := client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// formatFifoStatus lists the active ticket and the queue, one ticket per line.
+func formatFifoStatus(resp *api.FifoStatusResponse) string {
+	var lines []string
+	if resp.Active != nil {
+		lines = append(lines, formatTicketInfo(*resp.Active))
+	}
+	for _, t := range resp.Queue {
+		lines = append(lines, formatTicketInfo(t))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func newFifoWatchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "watch the active ticket and queue of the fifo",
+		Long: "watch the active ticket and queue of the fifo until it is deleted\n\n" +
+			"The status is rendered again on every event of the fifo. In a terminal, the screen is redrawn; " +
+			"otherwise each status is written after the previous one, with the json output one per line.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			return RunFifoWatch(cmd.Context(), client, flags, out, isTerminal(out))
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkFlagRequired("uuid"))
+	return cmd
+}
+
+// RunFifoWatch writes the status of the fifo to out whenever it changes,
+// until the fifo is deleted or the context is canceled. If redraw is set,
+// the screen is cleared before each status.
+func RunFifoWatch(ctx context.Context, client *ihttp.Client, flags *FifoFlags, out io.Writer, redraw bool) error {
+	render := func() error {
+		resp, err := getFifoStatus(ctx, client, flags)
+		if err != nil {
+			return err
+		}
+		if flags.output == "json" {
+			return json.NewEncoder(out).Encode(resp)
+		}
+		if redraw {
+			fmt.Fprint(out, "\x1b[H\x1b[2J")
+		}
+		fmt.Fprintf(out, "fifo %s, %d queued, updated %s\n", resp.UUID, len(resp.Queue), time.Now().Format(time.TimeOnly))
+		if status := formatFifoStatus(resp); status != "" {
+			fmt.Fprintln(out, status)
+		}
+		if !redraw {
+			fmt.Fprintln(out)
+		}
+		return nil
+	}
+	return followEvents(ctx, client, flags, render, func(event, _ string) error {
+		if event == api.EventFifoDeleted {
+			fmt.Fprintln(out, "fifo deleted")
+			return nil
+		}
+		return render()
+	})
+}
+
+// isTerminal reports whether out is a terminal.
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newFifoHistoryCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "show the recently ended tickets of the fifo",
+		Long: "show the recently ended tickets of the fifo\n\n" +
+			"The raw output lists one ticket per line with its outcome, the time it ended and the identity of its owner.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunFifoHistory(cmd.Context(), client, flags)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkFlagRequired("uuid"))
+	return cmd
+}
+
+func RunFifoHistory(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (string, error) {
+	url, err := fifoURL(flags, flags.uuid, "history")
+	if err != nil {
+		return "", err
+	}
+
+	resp := &api.FifoHistoryResponse{}
+	if err := client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
+		return "", err
+	}
+
+	if flags.output == "json" {
+		b, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	var lines []string
+	for _, t := range resp.Tickets {
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", t.TicketID, t.Outcome, t.EndedAt.Format(time.RFC3339), orDash(t.Identity)))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func newFifoListCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "list the fifo queues of the namespace",
+		Long: "list the fifo queues of the namespace\n\n" +
+			"The raw output lists one fifo per line with the number of tickets and the identity of the active owner.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunFifoList(cmd.Context(), client, flags)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func RunFifoList(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (string, error) {
+	url, err := fifoURL(flags, "list")
+	if err != nil {
+		return "", err
+	}
+
+	resp := &api.FifoListResponse{}
+	if err := client.RequestJSON(ctx, url, http.NoBody, resp); err != nil {
+		return "", err
+	}
+
+	if flags.output == "json" {
+		b, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	var lines []string
+	for _, f := range resp.Fifos {
+		tickets := len(f.Queue)
+		owner := "-"
+		if f.Active != nil {
+			tickets++
+			owner = orDash(f.Active.Identity)
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %s", f.UUID, tickets, owner))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func newFifoEventsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "follow the events of the fifo",
+		Long: "follow the events of the fifo until it is deleted\n\n" +
+			"With --since, the events the server logged after the event ID are listed instead, " +
+			"so they can be analyzed offline.\n\n" +
+			"The raw output lists one event per line with the ticket and the identity of its owner.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return RunFifoEvents(cmd.Context(), client, flags, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkFlagRequired("uuid"))
+	cmd.Flags().String("since", "", "list the logged events after this event ID instead of following new ones, 0 for all")
+	return cmd
+}
+
+// RunFifoEvents writes the events of the fifo to out until the fifo is
+// deleted or the context is canceled. If flags.since is set, it writes the
+// logged events after it instead.
+func RunFifoEvents(ctx context.Context, client *ihttp.Client, flags *FifoFlags, out io.Writer) error {
+	if flags.since != "" {
+		return listEvents(ctx, client, flags, out)
+	}
+	return followEvents(ctx, client, flags, nil, func(event, data string) error {
+		switch {
+		case flags.output == "json":
+			fmt.Fprintln(out, data)
+		case event == api.EventFifoDeleted:
+			fmt.Fprintln(out, event)
+		default:
+			var ev api.FifoEvent
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				return fmt.Errorf("decoding event: %w", err)
+			}
+			fmt.Fprintf(out, "%s %s %s\n", ev.Type, ev.TicketID, orDash(ev.Identity))
+		}
+		return nil
+	})
+}
+
+// listEvents writes the logged events of the fifo after flags.since to out,
+// fetching them page by page.
+func listEvents(ctx context.Context, client *ihttp.Client, flags *FifoFlags, out io.Writer) error {
+	eventsURL, err := fifoURL(flags, flags.uuid, "events")
+	if err != nil {
+		return err
+	}
+	cursor := flags.since
+	for {
+		resp := &api.FifoEventsResponse{}
+		if err := client.GetJSON(ctx, eventsURL+"?"+url.Values{"since": {cursor}}.Encode(), resp); err != nil {
+			return err
+		}
+		if resp.Truncated {
+			logFrom(ctx).Warn("events after the requested one were already dropped by the server")
+		}
+		for _, ev := range resp.Events {
+			if flags.output == "json" {
+				b, err := json.Marshal(ev)
+				if err != nil {
+					return fmt.Errorf("encoding event: %w", err)
+				}
+				fmt.Fprintln(out, string(b))
+				continue
+			}
+			fmt.Fprintf(out, "%s %s %s\n", ev.Type, ev.TicketID, orDash(ev.Identity))
+		}
+		if !resp.More {
+			return nil
+		}
+		cursor = strconv.FormatUint(resp.Next, 10)
+	}
+}
+
+// followEvents calls handle with the name and data of each event of the fifo
+// until the fifo is deleted or the context is canceled. If subscribed isn't
+// nil, it is called once the subscription is established.
+func followEvents(ctx context.Context, client *ihttp.Client, flags *FifoFlags, subscribed func() error, handle func(event, data string) error) error {
+	url, err := fifoURL(flags, flags.uuid, "events")
+	if err != nil {
+		return err
+	}
+
+	body, err := client.Stream(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if subscribed != nil {
+		if err := subscribed(); err != nil {
+			return err
+		}
+	}
+
+	var event string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if err := handle(event, data); err != nil {
+			return err
+		}
+		if event == api.EventFifoDeleted {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading events: %w", err)
+	}
+	return nil
+}
+
+func newFifoRunCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run -u UUID -- COMMAND [ARG...]",
+		Short: "run a command while holding the fifo",
+		Long: "run a command while holding the fifo\n\n" +
+			"Takes a ticket, waits for its turn, runs the command while sending heartbeats and marks the ticket done " +
+			"when the command succeeds. If the command fails or is interrupted, the ticket is canceled instead. " +
+			"The exit code of the command is propagated, failures of sync itself exit with 125.\n\n" +
+			"With --offline-fallback, the command runs while holding a file lock on this machine instead " +
+			"if the server is unreachable. The lock only excludes other clients on this machine that fall back as well.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return runFailure(RunFifoRun(cmd.Context(), client, flags, args, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.ErrOrStderr()))
+		},
+	}
+	cmd.Flags().StringP("uuid", "u", "", "uuid of the fifo queue")
+	must(cmd.MarkFlagRequired("uuid"))
+	cmd.Flags().Duration("heartbeat", 30*time.Second, "interval of heartbeats extending the done timeout while the command runs")
+	cmd.Flags().Bool("offline-fallback", false, "hold a file lock on this machine instead if the server is unreachable")
+	return cmd
+}
+
+// RunFifoRun runs the command once it's the turn of a new ticket and marks
+// the ticket done when the command exits. If the client is interrupted while
+// waiting, the ticket is canceled. The error of the command is returned.
+func RunFifoRun(ctx context.Context, client *ihttp.Client, flags *FifoFlags, command []string, stdin io.Reader, stdout, stderr io.Writer) (err error) {
+	if flags.heartbeat <= 0 {
+		return errors.New("heartbeat interval must be positive")
+	}
+	ticket, err := takeTicket(ctx, client, flags)
+	if err != nil && flags.offlineFallback && ctx.Err() == nil && unreachable(err) {
+		return runWithFileLock(ctx, flags, command, stdin, stdout, stderr, err)
+	} else if err != nil {
+		return fmt.Errorf("taking ticket: %w", err)
+	}
+	ticketFlags := *flags
+	ticketFlags.ticketID = ticket.TicketID.String()
+	ticketFlags.secret = ticket.Secret
+	ticketFlags.cancelOnDisconnect = true
+	log := logFrom(ctx).With("ticket", ticketFlags.ticketID)
+	// Release the fifo even if the client is interrupted. The ticket is
+	// canceled instead of done on every failure, also while waiting, so the
+	// failure shows in the history and a pipeline doesn't pass the ticket on
+	// to its next stage.
+	defer func() {
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		release, action := RunFifoDone, "marking ticket done"
+		if err != nil {
+			release, action = cancelTicket, "canceling ticket"
+		}
+		if err := release(releaseCtx, client, &ticketFlags); err != nil {
+			log.Error(action, "err", err)
+		}
+	}()
+	if err := RunFifoWait(ctx, client, &ticketFlags); err != nil {
+		return fmt.Errorf("waiting for ticket: %w", err)
+	}
+
+	heartbeatURL, err := fifoURL(flags, flags.uuid, "heartbeat", ticketFlags.ticketID)
+	if err != nil {
+		return err
+	}
+	heartbeatCtx, stopHeartbeats := context.WithCancel(ctx)
+	defer stopHeartbeats()
+	go func() {
+		ticker := time.NewTicker(flags.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := client.Do(heartbeatCtx, http.MethodPost, heartbeatURL, api.FifoSecretRequest{Secret: ticket.Secret}, nil); err != nil && heartbeatCtx.Err() == nil {
+					log.Warn("sending heartbeat", "err", err)
+				}
+			case <-heartbeatCtx.Done():
+				return
+			}
+		}
+	}()
+
+	return runCommand(ctx, log, command, stdin, stdout, stderr)
+}
+
+// cancelTicket gives up the ticket of the flags.
+func cancelTicket(ctx context.Context, client *ihttp.Client, flags *FifoFlags) error {
+	url, err := fifoURL(flags, flags.uuid, "cancel", flags.ticketID)
+	if err != nil {
+		return err
+	}
+	return client.Do(ctx, http.MethodPost, url, api.FifoSecretRequest{Secret: flags.secret}, nil)
+}
+
+// runWithFileLock runs the command while holding the file lock of the fifo,
+// after the server was unreachable with serverErr.
+func runWithFileLock(ctx context.Context, flags *FifoFlags, command []string, stdin io.Reader, stdout, stderr io.Writer, serverErr error) error {
+	path, err := fallbackLockPath(flags)
+	if err != nil {
+		return err
+	}
+	log := logFrom(ctx).With("lockFile", path)
+	log.Warn("server unreachable, falling back to a file lock", "err", serverErr)
+	unlock, err := lockFile(ctx, path)
+	if err != nil {
+		return fmt.Errorf("acquiring file lock: %w", err)
+	}
+	defer unlock()
+	return runCommand(ctx, log, command, stdin, stdout, stderr)
+}
+
+// fallbackLockPath returns the path of the file lock that stands in for the
+// fifo if the server is unreachable.
+func fallbackLockPath(flags *FifoFlags) (string, error) {
+	// Clients of a named fifo share the file lock of the name, whichever
+	// fifo they got.
+	name := flags.uuid
+	if flags.name != "" {
+		name = "name-" + flags.name
+	}
+	if flags.namespace != "" {
+		name = flags.namespace + "-" + name
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid fifo %q", name)
+	}
+	return filepath.Join(os.TempDir(), "sync-"+name+".lock"), nil
+}
+
+// unreachable reports whether a request failed because the server couldn't
+// be reached, rather than with an error response.
+func unreachable(err error) bool {
+	var urlErr *url.Error
+	return ihttp.StatusCode(err) == 0 && errors.As(err, &urlErr)
+}
+
+// runCommand runs the command and returns its error.
+func runCommand(ctx context.Context, log *slog.Logger, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	// Give the command the chance to shut down on interruption.
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 10 * time.Second
+	log.Debug("running command", "command", command[0])
+	err := cmd.Run()
+	log.Debug("command exited", "err", err)
+	return err
+}
+
+func formatTicketInfo(t api.FifoTicketInfo) string {
+	return fmt.Sprintf("%s %s %s", t.TicketID, t.State, orDash(t.Identity))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+type FifoFlags struct {
+	endpoint    string
+	namespace   string
+	output      string
+	identity    string
+	traceparent string
+	token       string
+	cacert      string
+	cert        string
+	key         string
+	uuid        string
+	ticketID    string
+	secret      string
+	ownerSecret string
+	// toNamespace is the namespace of a clone.
+	toNamespace string
+	// local connects to the local server, which is started if needed.
+	local bool
+	// offlineFallback makes run hold a file lock if the server is
+	// unreachable.
+	offlineFallback bool
+	// ci emits workflow commands of the CI system, if set.
+	ci *githubActions
+
+	waitTimeout          time.Duration
+	doneTimeout          time.Duration
+	unusedDestroyTimeout time.Duration
+	webhook              string
+	webhookSecret        string
+	webhookEvents        []string
+	waiterPolicy         string
+	name                 string
+	waitToken            string
+	poll                 bool
+	cancelOnDisconnect   bool
+	keepalive            time.Duration
+	heartbeat            time.Duration
+	timeout              time.Duration
+	ticketFile           string
+	since                string
+	after                []api.FifoTicketRef
+	retry                ihttp.RetryPolicy
+}
+
+func parseFifoFlags(cmd *cobra.Command) (*FifoFlags, error) {
+	s, err := loadSettings(cmd)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := s.getString("endpoint", "SYNC_ENDPOINT", s.context.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := s.getString("namespace", "SYNC_NAMESPACE", s.context.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.getString("output", "SYNC_OUTPUT", s.context.Output)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := s.getString("identity", "SYNC_IDENTITY", s.context.Identity)
+	if err != nil {
+		return nil, err
+	}
+	traceparent, err := s.getString("traceparent", "TRACEPARENT", "")
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.getString("token", "SYNC_TOKEN", s.context.Token)
+	if err != nil {
+		return nil, err
+	}
+	cacert, err := s.getString("cacert", "SYNC_CACERT", s.context.CACert)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := s.getString("cert", "SYNC_CERT", s.context.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.getString("key", "SYNC_KEY", s.context.Key)
+	if err != nil {
+		return nil, err
+	}
+	retries, err := cmd.Flags().GetInt("retries")
+	if err != nil {
+		return nil, err
+	}
+	if retries < 0 {
+		return nil, errors.New("retries must not be negative")
+	}
+	retryBackoff, err := cmd.Flags().GetDuration("retry-backoff")
+	if err != nil {
+		return nil, err
+	}
+	maxElapsed, err := cmd.Flags().GetDuration("max-elapsed")
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional flags
+	uuid, _ := cmd.Flags().GetString("uuid")
+	ticketID, _ := cmd.Flags().GetString("ticket")
+	secret, _ := cmd.Flags().GetString("secret")
+	ownerSecret, _ := cmd.Flags().GetString("owner-secret")
+	toNamespace, _ := cmd.Flags().GetString("to-namespace")
+	waitTimeout, _ := cmd.Flags().GetDuration("wait-timeout")
+	doneTimeout, _ := cmd.Flags().GetDuration("done-timeout")
+	unusedDestroyTimeout, _ := cmd.Flags().GetDuration("unused-destroy-timeout")
+	webhook, _ := cmd.Flags().GetString("webhook")
+	webhookSecret, _ := cmd.Flags().GetString("webhook-secret")
+	webhookEvents, _ := cmd.Flags().GetStringSlice("webhook-events")
+	waiterPolicy, _ := cmd.Flags().GetString("waiter-policy")
+	name, _ := cmd.Flags().GetString("name")
+	waitToken, _ := cmd.Flags().GetString("wait-token")
+	poll, _ := cmd.Flags().GetBool("poll")
+	cancelOnDisconnect, _ := cmd.Flags().GetBool("cancel-on-disconnect")
+	keepalive, _ := cmd.Flags().GetDuration("keepalive")
+	heartbeat, _ := cmd.Flags().GetDuration("heartbeat")
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	ticketFile, _ := cmd.Flags().GetString("ticket-file")
+	since, _ := cmd.Flags().GetString("since")
+	rawAfter, _ := cmd.Flags().GetStringSlice("after")
+	after, err := parseTicketRefs(rawAfter)
+	if err != nil {
+		return nil, err
+	}
+	local, _ := cmd.Flags().GetBool("local")
+	if local {
+		endpoint = localEndpoint
+	}
+	offlineFallback, _ := cmd.Flags().GetBool("offline-fallback")
+	ciName, err := s.getString("ci", "SYNC_CI", "")
+	if err != nil {
+		return nil, err
+	}
+	ci, err := newCIOutput(ciName, cmd.OutOrStdout())
+	if err != nil {
+		return nil, err
+	}
+
+	return &FifoFlags{
+		endpoint:    endpoint,
+		namespace:   namespace,
+		output:      output,
+		identity:    identity,
+		traceparent: traceparent,
+		token:       token,
+		cacert:      cacert,
+		cert:        cert,
+		key:         key,
+		uuid:        uuid,
+		ticketID:    ticketID,
+		secret:      secret,
+		ownerSecret: ownerSecret,
+		toNamespace: toNamespace,
+		local:       local,
+
+		waitTimeout:          waitTimeout,
+		doneTimeout:          doneTimeout,
+		unusedDestroyTimeout: unusedDestroyTimeout,
+		webhook:              webhook,
+		webhookSecret:        webhookSecret,
+		webhookEvents:        webhookEvents,
+		waiterPolicy:         waiterPolicy,
+		name:                 name,
+		waitToken:            waitToken,
+		poll:                 poll,
+		cancelOnDisconnect:   cancelOnDisconnect,
+		keepalive:            keepalive,
+		heartbeat:            heartbeat,
+		timeout:              timeout,
+		ticketFile:           ticketFile,
+		since:                since,
+		after:                after,
+		offlineFallback:      offlineFallback,
+		ci:                   ci,
+		retry: ihttp.RetryPolicy{
+			Retries:    retries,
+			Backoff:    retryBackoff,
+			MaxElapsed: maxElapsed,
+		},
+	}, nil
+}
+
+func newClient(ctx context.Context, flags *FifoFlags) (*ihttp.Client, error) {
+	opts := []ihttp.Option{
+		ihttp.WithToken(flags.token),
+		ihttp.WithHeader(api.VersionHeader, api.Version),
+		ihttp.WithUserAgent(userAgent),
+		ihttp.WithLogger(logFrom(ctx)),
+		ihttp.WithRetries(flags.retry),
+	}
+	if flags.identity != "" {
+		opts = append(opts, ihttp.WithHeader(api.IdentityHeader, flags.identity))
+	}
+	if flags.traceparent != "" {
+		opts = append(opts, ihttp.WithHeader(api.TraceparentHeader, flags.traceparent))
+	}
+	if flags.cacert != "" || flags.cert != "" || flags.key != "" {
+		tlsConfig, err := ihttp.LoadTLSConfig(flags.cacert, flags.cert, flags.key)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, ihttp.WithTLSConfig(tlsConfig))
+	}
+	if flags.local {
+		socket, err := localSocket()
+		if err != nil {
+			return nil, err
+		}
+		if err := ensureLocalServer(ctx, socket); err != nil {
+			return nil, err
+		}
+		opts = append(opts, ihttp.WithUnixSocket(socket))
+	}
+	return ihttp.NewClient(opts...), nil
+}
+
+// fifoURL returns the URL of the fifo API, taking the namespace into account.
+func fifoURL(flags *FifoFlags, pathSegments ...string) (string, error) {
+	if flags.namespace != "" {
+		pathSegments = append([]string{"v1", "ns", flags.namespace, "fifo"}, pathSegments...)
+	} else {
+		pathSegments = append([]string{"v1", "fifo"}, pathSegments...)
+	}
+	return ihttp.JoinURL(flags.endpoint, pathSegments...)
+}
+
+// durationOrEmpty formats positive durations, others are left to the server.
+func durationOrEmpty(d time.Duration) string {
+	if d <= 0 {
+		return ""
 	}
-	return u.JoinPath(pathSegments...).String(), nil
+	return d.String()
 }
@@ -4,8 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -18,7 +24,7 @@ import (
 func TestFifoBasics(t *testing.T) {
 	ctx := context.Background()
 	endpoint := endpoint()
-	var uuid, ticket string
+	var uuid, ownerSecret, ticket, secret string
 	t.Run("new", func(t *testing.T) {
 		require := require.New(t)
 		out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
@@ -29,6 +35,16 @@ func TestFifoBasics(t *testing.T) {
 		resp, err := decode[api.FifoNewResponse](out)
 		require.NoError(err)
 		uuid = resp.UUID.String()
+		ownerSecret = resp.OwnerSecret
+	})
+	t.Run("new with timeout above maximum", func(t *testing.T) {
+		require := require.New(t)
+		_, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint:    endpoint,
+			output:      "json",
+			doneTimeout: 365 * 24 * time.Hour,
+		})
+		require.Error(err)
 	})
 	t.Run("ticket", func(t *testing.T) {
 		require := require.New(t)
@@ -41,6 +57,17 @@ func TestFifoBasics(t *testing.T) {
 		resp, err := decode[api.FifoTicketResponse](out)
 		require.NoError(err)
 		ticket = resp.TicketID.String()
+		secret = resp.Secret
+	})
+	t.Run("wait with wrong secret", func(t *testing.T) {
+		require := require.New(t)
+		require.Error(RunFifoWait(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     uuid,
+			ticketID: ticket,
+			secret:   "wrong",
+		}))
 	})
 	t.Run("wait", func(t *testing.T) {
 		require := require.New(t)
@@ -49,6 +76,28 @@ func TestFifoBasics(t *testing.T) {
 			output:   "json",
 			uuid:     uuid,
 			ticketID: ticket,
+			secret:   secret,
+		}))
+	})
+	t.Run("wait again", func(t *testing.T) {
+		require := require.New(t)
+		require.NoError(RunFifoWait(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     uuid,
+			ticketID: ticket,
+			secret:   secret,
+		}))
+	})
+	t.Run("wait by polling", func(t *testing.T) {
+		require := require.New(t)
+		require.NoError(RunFifoWait(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     uuid,
+			ticketID: ticket,
+			secret:   secret,
+			poll:     true,
 		}))
 	})
 	t.Run("done", func(t *testing.T) {
@@ -58,8 +107,786 @@ func TestFifoBasics(t *testing.T) {
 			output:   "json",
 			uuid:     uuid,
 			ticketID: ticket,
+			secret:   secret,
 		}))
 	})
+	t.Run("delete with wrong secret", func(t *testing.T) {
+		require := require.New(t)
+		require.Error(RunFifoDelete(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint:    endpoint,
+			output:      "json",
+			uuid:        uuid,
+			ownerSecret: "wrong",
+		}))
+	})
+	t.Run("delete", func(t *testing.T) {
+		require := require.New(t)
+		require.NoError(RunFifoDelete(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint:    endpoint,
+			output:      "json",
+			uuid:        uuid,
+			ownerSecret: ownerSecret,
+		}))
+		_, err := RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     uuid,
+		})
+		require.Error(err)
+	})
+	t.Run("undelete", func(t *testing.T) {
+		require := require.New(t)
+		require.NoError(RunFifoUndelete(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint:    endpoint,
+			output:      "json",
+			uuid:        uuid,
+			ownerSecret: ownerSecret,
+		}))
+		_, err := RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     uuid,
+		})
+		require.NoError(err)
+	})
+	t.Run("clone", func(t *testing.T) {
+		require := require.New(t)
+		out, err := RunFifoClone(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint:    endpoint,
+			output:      "json",
+			uuid:        uuid,
+			ownerSecret: ownerSecret,
+		})
+		require.NoError(err)
+		clone := &api.FifoNewResponse{}
+		require.NoError(json.Unmarshal([]byte(out), clone))
+		require.NotEqual(uuid, clone.UUID.String())
+		_, err = RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     clone.UUID.String(),
+		})
+		require.NoError(err)
+	})
+}
+
+func TestFifoLegacyPaths(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	// The unversioned paths are deprecated aliases of /v1, taking all
+	// parameters from the query.
+	client := ihttp.NewClient()
+	resp := &api.FifoNewResponse{}
+	require.NoError(client.GetJSON(ctx, endpoint()+"/fifo/new", resp))
+	fifoURL := endpoint() + "/fifo/" + resp.UUID.String()
+	ticket := &api.FifoTicketResponse{}
+	require.NoError(client.GetJSON(ctx, fifoURL+"/ticket", ticket))
+	ticketQuery := ticket.TicketID.String() + "?secret=" + ticket.Secret
+	require.NoError(client.Get(ctx, fifoURL+"/wait/"+ticketQuery))
+	require.NoError(client.Get(ctx, fifoURL+"/done/"+ticketQuery))
+	require.NoError(client.Get(ctx, fifoURL+"/delete?secret="+resp.OwnerSecret))
+
+	// The versioned API enforces methods.
+	err := client.GetJSON(ctx, endpoint()+"/v1/fifo/new", resp)
+	require.Equal(http.StatusMethodNotAllowed, ihttp.StatusCode(err))
+
+	// Requests for other API versions are rejected.
+	client = ihttp.NewClient(ihttp.WithHeader(api.VersionHeader, "0"))
+	require.Error(client.GetJSON(ctx, endpoint()+"/v1/fifo/list", resp))
+}
+
+func TestFifoNamespaces(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:  endpoint,
+		namespace: "team-a",
+		output:    "json",
+	})
+	require.NoError(err)
+	resp, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+
+	// The fifo isn't visible in other namespaces.
+	_, err = RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:  endpoint,
+		namespace: "team-b",
+		output:    "json",
+		uuid:      resp.UUID.String(),
+	})
+	require.Error(err)
+	_, err = RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+		uuid:     resp.UUID.String(),
+	})
+	require.Error(err)
+
+	_, err = RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:  endpoint,
+		namespace: "team-a",
+		output:    "json",
+		uuid:      resp.UUID.String(),
+	})
+	require.NoError(err)
+
+	_, err = RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:  endpoint,
+		namespace: "Invalid_Namespace",
+		output:    "json",
+	})
+	require.Error(err)
+}
+
+func TestFifoStatus(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+
+	var tickets []api.FifoTicketResponse
+	for _, identity := range []string{"alice", "bob"} {
+		out, err := RunFifoTicket(ctx, ihttp.NewClient(ihttp.WithHeader(api.IdentityHeader, identity)), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		})
+		require.NoError(err)
+		resp, err := decode[api.FifoTicketResponse](out)
+		require.NoError(err)
+		tickets = append(tickets, resp)
+	}
+
+	require.NoError(RunFifoWait(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+		uuid:     respNew.UUID.String(),
+		ticketID: tickets[0].TicketID.String(),
+		secret:   tickets[0].Secret,
+	}))
+
+	// The ticket becomes accepted asynchronously after wait returned.
+	var status api.FifoStatusResponse
+	require.Eventually(func() bool {
+		out, err := RunFifoStatus(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		})
+		if err != nil {
+			return false
+		}
+		status, err = decode[api.FifoStatusResponse](out)
+		return err == nil && status.Active != nil && status.Active.State == api.TicketAccepted
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(tickets[0].TicketID, status.Active.TicketID)
+	require.Equal("alice", status.Active.Identity)
+	require.Len(status.Queue, 1)
+	require.Equal(tickets[1].TicketID, status.Queue[0].TicketID)
+	require.Equal("bob", status.Queue[0].Identity)
+	require.Equal(api.TicketQueued, status.Queue[0].State)
+
+	out, err = RunFifoList(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	list, err := decode[api.FifoListResponse](out)
+	require.NoError(err)
+	require.True(slices.ContainsFunc(list.Fifos, func(f api.FifoStatusResponse) bool {
+		return f.UUID == respNew.UUID
+	}))
+}
+
+func TestFifoWaitCancelOnDisconnect(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+
+	var tickets []api.FifoTicketResponse
+	for range 2 {
+		out, err := RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		})
+		require.NoError(err)
+		resp, err := decode[api.FifoTicketResponse](out)
+		require.NoError(err)
+		tickets = append(tickets, resp)
+	}
+
+	require.NoError(RunFifoWait(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+		uuid:     respNew.UUID.String(),
+		ticketID: tickets[0].TicketID.String(),
+		secret:   tickets[0].Secret,
+	}))
+
+	// The second ticket is queued behind the first, give up waiting.
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	require.Error(RunFifoWait(waitCtx, ihttp.NewClient(), &FifoFlags{
+		endpoint:           endpoint,
+		output:             "json",
+		uuid:               respNew.UUID.String(),
+		ticketID:           tickets[1].TicketID.String(),
+		secret:             tickets[1].Secret,
+		cancelOnDisconnect: true,
+	}))
+
+	require.Eventually(func() bool {
+		out, err := RunFifoStatus(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		})
+		if err != nil {
+			return false
+		}
+		status, err := decode[api.FifoStatusResponse](out)
+		return err == nil && len(status.Queue) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFifoRun(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+	flags := &FifoFlags{
+		endpoint:  endpoint,
+		output:    "json",
+		uuid:      respNew.UUID.String(),
+		heartbeat: 10 * time.Millisecond,
+	}
+
+	var stdout strings.Builder
+	require.NoError(RunFifoRun(ctx, ihttp.NewClient(), flags, []string{"sh", "-c", "sleep 0.1; echo running"}, http.NoBody, &stdout, os.Stderr))
+	require.Equal("running\n", stdout.String())
+
+	// The exit code of the command is propagated.
+	err = RunFifoRun(ctx, ihttp.NewClient(), flags, []string{"sh", "-c", "exit 3"}, http.NoBody, io.Discard, os.Stderr)
+	var exitErr *exec.ExitError
+	require.ErrorAs(err, &exitErr)
+	require.Equal(3, exitErr.ExitCode())
+
+	// The ticket of the failed command is canceled instead of done.
+	require.Eventually(func() bool {
+		out, err := RunFifoHistory(ctx, ihttp.NewClient(), flags)
+		if err != nil {
+			return false
+		}
+		history, err := decode[api.FifoHistoryResponse](out)
+		if err != nil || len(history.Tickets) != 2 {
+			return false
+		}
+		outcomes := []string{history.Tickets[0].Outcome, history.Tickets[1].Outcome}
+		return slices.Contains(outcomes, api.OutcomeDone) && slices.Contains(outcomes, api.OutcomeCanceled)
+	}, time.Second, 10*time.Millisecond)
+
+	// The fifo is released after each run.
+	require.Eventually(func() bool {
+		out, err := RunFifoStatus(ctx, ihttp.NewClient(), flags)
+		if err != nil {
+			return false
+		}
+		status, err := decode[api.FifoStatusResponse](out)
+		return err == nil && status.Active == nil && len(status.Queue) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// The ticket is canceled if waiting for it fails. Polls don't cancel it
+	// on disconnect.
+	out, err = RunFifoTicket(ctx, ihttp.NewClient(), flags)
+	require.NoError(err)
+	held, err := decode[api.FifoTicketResponse](out)
+	require.NoError(err)
+	heldFlags := *flags
+	heldFlags.ticketID = held.TicketID.String()
+	heldFlags.secret = held.Secret
+	require.NoError(RunFifoWait(ctx, ihttp.NewClient(), &heldFlags))
+	waitFlags := *flags
+	waitFlags.poll = true
+	waitFlags.timeout = 100 * time.Millisecond
+	require.Error(RunFifoRun(ctx, ihttp.NewClient(), &waitFlags, []string{"true"}, http.NoBody, io.Discard, os.Stderr))
+	require.Eventually(func() bool {
+		out, err := RunFifoHistory(ctx, ihttp.NewClient(), flags)
+		if err != nil {
+			return false
+		}
+		history, err := decode[api.FifoHistoryResponse](out)
+		if err != nil {
+			return false
+		}
+		canceled := 0
+		for _, ticket := range history.Tickets {
+			if ticket.Outcome == api.OutcomeCanceled {
+				canceled++
+			}
+		}
+		return canceled == 2
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(RunFifoDone(ctx, ihttp.NewClient(), &heldFlags))
+}
+
+func TestLock(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	name := fmt.Sprintf("lock-%d", rand.Int())
+	flags := &FifoFlags{
+		endpoint:  endpoint(),
+		output:    "json",
+		name:      name,
+		heartbeat: 10 * time.Millisecond,
+	}
+
+	// The commands fail if they overlap.
+	dir := filepath.Join(t.TempDir(), "held")
+	command := []string{"sh", "-c", "mkdir " + dir + " && sleep 0.05 && rmdir " + dir}
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = RunLock(ctx, ihttp.NewClient(), flags, command, http.NoBody, io.Discard, os.Stderr)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(err)
+	}
+
+	// The name keeps referring to the same fifo.
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), flags)
+	require.NoError(err)
+	resp, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+	require.True(resp.Existing)
+	require.Empty(resp.OwnerSecret)
+}
+
+func TestFifoWaitExitCodes(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+
+	var tickets []api.FifoTicketResponse
+	for range 2 {
+		out, err := RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		})
+		require.NoError(err)
+		resp, err := decode[api.FifoTicketResponse](out)
+		require.NoError(err)
+		tickets = append(tickets, resp)
+	}
+	waitFlags := func(ticket api.FifoTicketResponse) *FifoFlags {
+		return &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+			ticketID: ticket.TicketID.String(),
+			secret:   ticket.Secret,
+			timeout:  100 * time.Millisecond,
+		}
+	}
+	var exitErr *exitCodeError
+
+	require.NoError(RunFifoWait(ctx, ihttp.NewClient(), waitFlags(tickets[0])))
+
+	// The second ticket is queued behind the first.
+	err = RunFifoWait(ctx, ihttp.NewClient(), waitFlags(tickets[1]))
+	require.ErrorAs(err, &exitErr)
+	require.Equal(exitTimeout, exitErr.ExitCode())
+
+	// The ticket is gone after the fifo was deleted.
+	require.NoError(RunFifoDelete(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:    endpoint,
+		uuid:        respNew.UUID.String(),
+		ownerSecret: respNew.OwnerSecret,
+	}))
+	err = RunFifoWait(ctx, ihttp.NewClient(), waitFlags(tickets[1]))
+	require.ErrorAs(err, &exitErr)
+	require.Equal(exitGone, exitErr.ExitCode())
+}
+
+func TestFifoAcquire(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+
+	ticketFile := filepath.Join(t.TempDir(), "ticket.json")
+	var acquireOut strings.Builder
+	require.NoError(RunFifoAcquire(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:   endpoint,
+		output:     "json",
+		uuid:       respNew.UUID.String(),
+		ticketFile: ticketFile,
+	}, &acquireOut))
+	ticket, err := decode[api.FifoTicketResponse](acquireOut.String())
+	require.NoError(err)
+
+	// Release the ticket from the file, like another script step would.
+	doneFlags := &FifoFlags{endpoint: endpoint}
+	require.NoError(readTicketFile(ticketFile, doneFlags))
+	require.Equal(ticket.TicketID.String(), doneFlags.ticketID)
+	require.NoError(RunFifoDone(ctx, ihttp.NewClient(), doneFlags))
+
+	require.Eventually(func() bool {
+		status, err := getFifoStatus(ctx, ihttp.NewClient(), doneFlags)
+		return err == nil && status.Active == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFifoWaitKeepalive(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+
+	var tickets []api.FifoTicketResponse
+	for range 3 {
+		out, err := RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		})
+		require.NoError(err)
+		resp, err := decode[api.FifoTicketResponse](out)
+		require.NoError(err)
+		tickets = append(tickets, resp)
+	}
+	waitFlags := func(ticket api.FifoTicketResponse) *FifoFlags {
+		return &FifoFlags{
+			endpoint:  endpoint,
+			output:    "json",
+			uuid:      respNew.UUID.String(),
+			ticketID:  ticket.TicketID.String(),
+			secret:    ticket.Secret,
+			keepalive: time.Second,
+		}
+	}
+
+	// Keepalives are sent while the second ticket waits for the first.
+	require.NoError(RunFifoWait(ctx, ihttp.NewClient(), waitFlags(tickets[0])))
+	waitErr := make(chan error)
+	go func() { waitErr <- RunFifoWait(ctx, ihttp.NewClient(), waitFlags(tickets[1])) }()
+	time.Sleep(1500 * time.Millisecond)
+	require.NoError(RunFifoDone(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		uuid:     respNew.UUID.String(),
+		ticketID: tickets[0].TicketID.String(),
+		secret:   tickets[0].Secret,
+	}))
+	require.NoError(<-waitErr)
+
+	// Failures after keepalives were sent are reported in the body.
+	go func() { waitErr <- RunFifoWait(ctx, ihttp.NewClient(), waitFlags(tickets[2])) }()
+	time.Sleep(1500 * time.Millisecond)
+	require.NoError(RunFifoDelete(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:    endpoint,
+		uuid:        respNew.UUID.String(),
+		ownerSecret: respNew.OwnerSecret,
+	}))
+	var apiErr *api.WaitError
+	require.ErrorAs(<-waitErr, &apiErr)
+	require.Equal(http.StatusGone, apiErr.Status)
+}
+
+func TestFifoEvents(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+
+	var events strings.Builder
+	eventsErr := make(chan error)
+	go func() {
+		eventsErr <- RunFifoEvents(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			uuid:     respNew.UUID.String(),
+		}, &events)
+	}()
+	time.Sleep(200 * time.Millisecond) // Let the stream subscribe.
+
+	out, err = RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+		uuid:     respNew.UUID.String(),
+	})
+	require.NoError(err)
+	ticket, err := decode[api.FifoTicketResponse](out)
+	require.NoError(err)
+	ticketFlags := &FifoFlags{
+		endpoint: endpoint,
+		uuid:     respNew.UUID.String(),
+		ticketID: ticket.TicketID.String(),
+		secret:   ticket.Secret,
+	}
+	require.NoError(RunFifoWait(ctx, ihttp.NewClient(), ticketFlags))
+	require.NoError(RunFifoDone(ctx, ihttp.NewClient(), ticketFlags))
+	time.Sleep(100 * time.Millisecond) // Let done be published before the fifo is deleted.
+
+	// The logged events can be listed after any of them.
+	var logged strings.Builder
+	require.NoError(RunFifoEvents(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		uuid:     respNew.UUID.String(),
+		since:    "1",
+	}, &logged))
+	require.Len(strings.Split(strings.TrimSpace(logged.String()), "\n"), 3)
+	require.True(strings.HasPrefix(logged.String(), api.EventTicketNotified+" "))
+
+	require.NoError(RunFifoDelete(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:    endpoint,
+		uuid:        respNew.UUID.String(),
+		ownerSecret: respNew.OwnerSecret,
+	}))
+
+	require.NoError(<-eventsErr)
+	var types []string
+	for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+		types = append(types, strings.Fields(line)[0])
+	}
+	require.Equal([]string{
+		api.EventTicketCreated,
+		api.EventTicketNotified,
+		api.EventTicketAccepted,
+		api.EventTicketDone,
+		api.EventFifoDeleted,
+	}, types)
+}
+
+func TestFifoWatch(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+
+	var watch strings.Builder
+	watchErr := make(chan error)
+	go func() {
+		watchErr <- RunFifoWatch(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		}, &watch, false)
+	}()
+	time.Sleep(200 * time.Millisecond) // Let the stream subscribe.
+
+	out, err = RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+		uuid:     respNew.UUID.String(),
+	})
+	require.NoError(err)
+	ticket, err := decode[api.FifoTicketResponse](out)
+	require.NoError(err)
+	time.Sleep(100 * time.Millisecond) // Let the ticket be rendered before the fifo is deleted.
+	require.NoError(RunFifoDelete(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint:    endpoint,
+		uuid:        respNew.UUID.String(),
+		ownerSecret: respNew.OwnerSecret,
+	}))
+
+	require.NoError(<-watchErr)
+	lines := strings.Split(strings.TrimSpace(watch.String()), "\n")
+	require.Equal("fifo deleted", lines[len(lines)-1])
+	// The initial status is empty, later ones show the ticket.
+	first, err := decode[api.FifoStatusResponse](lines[0])
+	require.NoError(err)
+	require.Nil(first.Active)
+	require.Empty(first.Queue)
+	var seen bool
+	for _, line := range lines[1 : len(lines)-1] {
+		status, err := decode[api.FifoStatusResponse](line)
+		require.NoError(err)
+		if status.Active != nil && status.Active.TicketID == ticket.TicketID {
+			seen = true
+		}
+		for _, t := range status.Queue {
+			seen = seen || t.TicketID == ticket.TicketID
+		}
+	}
+	require.True(seen)
+}
+
+func TestServerInfo(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	out, err := RunServerInfo(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint(),
+		output:   "json",
+	})
+	require.NoError(err)
+	info, err := decode[serverInfo](out)
+	require.NoError(err)
+	require.Equal(api.Version, info.APIVersion)
+	require.Equal("memory", info.Backend)
+	require.NotEmpty(info.Latency)
+}
+
+func TestFifoAdmin(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	endpoint := endpoint()
+
+	out, err := RunFifoNew(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+	})
+	require.NoError(err)
+	respNew, err := decode[api.FifoNewResponse](out)
+	require.NoError(err)
+	adminFlags := func(ticket api.FifoTicketResponse, ownerSecret string) *FifoFlags {
+		return &FifoFlags{
+			endpoint:    endpoint,
+			uuid:        respNew.UUID.String(),
+			ticketID:    ticket.TicketID.String(),
+			ownerSecret: ownerSecret,
+		}
+	}
+	queue := func() []string {
+		out, err := RunFifoStatus(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		})
+		require.NoError(err)
+		status, err := decode[api.FifoStatusResponse](out)
+		require.NoError(err)
+		var ids []string
+		if status.Active != nil {
+			ids = append(ids, "active:"+status.Active.TicketID.String())
+		}
+		for _, t := range status.Queue {
+			ids = append(ids, t.TicketID.String())
+		}
+		return ids
+	}
+
+	var tickets []api.FifoTicketResponse
+	for range 3 {
+		out, err := RunFifoTicket(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+			uuid:     respNew.UUID.String(),
+		})
+		require.NoError(err)
+		resp, err := decode[api.FifoTicketResponse](out)
+		require.NoError(err)
+		tickets = append(tickets, resp)
+	}
+	require.NoError(RunFifoWait(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		uuid:     respNew.UUID.String(),
+		ticketID: tickets[0].TicketID.String(),
+		secret:   tickets[0].Secret,
+	}))
+
+	require.Error(RunFifoAdminBump(ctx, ihttp.NewClient(), adminFlags(tickets[2], "wrong")))
+	require.NoError(RunFifoAdminBump(ctx, ihttp.NewClient(), adminFlags(tickets[2], respNew.OwnerSecret)))
+	require.Equal([]string{
+		"active:" + tickets[0].TicketID.String(),
+		tickets[2].TicketID.String(),
+		tickets[1].TicketID.String(),
+	}, queue())
+
+	require.NoError(RunFifoAdminCancel(ctx, ihttp.NewClient(), adminFlags(tickets[1], respNew.OwnerSecret)))
+	require.Equal([]string{
+		"active:" + tickets[0].TicketID.String(),
+		tickets[2].TicketID.String(),
+	}, queue())
+
+	require.NoError(RunFifoAdminComplete(ctx, ihttp.NewClient(), adminFlags(api.FifoTicketResponse{}, respNew.OwnerSecret)))
+	require.Eventually(func() bool {
+		q := queue()
+		return len(q) == 1 && q[0] == "active:"+tickets[2].TicketID.String()
+	}, time.Second, 10*time.Millisecond)
+
+	// The history records why the tickets ended.
+	out, err = RunFifoHistory(ctx, ihttp.NewClient(), &FifoFlags{
+		endpoint: endpoint,
+		output:   "json",
+		uuid:     respNew.UUID.String(),
+	})
+	require.NoError(err)
+	history, err := decode[api.FifoHistoryResponse](out)
+	require.NoError(err)
+	require.Len(history.Tickets, 2)
+	require.Equal(tickets[1].TicketID, history.Tickets[0].TicketID)
+	require.Equal(api.OutcomeCanceledByOwner, history.Tickets[0].Outcome)
+	require.Nil(history.Tickets[0].NotifiedAt)
+	require.Equal(tickets[0].TicketID, history.Tickets[1].TicketID)
+	require.Equal(api.OutcomeCompletedByOwner, history.Tickets[1].Outcome)
+	require.NotNil(history.Tickets[1].AcceptedAt)
 }
 
 func TestFifoConcurrent100(t *testing.T) {
@@ -104,6 +931,7 @@ func TestFifoConcurrent100(t *testing.T) {
 			output:   "json",
 			uuid:     respNew.UUID.String(),
 			ticketID: respTicket.TicketID.String(),
+			secret:   respTicket.Secret,
 		}))
 
 		assertResourceExclusive()
@@ -113,6 +941,7 @@ func TestFifoConcurrent100(t *testing.T) {
 			output:   "json",
 			uuid:     respNew.UUID.String(),
 			ticketID: respTicket.TicketID.String(),
+			secret:   respTicket.Secret,
 		}))
 	}
 
@@ -168,19 +997,21 @@ func TestFifo100Waiting(t *testing.T) {
 		output:   "json",
 		uuid:     respNew.UUID.String(),
 		ticketID: respTicket1.TicketID.String(),
+		secret:   respTicket1.Secret,
 	}))
 	t.Log("ticket1 is ready")
 
 	// Now the resource is blocked.
 	// Additional clients can join waiting the ticket.
 
-	runWaitClient := func(wg *sync.WaitGroup, ticketID string) {
+	runWaitClient := func(wg *sync.WaitGroup, ticketID, secret string) {
 		defer wg.Done()
 		require.NoError(RunFifoWait(ctx, ihttp.NewClient(), &FifoFlags{
 			endpoint: endpoint,
 			output:   "json",
 			uuid:     respNew.UUID.String(),
 			ticketID: ticketID,
+			secret:   secret,
 		}))
 	}
 
@@ -188,15 +1019,28 @@ func TestFifo100Waiting(t *testing.T) {
 	n := 100
 	wg1.Add(n)
 	for i := 0; i < n; i++ {
-		go runWaitClient(&wg1, respTicket1.TicketID.String())
+		go runWaitClient(&wg1, respTicket1.TicketID.String(), respTicket1.Secret)
 	}
 	wg2.Add(n)
 	for i := 0; i < n; i++ {
-		go runWaitClient(&wg2, respTicket2.TicketID.String())
+		go runWaitClient(&wg2, respTicket2.TicketID.String(), respTicket2.Secret)
 	}
 
-	// Wait so that goroutines are started and blocking.
-	time.Sleep(100 * time.Millisecond)
+	// The first ticket holds the fifo, so its waiters are released right
+	// away. Wait until those of the second ticket are blocking.
+	wg1.Wait()
+	t.Log("all clients waiting on ticket1 are released")
+	require.Eventually(func() bool {
+		out, err := RunServerInfo(ctx, ihttp.NewClient(), &FifoFlags{
+			endpoint: endpoint,
+			output:   "json",
+		})
+		if err != nil {
+			return false
+		}
+		status, err := decode[api.ServerStatusResponse](out)
+		return err == nil && status.Waiters >= int64(n)
+	}, 10*time.Second, 10*time.Millisecond)
 
 	// Now we can release the first ticket.
 	require.NoError(RunFifoDone(ctx, ihttp.NewClient(), &FifoFlags{
@@ -204,19 +1048,17 @@ func TestFifo100Waiting(t *testing.T) {
 		output:   "json",
 		uuid:     respNew.UUID.String(),
 		ticketID: respTicket1.TicketID.String(),
+		secret:   respTicket1.Secret,
 	}))
 	t.Log("ticket1 is done")
 
-	// All clients wating on the first ticket should be released.
-	wg1.Wait()
-	t.Log("all clients waiting on ticket1 are released")
-
 	// Now we can release the second ticket.
 	require.NoError(RunFifoDone(ctx, ihttp.NewClient(), &FifoFlags{
 		endpoint: endpoint,
 		output:   "json",
 		uuid:     respNew.UUID.String(),
 		ticketID: respTicket2.TicketID.String(),
+		secret:   respTicket2.Secret,
 	}))
 	t.Log("ticket2 is done")
 
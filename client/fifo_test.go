@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ihttp "github.com/katexochen/sync/internal/http"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitResumesDroppedConnection(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			// Drop the connection after a keepalive was sent.
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("\n"))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = w.Write([]byte(`{"ticket": "0c0b8f1e-5a43-4f7e-bd1c-0f35f0b6a8c1"}`))
+	}))
+	defer srv.Close()
+
+	client := ihttp.NewClient(ihttp.WithRetries(ihttp.RetryPolicy{Retries: 1, Backoff: time.Millisecond}))
+	err := RunFifoWait(context.Background(), client, &FifoFlags{
+		endpoint: srv.URL,
+		uuid:     "7b4e3f43-2fd3-4a4c-9d1f-1a3b0d1e6f52",
+		ticketID: "0c0b8f1e-5a43-4f7e-bd1c-0f35f0b6a8c1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), attempts.Load())
+}
+
+func TestRunFallsBackToFileLock(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	flags := &FifoFlags{
+		endpoint:  srv.URL,
+		uuid:      "7b4e3f43-2fd3-4a4c-9d1f-1a3b0d1e6f52",
+		heartbeat: time.Second,
+	}
+	ctx := context.Background()
+	assert.Error(RunFifoRun(ctx, ihttp.NewClient(), flags, []string{"true"}, nil, io.Discard, io.Discard))
+
+	flags.offlineFallback = true
+	assert.NoError(RunFifoRun(ctx, ihttp.NewClient(), flags, []string{"true"}, nil, io.Discard, io.Discard))
+
+	// The lock is held while the command runs.
+	path, err := fallbackLockPath(flags)
+	assert.NoError(err)
+	unlock, err := lockFile(ctx, path)
+	assert.NoError(err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(RunFifoRun(timeoutCtx, ihttp.NewClient(), flags, []string{"true"}, nil, io.Discard, io.Discard), context.DeadlineExceeded)
+	unlock()
+}
@@ -0,0 +1,13 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// lockFile isn't supported on platforms without flock.
+func lockFile(context.Context, string) (func(), error) {
+	return nil, errors.New("file locks aren't supported on this platform")
+}
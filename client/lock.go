@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+	"github.com/spf13/cobra"
+)
+
+func newLockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lock --name NAME -- COMMAND [ARG...]",
+		Short: "run a command while holding a named lock",
+		Long: "run a command while holding a named lock\n\n" +
+			"Gets or creates the fifo with the name and runs the command while holding it, like 'fifo run'. " +
+			"Clients locking the same name in the same namespace run their commands one after another. " +
+			"The exit code of the command is propagated, failures of sync itself exit with 125.\n\n" +
+			"The timeout flags only apply if the fifo is created.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseFifoFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			return runFailure(RunLock(cmd.Context(), client, flags, args, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.ErrOrStderr()))
+		},
+	}
+	addFifoConnectionFlags(cmd)
+	cmd.Flags().String("name", "", "name of the lock")
+	must(cmd.MarkFlagRequired("name"))
+	addFifoTimeoutFlags(cmd)
+	cmd.Flags().Duration("heartbeat", 30*time.Second, "interval of heartbeats extending the done timeout while the command runs")
+	cmd.Flags().Bool("offline-fallback", false, "hold a file lock on this machine instead if the server is unreachable")
+	return cmd
+}
+
+// lockAttempts bounds how often the fifo of a lock is looked up again after
+// it was deleted while being used.
+const lockAttempts = 3
+
+// RunLock runs the command while holding the fifo with the name of the flags.
+func RunLock(ctx context.Context, client *ihttp.Client, flags *FifoFlags, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	for attempt := 1; ; attempt++ {
+		fifo, err := createFifo(ctx, client, flags)
+		if err != nil && flags.offlineFallback && ctx.Err() == nil && unreachable(err) {
+			return runWithFileLock(ctx, flags, command, stdin, stdout, stderr, err)
+		} else if err != nil {
+			return fmt.Errorf("getting fifo: %w", err)
+		}
+		fifoFlags := *flags
+		fifoFlags.uuid = fifo.UUID.String()
+		err = RunFifoRun(ctx, client, &fifoFlags, command, stdin, stdout, stderr)
+		// The fifo may be deleted between getting and using it, the name is
+		// then free for a new one.
+		if attempt < lockAttempts && (errors.Is(err, api.ErrNotFound) || errors.Is(err, api.ErrGone)) {
+			logFrom(ctx).Info("fifo of the name was deleted, retrying", "uuid", fifoFlags.uuid, "err", err)
+			continue
+		}
+		return err
+	}
+}
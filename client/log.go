@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+// newLogger returns the logger for client diagnostics configured by the
+// global --verbose, --quiet and --log-format flags. By default, only
+// warnings and errors are logged.
+func newLogger(cmd *cobra.Command, out io.Writer) (*slog.Logger, error) {
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	quiet, _ := cmd.Flags().GetBool("quiet")
+	format, _ := cmd.Flags().GetString("log-format")
+
+	opts := &slog.HandlerOptions{Level: slog.LevelWarn}
+	switch {
+	case verbose:
+		opts.Level = slog.LevelDebug
+	case quiet:
+		opts.Level = slog.LevelError
+	}
+	switch format {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(out, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// logFrom returns the logger of the context. Without one, nothing is logged.
+func logFrom(ctx context.Context) *slog.Logger {
+	if log, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return log
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
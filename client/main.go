@@ -2,39 +2,177 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
 	"github.com/spf13/cobra"
 )
 
 func main() {
-	if err := execute(); err != nil {
-		os.Exit(1)
-	}
+	os.Exit(execute())
 }
 
-func execute() error {
+// Exit codes of the client. They are stable, so scripts can rely on them.
+const (
+	exitOK = 0
+	// exitFailure is used for all failures without a more specific code.
+	exitFailure = 1
+	// exitTimeout is used if a wait timed out.
+	exitTimeout = 2
+	// exitGone is used if the ticket expired or was removed, or the fifo
+	// was deleted.
+	exitGone = 3
+	// exitNotFound is used if the fifo or ticket doesn't exist.
+	exitNotFound = 4
+	// exitServerError is used if the server failed or couldn't be reached.
+	exitServerError = 5
+	// exitRunFailure is used by the commands running a command if the
+	// client fails, so it can't be mistaken for an exit code of the command.
+	exitRunFailure = 125
+)
+
+const exitCodesHelp = "Exit codes:\n" +
+	"  0  success\n" +
+	"  1  failure\n" +
+	"  2  wait timed out\n" +
+	"  3  ticket expired or removed, or fifo deleted\n" +
+	"  4  fifo or ticket not found\n" +
+	"  5  server failed or unreachable\n" +
+	"'fifo run' and 'lock' exit with the exit code of the command instead,\n" +
+	"or with 125 if sync fails."
+
+func execute() int {
 	cmd := newRootCmd()
 	ctx, cancel := signalContext(context.Background(), os.Interrupt)
 	defer cancel()
-	return cmd.ExecuteContext(ctx)
+	executed, err := cmd.ExecuteContextC(ctx)
+	if err == nil {
+		return exitOK
+	}
+	code := exitCode(err)
+	var cmdErr *exec.ExitError
+	if !errors.As(err, &cmdErr) {
+		// Commands run by the client report their failure themselves.
+		printError(executed, err, code)
+	}
+	return code
+}
+
+// runFailure returns the error of a command running a command. Failures of
+// the client exit with exitRunFailure, those of the command with its exit
+// code.
+func runFailure(err error) error {
+	var cmdErr *exec.ExitError
+	if err == nil || errors.As(err, &cmdErr) {
+		return err
+	}
+	return &exitCodeError{code: exitRunFailure, err: err}
+}
+
+// exitCodeError makes the client exit with code if it fails with err.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string { return e.err.Error() }
+
+func (e *exitCodeError) Unwrap() error { return e.err }
+
+func (e *exitCodeError) ExitCode() int { return e.code }
+
+// exitCode returns the exit code for the failure err.
+func exitCode(err error) int {
+	// Exit codes of commands run by the client and of failures with a
+	// dedicated code are propagated.
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	status := ihttp.StatusCode(err)
+	switch {
+	case errors.Is(err, api.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, api.ErrGone):
+		return exitGone
+	case status >= http.StatusInternalServerError:
+		return exitServerError
+	case status != 0:
+		return exitFailure
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return exitServerError
+	}
+	return exitFailure
+}
+
+// cliError is the machine-readable form of a failure, written with
+// --output json.
+type cliError struct {
+	Error    string `json:"error"`
+	ExitCode int    `json:"exitCode"`
+	// Status is the HTTP status code the server responded with, if any.
+	Status int `json:"status,omitempty"`
+}
+
+// printError writes err to stderr in the output format of cmd.
+func printError(cmd *cobra.Command, err error, code int) {
+	output := "raw"
+	if s, loadErr := loadSettings(cmd); loadErr == nil {
+		if o, flagErr := s.getString("output", "SYNC_OUTPUT", s.context.Output); flagErr == nil {
+			output = o
+		}
+	}
+	if output != "json" {
+		cmd.PrintErrln("Error:", err)
+		return
+	}
+	enc := json.NewEncoder(cmd.ErrOrStderr())
+	_ = enc.Encode(cliError{Error: err.Error(), ExitCode: code, Status: ihttp.StatusCode(err)})
 }
 
 var version = "0.0.0-dev"
 
+// userAgent identifies the CLI and its version in requests to the server.
+var userAgent = "sync-cli/" + version
+
 func newRootCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Short:            "sync",
-		PersistentPreRun: preRunRoot,
-		Version:          version,
+		Use:               "sync",
+		Short:             "sync",
+		Long:              "sync\n\n" + exitCodesHelp,
+		PersistentPreRunE: preRunRoot,
+		Version:           version,
+		// Errors are written by execute, in the requested output format.
+		SilenceErrors: true,
 	}
 	cmd.SetOut(os.Stdout)
+	cmd.PersistentFlags().StringP("output", "o", "raw", "output format: raw, json (env SYNC_OUTPUT)")
+	must(cmd.RegisterFlagCompletionFunc("output", cobra.FixedCompletions([]string{"raw", "json"}, cobra.ShellCompDirectiveNoFileComp)))
+	cmd.PersistentFlags().BoolP("verbose", "v", false, "log requests, retries and wait progress")
+	cmd.PersistentFlags().BoolP("quiet", "q", false, "only log errors")
+	cmd.MarkFlagsMutuallyExclusive("verbose", "quiet")
+	cmd.PersistentFlags().String("log-format", "text", "format of the logs written to stderr: text, json")
+	must(cmd.RegisterFlagCompletionFunc("log-format", cobra.FixedCompletions([]string{"text", "json"}, cobra.ShellCompDirectiveNoFileComp)))
+	cmd.PersistentFlags().String("config", "", "configuration file with contexts (env SYNC_CONFIG, default ~/.config/sync/config.yaml)")
+	cmd.PersistentFlags().String("context", "", "context of the configuration file to use (env SYNC_CONTEXT, default current context)")
 
 	cmd.InitDefaultVersionFlag()
 	cmd.AddCommand(
 		newFifoCommand(),
+		newLockCommand(),
+		newAdminCommand(),
+		newServerInfoCommand(),
+		newServeCommand(),
 	)
 
 	return cmd
@@ -67,8 +205,14 @@ func signalContext(ctx context.Context, sig os.Signal) (context.Context, context
 	return sigCtx, cancelFunc
 }
 
-func preRunRoot(cmd *cobra.Command, _ []string) {
+func preRunRoot(cmd *cobra.Command, _ []string) error {
 	cmd.SilenceUsage = true
+	log, err := newLogger(cmd, cmd.ErrOrStderr())
+	if err != nil {
+		return err
+	}
+	cmd.SetContext(withLogger(cmd.Context(), log))
+	return nil
 }
 
 func must(err error) {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	statusErr := func(status int) error {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		defer srv.Close()
+		return ihttp.NewClient().Get(context.Background(), srv.URL)
+	}
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	testCases := map[string]struct {
+		err  error
+		want int
+	}{
+		"generic":        {err: errors.New("failed"), want: exitFailure},
+		"explicit code":  {err: fmt.Errorf("waiting: %w", &exitCodeError{code: exitTimeout, err: errors.New("timed out")}), want: exitTimeout},
+		"not found":      {err: statusErr(http.StatusNotFound), want: exitNotFound},
+		"gone":           {err: statusErr(http.StatusGone), want: exitGone},
+		"server error":   {err: statusErr(http.StatusBadGateway), want: exitServerError},
+		"client error":   {err: statusErr(http.StatusForbidden), want: exitFailure},
+		"wait error":     {err: &api.WaitError{Status: http.StatusGone, Message: "fifo deleted"}, want: exitGone},
+		"not reachable":  {err: ihttp.NewClient().Get(context.Background(), closed.URL), want: exitServerError},
+		"invalid config": {err: errors.New("parsing flags: context not found"), want: exitFailure},
+		"run failure":    {err: runFailure(statusErr(http.StatusNotFound)), want: exitRunFailure},
+		"run command":    {err: runFailure(exec.Command("sh", "-c", "exit 4").Run()), want: 4},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, exitCode(tc.err))
+		})
+	}
+}
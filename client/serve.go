@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/katexochen/sync/pkg/server"
+	"github.com/spf13/cobra"
+)
+
+func newServeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve [server flags]",
+		Short: "run a sync server",
+		Long: "run a sync server\n\n" +
+			"The server takes the flags and environment variables of the sync server, see 'serve -help'. " +
+			"Use it to coordinate processes on a single machine without deploying a separate server, " +
+			"or use --local on the fifo commands to start one in the background on demand.",
+		// The flags are parsed by the server.
+		DisableFlagParsing: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runServe(cmd.Context(), args)
+		},
+	}
+	return cmd
+}
+
+func runServe(ctx context.Context, args []string) error {
+	cfg, err := server.LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if cfg.Check {
+		return server.CheckRestore(cfg, os.Stdout)
+	}
+	log, level := cfg.NewLogger(os.Stderr)
+	srv, err := server.New(server.Options{
+		Config: cfg,
+		// Tokens in SYNC_TOKENS are separated by commas.
+		Tokens:   strings.Split(os.Getenv("SYNC_TOKENS"), ","),
+		Logger:   log,
+		LogLevel: level,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM)
+	defer stop()
+	srv.ReloadOnSIGHUP(ctx, func() (*server.Config, error) {
+		return server.LoadConfig(args)
+	})
+	return srv.Run(ctx)
+}
+
+// localEndpoint is the endpoint of the local server. The host is ignored, as
+// the server is reached on its unix socket.
+const localEndpoint = "http://localhost"
+
+// localStartTimeout bounds how long the client waits for a local server it
+// started to accept connections.
+const localStartTimeout = 5 * time.Second
+
+// localSocket returns the path of the unix socket of the local server of the
+// user, in a directory only the user can access.
+func localSocket() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "sync-"+strconv.Itoa(os.Getuid()))
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", fmt.Errorf("creating directory of local server socket: %w", err)
+		}
+	}
+	return filepath.Join(dir, "sync.sock"), nil
+}
+
+// ensureLocalServer starts a local server on the socket in the background,
+// unless one is running already. The server keeps running after the client
+// exits, so later invocations share its fifos.
+func ensureLocalServer(ctx context.Context, socket string) error {
+	if localServerRunning(socket) {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("starting local server: %w", err)
+	}
+	cmd := exec.Command(self, "serve", "-unix-socket", socket, "-log-level", "error")
+	// The environment of the client must not configure the server, nor
+	// make it report to the service manager of the client.
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "SYNC_") && !strings.HasPrefix(env, "NOTIFY_SOCKET=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting local server: %w", err)
+	}
+	logFrom(ctx).Info("started local server", "socket", socket, "pid", cmd.Process.Pid)
+	// The server outlives the client, there is nothing to wait for.
+	_ = cmd.Process.Release()
+
+	ctx, cancel := context.WithTimeout(ctx, localStartTimeout)
+	defer cancel()
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for !localServerRunning(socket) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("local server on %s didn't start: %w", socket, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// localServerRunning reports whether a server accepts connections on the
+// socket.
+func localServerRunning(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	ihttp "github.com/katexochen/sync/internal/http"
+	"github.com/spf13/cobra"
+)
+
+func newServerInfoCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "server-info",
+		Aliases: []string{"ping"},
+		Short:   "show the version and status of the sync server",
+		Long: "show the version and status of the sync server\n\n" +
+			"Use it to check that the endpoint is reachable and the credentials are accepted. " +
+			"The latency is the duration of the version request.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags, err := parseServerFlags(cmd)
+			if err != nil {
+				return fmt.Errorf("parsing flags: %w", err)
+			}
+			client, err := newClient(cmd.Context(), flags)
+			if err != nil {
+				return err
+			}
+			out, err := RunServerInfo(cmd.Context(), client, flags)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), out)
+			return nil
+		},
+	}
+	cmd.Flags().StringP("endpoint", "e", "http://localhost:8080", "endpoint of the sync server (env SYNC_ENDPOINT)")
+	cmd.Flags().String("token", "", "bearer token to authenticate against the sync server (env SYNC_TOKEN)")
+	cmd.Flags().String("cacert", "", "CA certificate file to verify the sync server (env SYNC_CACERT)")
+	cmd.Flags().String("cert", "", "client certificate file for mutual TLS (env SYNC_CERT)")
+	cmd.Flags().String("key", "", "client key file for mutual TLS (env SYNC_KEY)")
+	cmd.Flags().Bool("local", false, "use a server on this machine, started in the background if it isn't running")
+	cmd.MarkFlagsMutuallyExclusive("local", "endpoint")
+	return cmd
+}
+
+// serverInfo combines the version and status of the server.
+type serverInfo struct {
+	Endpoint string `json:"endpoint"`
+	api.VersionResponse
+	api.ServerStatusResponse
+	Latency string `json:"latency"`
+}
+
+func RunServerInfo(ctx context.Context, client *ihttp.Client, flags *FifoFlags) (string, error) {
+	versionURL, err := ihttp.JoinURL(flags.endpoint, "v1", "version")
+	if err != nil {
+		return "", err
+	}
+	statusURL, err := ihttp.JoinURL(flags.endpoint, "v1", "status")
+	if err != nil {
+		return "", err
+	}
+
+	info := serverInfo{Endpoint: flags.endpoint}
+	start := time.Now()
+	if err := client.RequestJSON(ctx, versionURL, http.NoBody, &info.VersionResponse); err != nil {
+		return "", fmt.Errorf("getting version: %w", err)
+	}
+	info.Latency = time.Since(start).Round(time.Microsecond).String()
+	if err := client.RequestJSON(ctx, statusURL, http.NoBody, &info.ServerStatusResponse); err != nil {
+		return "", fmt.Errorf("getting status: %w", err)
+	}
+
+	if flags.output == "json" {
+		b, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	lines := []string{
+		"endpoint: " + info.Endpoint,
+		fmt.Sprintf("version:  %s (API %s)", info.Version, info.APIVersion),
+		"backend:  " + info.Backend,
+		"uptime:   " + info.Uptime,
+		fmt.Sprintf("fifos:    %d", info.Fifos),
+		fmt.Sprintf("waiters:  %d", info.Waiters),
+		"latency:  " + info.Latency,
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func parseServerFlags(cmd *cobra.Command) (*FifoFlags, error) {
+	s, err := loadSettings(cmd)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := s.getString("endpoint", "SYNC_ENDPOINT", s.context.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.getString("output", "SYNC_OUTPUT", s.context.Output)
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.getString("token", "SYNC_TOKEN", s.context.Token)
+	if err != nil {
+		return nil, err
+	}
+	cacert, err := s.getString("cacert", "SYNC_CACERT", s.context.CACert)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := s.getString("cert", "SYNC_CERT", s.context.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.getString("key", "SYNC_KEY", s.context.Key)
+	if err != nil {
+		return nil, err
+	}
+	local, _ := cmd.Flags().GetBool("local")
+	if local {
+		endpoint = localEndpoint
+	}
+	return &FifoFlags{
+		endpoint: endpoint,
+		output:   output,
+		token:    token,
+		cacert:   cacert,
+		cert:     cert,
+		key:      key,
+		local:    local,
+	}, nil
+}
@@ -3,91 +3,482 @@ package http
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/katexochen/sync/api"
 )
 
 type Client struct {
-	c *http.Client
+	c       *http.Client
+	token   string
+	headers http.Header
+	log     *slog.Logger
+	// retryPolicy is the default policy for retrying failed requests.
+	retryPolicy RetryPolicy
+
+	// The fields below configure c and are only used by NewClient.
+	httpClient  *http.Client
+	transport   http.RoundTripper
+	tlsConfig   *tls.Config
+	caCerts     []*x509.Certificate
+	proxy       func(*http.Request) (*url.URL, error)
+	dialTimeout time.Duration
+	unixSocket  string
+	timeout     time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken sets a bearer token that is sent with every request.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
 }
 
 type httpStatusCodeError struct {
 	StatusCode int
+	// Message is the start of the response body, the server explains
+	// failures there.
+	Message string
+	// retryAfter is the delay requested by the server before retrying.
+	retryAfter time.Duration
 }
 
 func (e *httpStatusCodeError) Error() string {
-	return fmt.Sprintf("status code %d", e.StatusCode)
+	if e.Message == "" {
+		return fmt.Sprintf("status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status code %d: %s", e.StatusCode, e.Message)
 }
 
-func NewClient() *Client {
-	return &Client{
-		c: &http.Client{},
+func (e *httpStatusCodeError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+// Is reports whether the failure matches the API error of its status code,
+// like api.ErrNotFound.
+func (e *httpStatusCodeError) Is(target error) bool {
+	err := api.ErrorForStatus(e.StatusCode)
+	return err != nil && err == target
+}
+
+// maxErrorMessage limits how much of the body of a failed response is read
+// into the error.
+const maxErrorMessage = 1024
+
+func newStatusCodeError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorMessage))
+	msg := strings.TrimSpace(string(body))
+	// Errors come as api.ErrorResponse, except those of unknown paths and
+	// of proxies, which are plain text.
+	var errResp api.ErrorResponse
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
+		msg = errResp.Error
+	}
+	return &httpStatusCodeError{
+		StatusCode: res.StatusCode,
+		Message:    msg,
+		retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
 	}
 }
 
-func (c *Client) RequestJSON(ctx context.Context, url string, body, resp any) error {
-	if body == http.NoBody {
-		return c.GetJSON(ctx, url, resp)
+// StatusCode returns the HTTP status code of an error returned by the
+// Client, or 0 if the request didn't get a response. Other errors carrying a
+// status code can provide it with an HTTPStatus method.
+func StatusCode(err error) int {
+	var statusErr interface{ HTTPStatus() int }
+	if errors.As(err, &statusErr) {
+		return statusErr.HTTPStatus()
 	}
-	return c.PostJSON(ctx, url, body, resp)
+	return 0
 }
 
-func (c *Client) Get(ctx context.Context, url string) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
-	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+// Retriable reports whether a failed request may succeed on retry. That's
+// the case if the connection failed or dropped, the server failed or it is
+// rate limiting.
+func Retriable(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// The connection dropped while reading the response.
+		return true
 	}
-	res, err := c.c.Do(req)
-	if err != nil {
-		return err
+	if status := StatusCode(err); status != 0 {
+		return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return &httpStatusCodeError{StatusCode: res.StatusCode}
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return false
 	}
-	return nil
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
 }
 
-func (c *Client) GetJSON(ctx context.Context, url string, resp any) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+// JoinURL appends the path segments to the base URL.
+func JoinURL(base string, pathSegments ...string) (string, error) {
+	u, err := url.Parse(base)
 	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+		return "", fmt.Errorf("parsing endpoint: %w", err)
 	}
-	res, err := c.c.Do(req)
-	if err != nil {
-		return fmt.Errorf("performing request: %w", err)
+	return u.JoinPath(pathSegments...).String(), nil
+}
+
+// WithTicketSecret returns a context whose requests carry the ticket secret
+// in a header, keeping it out of the URL.
+func WithTicketSecret(ctx context.Context, secret string) context.Context {
+	return context.WithValue(ctx, ticketSecretKey{}, secret)
+}
+
+type ticketSecretKey struct{}
+
+// WithLogger sets a logger that requests are logged to on debug level.
+func WithLogger(log *slog.Logger) Option {
+	return func(c *Client) {
+		c.log = log
+	}
+}
+
+// WithHeader sets a header that is sent with every request.
+func WithHeader(key, value string) Option {
+	return func(c *Client) {
+		c.headers.Set(key, value)
+	}
+}
+
+// WithUserAgent sets the User-Agent header that is sent with every request.
+func WithUserAgent(userAgent string) Option {
+	return WithHeader("User-Agent", userAgent)
+}
+
+// WithHTTPClient makes the Client send requests with a copy of hc. If hc has
+// a Transport, the options configuring the transport have no effect.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return &httpStatusCodeError{StatusCode: res.StatusCode}
+}
+
+// WithTransport sets the transport requests are sent with. The options
+// configuring the transport have no effect then.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.transport = rt
 	}
-	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
-		return fmt.Errorf("decoding response: %w", err)
+}
+
+// WithTLSConfig sets the TLS configuration used for HTTPS connections.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = cfg
 	}
-	return nil
 }
 
+// WithCACerts makes the Client trust the given CA certificates in addition
+// to the system roots, or the roots of the TLS configuration if it has any.
+func WithCACerts(certs ...*x509.Certificate) Option {
+	return func(c *Client) {
+		c.caCerts = append(c.caCerts, certs...)
+	}
+}
+
+// WithProxy sends requests through the proxy at proxyURL, or directly if it
+// is nil. By default, the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables.
+func WithProxy(proxyURL *url.URL) Option {
+	return func(c *Client) {
+		c.proxy = http.ProxyURL(proxyURL)
+	}
+}
+
+// WithDialTimeout bounds the time to establish a connection to the server.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithUnixSocket connects to the server on the unix domain socket at path.
+// The host of request URLs is ignored then.
+func WithUnixSocket(path string) Option {
+	return func(c *Client) {
+		c.unixSocket = path
+	}
+}
+
+// WithTimeout bounds the time of each request, including reading the
+// response body. Waits block until the ticket is due, so the timeout must be
+// longer than the wait timeout of the fifos the Client waits on.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// LoadTLSConfig returns a TLS configuration trusting the CA certificates in
+// caFile in addition to the system roots, and presenting the client
+// certificate from certFile and keyFile. All arguments are optional.
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA file")
+		}
+		cfg.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		headers: http.Header{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	hc := &http.Client{}
+	if c.httpClient != nil {
+		*hc = *c.httpClient
+	}
+	switch {
+	case c.transport != nil:
+		hc.Transport = c.transport
+	case hc.Transport == nil:
+		hc.Transport = c.newTransport()
+	}
+	if c.timeout > 0 {
+		hc.Timeout = c.timeout
+	}
+	c.c = hc
+	return c
+}
+
+func (c *Client) newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if c.proxy != nil {
+		t.Proxy = c.proxy
+	}
+	if c.dialTimeout > 0 {
+		t.DialContext = (&net.Dialer{Timeout: c.dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if c.unixSocket != "" {
+		dialer := &net.Dialer{Timeout: c.dialTimeout}
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", c.unixSocket)
+		}
+		t.Proxy = nil
+	}
+	if c.tlsConfig != nil {
+		t.TLSClientConfig = c.tlsConfig
+	}
+	if len(c.caCerts) > 0 {
+		cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+		if t.TLSClientConfig != nil {
+			cfg = t.TLSClientConfig.Clone()
+		}
+		pool := cfg.RootCAs
+		if pool == nil {
+			var err error
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		} else {
+			pool = pool.Clone()
+		}
+		for _, cert := range c.caCerts {
+			pool.AddCert(cert)
+		}
+		cfg.RootCAs = pool
+		t.TLSClientConfig = cfg
+	}
+	return t
+}
+
+func (c *Client) RequestJSON(ctx context.Context, url string, body, resp any) error {
+	if body == http.NoBody {
+		return c.GetJSON(ctx, url, resp)
+	}
+	return c.PostJSON(ctx, url, body, resp)
+}
+
+func (c *Client) Get(ctx context.Context, url string) error {
+	return c.retry(ctx, http.MethodGet, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+		if err != nil {
+			return fmt.Errorf("creating request: %w", err)
+		}
+		res, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return newStatusCodeError(res)
+		}
+		return nil
+	})
+}
+
+// GetJSON performs a GET request and decodes the response into resp. If resp
+// reports a failure in the body with an Err method, like a wait response,
+// that is returned as error.
+func (c *Client) GetJSON(ctx context.Context, url string, resp any) error {
+	return c.Do(ctx, http.MethodGet, url, nil, resp)
+}
+
+// PostJSON performs a POST request with the JSON encoded body and decodes the
+// response into resp.
 func (c *Client) PostJSON(ctx context.Context, url string, body, resp any) error {
-	bodyJSON, err := json.Marshal(body)
-	if err != nil {
-		return fmt.Errorf("marshaling request body: %w", err)
+	return c.Do(ctx, http.MethodPost, url, body, resp)
+}
+
+// Do performs a request with the given method. The body is sent JSON encoded
+// and the response is decoded into resp, both are skipped if nil.
+func (c *Client) Do(ctx context.Context, method, url string, body, resp any) error {
+	var bodyJSON []byte
+	if body != nil {
+		var err error
+		bodyJSON, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshaling request body: %w", err)
+		}
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyJSON))
-	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+	return c.retry(ctx, method, func(ctx context.Context) error {
+		var reqBody io.Reader = http.NoBody
+		if body != nil {
+			reqBody = bytes.NewReader(bodyJSON)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+		if err != nil {
+			return fmt.Errorf("creating request: %w", err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := c.do(req)
+		if err != nil {
+			return fmt.Errorf("performing request: %w", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return newStatusCodeError(res)
+		}
+		if resp == nil {
+			return nil
+		}
+		if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+			return fmt.Errorf("decoding response: %w", err)
+		}
+		if failed, ok := resp.(interface{ Err() error }); ok {
+			return failed.Err()
+		}
+		return nil
+	})
+}
+
+// Poll performs GET requests until the response is something other than 202
+// Accepted and decodes it into resp, like GetJSON. Between the requests, it
+// waits as long as the Retry-After header of the previous response asks
+// for, or a second if it doesn't.
+func (c *Client) Poll(ctx context.Context, url string, resp any) error {
+	for {
+		err := c.GetJSON(ctx, url, resp)
+		if StatusCode(err) != http.StatusAccepted {
+			return err
+		}
+		delay := retryAfter(err)
+		if delay == 0 {
+			delay = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
-	res, err := c.c.Do(req)
-	if err != nil {
-		return fmt.Errorf("performing request: %w", err)
+}
+
+// Stream performs a GET request and returns the response body for reading
+// while the server writes it. The caller must close the body.
+func (c *Client) Stream(ctx context.Context, url string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := c.retry(ctx, http.MethodGet, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+		if err != nil {
+			return fmt.Errorf("creating request: %w", err)
+		}
+		res, err := c.do(req)
+		if err != nil {
+			return fmt.Errorf("performing request: %w", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			defer res.Body.Close()
+			return newStatusCodeError(res)
+		}
+		body = res.Body
+		return nil
+	})
+	return body, err
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for key, values := range c.headers {
+		req.Header[key] = values
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return &httpStatusCodeError{StatusCode: res.StatusCode}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
 	}
-	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
-		return fmt.Errorf("decoding response: %w", err)
+	if key, ok := req.Context().Value(idempotencyKeyKey{}).(string); ok {
+		req.Header.Set(api.IdempotencyKeyHeader, key)
+	}
+	if secret, ok := req.Context().Value(ticketSecretKey{}).(string); ok {
+		req.Header.Set(api.TicketSecretHeader, secret)
+	}
+	if c.log == nil {
+		return c.c.Do(req)
+	}
+
+	// The query may contain secrets.
+	u := *req.URL
+	u.RawQuery = ""
+	log := c.log.With("method", req.Method, "url", u.String())
+	log.Debug("sending request")
+	start := time.Now()
+	res, err := c.c.Do(req)
+	if err != nil {
+		log.Debug("request failed", "err", err, "duration", time.Since(start))
+		return nil, err
 	}
-	return nil
+	log.Debug("received response", "status", res.StatusCode, "duration", time.Since(start))
+	return res, nil
 }
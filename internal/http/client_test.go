@@ -0,0 +1,188 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	var logs strings.Builder
+	log := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := NewClient(WithLogger(log))
+	assert.NoError(c.Get(context.Background(), srv.URL+"/v1/fifo/wait?secret=hunter2"))
+
+	assert.Contains(logs.String(), "url="+srv.URL+"/v1/fifo/wait")
+	assert.Contains(logs.String(), "status=200")
+	assert.NotContains(logs.String(), "hunter2")
+}
+
+func TestPoll(t *testing.T) {
+	assert := assert.New(t)
+
+	var polls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 3 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		fmt.Fprint(w, `{"ticket": "00000000-0000-0000-0000-000000000001"}`)
+	}))
+	defer srv.Close()
+
+	var resp api.FifoWaitResponse
+	start := time.Now()
+	assert.NoError(NewClient().Poll(context.Background(), srv.URL, &resp))
+	assert.Equal(3, polls)
+	assert.GreaterOrEqual(time.Since(start), 2*time.Second)
+	assert.Equal("00000000-0000-0000-0000-000000000001", resp.TicketID.String())
+}
+
+func TestStatusCodeError(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fifo not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	err := NewClient().Get(context.Background(), srv.URL)
+	assert.Equal(http.StatusNotFound, StatusCode(err))
+	assert.EqualError(err, "status code 404: fifo not found")
+
+	assert.ErrorIs(err, api.ErrNotFound)
+	assert.NotErrorIs(err, api.ErrGone)
+
+	var resp struct{}
+	err = NewClient().GetJSON(context.Background(), srv.URL, &resp)
+	assert.Equal(http.StatusNotFound, StatusCode(fmt.Errorf("waiting: %w", err)))
+
+	// Messages of error envelopes are unwrapped.
+	envelope := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprint(w, `{"error": "request body exceeds 1048576 bytes", "status": 413}`)
+	}))
+	defer envelope.Close()
+	err = NewClient().Get(context.Background(), envelope.URL)
+	assert.EqualError(err, "status code 413: request body exceeds 1048576 bytes")
+
+	// Failures reported in wait bodies match the same way.
+	err = &api.WaitError{Status: http.StatusGone, Message: "fifo deleted"}
+	assert.ErrorIs(err, api.ErrGone)
+	assert.Equal(http.StatusGone, StatusCode(err))
+}
+
+type statusErr int
+
+func (e statusErr) Error() string   { return "failed" }
+func (e statusErr) HTTPStatus() int { return int(e) }
+
+func TestRetriable(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	connErr := NewClient().Get(context.Background(), closed.URL)
+
+	testCases := map[string]struct {
+		err  error
+		want bool
+	}{
+		"server error":     {err: statusErr(http.StatusInternalServerError), want: true},
+		"unavailable":      {err: statusErr(http.StatusServiceUnavailable), want: true},
+		"rate limited":     {err: statusErr(http.StatusTooManyRequests), want: true},
+		"not found":        {err: statusErr(http.StatusNotFound)},
+		"forbidden":        {err: statusErr(http.StatusForbidden)},
+		"connection error": {err: connErr, want: true},
+		"dropped":          {err: fmt.Errorf("decoding response: %w", io.ErrUnexpectedEOF), want: true},
+		"other":            {err: errors.New("parsing endpoint")},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, Retriable(tc.err))
+		})
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	var userAgent string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+		userAgent = r.UserAgent()
+	}))
+	defer srv.Close()
+
+	// The test server's certificate isn't trusted by default.
+	assert.Error(NewClient().Get(ctx, srv.URL))
+
+	c := NewClient(WithCACerts(srv.Certificate()), WithUserAgent("sync-test/1.0"))
+	assert.NoError(c.Get(ctx, srv.URL))
+	assert.Equal("sync-test/1.0", userAgent)
+
+	c = NewClient(WithCACerts(srv.Certificate()), WithTimeout(10*time.Millisecond))
+	assert.Error(c.Get(ctx, srv.URL+"/slow"))
+
+	// The test server's client trusts its certificate.
+	c = NewClient(WithHTTPClient(srv.Client()))
+	assert.NoError(c.Get(ctx, srv.URL))
+}
+
+func TestWithProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(err)
+
+	c := NewClient(WithProxy(proxyURL))
+	assert.NoError(c.Get(context.Background(), "http://sync.example/v1/version"))
+	assert.Equal("http://sync.example/v1/version", proxied)
+}
+
+func TestWithUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	socket := filepath.Join(t.TempDir(), "sync.sock")
+	l, err := net.Listen("unix", socket)
+	assert.NoError(err)
+	var path string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	c := NewClient(WithUnixSocket(socket))
+	assert.NoError(c.Get(context.Background(), "http://localhost/v1/version"))
+	assert.Equal("/v1/version", path)
+}
@@ -0,0 +1,150 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+)
+
+// RetryPolicy configures how failed requests are retried.
+type RetryPolicy struct {
+	// Retries is the number of retries after the first attempt. Negative
+	// values retry until the context is done.
+	Retries int
+	// Backoff is the delay before the first retry, it doubles with every
+	// further retry.
+	Backoff time.Duration
+	// MaxElapsed bounds the time spent retrying after the first failure.
+	// Zero means no bound.
+	MaxElapsed time.Duration
+}
+
+// maxRetryBackoff caps the delay between two retries.
+const maxRetryBackoff = 30 * time.Second
+
+// WithRetries makes the Client retry failed requests by the policy.
+//
+// Requests are retried if they failed with a retriable error, see Retriable.
+// GET, HEAD, PUT and DELETE requests are idempotent, POST requests only if
+// they are made with a context returned by Idempotent. Other POST requests
+// are only retried if they didn't reach the server, as they could have
+// taken effect otherwise.
+func WithRetries(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retryPolicy = policy
+	}
+}
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy returns a context that makes requests retried by the policy
+// instead of the policy of the Client. A zero policy disables retries.
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+type idempotentKey struct{}
+
+// Idempotent returns a context that marks POST requests as safe to retry.
+// Each request made with it carries an Idempotency-Key header that stays
+// the same across retries, so the server can recognize repeated requests.
+func Idempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+type idempotencyKeyKey struct{}
+
+// retry calls op until it succeeds, fails with an error that isn't
+// retriable, or the retries are exhausted. The delays between attempts grow
+// exponentially and are jittered, so clients failing together don't retry
+// in lockstep. A Retry-After sent by the server extends the delay.
+func (c *Client) retry(ctx context.Context, method string, op func(context.Context) error) error {
+	policy := c.retryPolicy
+	if p, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy); ok {
+		policy = p
+	}
+	idempotent := method != http.MethodPost && method != http.MethodPatch
+	if ctx.Value(idempotentKey{}) != nil && !idempotent {
+		idempotent = true
+		ctx = context.WithValue(ctx, idempotencyKeyKey{}, uuidlib.NewString())
+	}
+
+	var firstFailure time.Time
+	backoff := policy.Backoff
+	for attempt := 0; ; attempt++ {
+		err := op(ctx)
+		if err == nil || (policy.Retries >= 0 && attempt >= policy.Retries) || ctx.Err() != nil {
+			return err
+		}
+		if !Retriable(err) || (!idempotent && !notProcessed(err)) {
+			return err
+		}
+		if firstFailure.IsZero() {
+			firstFailure = time.Now()
+		}
+		delay := max(jitter(backoff), retryAfter(err))
+		if policy.MaxElapsed > 0 && time.Since(firstFailure)+delay > policy.MaxElapsed {
+			return err
+		}
+		if c.log != nil {
+			c.log.Warn("request failed, retrying", "err", err, "attempt", attempt+1, "delay", delay)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// notProcessed reports whether a failed request certainly had no effect on
+// the server, because the connection couldn't be established or the server
+// declined to handle it.
+func notProcessed(err error) bool {
+	switch StatusCode(err) {
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryAfter returns the delay requested by the Retry-After header of a
+// failed response, or 0 if there is none.
+func retryAfter(err error) time.Duration {
+	var statusErr *httpStatusCodeError
+	if !errors.As(err, &statusErr) {
+		return 0
+	}
+	return min(statusErr.retryAfter, maxRetryBackoff)
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// jitter returns a random duration in [d/2, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
@@ -0,0 +1,186 @@
+package http
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	testCases := map[string]struct {
+		failures     int32
+		failStatus   int
+		method       string
+		idempotent   bool
+		policy       RetryPolicy
+		wantErr      bool
+		wantAttempts int32
+	}{
+		"success": {
+			policy:       RetryPolicy{Retries: 3, Backoff: time.Millisecond},
+			wantAttempts: 1,
+		},
+		"recovers from unavailable server": {
+			failures:     2,
+			failStatus:   http.StatusServiceUnavailable,
+			policy:       RetryPolicy{Retries: 3, Backoff: time.Millisecond},
+			wantAttempts: 3,
+		},
+		"recovers from rate limit": {
+			failures:     1,
+			failStatus:   http.StatusTooManyRequests,
+			policy:       RetryPolicy{Retries: 3, Backoff: time.Millisecond},
+			wantAttempts: 2,
+		},
+		"retries exhausted": {
+			failures:     5,
+			failStatus:   http.StatusBadGateway,
+			policy:       RetryPolicy{Retries: 2, Backoff: time.Millisecond},
+			wantErr:      true,
+			wantAttempts: 3,
+		},
+		"client error isn't retried": {
+			failures:     1,
+			failStatus:   http.StatusNotFound,
+			policy:       RetryPolicy{Retries: 3, Backoff: time.Millisecond},
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		"max elapsed": {
+			failures:     5,
+			failStatus:   http.StatusInternalServerError,
+			policy:       RetryPolicy{Retries: 10, Backoff: time.Hour, MaxElapsed: time.Minute},
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		"no retries by default": {
+			failures:     1,
+			failStatus:   http.StatusServiceUnavailable,
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		"post may have taken effect": {
+			failures:     1,
+			failStatus:   http.StatusInternalServerError,
+			method:       http.MethodPost,
+			policy:       RetryPolicy{Retries: 3, Backoff: time.Millisecond},
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		"post declined by server": {
+			failures:     1,
+			failStatus:   http.StatusServiceUnavailable,
+			method:       http.MethodPost,
+			policy:       RetryPolicy{Retries: 3, Backoff: time.Millisecond},
+			wantAttempts: 2,
+		},
+		"idempotent post": {
+			failures:     2,
+			failStatus:   http.StatusInternalServerError,
+			method:       http.MethodPost,
+			idempotent:   true,
+			policy:       RetryPolicy{Retries: 3, Backoff: time.Millisecond},
+			wantAttempts: 3,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var attempts atomic.Int32
+			var keysMux sync.Mutex
+			keys := map[string]bool{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				keysMux.Lock()
+				keys[r.Header.Get(api.IdempotencyKeyHeader)] = true
+				keysMux.Unlock()
+				if attempts.Add(1) <= tc.failures {
+					w.WriteHeader(tc.failStatus)
+				}
+			}))
+			defer srv.Close()
+
+			ctx := context.Background()
+			if tc.idempotent {
+				ctx = Idempotent(ctx)
+			}
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			err := NewClient(WithRetries(tc.policy)).Do(ctx, method, srv.URL, nil, nil)
+			if tc.wantErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+			assert.Equal(tc.wantAttempts, attempts.Load())
+			// Retries carry the same idempotency key.
+			keysMux.Lock()
+			defer keysMux.Unlock()
+			assert.Len(keys, 1)
+			assert.Equal(tc.idempotent, !keys[""])
+		})
+	}
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	var logs strings.Builder
+	c := NewClient(
+		WithRetries(RetryPolicy{Retries: 2, Backoff: time.Millisecond}),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+	)
+	// The request didn't reach the server, so even a POST is retried.
+	assert.Error(t, c.PostJSON(context.Background(), srv.URL, struct{}{}, nil))
+	assert.Equal(t, 2, strings.Count(logs.String(), "retrying"))
+}
+
+func TestRetryPolicyOverride(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithRetries(RetryPolicy{Retries: 3, Backoff: time.Millisecond}))
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{})
+	assert.Error(t, c.Get(ctx, srv.URL))
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Zero(parseRetryAfter(""))
+	assert.Zero(parseRetryAfter("soon"))
+	assert.Equal(2*time.Second, parseRetryAfter("2"))
+	assert.InDelta(time.Minute, parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)), float64(time.Second))
+	assert.Zero(parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)))
+
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	c := NewClient(WithRetries(RetryPolicy{Retries: 1, Backoff: time.Millisecond}))
+	assert.NoError(c.Get(context.Background(), srv.URL))
+	assert.GreaterOrEqual(time.Since(start), time.Second)
+}
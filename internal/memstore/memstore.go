@@ -32,8 +32,8 @@ func (s *Store[keyT, valueT]) Put(key keyT, value valueT) {
 
 // Delete removes the element with the given key.
 func (s *Store[keyT, valueT]) Delete(key keyT) {
-	s.mux.RLock()
-	defer s.mux.RUnlock()
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	delete(s.m, key)
 }
 
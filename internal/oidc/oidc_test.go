@@ -0,0 +1,194 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer,
+			"jwks_uri": issuer + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"n":   b64(rsaKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec",
+				"crv": "P-256",
+				"x":   b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   b64(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		}})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	issuer = srv.URL
+
+	validClaims := func() map[string]any {
+		return map[string]any{
+			"iss": issuer,
+			"aud": "sync",
+			"sub": "ci-job",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	testCases := map[string]struct {
+		token   func() string
+		wantErr bool
+	}{
+		"valid RS256": {
+			token: func() string { return signRSA(t, rsaKey, "rsa", validClaims()) },
+		},
+		"valid ES256": {
+			token: func() string { return signEC(t, ecKey, "ec", validClaims()) },
+		},
+		"audience in list": {
+			token: func() string {
+				c := validClaims()
+				c["aud"] = []string{"other", "sync"}
+				return signRSA(t, rsaKey, "rsa", c)
+			},
+		},
+		"wrong audience": {
+			token: func() string {
+				c := validClaims()
+				c["aud"] = "other"
+				return signRSA(t, rsaKey, "rsa", c)
+			},
+			wantErr: true,
+		},
+		"wrong issuer": {
+			token: func() string {
+				c := validClaims()
+				c["iss"] = "https://evil.example.com"
+				return signRSA(t, rsaKey, "rsa", c)
+			},
+			wantErr: true,
+		},
+		"expired": {
+			token: func() string {
+				c := validClaims()
+				c["exp"] = time.Now().Add(-time.Hour).Unix()
+				return signRSA(t, rsaKey, "rsa", c)
+			},
+			wantErr: true,
+		},
+		"not yet valid": {
+			token: func() string {
+				c := validClaims()
+				c["nbf"] = time.Now().Add(time.Hour).Unix()
+				return signRSA(t, rsaKey, "rsa", c)
+			},
+			wantErr: true,
+		},
+		"unknown key": {
+			token:   func() string { return signRSA(t, rsaKey, "other", validClaims()) },
+			wantErr: true,
+		},
+		"key type mismatch": {
+			token:   func() string { return signRSA(t, rsaKey, "ec", validClaims()) },
+			wantErr: true,
+		},
+		"tampered claims": {
+			token: func() string {
+				parts := strings.Split(signRSA(t, rsaKey, "rsa", validClaims()), ".")
+				c := validClaims()
+				c["sub"] = "admin"
+				parts[1] = encodeSegment(t, c)
+				return strings.Join(parts, ".")
+			},
+			wantErr: true,
+		},
+		"alg none": {
+			token: func() string {
+				return encodeSegment(t, map[string]string{"alg": "none", "kid": "rsa"}) + "." +
+					encodeSegment(t, validClaims()) + "."
+			},
+			wantErr: true,
+		},
+		"malformed": {
+			token:   func() string { return "not-a-token" },
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			v := NewVerifier(issuer, "sync")
+			claims, err := v.Verify(context.Background(), tc.token())
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			sub, ok := claims.String("sub")
+			assert.True(ok)
+			assert.Equal("ci-job", sub)
+		})
+	}
+}
+
+func signRSA(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	signed := encodeSegment(t, map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + b64(sig)
+}
+
+func signEC(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	signed := encodeSegment(t, map[string]string{"alg": "ES256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + b64(sig)
+}
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return b64(b)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+)
+
+// maxAcquireFifos bounds the number of fifos acquired by one request.
+const maxAcquireFifos = 16
+
+// acquireFailure ends an acquire request with the status.
+type acquireFailure struct {
+	status int
+	msg    string
+}
+
+func (e *acquireFailure) Error() string {
+	return e.msg
+}
+
+// acquire takes a ticket in each of the fifos of the request and waits for
+// their turns, one fifo after the other in the order of their UUIDs. As all
+// clients acquire fifos in the same order, they can't deadlock each other.
+// If a fifo can't be acquired, the tickets taken so far are canceled, so the
+// client holds either all fifos or none. The server sends heartbeats for the
+// held tickets until the response is sent.
+func (s *fifoManager) acquire(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "acquire", "namespace", namespaceOf(r))
+	log.Info("called")
+
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoAcquireRequest](w, r)
+	if !ok {
+		return
+	}
+	uuids := slices.Clone(req.UUIDs)
+	slices.SortFunc(uuids, func(a, b uuidlib.UUID) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	if len(uuids) == 0 || len(uuids) > maxAcquireFifos {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("between 1 and %d fifos must be given", maxAcquireFifos))
+		return
+	}
+	if len(slices.Compact(slices.Clone(uuids))) != len(uuids) {
+		writeError(w, http.StatusBadRequest, "fifos must not be given twice")
+		return
+	}
+	fifos := make([]*fifo, 0, len(uuids))
+	for _, uuid := range uuids {
+		fifo, ok := s.fifos.Get(fifoKey(ns, uuid.String()))
+		if !ok {
+			log.Warn("fifo not found", "uuid", uuid)
+			writeError(w, http.StatusNotFound, fmt.Sprintf("fifo %s not found", uuid))
+			return
+		}
+		fifos = append(fifos, fifo)
+	}
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	identity := clientIdentity(r, req.Identity)
+	resp := api.FifoAcquireResponse{Tickets: make([]api.FifoAcquiredTicket, 0, len(fifos))}
+	var held []*ticket
+	releaseAll := func() {
+		for i, tick := range held {
+			fifos[i].abort(tick, api.OutcomeCanceled)
+		}
+	}
+	for _, fifo := range fifos {
+		log := log.With("uuid", fifo.uuid.String())
+		tick := newTicket(identity)
+		if !s.acquireTicketQuota(w, r, log, fifo, tick) {
+			releaseAll()
+			return
+		}
+		resp.Tickets = append(resp.Tickets, api.FifoAcquiredTicket{UUID: fifo.uuid, FifoTicketResponse: tick.FifoTicketResponse})
+		held = append(held, tick)
+		fifo.enqueue(tick)
+		log.Info("ticket created", "ticket", tick.TicketID, "identity", identity)
+
+		if err := s.acquireTurn(ctx, w, r, log, fifo, tick); err != nil {
+			releaseAll()
+			if r.Context().Err() != nil {
+				log.Info("client disconnected")
+				return
+			}
+			log.Warn("acquiring fifo failed, released all tickets", "err", err)
+			if err.status == http.StatusServiceUnavailable {
+				unavailable(w, err.msg)
+			} else if err.status != 0 {
+				writeError(w, err.status, err.msg)
+			}
+			return
+		}
+		fifo.accept(tick)
+		go holdTicket(ctx, cancel, fifo, tick)
+	}
+	log.Info("all fifos acquired")
+	encode(w, 200, resp)
+}
+
+// acquireTurn waits for the turn of the ticket in the fifo. It fails if the
+// context is canceled, which happens if a ticket held before ended. A zero
+// status of the failure means the response was already written.
+func (s *fifoManager) acquireTurn(ctx context.Context, w http.ResponseWriter, r *http.Request, log *slog.Logger, fifo *fifo, tick *ticket) *acquireFailure {
+	release, ok := s.acquireWaiter(w, r, log, fifo)
+	if !ok {
+		return &acquireFailure{msg: "too many waiters"}
+	}
+	defer release()
+
+	select {
+	case <-tick.waitC:
+		return nil
+	case <-tick.abortC:
+		return &acquireFailure{http.StatusGone, fmt.Sprintf("ticket aborted by owner of fifo %s", fifo.uuid)}
+	case <-fifo.stopC:
+		return &acquireFailure{http.StatusGone, fmt.Sprintf("fifo %s deleted", fifo.uuid)}
+	case <-s.shutdownC:
+		return &acquireFailure{http.StatusServiceUnavailable, "server shutting down"}
+	case <-ctx.Done():
+		if failure, ok := context.Cause(ctx).(*acquireFailure); ok {
+			return failure
+		}
+		return &acquireFailure{msg: ctx.Err().Error()}
+	}
+}
+
+// minHeartbeatInterval is the floor of the interval of the heartbeats the
+// server sends for tickets it holds, as tickers need a positive interval.
+const minHeartbeatInterval = 10 * time.Millisecond
+
+// heartbeatInterval is the interval of the heartbeats the server sends for
+// tickets of the fifo it holds, well within the done timeout.
+func (f *fifo) heartbeatInterval() time.Duration {
+	return max(f.doneTimeout/2, minHeartbeatInterval)
+}
+
+// holdTicket sends heartbeats for the active ticket until the context is
+// done. If the ticket ends early, the context is canceled with the reason.
+func holdTicket(ctx context.Context, cancel context.CancelCauseFunc, fifo *fifo, tick *ticket) {
+	ticker := time.NewTicker(fifo.heartbeatInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case tick.heartbeatC <- struct{}{}:
+			default:
+			}
+		case <-tick.abortC:
+			cancel(&acquireFailure{http.StatusGone, fmt.Sprintf("ticket aborted by owner of fifo %s", fifo.uuid)})
+			return
+		case <-fifo.stopC:
+			cancel(&acquireFailure{http.StatusGone, fmt.Sprintf("fifo %s deleted", fifo.uuid)})
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
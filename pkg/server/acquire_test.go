@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquire(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// setup returns two fifos ordered by UUID, the second one held by
+	// another ticket, and a function to acquire fifos by UUID.
+	setup := func(t *testing.T) ([]*fifo, *ticket, func(...uuidlib.UUID) *httptest.ResponseRecorder) {
+		cfg := DefaultConfig().Fifo
+		fm := newFifoManager(cfg, nil, log)
+		t.Cleanup(fm.stopAll)
+		mux := http.NewServeMux()
+		fm.registerHandlers(mux, "/v1/fifo")
+
+		var fifos []*fifo
+		for range 2 {
+			fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+			fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+			fifo.start(func() {})
+			fifos = append(fifos, fifo)
+		}
+		slices.SortFunc(fifos, func(a, b *fifo) int {
+			return strings.Compare(a.uuid.String(), b.uuid.String())
+		})
+		blocker := newTicket("")
+		fifos[1].enqueue(blocker)
+		<-blocker.waitC
+		fifos[1].accept(blocker)
+
+		acquire := func(uuids ...uuidlib.UUID) *httptest.ResponseRecorder {
+			b, err := json.Marshal(api.FifoAcquireRequest{UUIDs: uuids, Identity: "job"})
+			require.NoError(t, err)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/fifo/acquire", strings.NewReader(string(b))))
+			return rec
+		}
+		return fifos, blocker, acquire
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		require := require.New(t)
+		fifos, _, acquire := setup(t)
+
+		require.Equal(http.StatusBadRequest, acquire().Code)
+		require.Equal(http.StatusBadRequest, acquire(fifos[0].uuid, fifos[0].uuid).Code)
+		require.Equal(http.StatusNotFound, acquire(fifos[0].uuid, uuidlib.New()).Code)
+		require.Empty(fifos[0].ticketLookup.GetAll())
+	})
+
+	t.Run("all acquired", func(t *testing.T) {
+		require := require.New(t)
+		fifos, blocker, acquire := setup(t)
+
+		recC := make(chan *httptest.ResponseRecorder)
+		go func() { recC <- acquire(fifos[1].uuid, fifos[0].uuid) }()
+
+		// The first fifo is held while waiting for the second one.
+		require.Eventually(func() bool {
+			active, ok := fifos[0].activeTicket()
+			return ok && fifos[1].position(active) < 0 && len(fifos[1].status().Queue) == 1
+		}, time.Second, 10*time.Millisecond)
+		blocker.doneC <- struct{}{}
+
+		rec := <-recC
+		require.Equal(http.StatusOK, rec.Code)
+		var resp api.FifoAcquireResponse
+		require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		require.Len(resp.Tickets, 2)
+		for i, fifo := range fifos {
+			require.Equal(fifo.uuid, resp.Tickets[i].UUID)
+			active, ok := fifo.activeTicket()
+			require.True(ok)
+			require.Equal(resp.Tickets[i].TicketID, active.TicketID)
+			require.Equal(api.TicketAccepted, fifo.status().Active.State)
+			require.Equal("job", fifo.status().Active.Identity)
+		}
+	})
+
+	t.Run("none acquired", func(t *testing.T) {
+		require := require.New(t)
+		fifos, _, acquire := setup(t)
+
+		recC := make(chan *httptest.ResponseRecorder)
+		go func() { recC <- acquire(fifos[0].uuid, fifos[1].uuid) }()
+		require.Eventually(func() bool {
+			_, ok := fifos[0].activeTicket()
+			return ok && len(fifos[1].status().Queue) == 1
+		}, time.Second, 10*time.Millisecond)
+		fifos[1].stop()
+
+		require.Equal(http.StatusGone, (<-recC).Code)
+		require.Eventually(func() bool {
+			_, ok := fifos[0].activeTicket()
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(api.OutcomeCanceled, fifos[0].recentHistory()[0].Outcome)
+	})
+}
+
+func TestHoldTicketShortDoneTimeout(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := DefaultConfig().Fifo
+	cfg.DoneTimeout = time.Nanosecond
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	require.Equal(t, minHeartbeatInterval, fifo.heartbeatInterval())
+
+	// Holding the ticket must not panic on the tiny done timeout.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(50*time.Millisecond, func() { cancel(nil) })
+	holdTicket(ctx, cancel, fifo, newTicket(""))
+}
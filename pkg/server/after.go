@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/katexochen/sync/api"
+)
+
+// maxAfter bounds the number of tickets a ticket can wait for.
+const maxAfter = 16
+
+// dependency is a ticket that must end before the ticket waiting for it is
+// notified.
+type dependency struct {
+	fifo   *fifo
+	ticket *ticket
+}
+
+// done returns a channel that is closed once the ticket ended.
+func (d dependency) done() <-chan struct{} {
+	return d.ticket.endC
+}
+
+// ended reports whether the ticket ended or its fifo was deleted.
+func (d dependency) ended() bool {
+	select {
+	case <-d.ticket.endC:
+		return true
+	case <-d.fifo.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d dependency) ref() api.FifoTicketRef {
+	return api.FifoTicketRef{UUID: d.fifo.uuid, TicketID: d.ticket.TicketID}
+}
+
+// pendingAfter returns the dependencies of the ticket that didn't end yet.
+func (t *ticket) pendingAfter() []dependency {
+	var pending []dependency
+	for _, d := range t.after {
+		if !d.ended() {
+			pending = append(pending, d)
+		}
+	}
+	return pending
+}
+
+// resolveAfter returns the dependencies on the referenced tickets of fifos in
+// the namespace, which are looked up by their key. Tickets that already ended
+// are forgotten by their fifo and skipped, just as tickets of fifos that are
+// gone.
+func resolveAfter(lookup func(key string) (*fifo, bool), namespace string, refs []api.FifoTicketRef) ([]dependency, error) {
+	if len(refs) > maxAfter {
+		return nil, fmt.Errorf("a ticket can wait for at most %d tickets", maxAfter)
+	}
+	var deps []dependency
+	for _, ref := range refs {
+		fifo, ok := lookup(fifoKey(namespace, ref.UUID.String()))
+		if !ok {
+			continue
+		}
+		t, ok := fifo.ticketLookup.Get(ref.TicketID.String())
+		if !ok {
+			continue
+		}
+		deps = append(deps, dependency{fifo: fifo, ticket: t})
+	}
+	return deps, nil
+}
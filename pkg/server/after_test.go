@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTicketAfter(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+
+	db := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.run(fifoKey(db.namespace, db.uuid.String()), db)
+	deploy := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.run(fifoKey(deploy.namespace, deploy.uuid.String()), deploy)
+
+	// takeTicket queues a ticket in the deploy fifo after the tickets.
+	takeTicket := func(after ...api.FifoTicketRef) (*ticket, int) {
+		b, err := json.Marshal(api.FifoTicketRequest{After: after})
+		require.NoError(err)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/fifo/"+deploy.uuid.String()+"/ticket", strings.NewReader(string(b))))
+		if rec.Code != http.StatusOK {
+			return nil, rec.Code
+		}
+		var resp api.FifoTicketResponse
+		require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		tick, ok := deploy.ticketLookup.Get(resp.TicketID.String())
+		require.True(ok)
+		return tick, rec.Code
+	}
+
+	_, code := takeTicket(make([]api.FifoTicketRef, maxAfter+1)...)
+	require.Equal(http.StatusBadRequest, code)
+
+	migration := newTicket("")
+	db.enqueue(migration)
+	dbRef := api.FifoTicketRef{UUID: db.uuid, TicketID: migration.TicketID}
+	unknownRef := api.FifoTicketRef{UUID: db.uuid, TicketID: uuidlib.New()}
+	api1, _ := takeTicket(dbRef, unknownRef)
+	api2, _ := takeTicket()
+
+	// The ticket holds up the queue until the migration is done.
+	status := deploy.status()
+	require.Len(status.Queue, 2)
+	require.Equal([]api.FifoTicketRef{dbRef}, status.Queue[0].After)
+	<-migration.waitC
+	db.accept(migration)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(0, deploy.position(api1))
+
+	migration.doneC <- struct{}{}
+	<-api1.waitC
+	require.Empty(deploy.status().Active.After)
+	deploy.accept(api1)
+	api1.doneC <- struct{}{}
+	<-api2.waitC
+
+	// Tickets that already ended are ignored.
+	api3, _ := takeTicket(dbRef)
+	require.Empty(api3.after)
+
+	// A deleted fifo doesn't hold up tickets waiting for its tickets.
+	blocked := newTicket("")
+	db.enqueue(blocked)
+	deploy.accept(api2)
+	api4, _ := takeTicket(api.FifoTicketRef{UUID: db.uuid, TicketID: blocked.TicketID})
+	api2.doneC <- struct{}{}
+	<-api3.waitC
+	deploy.accept(api3)
+	api3.doneC <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(0, deploy.position(api4))
+	db.stop()
+	<-api4.waitC
+}
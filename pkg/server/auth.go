@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/katexochen/sync/internal/oidc"
+)
+
+// authenticator requires a bearer token on all requests. Tokens are either
+// one of the static API tokens or a JWT issued by the configured OIDC issuer.
+type authenticator struct {
+	tokens        []staticToken
+	verifier      *oidc.Verifier
+	identityClaim string
+	log           *slog.Logger
+}
+
+// staticToken is an API token, optionally restricted to a set of namespaces.
+type staticToken struct {
+	secret     []byte
+	namespaces []string
+}
+
+func newAuthenticator(tokens []staticToken, log *slog.Logger) *authenticator {
+	return &authenticator{
+		tokens: tokens,
+		log:    log.WithGroup("auth"),
+	}
+}
+
+// withOIDC additionally accepts JWTs of the given issuer and audience.
+// The identityClaim of the token is recorded as the client identity.
+func (a *authenticator) withOIDC(issuer, audience, identityClaim string) *authenticator {
+	a.verifier = oidc.NewVerifier(issuer, audience)
+	a.identityClaim = identityClaim
+	return a
+}
+
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.authenticate(r)
+		if err != nil {
+			a.log.Warn("unauthorized request", "path", r.URL.Path, "remote", r.RemoteAddr, "err", err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// authenticate validates the bearer token of the request and returns
+// the principal it belongs to.
+func (a *authenticator) authenticate(r *http.Request) (principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return principal{}, errors.New("missing bearer token")
+	}
+	if t, ok := a.matchStatic(token); ok {
+		return principal{namespaces: t.namespaces}, nil
+	}
+	if a.verifier == nil {
+		return principal{}, errors.New("invalid token")
+	}
+	claims, err := a.verifier.Verify(r.Context(), token)
+	if err != nil {
+		return principal{}, fmt.Errorf("verifying token: %w", err)
+	}
+	identity, ok := claims.String(a.identityClaim)
+	if !ok || identity == "" {
+		return principal{}, fmt.Errorf("token has no %q claim", a.identityClaim)
+	}
+	return principal{identity: identity}, nil
+}
+
+func (a *authenticator) matchStatic(token string) (staticToken, bool) {
+	var match staticToken
+	var valid bool
+	for _, t := range a.tokens {
+		// Compare against all tokens to not leak which one matched.
+		if subtle.ConstantTimeCompare([]byte(token), t.secret) == 1 {
+			match = t
+			valid = true
+		}
+	}
+	return match, valid
+}
+
+// principal is the authenticated client of a request.
+type principal struct {
+	// identity of the client, if known.
+	identity string
+	// namespaces the client may access, nil means all.
+	namespaces []string
+}
+
+func (p principal) mayAccess(namespace string) bool {
+	return p.namespaces == nil || slices.Contains(p.namespaces, namespace)
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the principal of the request. Without authentication,
+// the zero principal is returned which may access all namespaces.
+func principalFrom(ctx context.Context) principal {
+	p, _ := ctx.Value(principalKey{}).(principal)
+	return p
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// requireAdmin only passes requests bearing the admin token.
+func requireAdmin(token string, log *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := bearerToken(r)
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				log.Warn("unauthorized admin request", "path", r.URL.Path, "remote", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseTokens returns the static tokens of the secrets, skipping empty ones.
+// These tokens may access all namespaces.
+func parseTokens(secrets []string) []staticToken {
+	var tokens []staticToken
+	for _, t := range secrets {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, staticToken{secret: []byte(t)})
+		}
+	}
+	return tokens
+}
+
+// readTokenFile reads one token per line, ignoring empty lines and
+// lines starting with '#'. A token can be followed by a comma separated
+// list of namespaces it is restricted to, e.g. "s3cr3t team-a,team-b".
+func readTokenFile(path string) ([]staticToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening token file: %w", err)
+	}
+	defer f.Close()
+
+	var tokens []staticToken
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		t := staticToken{secret: []byte(fields[0])}
+		if len(fields) > 1 {
+			t.namespaces = strings.Split(fields[1], ",")
+		}
+		tokens = append(tokens, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading token file: %w", err)
+	}
+	return tokens, nil
+}
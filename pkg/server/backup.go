@@ -0,0 +1,280 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// backup returns a snapshot of all fifos. Each fifo is consistent in itself.
+func (s *fifoManager) backup() api.Backup {
+	b := api.Backup{
+		Version: api.BackupVersion,
+		Time:    time.Now(),
+		Fifos:   []api.FifoBackup{},
+	}
+	for _, fifo := range s.fifos.GetAll() {
+		b.Fifos = append(b.Fifos, fifo.backup())
+	}
+	return b
+}
+
+func (f *fifo) backup() api.FifoBackup {
+	history := f.recentHistory()
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	b := api.FifoBackup{
+		Namespace:            f.namespace,
+		UUID:                 f.uuid,
+		OwnerSecret:          f.ownerSecret,
+		Name:                 f.name,
+		WaitTimeout:          f.waitTimeout.String(),
+		DoneTimeout:          f.doneTimeout.String(),
+		UnusedDestroyTimeout: f.unusedDestroyTimeout.String(),
+		Webhook:              f.webhookURL,
+		WebhookSecret:        f.webhookSecret,
+		WebhookEvents:        f.webhookEvents,
+		WaiterPolicy:         f.waiterPolicy,
+		Tickets:              []api.TicketBackup{},
+		History:              history,
+	}
+	tickets := f.queue
+	if f.active != nil {
+		tickets = append([]*ticket{f.active}, tickets...)
+	}
+	for _, t := range tickets {
+		tb := api.TicketBackup{
+			TicketID:  t.TicketID,
+			Secret:    t.Secret,
+			Identity:  t.identity,
+			TraceID:   t.traceID,
+			State:     t.state,
+			CreatedAt: t.createdAt,
+		}
+		if notifiedAt := t.notifiedAt; !notifiedAt.IsZero() {
+			tb.NotifiedAt = &notifiedAt
+		}
+		if acceptedAt := t.acceptedAt; !acceptedAt.IsZero() {
+			tb.AcceptedAt = &acceptedAt
+		}
+		for _, d := range t.pendingAfter() {
+			tb.After = append(tb.After, d.ref())
+		}
+		b.Tickets = append(b.Tickets, tb)
+	}
+	return b
+}
+
+var (
+	// errFifoExists is returned when restoring a fifo that already exists.
+	errFifoExists = errors.New("fifo already exists")
+	// errNameTaken is returned when restoring a fifo whose name is taken by
+	// another fifo.
+	errNameTaken = errors.New("fifo name is taken")
+)
+
+// restore starts the fifos of the backup. An accepted ticket keeps the fifo,
+// all other tickets are queued and notified again. Inconsistencies are
+// repaired, see repairBackup. Nothing is restored if any fifo of the backup
+// is invalid, already exists or has a name that is taken.
+func (s *fifoManager) restore(b api.Backup) error {
+	if b.Version != api.BackupVersion {
+		return fmt.Errorf("unsupported backup version %d", b.Version)
+	}
+	for _, r := range repairBackup(&b) {
+		s.log.Warn("repaired backup", "repair", r)
+	}
+	s.namesMux.Lock()
+	defer s.namesMux.Unlock()
+	fifos := map[string]*fifo{}
+	names := map[string]bool{}
+	for _, fb := range b.Fifos {
+		key := fifoKey(fb.Namespace, fb.UUID.String())
+		if _, ok := s.fifos.Get(key); ok {
+			return fmt.Errorf("restoring fifo %s: %w", key, errFifoExists)
+		}
+		if fb.Name != "" {
+			nameKey := fifoKey(fb.Namespace, fb.Name)
+			if existing, ok := s.names.Get(nameKey); (ok && !existing.stopped()) || names[nameKey] {
+				return fmt.Errorf("restoring fifo %s: %w: %s", key, errNameTaken, fb.Name)
+			}
+			names[nameKey] = true
+		}
+		fifo, err := s.restoreFifo(fb)
+		if err != nil {
+			return fmt.Errorf("restoring fifo %s: %w", key, err)
+		}
+		fifos[key] = fifo
+	}
+	// Tickets can wait for tickets of any restored or running fifo.
+	lookup := func(key string) (*fifo, bool) {
+		if fifo, ok := fifos[key]; ok {
+			return fifo, true
+		}
+		return s.fifos.Get(key)
+	}
+	for _, fb := range b.Fifos {
+		fifo := fifos[fifoKey(fb.Namespace, fb.UUID.String())]
+		for _, tb := range fb.Tickets {
+			t, ok := fifo.ticketLookup.Get(tb.TicketID.String())
+			if !ok || len(tb.After) == 0 {
+				continue
+			}
+			after, err := resolveAfter(lookup, fb.Namespace, tb.After)
+			if err != nil {
+				return fmt.Errorf("restoring ticket %s: %w", tb.TicketID, err)
+			}
+			t.after = after
+		}
+	}
+	for key, fifo := range fifos {
+		s.run(key, fifo)
+		if fifo.name != "" {
+			s.names.Put(fifoKey(fifo.namespace, fifo.name), fifo)
+		}
+	}
+	s.log.Info("restored backup", "fifos", len(b.Fifos), "time", b.Time)
+	return nil
+}
+
+// restoreFifo builds the fifo of the backup with its queue. Its timeouts are
+// armed anew once it runs: an accepted ticket gets the full done timeout, the
+// owner of a notified one is notified again.
+func (s *fifoManager) restoreFifo(fb api.FifoBackup) (*fifo, error) {
+	if !validNamespace(fb.Namespace) {
+		return nil, fmt.Errorf("invalid namespace %q", fb.Namespace)
+	}
+	if fb.OwnerSecret == "" {
+		return nil, errors.New("missing owner secret")
+	}
+	if fb.Name != "" && !validName(fb.Name) {
+		return nil, fmt.Errorf("invalid name %q", fb.Name)
+	}
+	if err := validateWaiterPolicy(fb.WaiterPolicy); err != nil {
+		return nil, err
+	}
+	cfg := s.config()
+	for _, d := range []struct {
+		name  string
+		raw   string
+		value *time.Duration
+	}{
+		{"wait timeout", fb.WaitTimeout, &cfg.WaitTimeout},
+		{"done timeout", fb.DoneTimeout, &cfg.DoneTimeout},
+		{"unused destroy timeout", fb.UnusedDestroyTimeout, &cfg.UnusedDestroyTimeout},
+	} {
+		v, err := time.ParseDuration(d.raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", d.name, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("%s must be positive", d.name)
+		}
+		*d.value = v
+	}
+
+	f := newFifo(fb.Namespace, cfg, s.webhooks, fb.Webhook, s.fifoLog)
+	f.waitTimes = s.waitTimes
+	f.uuid = fb.UUID
+	f.ownerSecret = fb.OwnerSecret
+	f.name = fb.Name
+	f.webhookSecret = fb.WebhookSecret
+	f.webhookEvents = fb.WebhookEvents
+	if fb.WaiterPolicy != "" {
+		f.waiterPolicy = fb.WaiterPolicy
+	}
+	f.log = fifoLogger(s.fifoLog, f.namespace, f.uuid)
+	f.history = fb.History
+
+	for i, tb := range fb.Tickets {
+		if tb.Secret == "" {
+			return nil, fmt.Errorf("ticket %s: missing secret", tb.TicketID)
+		}
+		t := newTicket(tb.Identity)
+		t.TicketID = tb.TicketID
+		t.Secret = tb.Secret
+		t.createdAt = tb.CreatedAt
+		t.traceID = tb.TraceID
+		if tb.State == api.TicketAccepted {
+			if i != 0 {
+				return nil, fmt.Errorf("ticket %s: only the first ticket can be accepted", tb.TicketID)
+			}
+			t.state = api.TicketAccepted
+			if tb.NotifiedAt != nil {
+				t.notifiedAt = *tb.NotifiedAt
+			}
+			if tb.AcceptedAt != nil {
+				t.acceptedAt = *tb.AcceptedAt
+			}
+			// The owner was notified before the backup.
+			t.waitAck()
+		}
+		f.enqueue(t)
+	}
+	return f, nil
+}
+
+// restoreFile restores the backup in the file at path.
+func (s *fifoManager) restoreFile(path string) error {
+	b, err := readBackup(path)
+	if err != nil {
+		return err
+	}
+	return s.restore(b)
+}
+
+// readBackup decodes the backup in the file at path.
+func readBackup(path string) (api.Backup, error) {
+	var b api.Backup
+	file, err := os.Open(path)
+	if err != nil {
+		return b, fmt.Errorf("opening backup: %w", err)
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&b); err != nil {
+		return b, fmt.Errorf("decoding backup: %w", err)
+	}
+	return b, nil
+}
+
+// maxBackupBody limits the size of backups imported over the API.
+const maxBackupBody = 256 << 20
+
+// restoreHandler imports a backup into the running server.
+func (s *fifoManager) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "restore")
+	log.Info("called")
+	var b api.Backup
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBackupBody)).Decode(&b); err != nil {
+		log.Warn("decoding backup", "err", err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("decoding backup: %s", err))
+		return
+	}
+	if err := s.restore(b); errors.Is(err, errFifoExists) || errors.Is(err, errNameTaken) {
+		log.Warn("restoring backup", "err", err)
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		log.Warn("restoring backup", "err", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	encode(w, 200, api.RestoreResponse{Fifos: len(b.Fifos)})
+}
+
+// backupHandler streams a snapshot of all fifos, including their secrets.
+func (s *fifoManager) backupHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "backup")
+	log.Info("called")
+	b := s.backup()
+	if err := encode(w, 200, b); err != nil {
+		log.Warn("writing backup", "err", err)
+		return
+	}
+	log.Info("backup written", "fifos", len(b.Fifos))
+}
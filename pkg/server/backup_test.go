@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	fifo := newFifo("team-a", fm.cfg, nil, "https://example.com/hook", log)
+	fifo.webhookSecret = "hook-secret"
+	fifo.webhookEvents = []string{api.EventTicketExpired}
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	var tickets []*ticket
+	for _, identity := range []string{"alice", "bob", "carol"} {
+		tick := newTicket(identity)
+		if len(tickets) == 2 {
+			tick.after = []dependency{{fifo: fifo, ticket: tickets[1]}}
+		}
+		fifo.enqueue(tick)
+		tickets = append(tickets, tick)
+	}
+	active, ok := fifo.next()
+	require.True(ok)
+	fifo.accept(active)
+
+	// The backup survives encoding.
+	raw, err := json.Marshal(fm.backup())
+	require.NoError(err)
+	var backup api.Backup
+	require.NoError(json.Unmarshal(raw, &backup))
+
+	restored := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer restored.stopAll()
+	require.NoError(restored.restore(backup))
+	require.ErrorIs(restored.restore(backup), errFifoExists)
+
+	got, ok := restored.fifos.Get(fifoKey(fifo.namespace, fifo.uuid.String()))
+	require.True(ok)
+	require.True(got.checkOwnerSecret(fifo.ownerSecret))
+	require.Equal(fifo.webhookURL, got.webhookURL)
+	require.Equal(fifo.webhookSecret, got.webhookSecret)
+	require.Equal(fifo.webhookEvents, got.webhookEvents)
+	require.Eventually(func() bool {
+		return got.status().Active != nil
+	}, time.Second, 10*time.Millisecond)
+	status := got.status()
+	require.Equal(tickets[0].TicketID, status.Active.TicketID)
+	require.Equal(api.TicketAccepted, status.Active.State)
+	require.Equal("alice", status.Active.Identity)
+	require.Len(status.Queue, 2)
+	require.Equal(tickets[1].TicketID, status.Queue[0].TicketID)
+	require.Equal([]api.FifoTicketRef{{UUID: fifo.uuid, TicketID: tickets[1].TicketID}}, status.Queue[1].After)
+
+	// The accepted ticket can be done right away with its old secret.
+	restoredActive, ok := got.ticketLookup.Get(tickets[0].TicketID.String())
+	require.True(ok)
+	require.True(restoredActive.checkSecret(tickets[0].Secret))
+	select {
+	case restoredActive.doneC <- struct{}{}:
+	case <-time.After(time.Second):
+		require.FailNow("restored ticket not accepting done")
+	}
+	require.Eventually(func() bool {
+		active := got.status().Active
+		return active != nil && active.TicketID == tickets[1].TicketID && active.State == api.TicketNotified
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRestoreRearmsTimeouts(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	cfg.WaitTimeout = 50 * time.Millisecond
+	cfg.DoneTimeout = 50 * time.Millisecond
+	cfg.AcceptRetries = 0
+	fm := newFifoManager(cfg, nil, log)
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	for _, identity := range []string{"alice", "bob"} {
+		fifo.enqueue(newTicket(identity))
+	}
+	active, ok := fifo.next()
+	require.True(ok)
+	fifo.accept(active)
+	backup := fm.backup()
+
+	// The timeouts start anew with the restore. The accepted ticket expires
+	// without heartbeats and the next one is notified.
+	restored := newFifoManager(cfg, nil, log)
+	defer restored.stopAll()
+	require.NoError(restored.restore(backup))
+	got, ok := restored.fifos.Get(fifoKey(fifo.namespace, fifo.uuid.String()))
+	require.True(ok)
+	require.Eventually(func() bool {
+		return len(got.recentHistory()) == 2
+	}, time.Second, 10*time.Millisecond)
+	history := got.recentHistory()
+	require.Equal("alice", history[0].Identity)
+	require.Equal(api.OutcomeDoneTimeout, history[0].Outcome)
+	require.Equal("bob", history[1].Identity)
+	require.Equal(api.OutcomeWaitTimeout, history[1].Outcome)
+	require.NotNil(history[1].NotifiedAt)
+}
+
+func TestRestoreNamedFifo(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// newNamed gets or creates the fifo with the name, like sync lock.
+	newNamed := func(fm *fifoManager, name string) api.FifoNewResponse {
+		mux := http.NewServeMux()
+		fm.registerHandlers(mux, "/v1/fifo")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/fifo/new", strings.NewReader(`{"name": "`+name+`"}`)))
+		require.Equal(http.StatusOK, rec.Code)
+		var resp api.FifoNewResponse
+		require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	created := newNamed(fm, "deploy")
+	backup := fm.backup()
+	require.Equal("deploy", backup.Fifos[0].Name)
+
+	// The restored fifo keeps its name.
+	restored := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer restored.stopAll()
+	require.NoError(restored.restore(backup))
+	got := newNamed(restored, "deploy")
+	require.True(got.Existing)
+	require.Equal(created.UUID, got.UUID)
+
+	// Nothing is restored if another fifo has the name.
+	taken := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer taken.stopAll()
+	other := newNamed(taken, "deploy")
+	require.ErrorIs(taken.restore(backup), errNameTaken)
+	_, ok := taken.fifos.Get(fifoKey(defaultNamespace, created.UUID.String()))
+	require.False(ok)
+	got = newNamed(taken, "deploy")
+	require.Equal(other.UUID, got.UUID)
+}
+
+func TestRestoreInvalidBackup(t *testing.T) {
+	require := require.New(t)
+	fm := newFifoManager(DefaultConfig().Fifo, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	require.Error(fm.restore(api.Backup{Version: 2}))
+	require.Error(fm.restore(api.Backup{Version: api.BackupVersion, Fifos: []api.FifoBackup{{
+		Namespace:            "default",
+		OwnerSecret:          "secret",
+		WaitTimeout:          "soon",
+		DoneTimeout:          "1m",
+		UnusedDestroyTimeout: "1h",
+	}}}))
+	require.Empty(fm.fifos.GetAll())
+}
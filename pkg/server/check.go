@@ -0,0 +1,93 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	"github.com/katexochen/sync/api"
+)
+
+// repairBackup fixes inconsistencies of a backup that would wedge a restored
+// fifo, as left by a crash or an edited backup. It returns a description of
+// each repair. Backups written by the server need no repairs.
+func repairBackup(b *api.Backup) []string {
+	var repairs []string
+	seenFifos := map[string]bool{}
+	fifos := make([]api.FifoBackup, 0, len(b.Fifos))
+	for _, fb := range b.Fifos {
+		key := fifoKey(fb.Namespace, fb.UUID.String())
+		if seenFifos[key] {
+			repairs = append(repairs, fmt.Sprintf("fifo %s: dropped duplicate", key))
+			continue
+		}
+		seenFifos[key] = true
+
+		seenTickets := map[string]bool{}
+		tickets := make([]api.TicketBackup, 0, len(fb.Tickets))
+		for _, tb := range fb.Tickets {
+			switch {
+			case seenTickets[tb.TicketID.String()]:
+				repairs = append(repairs, fmt.Sprintf("fifo %s: dropped duplicate ticket %s", key, tb.TicketID))
+				continue
+			case tb.Secret == "":
+				repairs = append(repairs, fmt.Sprintf("fifo %s: dropped ticket %s without secret", key, tb.TicketID))
+				continue
+			case tb.State == api.TicketAccepted && len(tickets) > 0:
+				// Only the active ticket can be accepted, its owner
+				// must wait for the turn again.
+				repairs = append(repairs, fmt.Sprintf("fifo %s: requeued accepted ticket %s behind the active ticket", key, tb.TicketID))
+				tb.State = api.TicketQueued
+				tb.NotifiedAt, tb.AcceptedAt = nil, nil
+			}
+			seenTickets[tb.TicketID.String()] = true
+			tickets = append(tickets, tb)
+		}
+		fb.Tickets = tickets
+
+		// The history is pruned by binary search on the end time.
+		if !slices.IsSortedFunc(fb.History, compareEndedAt) {
+			repairs = append(repairs, fmt.Sprintf("fifo %s: sorted history", key))
+			fb.History = slices.Clone(fb.History)
+			slices.SortStableFunc(fb.History, compareEndedAt)
+		}
+		fifos = append(fifos, fb)
+	}
+	b.Fifos = fifos
+	return repairs
+}
+
+func compareEndedAt(a, b api.FifoHistoryEntry) int {
+	return cmp.Compare(a.EndedAt.UnixNano(), b.EndedAt.UnixNano())
+}
+
+// CheckRestore checks the backup the config restores on start without
+// starting a server. It writes the repairs the restore would make to out and
+// returns an error if the backup can't be restored.
+func CheckRestore(cfg *Config, out io.Writer) error {
+	if cfg.Restore == "" {
+		return errors.New("nothing to check, no backup to restore is configured")
+	}
+	b, err := readBackup(cfg.Restore)
+	if err != nil {
+		return err
+	}
+	if b.Version != api.BackupVersion {
+		return fmt.Errorf("unsupported backup version %d", b.Version)
+	}
+	repairs := repairBackup(&b)
+	for _, r := range repairs {
+		fmt.Fprintln(out, r)
+	}
+	fm := newFifoManager(cfg.Fifo, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for _, fb := range b.Fifos {
+		if _, err := fm.restoreFifo(fb); err != nil {
+			return fmt.Errorf("restoring fifo %s: %w", fifoKey(fb.Namespace, fb.UUID.String()), err)
+		}
+	}
+	fmt.Fprintf(out, "backup of %d fifos can be restored with %d repairs\n", len(b.Fifos), len(repairs))
+	return nil
+}
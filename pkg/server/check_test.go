@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairBackup(t *testing.T) {
+	require := require.New(t)
+	now := time.Now()
+	ticket := func(state string) api.TicketBackup {
+		return api.TicketBackup{TicketID: uuid.New(), Secret: "secret", State: state, CreatedAt: now}
+	}
+	active, queued, accepted := ticket(api.TicketAccepted), ticket(api.TicketQueued), ticket(api.TicketAccepted)
+	accepted.AcceptedAt = &now
+	noSecret := ticket(api.TicketQueued)
+	noSecret.Secret = ""
+	fb := api.FifoBackup{
+		Namespace:            "default",
+		UUID:                 uuid.New(),
+		OwnerSecret:          "secret",
+		WaitTimeout:          "1m",
+		DoneTimeout:          "1m",
+		UnusedDestroyTimeout: "1h",
+		Tickets:              []api.TicketBackup{active, queued, queued, noSecret, accepted},
+		History: []api.FifoHistoryEntry{
+			{EndedAt: now.Add(-time.Minute)},
+			{EndedAt: now.Add(-time.Hour)},
+		},
+	}
+	b := api.Backup{Version: api.BackupVersion, Fifos: []api.FifoBackup{fb, fb}}
+
+	repairs := repairBackup(&b)
+	require.Len(repairs, 5)
+	require.Len(b.Fifos, 1)
+	tickets := b.Fifos[0].Tickets
+	require.Len(tickets, 3)
+	require.Equal(active, tickets[0])
+	require.Equal(queued, tickets[1])
+	require.Equal(accepted.TicketID, tickets[2].TicketID)
+	require.Equal(api.TicketQueued, tickets[2].State)
+	require.Nil(tickets[2].AcceptedAt)
+	require.True(b.Fifos[0].History[0].EndedAt.Before(b.Fifos[0].History[1].EndedAt))
+
+	// The repaired backup is consistent.
+	require.Empty(repairBackup(&b))
+
+	// A check reports the repairs without restoring.
+	path := filepath.Join(t.TempDir(), "backup.json")
+	raw, err := json.Marshal(api.Backup{Version: api.BackupVersion, Fifos: []api.FifoBackup{fb}})
+	require.NoError(err)
+	require.NoError(os.WriteFile(path, raw, 0o600))
+	cfg := DefaultConfig()
+	cfg.Restore = path
+	var out strings.Builder
+	require.NoError(CheckRestore(cfg, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(lines, 5)
+	require.Equal("backup of 1 fifos can be restored with 4 repairs", lines[4])
+
+	fb.WaitTimeout = "soon"
+	raw, err = json.Marshal(api.Backup{Version: api.BackupVersion, Fifos: []api.FifoBackup{fb}})
+	require.NoError(err)
+	require.NoError(os.WriteFile(path, raw, 0o600))
+	require.Error(CheckRestore(cfg, &out))
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+)
+
+// clone creates a fifo with the settings of another one, like the timeouts
+// and the webhook, optionally in another namespace and with a name. The clone
+// starts with an empty queue and history and gets its own owner secret.
+// Requires the owner secret, as the webhook secret is cloned as well.
+func (s *fifoManager) clone(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "clone", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoCloneRequest](w, r)
+	if !ok {
+		return
+	}
+	if !fifo.checkOwnerSecret(req.Secret) {
+		log.Warn("invalid owner secret")
+		writeError(w, http.StatusForbidden, "invalid owner secret")
+		return
+	}
+	ns := fifo.namespace
+	if req.Namespace != "" {
+		ns = req.Namespace
+	}
+	if !validNamespace(ns) {
+		writeError(w, http.StatusBadRequest, "invalid namespace")
+		return
+	}
+	if !principalFrom(r.Context()).mayAccess(ns) {
+		log.Warn("namespace access denied", "target", ns, "identity", principalFrom(r.Context()).identity)
+		writeError(w, http.StatusForbidden, "access to namespace denied")
+		return
+	}
+	if req.Name != "" {
+		if !validName(req.Name) {
+			log.Warn("invalid fifo name", "name", req.Name)
+			writeError(w, http.StatusBadRequest, "invalid fifo name")
+			return
+		}
+		s.namesMux.Lock()
+		defer s.namesMux.Unlock()
+		if existing, ok := s.names.Get(fifoKey(ns, req.Name)); ok && !existing.stopped() {
+			log.Warn("fifo name is taken", "target", ns, "name", req.Name, "existing", existing.uuid)
+			writeError(w, http.StatusConflict, "fifo name is taken")
+			return
+		}
+	}
+
+	b := fifo.backup()
+	b.Namespace = ns
+	b.UUID = uuidlib.New()
+	b.OwnerSecret = newSecret()
+	b.Tickets = nil
+	b.History = nil
+	clone, err := s.restoreFifo(b)
+	if err != nil {
+		log.Error("cloning fifo", "err", err)
+		writeError(w, http.StatusInternalServerError, "cloning fifo failed")
+		return
+	}
+	clone.name = req.Name
+	clone.releaseQuota, ok = s.acquireQuota(w, r, log, ns, quotaFifos)
+	if !ok {
+		return
+	}
+	s.run(fifoKey(ns, clone.uuid.String()), clone)
+	if clone.name != "" {
+		s.names.Put(fifoKey(ns, clone.name), clone)
+	}
+	log.Info("fifo cloned", "clone", clone.uuid, "target", ns)
+	encode(w, 200, api.FifoNewResponse{UUID: clone.uuid, OwnerSecret: clone.ownerSecret})
+}
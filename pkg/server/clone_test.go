@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClone(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/ns/{namespace}/fifo")
+
+	fifo := newFifo("canonical", fm.config(), nil, "https://example.com/hook", log)
+	fifo.waitTimeout = time.Minute
+	fifo.webhookSecret = "hook-secret"
+	fifo.webhookEvents = []string{api.EventTicketExpired}
+	fm.run(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	tick := newTicket("")
+	fifo.enqueue(tick)
+
+	clone := func(body string) (api.FifoNewResponse, int) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/ns/canonical/fifo/"+fifo.uuid.String()+"/clone", strings.NewReader(body)))
+		var resp api.FifoNewResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return resp, rec.Code
+	}
+
+	_, code := clone(`{"secret": "wrong"}`)
+	require.Equal(http.StatusForbidden, code)
+	_, code = clone(`{"secret": "` + fifo.ownerSecret + `", "namespace": "Invalid"}`)
+	require.Equal(http.StatusBadRequest, code)
+
+	// The clone has the settings, but neither the tickets nor the owner
+	// secret of the fifo.
+	for _, ns := range []string{"", "branch"} {
+		resp, code := clone(`{"secret": "` + fifo.ownerSecret + `", "namespace": "` + ns + `"}`)
+		require.Equal(http.StatusOK, code)
+		if ns == "" {
+			ns = fifo.namespace
+		}
+		c, ok := fm.fifos.Get(fifoKey(ns, resp.UUID.String()))
+		require.True(ok, ns)
+		require.NotEqual(fifo.uuid, c.uuid)
+		require.Equal(resp.OwnerSecret, c.ownerSecret)
+		require.NotEqual(fifo.ownerSecret, c.ownerSecret)
+		require.Equal(time.Minute, c.waitTimeout)
+		require.Equal(fifo.doneTimeout, c.doneTimeout)
+		require.Equal(fifo.webhookURL, c.webhookURL)
+		require.Equal(fifo.webhookSecret, c.webhookSecret)
+		require.Equal(fifo.webhookEvents, c.webhookEvents)
+		require.Empty(c.ticketLookup.GetAll())
+	}
+
+	// A named clone can be found by its name, which it can't take twice.
+	resp, code := clone(`{"secret": "` + fifo.ownerSecret + `", "name": "mirror"}`)
+	require.Equal(http.StatusOK, code)
+	named, ok := fm.names.Get(fifoKey(fifo.namespace, "mirror"))
+	require.True(ok)
+	require.Equal(resp.UUID, named.uuid)
+	_, code = clone(`{"secret": "` + fifo.ownerSecret + `", "name": "mirror"}`)
+	require.Equal(http.StatusConflict, code)
+	_, code = clone(`{"secret": "` + fifo.ownerSecret + `", "name": "-invalid"}`)
+	require.Equal(http.StatusBadRequest, code)
+}
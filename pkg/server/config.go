@@ -0,0 +1,507 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration. Values are taken from, in increasing
+// precedence, the defaults, the config file, environment variables and flags.
+type Config struct {
+	Listen     string     `yaml:"listen"`
+	UnixSocket string     `yaml:"unixSocket"`
+	Log        LogConfig  `yaml:"log"`
+	TLS        TLSConfig  `yaml:"tls"`
+	Auth       AuthConfig `yaml:"auth"`
+	Fifo       FifoConfig `yaml:"fifo"`
+	// Webhooks receive the events of all fifos.
+	Webhooks WebhookConfig `yaml:"webhooks"`
+	Alerts   AlertConfig   `yaml:"alerts"`
+	// RateLimit limits the request rate per client.
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+	// AdminListen is a TCP address to serve the admin API on instead of the
+	// listen addresses, so it can be firewalled separately.
+	AdminListen string `yaml:"adminListen"`
+	// Docs enables the Swagger UI under /docs.
+	Docs bool `yaml:"docs"`
+	// Metrics enables gauges of the fifos in the Prometheus text format
+	// under /metrics. They are served with the admin API and require the
+	// admin token.
+	Metrics bool `yaml:"metrics"`
+	// Restore is the path of a backup to restore on start.
+	Restore string `yaml:"restore"`
+	// Check only checks the backup to restore instead of serving, see
+	// CheckRestore.
+	Check bool `yaml:"-"`
+}
+
+type LogConfig struct {
+	// Level is one of debug, info, warn, error.
+	Level string `yaml:"level"`
+	// Format is one of text, json.
+	Format string `yaml:"format"`
+}
+
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"clientCA"`
+}
+
+type AuthConfig struct {
+	TokenFile string     `yaml:"tokenFile"`
+	OIDC      OIDCConfig `yaml:"oidc"`
+	// AdminToken enables the admin API under /v1/admin for clients
+	// presenting it as bearer token.
+	AdminToken string `yaml:"adminToken"`
+}
+
+type OIDCConfig struct {
+	Issuer        string `yaml:"issuer"`
+	Audience      string `yaml:"audience"`
+	IdentityClaim string `yaml:"identityClaim"`
+}
+
+type WebhookConfig struct {
+	URLs []string `yaml:"urls"`
+	// Secret signs the payloads.
+	Secret string `yaml:"secret"`
+}
+
+type RateLimitConfig struct {
+	// Rate is the sustained number of requests per second, zero disables
+	// the rate limit.
+	Rate float64 `yaml:"rate"`
+	// Burst is the number of requests a client may make at once.
+	Burst int `yaml:"burst"`
+}
+
+// AlertConfig configures the alerts raised for stuck fifos. Alerts are
+// logged and delivered to the webhooks.
+type AlertConfig struct {
+	// ActiveThreshold raises an alert if a ticket is active longer, zero
+	// disables the alert.
+	ActiveThreshold time.Duration `yaml:"activeThreshold"`
+	// QueueLimit raises an alert if more tickets are queued, zero disables
+	// the alert.
+	QueueLimit int `yaml:"queueLimit"`
+	// Deadlocks raises an alert for clients waiting for each other in a
+	// cycle. With BreakDeadlocks, the youngest waiting ticket of a cycle
+	// that persists until the next check is canceled.
+	Deadlocks      bool `yaml:"deadlocks"`
+	BreakDeadlocks bool `yaml:"breakDeadlocks"`
+	// Interval is the time between two checks of all fifos.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// FifoConfig holds the default timeouts of fifos and the maximum values
+// clients may override them with.
+type FifoConfig struct {
+	WaitTimeout             time.Duration `yaml:"waitTimeout"`
+	DoneTimeout             time.Duration `yaml:"doneTimeout"`
+	UnusedDestroyTimeout    time.Duration `yaml:"unusedDestroyTimeout"`
+	MaxWaitTimeout          time.Duration `yaml:"maxWaitTimeout"`
+	MaxDoneTimeout          time.Duration `yaml:"maxDoneTimeout"`
+	MaxUnusedDestroyTimeout time.Duration `yaml:"maxUnusedDestroyTimeout"`
+	// MinWaitTimeout, MinDoneTimeout and MinUnusedDestroyTimeout are the
+	// lowest timeouts clients may set, so fifos can't be created with
+	// timeouts their owners can't possibly meet.
+	MinWaitTimeout          time.Duration `yaml:"minWaitTimeout"`
+	MinDoneTimeout          time.Duration `yaml:"minDoneTimeout"`
+	MinUnusedDestroyTimeout time.Duration `yaml:"minUnusedDestroyTimeout"`
+	// HistoryRetention is how long ended tickets are kept in the history,
+	// zero disables the history.
+	HistoryRetention time.Duration `yaml:"historyRetention"`
+	// DeletedRetention is how long deleted fifos can be undeleted, zero
+	// deletes them right away.
+	DeletedRetention time.Duration `yaml:"deletedRetention"`
+	// GCInterval is the time between two sweeps of the history of all
+	// fifos, zero disables the periodic sweep. Histories are also pruned
+	// when read and by the admin API.
+	GCInterval time.Duration `yaml:"gcInterval"`
+	// AcceptRetries is the number of times a notified ticket whose owner
+	// missed the wait timeout is notified again, each time giving the owner
+	// AcceptGrace to call wait, before the ticket expires.
+	AcceptRetries int           `yaml:"acceptRetries"`
+	AcceptGrace   time.Duration `yaml:"acceptGrace"`
+	// MaxWaiters limits the concurrent wait requests per fifo and
+	// MaxTotalWaiters those on all fifos, zero means unlimited.
+	MaxWaiters      int `yaml:"maxWaiters"`
+	MaxTotalWaiters int `yaml:"maxTotalWaiters"`
+	// ClientQuota limits each client, identified by its authenticated
+	// identity or else its IP address, and NamespaceQuota each namespace.
+	ClientQuota    QuotaConfig `yaml:"clientQuota"`
+	NamespaceQuota QuotaConfig `yaml:"namespaceQuota"`
+}
+
+// QuotaConfig limits the resources a client or namespace holds at once, zero
+// means unlimited.
+type QuotaConfig struct {
+	// Fifos is the number of fifos created that still exist.
+	Fifos int `yaml:"fifos"`
+	// Tickets is the number of tickets that haven't ended.
+	Tickets int `yaml:"tickets"`
+	// Waits is the number of concurrent wait requests.
+	Waits int `yaml:"waits"`
+}
+
+// DefaultConfig returns the configuration of a server with no settings.
+func DefaultConfig() *Config {
+	return &Config{
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Auth: AuthConfig{
+			OIDC: OIDCConfig{IdentityClaim: "sub"},
+		},
+		Fifo: FifoConfig{
+			WaitTimeout:             time.Minute,
+			DoneTimeout:             10 * time.Minute,
+			UnusedDestroyTimeout:    30 * 24 * time.Hour,
+			MaxWaitTimeout:          time.Hour,
+			MaxDoneTimeout:          24 * time.Hour,
+			MaxUnusedDestroyTimeout: 90 * 24 * time.Hour,
+			MinWaitTimeout:          time.Second,
+			MinDoneTimeout:          time.Second,
+			MinUnusedDestroyTimeout: time.Second,
+			HistoryRetention:        24 * time.Hour,
+			DeletedRetention:        7 * 24 * time.Hour,
+			GCInterval:              5 * time.Minute,
+			AcceptGrace:             10 * time.Second,
+		},
+		Alerts: AlertConfig{
+			Interval: 30 * time.Second,
+		},
+		RateLimit: RateLimitConfig{
+			Burst: 20,
+		},
+	}
+}
+
+// LoadConfig parses the command line arguments, the config file and the
+// environment into a config.
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("SYNC_CONFIG"), "path of a YAML config file")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "TCP address to listen on (default \":8080\" unless unix-socket is set)")
+	fs.StringVar(&cfg.UnixSocket, "unix-socket", cfg.UnixSocket, "path of a unix domain socket to listen on")
+	fs.StringVar(&cfg.AdminListen, "admin-listen", cfg.AdminListen, "TCP address to serve the admin API on instead of the listen addresses")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "log level: debug, info, warn, error")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "log format: text, json")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "certificate file, enables HTTPS")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "key file of the certificate")
+	fs.StringVar(&cfg.TLS.ClientCA, "tls-client-ca", cfg.TLS.ClientCA, "CA file to verify client certificates, enables mutual TLS")
+	fs.StringVar(&cfg.Auth.TokenFile, "token-file", cfg.Auth.TokenFile, "file with one API token per line, enables authentication")
+	fs.StringVar(&cfg.Auth.OIDC.Issuer, "oidc-issuer", cfg.Auth.OIDC.Issuer, "accept JWTs of this OIDC issuer, enables authentication")
+	fs.StringVar(&cfg.Auth.OIDC.Audience, "oidc-audience", cfg.Auth.OIDC.Audience, "audience JWTs must be issued for")
+	fs.StringVar(&cfg.Auth.OIDC.IdentityClaim, "oidc-identity-claim", cfg.Auth.OIDC.IdentityClaim, "JWT claim used as client identity")
+	fs.StringVar(&cfg.Auth.AdminToken, "admin-token", cfg.Auth.AdminToken, "bearer token of the admin API, enables it")
+	fs.DurationVar(&cfg.Fifo.WaitTimeout, "wait-timeout", cfg.Fifo.WaitTimeout, "time a notified ticket owner has to call wait")
+	fs.DurationVar(&cfg.Fifo.DoneTimeout, "done-timeout", cfg.Fifo.DoneTimeout, "time a ticket owner has to call done or heartbeat")
+	fs.DurationVar(&cfg.Fifo.UnusedDestroyTimeout, "unused-destroy-timeout", cfg.Fifo.UnusedDestroyTimeout, "time after which an unused fifo is deleted")
+	fs.DurationVar(&cfg.Fifo.MaxWaitTimeout, "max-wait-timeout", cfg.Fifo.MaxWaitTimeout, "maximum wait timeout clients may set")
+	fs.DurationVar(&cfg.Fifo.MaxDoneTimeout, "max-done-timeout", cfg.Fifo.MaxDoneTimeout, "maximum done timeout clients may set")
+	fs.DurationVar(&cfg.Fifo.MaxUnusedDestroyTimeout, "max-unused-destroy-timeout", cfg.Fifo.MaxUnusedDestroyTimeout, "maximum unused destroy timeout clients may set")
+	fs.DurationVar(&cfg.Fifo.MinWaitTimeout, "min-wait-timeout", cfg.Fifo.MinWaitTimeout, "minimum wait timeout clients may set")
+	fs.DurationVar(&cfg.Fifo.MinDoneTimeout, "min-done-timeout", cfg.Fifo.MinDoneTimeout, "minimum done timeout clients may set")
+	fs.DurationVar(&cfg.Fifo.MinUnusedDestroyTimeout, "min-unused-destroy-timeout", cfg.Fifo.MinUnusedDestroyTimeout, "minimum unused destroy timeout clients may set")
+	fs.IntVar(&cfg.Fifo.AcceptRetries, "accept-retries", cfg.Fifo.AcceptRetries, "times a ticket whose owner missed the wait timeout is notified again before it expires")
+	fs.DurationVar(&cfg.Fifo.AcceptGrace, "accept-grace", cfg.Fifo.AcceptGrace, "time a re-notified ticket owner has to call wait")
+	fs.IntVar(&cfg.Fifo.MaxWaiters, "max-waiters", cfg.Fifo.MaxWaiters, "maximum concurrent wait requests per fifo, 0 means unlimited")
+	fs.IntVar(&cfg.Fifo.MaxTotalWaiters, "max-total-waiters", cfg.Fifo.MaxTotalWaiters, "maximum concurrent wait requests on all fifos, 0 means unlimited")
+	fs.IntVar(&cfg.Fifo.ClientQuota.Fifos, "client-quota-fifos", cfg.Fifo.ClientQuota.Fifos, "maximum existing fifos created per client, 0 means unlimited")
+	fs.IntVar(&cfg.Fifo.ClientQuota.Tickets, "client-quota-tickets", cfg.Fifo.ClientQuota.Tickets, "maximum open tickets per client, 0 means unlimited")
+	fs.IntVar(&cfg.Fifo.ClientQuota.Waits, "client-quota-waits", cfg.Fifo.ClientQuota.Waits, "maximum concurrent wait requests per client, 0 means unlimited")
+	fs.IntVar(&cfg.Fifo.NamespaceQuota.Fifos, "namespace-quota-fifos", cfg.Fifo.NamespaceQuota.Fifos, "maximum existing fifos created per namespace, 0 means unlimited")
+	fs.IntVar(&cfg.Fifo.NamespaceQuota.Tickets, "namespace-quota-tickets", cfg.Fifo.NamespaceQuota.Tickets, "maximum open tickets per namespace, 0 means unlimited")
+	fs.IntVar(&cfg.Fifo.NamespaceQuota.Waits, "namespace-quota-waits", cfg.Fifo.NamespaceQuota.Waits, "maximum concurrent wait requests per namespace, 0 means unlimited")
+	fs.DurationVar(&cfg.Fifo.HistoryRetention, "history-retention", cfg.Fifo.HistoryRetention, "time ended tickets are kept in the history of a fifo, 0 disables it")
+	fs.DurationVar(&cfg.Fifo.DeletedRetention, "deleted-retention", cfg.Fifo.DeletedRetention, "time a deleted fifo can be undeleted by its owner, 0 disables it")
+	fs.DurationVar(&cfg.Fifo.GCInterval, "gc-interval", cfg.Fifo.GCInterval, "time between two sweeps of expired history entries, 0 disables it")
+	fs.Var((*stringList)(&cfg.Webhooks.URLs), "webhook-urls", "comma separated URLs that receive the events of all fifos")
+	fs.StringVar(&cfg.Webhooks.Secret, "webhook-secret", cfg.Webhooks.Secret, "secret to sign webhook payloads with")
+	fs.Float64Var(&cfg.RateLimit.Rate, "rate-limit", cfg.RateLimit.Rate, "requests per second per client, 0 disables the rate limit")
+	fs.IntVar(&cfg.RateLimit.Burst, "rate-limit-burst", cfg.RateLimit.Burst, "requests a client may make at once")
+	fs.DurationVar(&cfg.Alerts.ActiveThreshold, "alert-active-threshold", cfg.Alerts.ActiveThreshold, "alert if a ticket is active longer, 0 disables it")
+	fs.IntVar(&cfg.Alerts.QueueLimit, "alert-queue-limit", cfg.Alerts.QueueLimit, "alert if more tickets are queued in a fifo, 0 disables it")
+	fs.BoolVar(&cfg.Alerts.Deadlocks, "alert-deadlocks", cfg.Alerts.Deadlocks, "alert if clients wait for each other in a cycle")
+	fs.BoolVar(&cfg.Alerts.BreakDeadlocks, "break-deadlocks", cfg.Alerts.BreakDeadlocks, "cancel the youngest waiting ticket of a persisting deadlock")
+	fs.DurationVar(&cfg.Alerts.Interval, "alert-interval", cfg.Alerts.Interval, "time between two checks for alerts")
+	fs.BoolVar(&cfg.Docs, "docs", cfg.Docs, "serve a Swagger UI of the API under /docs")
+	fs.BoolVar(&cfg.Metrics, "metrics", cfg.Metrics, "serve gauges of the fifos for Prometheus under /metrics of the admin API")
+	fs.StringVar(&cfg.Restore, "restore", cfg.Restore, "path of a backup to restore on start")
+	fs.BoolVar(&cfg.Check, "check", cfg.Check, "check the backup to restore and report the repairs it needs, without serving")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Remember explicitly set flags, they take precedence over file and env.
+	setFlags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	if *configFile != "" {
+		if err := readConfigFile(*configFile, cfg); err != nil {
+			return nil, err
+		}
+	}
+	for name, env := range envVars {
+		if v, ok := os.LookupEnv(env); ok {
+			if err := fs.Set(name, v); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", env, err)
+			}
+		}
+	}
+	for name, v := range setFlags {
+		if err := fs.Set(name, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Listen == "" && cfg.UnixSocket == "" {
+		cfg.Listen = ":8080"
+	}
+	return cfg, cfg.validate()
+}
+
+// envVars maps flag names to the environment variables that can set them.
+var envVars = map[string]string{
+	"listen":                     "SYNC_LISTEN",
+	"unix-socket":                "SYNC_UNIX_SOCKET",
+	"admin-listen":               "SYNC_ADMIN_LISTEN",
+	"log-level":                  "SYNC_LOG_LEVEL",
+	"log-format":                 "SYNC_LOG_FORMAT",
+	"tls-cert":                   "SYNC_TLS_CERT",
+	"tls-key":                    "SYNC_TLS_KEY",
+	"tls-client-ca":              "SYNC_TLS_CLIENT_CA",
+	"token-file":                 "SYNC_TOKEN_FILE",
+	"oidc-issuer":                "SYNC_OIDC_ISSUER",
+	"oidc-audience":              "SYNC_OIDC_AUDIENCE",
+	"oidc-identity-claim":        "SYNC_OIDC_IDENTITY_CLAIM",
+	"admin-token":                "SYNC_ADMIN_TOKEN",
+	"wait-timeout":               "SYNC_WAIT_TIMEOUT",
+	"done-timeout":               "SYNC_DONE_TIMEOUT",
+	"unused-destroy-timeout":     "SYNC_UNUSED_DESTROY_TIMEOUT",
+	"max-wait-timeout":           "SYNC_MAX_WAIT_TIMEOUT",
+	"max-done-timeout":           "SYNC_MAX_DONE_TIMEOUT",
+	"max-unused-destroy-timeout": "SYNC_MAX_UNUSED_DESTROY_TIMEOUT",
+	"min-wait-timeout":           "SYNC_MIN_WAIT_TIMEOUT",
+	"min-done-timeout":           "SYNC_MIN_DONE_TIMEOUT",
+	"min-unused-destroy-timeout": "SYNC_MIN_UNUSED_DESTROY_TIMEOUT",
+	"accept-retries":             "SYNC_ACCEPT_RETRIES",
+	"accept-grace":               "SYNC_ACCEPT_GRACE",
+	"max-waiters":                "SYNC_MAX_WAITERS",
+	"max-total-waiters":          "SYNC_MAX_TOTAL_WAITERS",
+	"client-quota-fifos":         "SYNC_CLIENT_QUOTA_FIFOS",
+	"client-quota-tickets":       "SYNC_CLIENT_QUOTA_TICKETS",
+	"client-quota-waits":         "SYNC_CLIENT_QUOTA_WAITS",
+	"namespace-quota-fifos":      "SYNC_NAMESPACE_QUOTA_FIFOS",
+	"namespace-quota-tickets":    "SYNC_NAMESPACE_QUOTA_TICKETS",
+	"namespace-quota-waits":      "SYNC_NAMESPACE_QUOTA_WAITS",
+	"history-retention":          "SYNC_HISTORY_RETENTION",
+	"deleted-retention":          "SYNC_DELETED_RETENTION",
+	"gc-interval":                "SYNC_GC_INTERVAL",
+	"webhook-urls":               "SYNC_WEBHOOK_URLS",
+	"webhook-secret":             "SYNC_WEBHOOK_SECRET",
+	"rate-limit":                 "SYNC_RATE_LIMIT",
+	"rate-limit-burst":           "SYNC_RATE_LIMIT_BURST",
+	"alert-active-threshold":     "SYNC_ALERT_ACTIVE_THRESHOLD",
+	"alert-queue-limit":          "SYNC_ALERT_QUEUE_LIMIT",
+	"alert-deadlocks":            "SYNC_ALERT_DEADLOCKS",
+	"break-deadlocks":            "SYNC_BREAK_DEADLOCKS",
+	"alert-interval":             "SYNC_ALERT_INTERVAL",
+	"docs":                       "SYNC_DOCS",
+	"metrics":                    "SYNC_METRICS",
+	"restore":                    "SYNC_RESTORE",
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening config file: %w", err)
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("decoding config file: %w", err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.TLS.Cert == "" && c.TLS.ClientCA != "" {
+		return errors.New("tls client CA requires tls cert and key")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls cert and key must be set together")
+	}
+	if c.AdminListen != "" && c.Auth.AdminToken == "" {
+		return errors.New("admin listen requires an admin token")
+	}
+	if c.Metrics && c.Auth.AdminToken == "" {
+		return errors.New("metrics require an admin token")
+	}
+	if c.Auth.OIDC.Issuer != "" && c.Auth.OIDC.Audience == "" {
+		return errors.New("oidc audience must be set when using an oidc issuer")
+	}
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		return err
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("unknown log format %q", c.Log.Format)
+	}
+	if len(c.Webhooks.URLs) > 0 && c.Webhooks.Secret == "" {
+		return errors.New("webhook secret must be set when using webhooks")
+	}
+	for _, u := range c.Webhooks.URLs {
+		if err := validateWebhookURL(u); err != nil {
+			return err
+		}
+	}
+	if c.RateLimit.Rate < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+	if c.RateLimit.Rate > 0 && c.RateLimit.Burst < 1 {
+		return errors.New("rate limit burst must be at least 1")
+	}
+	if c.Alerts.ActiveThreshold < 0 || c.Alerts.QueueLimit < 0 {
+		return errors.New("alert thresholds must not be negative")
+	}
+	if c.Alerts.Interval <= 0 {
+		return errors.New("alert interval must be positive")
+	}
+	if c.Alerts.BreakDeadlocks && !c.Alerts.Deadlocks {
+		return errors.New("breaking deadlocks requires deadlock alerts")
+	}
+	if c.Fifo.AcceptRetries < 0 {
+		return errors.New("accept retries must not be negative")
+	}
+	if c.Fifo.AcceptRetries > 0 && c.Fifo.AcceptGrace <= 0 {
+		return errors.New("accept grace must be positive when using accept retries")
+	}
+	if c.Fifo.MaxWaiters < 0 || c.Fifo.MaxTotalWaiters < 0 {
+		return errors.New("waiter limits must not be negative")
+	}
+	for _, q := range []QuotaConfig{c.Fifo.ClientQuota, c.Fifo.NamespaceQuota} {
+		if q.Fifos < 0 || q.Tickets < 0 || q.Waits < 0 {
+			return errors.New("quotas must not be negative")
+		}
+	}
+	if c.Fifo.HistoryRetention < 0 {
+		return errors.New("history retention must not be negative")
+	}
+	if c.Fifo.DeletedRetention < 0 {
+		return errors.New("deleted retention must not be negative")
+	}
+	if c.Fifo.GCInterval < 0 {
+		return errors.New("gc interval must not be negative")
+	}
+	for name, d := range map[string][3]time.Duration{
+		"wait timeout":           {c.Fifo.WaitTimeout, c.Fifo.MinWaitTimeout, c.Fifo.MaxWaitTimeout},
+		"done timeout":           {c.Fifo.DoneTimeout, c.Fifo.MinDoneTimeout, c.Fifo.MaxDoneTimeout},
+		"unused destroy timeout": {c.Fifo.UnusedDestroyTimeout, c.Fifo.MinUnusedDestroyTimeout, c.Fifo.MaxUnusedDestroyTimeout},
+	} {
+		if d[0] <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+		if d[1] <= 0 {
+			return fmt.Errorf("minimum %s must be positive", name)
+		}
+		if d[0] < d[1] {
+			return fmt.Errorf("%s %s is below its minimum %s", name, d[0], d[1])
+		}
+		if d[0] > d[2] {
+			return fmt.Errorf("%s %s exceeds its maximum %s", name, d[0], d[2])
+		}
+	}
+	return nil
+}
+
+// NewLogger returns a logger as configured and its level, which can be
+// changed while the logger is in use.
+func (c *Config) NewLogger(w io.Writer) (*slog.Logger, *slog.LevelVar) {
+	l, _ := parseLogLevel(c.Log.Level)
+	level := &slog.LevelVar{}
+	level.Set(l)
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Log.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts)), level
+	}
+	return slog.New(slog.NewTextHandler(w, opts)), level
+}
+
+// withOverrides returns the config of a single fifo, with the timeouts the
+// client requested. Overrides must be within the minimums and maximums.
+func (c FifoConfig) withOverrides(req api.FifoNewRequest) (FifoConfig, error) {
+	for _, o := range []struct {
+		param string
+		raw   string
+		value *time.Duration
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"wait_timeout", req.WaitTimeout, &c.WaitTimeout, c.MinWaitTimeout, c.MaxWaitTimeout},
+		{"done_timeout", req.DoneTimeout, &c.DoneTimeout, c.MinDoneTimeout, c.MaxDoneTimeout},
+		{"unused_destroy_timeout", req.UnusedDestroyTimeout, &c.UnusedDestroyTimeout, c.MinUnusedDestroyTimeout, c.MaxUnusedDestroyTimeout},
+	} {
+		raw := o.raw
+		if raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return FifoConfig{}, fmt.Errorf("parsing %s: %w", o.param, err)
+		}
+		if d < o.min {
+			return FifoConfig{}, fmt.Errorf("%s must be at least %s", o.param, o.min)
+		}
+		if d > o.max {
+			return FifoConfig{}, fmt.Errorf("%s must not exceed %s", o.param, o.max)
+		}
+		*o.value = d
+	}
+	return c, nil
+}
+
+// stringList is a flag of comma separated values. Setting it replaces the
+// previous values.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(s))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+listen: ":9000"
+log:
+  level: debug
+fifo:
+  waitTimeout: 2m
+  doneTimeout: 1h
+`), 0o644))
+
+	t.Run("defaults", func(t *testing.T) {
+		assert := assert.New(t)
+
+		cfg, err := LoadConfig(nil)
+		assert.NoError(err)
+		assert.Equal(":8080", cfg.Listen)
+		assert.Equal("info", cfg.Log.Level)
+		assert.Equal(time.Minute, cfg.Fifo.WaitTimeout)
+	})
+
+	t.Run("unix socket only", func(t *testing.T) {
+		assert := assert.New(t)
+
+		cfg, err := LoadConfig([]string{"-unix-socket", "/run/sync.sock"})
+		assert.NoError(err)
+		assert.Empty(cfg.Listen)
+	})
+
+	t.Run("file overrides defaults", func(t *testing.T) {
+		assert := assert.New(t)
+
+		cfg, err := LoadConfig([]string{"-config", configFile})
+		assert.NoError(err)
+		assert.Equal(":9000", cfg.Listen)
+		assert.Equal("debug", cfg.Log.Level)
+		assert.Equal(2*time.Minute, cfg.Fifo.WaitTimeout)
+		assert.Equal(time.Hour, cfg.Fifo.DoneTimeout)
+		assert.Equal(30*24*time.Hour, cfg.Fifo.UnusedDestroyTimeout)
+	})
+
+	t.Run("env overrides file", func(t *testing.T) {
+		assert := assert.New(t)
+		t.Setenv("SYNC_WAIT_TIMEOUT", "3m")
+
+		cfg, err := LoadConfig([]string{"-config", configFile})
+		assert.NoError(err)
+		assert.Equal(3*time.Minute, cfg.Fifo.WaitTimeout)
+	})
+
+	t.Run("flags override env and file", func(t *testing.T) {
+		assert := assert.New(t)
+		t.Setenv("SYNC_WAIT_TIMEOUT", "3m")
+
+		cfg, err := LoadConfig([]string{"-config", configFile, "-wait-timeout", "4m", "-listen", ":9001"})
+		assert.NoError(err)
+		assert.Equal(4*time.Minute, cfg.Fifo.WaitTimeout)
+		assert.Equal(":9001", cfg.Listen)
+	})
+
+	t.Run("webhooks", func(t *testing.T) {
+		assert := assert.New(t)
+		t.Setenv("SYNC_WEBHOOK_URLS", "https://a.example.com, https://b.example.com")
+
+		cfg, err := LoadConfig([]string{"-webhook-secret", "secret"})
+		assert.NoError(err)
+		assert.Equal([]string{"https://a.example.com", "https://b.example.com"}, cfg.Webhooks.URLs)
+	})
+
+	t.Run("unknown field in file", func(t *testing.T) {
+		badFile := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(badFile, []byte("lisen: :9000\n"), 0o644))
+
+		_, err := LoadConfig([]string{"-config", badFile})
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := LoadConfig([]string{"-log-format", "xml"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-done-timeout", "-1s"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-history-retention", "-1s"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-webhook-urls", "https://example.com/hook"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-alert-interval", "0s"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-break-deadlocks"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-max-waiters", "-1"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-namespace-quota-tickets", "-1"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-accept-retries", "1", "-accept-grace", "0s"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-rate-limit", "10", "-rate-limit-burst", "0"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-oidc-issuer", "https://issuer.example.com"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-tls-client-ca", "ca.pem"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-admin-listen", ":9090"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-metrics"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-min-done-timeout", "0s"})
+		assert.Error(err)
+		_, err = LoadConfig([]string{"-min-wait-timeout", "2m"})
+		assert.Error(err)
+	})
+}
+
+func TestFifoConfigWithOverrides(t *testing.T) {
+	cfg := DefaultConfig().Fifo
+
+	testCases := map[string]struct {
+		req     api.FifoNewRequest
+		want    FifoConfig
+		wantErr bool
+	}{
+		"no overrides": {
+			want: cfg,
+		},
+		"overrides within limits": {
+			req: api.FifoNewRequest{WaitTimeout: "5m", UnusedDestroyTimeout: "1h"},
+			want: func() FifoConfig {
+				c := cfg
+				c.WaitTimeout = 5 * time.Minute
+				c.UnusedDestroyTimeout = time.Hour
+				return c
+			}(),
+		},
+		"exceeds maximum": {
+			req:     api.FifoNewRequest{DoneTimeout: "25h"},
+			wantErr: true,
+		},
+		"not positive": {
+			req:     api.FifoNewRequest{WaitTimeout: "0s"},
+			wantErr: true,
+		},
+		"below minimum": {
+			req:     api.FifoNewRequest{DoneTimeout: "1ns"},
+			wantErr: true,
+		},
+		"at minimum": {
+			req: api.FifoNewRequest{DoneTimeout: "1s"},
+			want: func() FifoConfig {
+				c := cfg
+				c.DoneTimeout = time.Second
+				return c
+			}(),
+		},
+		"invalid duration": {
+			req:     api.FifoNewRequest{WaitTimeout: "soon"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := cfg.withOverrides(tc.req)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
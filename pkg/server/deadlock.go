@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// waitEdge is a client waiting with a queued ticket for a fifo held by
+// another client.
+type waitEdge struct {
+	fifo   *fifo
+	ticket api.FifoTicketInfo
+	holder string
+}
+
+// findDeadlocks returns cycles of clients waiting for each other, each as
+// the waits that close the cycle. Clients are told apart by their identity,
+// tickets without identity are ignored. Every client in a cycle is reported
+// in one cycle at most.
+func (s *fifoManager) findDeadlocks() [][]waitEdge {
+	fifos := s.fifos.GetAll()
+	slices.SortFunc(fifos, func(a, b *fifo) int {
+		return strings.Compare(fifoKey(a.namespace, a.uuid.String()), fifoKey(b.namespace, b.uuid.String()))
+	})
+	waits := map[string][]waitEdge{}
+	for _, fifo := range fifos {
+		status := fifo.status()
+		if status.Active == nil || status.Active.Identity == "" {
+			continue
+		}
+		for _, t := range status.Queue {
+			// A client can queue behind itself without waiting for anyone else.
+			if t.Identity == "" || t.Identity == status.Active.Identity {
+				continue
+			}
+			waits[t.Identity] = append(waits[t.Identity], waitEdge{fifo: fifo, ticket: t, holder: status.Active.Identity})
+		}
+	}
+
+	const (
+		unvisited = iota
+		onPath
+		visited
+	)
+	state := map[string]int{}
+	var path []waitEdge
+	var cycles [][]waitEdge
+	var visit func(identity string)
+	visit = func(identity string) {
+		state[identity] = onPath
+		for _, e := range waits[identity] {
+			switch state[e.holder] {
+			case unvisited:
+				path = append(path, e)
+				visit(e.holder)
+				path = path[:len(path)-1]
+			case onPath:
+				i := slices.IndexFunc(path, func(p waitEdge) bool { return p.ticket.Identity == e.holder })
+				cycles = append(cycles, append(slices.Clone(path[i:]), e))
+			}
+		}
+		state[identity] = visited
+	}
+	identities := make([]string, 0, len(waits))
+	for identity := range waits {
+		identities = append(identities, identity)
+	}
+	slices.Sort(identities)
+	for _, identity := range identities {
+		if state[identity] == unvisited {
+			visit(identity)
+		}
+	}
+	return cycles
+}
+
+// deadlocks returns the cycles of clients waiting for each other.
+func (s *fifoManager) deadlocks() []api.Deadlock {
+	deadlocks := []api.Deadlock{}
+	for _, cycle := range s.findDeadlocks() {
+		deadlock := api.Deadlock{}
+		for _, e := range cycle {
+			deadlock.Waits = append(deadlock.Waits, api.DeadlockWait{
+				Identity:  e.ticket.Identity,
+				Namespace: e.fifo.namespace,
+				UUID:      e.fifo.uuid,
+				TicketID:  e.ticket.TicketID,
+				Holder:    e.holder,
+			})
+		}
+		deadlocks = append(deadlocks, deadlock)
+	}
+	return deadlocks
+}
+
+// deadlocksHandler reports the cycles of clients waiting for each other.
+func (s *fifoManager) deadlocksHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "deadlocks")
+	log.Debug("called")
+	encode(w, 200, api.DeadlocksResponse{Deadlocks: s.deadlocks()})
+}
+
+// checkDeadlocks raises an alert for each wait of a deadlock. If deadlocks
+// are broken, the youngest ticket of a cycle that was already found by the
+// previous check is canceled, so its client releases what it holds.
+func (m *monitor) checkDeadlocks(now time.Time, seen map[alertID]bool) []api.FifoWebhook {
+	var raised []api.FifoWebhook
+	for _, cycle := range m.fifos.findDeadlocks() {
+		identities := make([]string, 0, len(cycle)+1)
+		for _, e := range cycle {
+			identities = append(identities, e.ticket.Identity)
+		}
+		identities = append(identities, cycle[0].ticket.Identity)
+		text := strings.Join(identities, " -> ")
+
+		youngest := cycle[0]
+		persisting := true
+		for _, e := range cycle {
+			if e.ticket.CreatedAt.After(youngest.ticket.CreatedAt) {
+				youngest = e
+			}
+			ev := api.FifoEvent{Type: api.EventFifoAlert, TicketID: e.ticket.TicketID, Identity: e.ticket.Identity, Time: now}
+			alert, ok := m.raise(e.fifo, api.FifoWebhook{
+				Alert: api.AlertDeadlock,
+				Event: &ev,
+				Text: fmt.Sprintf("fifo %s: %s waits for %s in a deadlock: %s",
+					fifoKey(e.fifo.namespace, e.fifo.uuid.String()), e.ticket.Identity, e.holder, text),
+			}, now, seen)
+			if ok {
+				raised = append(raised, alert)
+				persisting = false
+			}
+		}
+
+		if !m.cfg.BreakDeadlocks || !persisting {
+			continue
+		}
+		tick, ok := youngest.fifo.ticketLookup.Get(youngest.ticket.TicketID.String())
+		if ok && youngest.fifo.abort(tick, api.OutcomeDeadlock) {
+			m.log.Warn("deadlock broken", "namespace", youngest.fifo.namespace, "uuid", youngest.fifo.uuid.String(),
+				"ticket", tick.TicketID, "identity", youngest.ticket.Identity, "deadlock", text)
+		}
+	}
+	return raised
+}
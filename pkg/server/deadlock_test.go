@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadlocks(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	// hold returns a fifo held by the identity.
+	hold := func(identity string) *fifo {
+		fifo := newFifo(defaultNamespace, fm.cfg, nil, "", log)
+		fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+		fifo.enqueue(newTicket(identity))
+		_, ok := fifo.next()
+		require.True(ok)
+		return fifo
+	}
+	a, b, c := hold("x"), hold("y"), hold("z")
+
+	// Waiting for a fifo held by nobody else or without identity isn't a
+	// deadlock.
+	a.enqueue(newTicket("x"))
+	a.enqueue(newTicket(""))
+	b.enqueue(newTicket("x"))
+	c.enqueue(newTicket("y"))
+	require.Empty(fm.deadlocks())
+
+	// x waits for y, who waits for z, who waits for x.
+	waiting := newTicket("z")
+	a.enqueue(waiting)
+	deadlocks := fm.deadlocks()
+	require.Len(deadlocks, 1)
+	require.Len(deadlocks[0].Waits, 3)
+	for _, wait := range deadlocks[0].Waits {
+		if wait.UUID == a.uuid {
+			require.Equal(api.DeadlockWait{
+				Identity: "z", Namespace: defaultNamespace, UUID: a.uuid, TicketID: waiting.TicketID, Holder: "x",
+			}, wait)
+		}
+	}
+
+	// The deadlock is broken once it persists.
+	mon := newMonitor(AlertConfig{Deadlocks: true, BreakDeadlocks: true, Interval: time.Second}, fm, log)
+	require.True(mon.enabled())
+	alerts := mon.check(time.Now())
+	require.Len(alerts, 3)
+	require.Equal(api.AlertDeadlock, alerts[0].Alert)
+	require.Len(fm.deadlocks(), 1)
+	require.Empty(mon.check(time.Now()))
+	require.Empty(fm.deadlocks())
+	require.Equal(-1, a.position(waiting))
+	require.Equal(api.OutcomeDeadlock, a.recentHistory()[0].Outcome)
+
+	mon.check(time.Now())
+	require.Empty(mon.firing)
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+)
+
+// openAPISpec documents the HTTP API.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// registerDocs serves the OpenAPI document and, if ui is set, a Swagger UI
+// rendering it under /docs. The UI is loaded from a CDN by the browser.
+func registerDocs(mux *http.ServeMux, ui bool) {
+	mux.HandleFunc("GET /openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(openAPISpec)
+	})
+	if !ui {
+		return
+	}
+	mux.HandleFunc("GET /docs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, swaggerUI)
+	})
+}
+
+const swaggerUI = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>sync API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({url: "/openapi.yaml", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	require := require.New(t)
+
+	var spec struct {
+		Paths map[string]map[string]any `yaml:"paths"`
+	}
+	require.NoError(yaml.Unmarshal(openAPISpec, &spec))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	operations := 0
+	for _, rt := range fm.routes() {
+		path := "/v1/ns/{namespace}/fifo" + rt.path
+		_, ok := spec.Paths[path][strings.ToLower(rt.method)]
+		assert.True(t, ok, "%s %s is not documented", rt.method, path)
+		operations++
+	}
+	for _, rt := range fm.pipelineRoutes() {
+		path := "/v1/ns/{namespace}/pipeline" + rt.path
+		_, ok := spec.Paths[path][strings.ToLower(rt.method)]
+		assert.True(t, ok, "%s %s is not documented", rt.method, path)
+		operations++
+	}
+	for _, rt := range fm.queueRoutes() {
+		path := "/v1/ns/{namespace}/queue" + rt.path
+		_, ok := spec.Paths[path][strings.ToLower(rt.method)]
+		assert.True(t, ok, "%s %s is not documented", rt.method, path)
+		operations++
+	}
+	for _, rt := range newServerInfo(fm).routes() {
+		path := "/v1" + rt.path
+		_, ok := spec.Paths[path][strings.ToLower(rt.method)]
+		assert.True(t, ok, "%s %s is not documented", rt.method, path)
+		operations++
+	}
+	for _, rt := range append(fm.adminRoutes(), newLogLevel(nil, nil).routes()...) {
+		path := "/v1/admin" + rt.path
+		_, ok := spec.Paths[path][strings.ToLower(rt.method)]
+		assert.True(t, ok, "%s %s is not documented", rt.method, path)
+		operations++
+	}
+	specOperations := 0
+	for _, ops := range spec.Paths {
+		specOperations += len(ops)
+	}
+	assert.Equal(t, operations, specOperations)
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// encodeWithETag writes v like encode, with an ETag of the body, so clients
+// polling the endpoint can make the request conditional. If the ETag is in
+// the If-None-Match header of the request, it responds with 304 Not
+// Modified and no body instead. The ETag is weak, as the body may be
+// compressed.
+func encodeWithETag[T any](w http.ResponseWriter, r *http.Request, status int, v T) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode json: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	etag := `W/"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// etagMatches reports whether the If-None-Match header matches the ETag,
+// using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusETag(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.run(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+
+	status := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/fifo/"+fifo.uuid.String()+"/status", http.NoBody)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := status("")
+	require.Equal(http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(etag)
+
+	rec = status(`"other", ` + etag)
+	require.Equal(http.StatusNotModified, rec.Code)
+	require.Empty(rec.Body.Bytes())
+	require.Empty(rec.Header().Get("Content-Encoding"))
+
+	// The ETag changes with the status.
+	fifo.enqueue(newTicket(""))
+	rec = status(etag)
+	require.Equal(http.StatusOK, rec.Code)
+	require.NotEqual(etag, rec.Header().Get("ETag"))
+}
+
+func TestETagMatches(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(etagMatches(`W/"a"`, `W/"a"`))
+	assert.True(etagMatches(`"a"`, `W/"a"`))
+	assert.True(etagMatches(`"b", W/"a"`, `W/"a"`))
+	assert.True(etagMatches(`*`, `W/"a"`))
+	assert.False(etagMatches(``, `W/"a"`))
+	assert.False(etagMatches(`W/"b"`, `W/"a"`))
+}
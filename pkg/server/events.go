@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+const (
+	// maxEventLog limits the number of events logged per fifo, older ones
+	// are dropped. Events are also dropped after the history retention.
+	maxEventLog = 10000
+	// defaultEventsLimit and maxEventsLimit bound the events of a page.
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// logEvent assigns the next ID to the event and appends it to the event log.
+// Must be called with the mutex of the fifo held.
+func (f *fifo) logEvent(ev *api.FifoEvent) {
+	f.lastEventID++
+	ev.ID = f.lastEventID
+	f.events = append(f.events, *ev)
+	if len(f.events) > maxEventLog {
+		f.events = f.events[len(f.events)-maxEventLog:]
+	}
+}
+
+// eventsSince returns up to limit logged events after the cursor, whether
+// there are more and whether events after the cursor were already dropped.
+func (f *fifo) eventsSince(cursor uint64, limit int) (events []api.FifoEvent, more, truncated bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	// The IDs of the logged events have no gaps.
+	oldest := f.lastEventID - uint64(len(f.events)) + 1
+	start := 0
+	if cursor >= oldest {
+		start = int(min(cursor-oldest+1, uint64(len(f.events))))
+	}
+	end := min(start+limit, len(f.events))
+	return slices.Clone(f.events[start:end]), end < len(f.events), cursor+1 < oldest
+}
+
+// pruneEvents drops the logged events older than the history retention and
+// returns their number. Must be called with the mutex of the fifo held.
+func (f *fifo) pruneEvents(now time.Time) int {
+	cutoff := now.Add(-f.historyRetention)
+	i, _ := slices.BinarySearchFunc(f.events, cutoff, func(ev api.FifoEvent, t time.Time) int {
+		return ev.Time.Compare(t)
+	})
+	f.events = slices.Delete(f.events, 0, i)
+	return i
+}
+
+// listEvents responds with a page of the event log of the fifo, starting
+// after the cursor of the since query parameter.
+func (s *fifoManager) listEvents(w http.ResponseWriter, r *http.Request, log *slog.Logger, fifo *fifo) {
+	cursor, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		log.Warn("invalid cursor", "err", err)
+		writeError(w, http.StatusBadRequest, "invalid since: not an event ID")
+		return
+	}
+	limit := defaultEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxEventsLimit {
+			log.Warn("invalid limit", "limit", v)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit: must be between 1 and %d", maxEventsLimit))
+			return
+		}
+	}
+
+	events, more, truncated := fifo.eventsSince(cursor, limit)
+	resp := api.FifoEventsResponse{Events: events, Next: cursor, More: more, Truncated: truncated}
+	if len(events) > 0 {
+		resp.Next = events[len(events)-1].ID
+	}
+	encode(w, 200, resp)
+}
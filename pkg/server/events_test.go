@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLog(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+	fifo := newFifo(defaultNamespace, fm.cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	for range 5 {
+		fifo.enqueue(newTicket(""))
+	}
+
+	list := func(query string) (api.FifoEventsResponse, int) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/fifo/"+fifo.uuid.String()+"/events?"+query, http.NoBody))
+		var resp api.FifoEventsResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return resp, rec.Code
+	}
+
+	_, code := list("since=-1")
+	require.Equal(http.StatusBadRequest, code)
+	_, code = list("since=0&limit=0")
+	require.Equal(http.StatusBadRequest, code)
+
+	// Pages continue at the cursor of the previous one.
+	page, code := list("since=0&limit=3")
+	require.Equal(http.StatusOK, code)
+	require.Len(page.Events, 3)
+	require.Equal(uint64(1), page.Events[0].ID)
+	require.Equal(api.EventTicketCreated, page.Events[0].Type)
+	require.Equal(uint64(3), page.Next)
+	require.True(page.More)
+	page, _ = list("since=3&limit=3")
+	require.Len(page.Events, 2)
+	require.Equal(uint64(5), page.Next)
+	require.False(page.More)
+	page, _ = list("since=5")
+	require.Empty(page.Events)
+	require.Equal(uint64(5), page.Next)
+
+	// Events past the history retention are dropped.
+	require.Equal(5, fm.gc(time.Now().Add(fm.cfg.HistoryRetention+time.Minute)).Events)
+	page, _ = list("since=2")
+	require.Empty(page.Events)
+	require.True(page.Truncated)
+	page, _ = list("since=5")
+	require.False(page.Truncated)
+}
+
+func TestEventStreamResume(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	fifo := newFifo(defaultNamespace, fm.cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	for range 3 {
+		fifo.enqueue(newTicket(""))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v1/fifo/"+fifo.uuid.String()+"/events", http.NoBody)
+	require.NoError(err)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	// The missed events are followed by new ones.
+	fifo.enqueue(newTicket(""))
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(ids) < 3 && scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			ids = append(ids, id)
+		}
+	}
+	require.Equal([]string{"2", "3", "4"}, ids)
+}
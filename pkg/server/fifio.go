@@ -0,0 +1,1879 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	"github.com/katexochen/sync/internal/memstore"
+)
+
+type ticket struct {
+	api.FifoTicketResponse
+	// waitC is closed to notify any waiters that its the ticket's turn.
+	waitC chan struct{}
+	// waitAckC is closed to notify the fifo that the owner has been notified.
+	waitAckC chan struct{}
+	// waitAckOnce is used to ensure that waitAckC is closed only once.
+	waitAckOnce sync.Once
+	// doneC is closed to notify the fifo that the ticket is done.
+	doneC chan struct{}
+	// heartbeatC is used by the owner to extend the done timeout.
+	heartbeatC chan struct{}
+	// abortC is closed when the fifo owner ends the ticket early,
+	// abortOutcome is recorded for it.
+	abortC       chan struct{}
+	abortOnce    sync.Once
+	abortOutcome string
+	// endC is closed when the ticket ended.
+	endC chan struct{}
+	// after are the tickets that must end before the ticket is notified.
+	after []dependency
+	// onDone is called with the ticket and the identity of its owner once
+	// the ticket is done, if set.
+	onDone func(api.FifoTicketResponse, string)
+	// identity of the client that requested the ticket, if known. The
+	// identity and the secret are guarded by the mutex of the fifo once the
+	// ticket is queued, as they change on transfer.
+	identity  string
+	createdAt time.Time
+	// idempotencyKey was sent by the client with the ticket request, if any.
+	idempotencyKey string
+	// traceID is the trace the client created the ticket in, if it sent one.
+	traceID string
+	// state and the lifecycle timestamps are guarded by the mutex of the fifo.
+	state      string
+	notifiedAt time.Time
+	acceptedAt time.Time
+	// renotified counts the notifications repeated after the owner missed
+	// the wait timeout.
+	renotified int
+	// outcome is set once the ticket ended. Guarded by the mutex of the
+	// fifo.
+	outcome string
+	// claimed is set once a wait received the turn of the ticket, with the
+	// wait token it presented. Guarded by the mutex of the fifo.
+	claimed   bool
+	waitToken string
+}
+
+func (t *ticket) waitAck() {
+	t.waitAckOnce.Do(func() {
+		close(t.waitAckC)
+	})
+}
+
+func (t *ticket) abort(outcome string) {
+	t.abortOnce.Do(func() {
+		t.abortOutcome = outcome
+		close(t.abortC)
+	})
+}
+
+// checkSecret reports whether secret is the secret of the ticket.
+func (t *ticket) checkSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(t.Secret)) == 1
+}
+
+func (t *ticket) info() api.FifoTicketInfo {
+	info := api.FifoTicketInfo{
+		TicketID:  t.TicketID,
+		State:     t.state,
+		Identity:  t.identity,
+		CreatedAt: t.createdAt,
+	}
+	for _, d := range t.pendingAfter() {
+		info.After = append(info.After, d.ref())
+	}
+	return info
+}
+
+func newTicket(identity string) *ticket {
+	return &ticket{
+		FifoTicketResponse: api.FifoTicketResponse{
+			TicketID: uuidlib.New(),
+			Secret:   newSecret(),
+		},
+		waitC:      make(chan struct{}),
+		waitAckC:   make(chan struct{}),
+		doneC:      make(chan struct{}),
+		heartbeatC: make(chan struct{}, 1),
+		abortC:     make(chan struct{}),
+		endC:       make(chan struct{}),
+		identity:   identity,
+		createdAt:  time.Now(),
+		state:      api.TicketQueued,
+	}
+}
+
+type fifo struct {
+	namespace string
+	uuid      uuidlib.UUID
+	// name makes the fifo findable by name in its namespace, if set.
+	name                 string
+	waitTimeout          time.Duration
+	doneTimeout          time.Duration
+	unusedDestroyTimeout time.Duration
+	historyRetention     time.Duration
+	// acceptRetries is the number of times a notified ticket is re-notified
+	// before it expires, each time giving its owner acceptGrace to call wait.
+	acceptRetries int
+	acceptGrace   time.Duration
+	ticketLookup  *memstore.Store[string, *ticket]
+	// ticketsByKey holds the tickets that were requested with an idempotency
+	// key until they end, so repeated requests return the same ticket.
+	// keyMux serializes the ticket requests with a key, so that a retry
+	// racing the original request doesn't queue a second ticket.
+	ticketsByKey *memstore.Store[string, *ticket]
+	keyMux       sync.Mutex
+	// ownerSecret is required for destructive operations on the fifo.
+	ownerSecret string
+	// stopC is closed when the fifo is deleted.
+	stopC    chan struct{}
+	stopOnce sync.Once
+	// enqueueC signals the run loop that a ticket was queued.
+	enqueueC chan struct{}
+	// webhooks deliver the events of the fifo, webhookURL is the webhook
+	// of this fifo, if any. It is signed with webhookSecret, or else the
+	// owner secret, and receives webhookEvents, or else all events.
+	webhooks      *webhookSender
+	webhookURL    string
+	webhookSecret string
+	webhookEvents []string
+	// waiterPolicy decides which waits of a ticket get its turn, one of the
+	// api.WaiterPolicy values.
+	waiterPolicy string
+	// waitTimes records the time tickets wait for their turn, shared by all
+	// fifos of the server.
+	waitTimes *histogram
+	log       *slog.Logger
+	// releaseQuota gives the fifo back to the quotas of its creator once it
+	// stops, if it was created by a client.
+	releaseQuota func()
+
+	mux sync.Mutex
+	// queue holds the waiting tickets, the head is next.
+	queue []*ticket
+	// active is the ticket that currently holds the fifo.
+	active *ticket
+	// subscribers receive the events of the fifo.
+	subscribers map[chan api.FifoEvent]struct{}
+	// history holds the ended tickets, oldest first.
+	history []api.FifoHistoryEntry
+	// events logs the published events, oldest first. Their IDs count up
+	// without gaps, lastEventID is the ID of the last published event.
+	events      []api.FifoEvent
+	lastEventID uint64
+
+	// waiters is the number of running wait requests.
+	waiters atomic.Int64
+}
+
+func newFifo(namespace string, cfg FifoConfig, webhooks *webhookSender, webhookURL string, log *slog.Logger) *fifo {
+	uuid := uuidlib.New()
+	return &fifo{
+		namespace:            namespace,
+		uuid:                 uuid,
+		ownerSecret:          newSecret(),
+		stopC:                make(chan struct{}),
+		enqueueC:             make(chan struct{}, 1),
+		waitTimeout:          cfg.WaitTimeout,
+		doneTimeout:          cfg.DoneTimeout,
+		unusedDestroyTimeout: cfg.UnusedDestroyTimeout,
+		historyRetention:     cfg.HistoryRetention,
+		acceptRetries:        cfg.AcceptRetries,
+		acceptGrace:          cfg.AcceptGrace,
+		ticketLookup:         memstore.New[string, *ticket](),
+		ticketsByKey:         memstore.New[string, *ticket](),
+		subscribers:          map[chan api.FifoEvent]struct{}{},
+		webhooks:             webhooks,
+		webhookURL:           webhookURL,
+		waiterPolicy:         api.WaiterPolicyAll,
+		log:                  fifoLogger(log, namespace, uuid),
+	}
+}
+
+func fifoLogger(log *slog.Logger, namespace string, uuid uuidlib.UUID) *slog.Logger {
+	return log.WithGroup("fifo").With("namespace", namespace, "uuid", uuid.String())
+}
+
+// start runs the fifo until it is stopped or the unused timeout is reached.
+// onExit is called when the fifo is no longer running.
+func (f *fifo) start(onExit func()) {
+	go func() {
+		defer onExit()
+		f.log.Info("started")
+		for {
+			f.log.Info("waiting for ticket")
+			t, ok := f.next()
+			if !ok {
+				return
+			}
+			f.log.Info("got ticket", "ticket", t.TicketID)
+
+			close(t.waitC) // Boardcast to all waiters.
+
+			// Wait for the acknowledgement from the ticket owner.
+			outcome, ok := f.waitAck(t)
+			if !ok {
+				f.log.Info("stopped")
+				return
+			}
+			if outcome != "" {
+				f.finish(t, outcome)
+				continue
+			}
+
+			// Wait for the ticket to be done, heartbeats extend the deadline.
+			outcome, ok = f.waitDone(t)
+			if !ok {
+				f.log.Info("stopped")
+				return
+			}
+			f.finish(t, outcome)
+		}
+	}()
+}
+
+// waitAck waits for the owner of the notified ticket to call wait. If the
+// owner misses the wait timeout, the ticket is re-notified up to
+// acceptRetries times, each time with acceptGrace to respond, before it
+// expires. It returns the outcome if the ticket ended instead, or false if
+// the fifo was stopped.
+func (f *fifo) waitAck(t *ticket) (string, bool) {
+	timer := time.NewTimer(f.waitTimeout)
+	defer timer.Stop()
+	for retries := f.acceptRetries; ; retries-- {
+		select {
+		case <-timer.C:
+			if retries == 0 {
+				f.log.Warn("timeout waiting for ticket owner", "ticket", t.TicketID)
+				return api.OutcomeWaitTimeout, true
+			}
+			f.log.Info("re-notifying ticket owner", "ticket", t.TicketID, "retries", retries-1)
+			f.mux.Lock()
+			t.renotified++
+			f.publish(api.EventTicketNotified, t)
+			f.mux.Unlock()
+			timer.Reset(f.acceptGrace)
+		case <-t.waitAckC:
+			f.log.Info("ticket owner notified", "ticket", t.TicketID)
+			return "", true
+		case <-t.abortC:
+			f.log.Info("ticket aborted", "ticket", t.TicketID)
+			return t.abortOutcome, true
+		case <-f.stopC:
+			return "", false
+		}
+	}
+}
+
+// enqueue adds the ticket to the end of the queue.
+func (f *fifo) enqueue(t *ticket) {
+	f.ticketLookup.Put(t.TicketID.String(), t)
+	if t.idempotencyKey != "" {
+		f.ticketsByKey.Put(t.idempotencyKey, t)
+	}
+	f.mux.Lock()
+	f.queue = append(f.queue, t)
+	f.publish(api.EventTicketCreated, t)
+	f.mux.Unlock()
+	f.wake()
+}
+
+// wake signals the run loop that the queue changed.
+func (f *fifo) wake() {
+	select {
+	case f.enqueueC <- struct{}{}:
+	default:
+	}
+}
+
+// next blocks until a ticket is queued and makes it the active ticket.
+// It returns false if the fifo was stopped or the unused timeout is reached.
+func (f *fifo) next() (*ticket, bool) {
+	timer := time.NewTimer(f.unusedDestroyTimeout)
+	defer timer.Stop()
+	for {
+		f.mux.Lock()
+		if len(f.queue) > 0 {
+			t := f.queue[0]
+			if pending := t.pendingAfter(); len(pending) > 0 {
+				f.mux.Unlock()
+				// The ticket keeps its place until the tickets it waits
+				// for ended, unless it leaves the queue or is bumped.
+				d := pending[0]
+				select {
+				case <-d.done():
+				case <-d.fifo.stopC:
+				case <-t.endC:
+				case <-f.enqueueC:
+				case <-timer.C:
+					// The fifo isn't unused while the ticket waits.
+					timer.Reset(f.unusedDestroyTimeout)
+				case <-f.stopC:
+					f.log.Info("stopped")
+					return nil, false
+				}
+				continue
+			}
+			f.queue = f.queue[1:]
+			f.active = t
+			// Tickets restored from a backup may already be accepted.
+			if t.state == api.TicketQueued {
+				t.state = api.TicketNotified
+				t.notifiedAt = time.Now()
+				f.waitTimes.observe(t.notifiedAt.Sub(t.createdAt).Seconds(), t.traceID)
+				f.publish(api.EventTicketNotified, t)
+			}
+			f.mux.Unlock()
+			return t, true
+		}
+		f.mux.Unlock()
+
+		select {
+		case <-f.enqueueC:
+		case <-timer.C:
+			f.log.Info("unused timeout reached, self destruction")
+			f.notifyWebhooks(api.EventFifoDeleted, nil)
+			return nil, false
+		case <-f.stopC:
+			f.log.Info("stopped")
+			return nil, false
+		}
+	}
+}
+
+// finish releases the fifo from the active ticket.
+func (f *fifo) finish(t *ticket, outcome string) {
+	if t.onDone != nil && outcomeEvents[outcome] == api.EventTicketDone {
+		f.mux.Lock()
+		resp, identity := t.FifoTicketResponse, t.identity
+		f.mux.Unlock()
+		// Called before the ticket ends, so whatever onDone does is
+		// visible once done returns.
+		t.onDone(resp, identity)
+	}
+	f.mux.Lock()
+	if f.active == t {
+		f.active = nil
+	}
+	f.end(t, outcome)
+	f.mux.Unlock()
+	f.forget(t)
+}
+
+// forget removes the ended ticket from the lookups.
+func (f *fifo) forget(t *ticket) {
+	f.ticketLookup.Delete(t.TicketID.String())
+	// The key may refer to a new ticket if this one was transferred.
+	if cur, ok := f.ticketsByKey.Get(t.idempotencyKey); ok && cur == t {
+		f.ticketsByKey.Delete(t.idempotencyKey)
+	}
+}
+
+// cancel removes the ticket from the queue. It returns false if the ticket
+// isn't queued anymore.
+func (f *fifo) cancel(t *ticket) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	i := slices.Index(f.queue, t)
+	if i < 0 {
+		return false
+	}
+	f.queue = slices.Delete(f.queue, i, i+1)
+	f.forget(t)
+	f.end(t, api.OutcomeDisconnected)
+	return true
+}
+
+// abort ends the ticket on behalf of the fifo owner. A queued ticket is
+// removed from the queue, an active one loses its turn. It returns false if
+// the ticket is neither queued nor active.
+func (f *fifo) abort(t *ticket, outcome string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if i := slices.Index(f.queue, t); i >= 0 {
+		f.queue = slices.Delete(f.queue, i, i+1)
+		f.forget(t)
+		f.end(t, outcome)
+	} else if f.active != t {
+		return false
+	}
+	// The run loop finishes the active ticket.
+	t.abort(outcome)
+	return true
+}
+
+// end publishes the end of the ticket and records it in the history. Must be
+// called with the mutex of the fifo held.
+func (f *fifo) end(t *ticket, outcome string) {
+	t.outcome = outcome
+	close(t.endC)
+	f.publish(outcomeEvents[outcome], t)
+	if f.historyRetention <= 0 {
+		return
+	}
+	entry := api.FifoHistoryEntry{
+		TicketID:  t.TicketID,
+		Identity:  t.identity,
+		Outcome:   outcome,
+		CreatedAt: t.createdAt,
+		EndedAt:   time.Now(),
+	}
+	if notifiedAt := t.notifiedAt; !notifiedAt.IsZero() {
+		entry.NotifiedAt = &notifiedAt
+	}
+	if acceptedAt := t.acceptedAt; !acceptedAt.IsZero() {
+		entry.AcceptedAt = &acceptedAt
+	}
+	f.history = append(f.history, entry)
+	if len(f.history) > maxHistory {
+		f.history = slices.Delete(f.history, 0, len(f.history)-maxHistory)
+	}
+}
+
+// maxHistory bounds the number of history entries kept per fifo.
+const maxHistory = 1000
+
+// outcomeEvents maps the outcome of a ticket to the event published for it.
+var outcomeEvents = map[string]string{
+	api.OutcomeDone:             api.EventTicketDone,
+	api.OutcomeCompletedByOwner: api.EventTicketDone,
+	api.OutcomeWaitTimeout:      api.EventTicketExpired,
+	api.OutcomeDoneTimeout:      api.EventTicketExpired,
+	api.OutcomeCanceled:         api.EventTicketCanceled,
+	api.OutcomeCanceledByOwner:  api.EventTicketCanceled,
+	api.OutcomeDisconnected:     api.EventTicketCanceled,
+	api.OutcomeDeadlock:         api.EventTicketCanceled,
+}
+
+// recentHistory returns the history entries of tickets that ended within the
+// retention period, oldest first. Older entries are dropped.
+func (f *fifo) recentHistory() []api.FifoHistoryEntry {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.pruneHistory(time.Now())
+	return append([]api.FifoHistoryEntry{}, f.history...)
+}
+
+// pruneHistory drops the history entries of tickets that ended before the
+// retention period up to now and returns their number. Must be called with
+// the mutex of the fifo held.
+func (f *fifo) pruneHistory(now time.Time) int {
+	cutoff := now.Add(-f.historyRetention)
+	i, _ := slices.BinarySearchFunc(f.history, cutoff, func(e api.FifoHistoryEntry, t time.Time) int {
+		return e.EndedAt.Compare(t)
+	})
+	f.history = slices.Delete(f.history, 0, i)
+	return i
+}
+
+// bump moves the queued ticket to the front of the queue. It returns false
+// if the ticket isn't queued.
+func (f *fifo) bump(t *ticket) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	i := slices.Index(f.queue, t)
+	if i < 0 {
+		return false
+	}
+	f.queue = slices.Insert(slices.Delete(f.queue, i, i+1), 0, t)
+	f.wake()
+	return true
+}
+
+// transfer hands the ticket over to a new owner with the identity, if known.
+// The ticket gets a new secret, so the previous owner can no longer use it.
+// The secret must be the ticket secret or the owner secret. It returns false
+// if the secret is invalid.
+func (f *fifo) transfer(t *ticket, secret, identity string) (api.FifoTicketResponse, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if !t.checkSecret(secret) && !f.checkOwnerSecret(secret) {
+		return api.FifoTicketResponse{}, false
+	}
+	t.Secret = newSecret()
+	if identity != "" {
+		t.identity = identity
+	}
+	// The new owner waits for the turn itself.
+	t.claimed = false
+	t.waitToken = ""
+	// Repeated ticket requests of the previous owner get a new ticket.
+	if t.idempotencyKey != "" {
+		f.ticketsByKey.Delete(t.idempotencyKey)
+	}
+	return t.FifoTicketResponse, true
+}
+
+// claim hands the turn of the ticket to a wait presenting the wait token,
+// according to the waiter policy of the fifo. It returns false if the turn
+// went to another wait.
+func (f *fifo) claim(t *ticket, token string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if t.claimed {
+		switch f.waiterPolicy {
+		case api.WaiterPolicyFirst:
+			return false
+		case api.WaiterPolicyToken:
+			return subtle.ConstantTimeCompare([]byte(token), []byte(t.waitToken)) == 1
+		}
+	}
+	t.claimed = true
+	t.waitToken = token
+	return true
+}
+
+// validateWaiterPolicy checks the waiter policy requested for a new fifo,
+// empty means the default.
+func validateWaiterPolicy(policy string) error {
+	switch policy {
+	case "", api.WaiterPolicyAll, api.WaiterPolicyFirst, api.WaiterPolicyToken:
+		return nil
+	}
+	return fmt.Errorf("waiter policy must be %q, %q or %q", api.WaiterPolicyAll, api.WaiterPolicyFirst, api.WaiterPolicyToken)
+}
+
+// checkWaitToken returns an error if the waiter policy of the fifo requires
+// a wait token and none is given.
+func (f *fifo) checkWaitToken(token string) error {
+	if f.waiterPolicy == api.WaiterPolicyToken && token == "" {
+		return errors.New("fifo requires a wait token")
+	}
+	return nil
+}
+
+// checkTicketSecret reports whether secret is the secret of the ticket.
+func (f *fifo) checkTicketSecret(t *ticket, secret string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return t.checkSecret(secret)
+}
+
+// activeTicket returns the ticket that currently holds the fifo, if any.
+func (f *fifo) activeTicket() (*ticket, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.active, f.active != nil
+}
+
+// accept marks the notified ticket as accepted by its owner and returns
+// its info. Accepting a ticket more than once has no further effect.
+func (f *fifo) accept(t *ticket) api.FifoTicketInfo {
+	f.mux.Lock()
+	if t.state == api.TicketNotified {
+		t.state = api.TicketAccepted
+		t.acceptedAt = time.Now()
+		f.publish(api.EventTicketAccepted, t)
+	}
+	info := t.info()
+	f.mux.Unlock()
+	t.waitAck()
+	return info
+}
+
+// status returns the active ticket and the queue of the fifo.
+func (f *fifo) status() api.FifoStatusResponse {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	status := api.FifoStatusResponse{
+		UUID:  f.uuid,
+		Queue: make([]api.FifoTicketInfo, 0, len(f.queue)),
+	}
+	if f.active != nil {
+		info := f.active.info()
+		status.Active = &info
+	}
+	for _, t := range f.queue {
+		status.Queue = append(status.Queue, t.info())
+	}
+	return status
+}
+
+// load returns the active ticket with the time it was notified, and the
+// number of queued tickets.
+func (f *fifo) load() (*ticket, time.Time, int) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.active == nil {
+		return nil, time.Time{}, len(f.queue)
+	}
+	return f.active, f.active.notifiedAt, len(f.queue)
+}
+
+// stopped reports whether the fifo was stopped.
+func (f *fifo) stopped() bool {
+	select {
+	case <-f.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops the fifo. Waiters are released with an error.
+func (f *fifo) stop() {
+	f.stopOnce.Do(func() {
+		close(f.stopC)
+	})
+}
+
+// checkOwnerSecret reports whether secret is the owner secret of the fifo.
+func (f *fifo) checkOwnerSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(f.ownerSecret)) == 1
+}
+
+// waitDone waits until the ticket is done or timed out and returns the
+// outcome. It returns false if the fifo was stopped.
+func (f *fifo) waitDone(t *ticket) (string, bool) {
+	timer := time.NewTimer(f.doneTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			f.log.Warn("timeout waiting for ticket completion", "ticket", t.TicketID)
+			return api.OutcomeDoneTimeout, true
+		case <-t.heartbeatC:
+			f.log.Debug("heartbeat received", "ticket", t.TicketID)
+			timer.Reset(f.doneTimeout)
+		case <-t.doneC:
+			f.log.Info("ticket completed", "ticket", t.TicketID)
+			return api.OutcomeDone, true
+		case <-t.abortC:
+			f.log.Info("ticket aborted", "ticket", t.TicketID)
+			return t.abortOutcome, true
+		case <-f.stopC:
+			return "", false
+		}
+	}
+}
+
+// subscribe returns a channel receiving the events of the fifo and a
+// function to unsubscribe.
+func (f *fifo) subscribe() (<-chan api.FifoEvent, func()) {
+	events := make(chan api.FifoEvent, 64)
+	f.mux.Lock()
+	f.subscribers[events] = struct{}{}
+	f.mux.Unlock()
+	return events, func() {
+		f.mux.Lock()
+		delete(f.subscribers, events)
+		f.mux.Unlock()
+	}
+}
+
+// publish logs an event about the ticket and sends it to all subscribers.
+// Events are dropped for subscribers that don't keep up. Must be called with
+// the mutex of the fifo held.
+func (f *fifo) publish(event string, t *ticket) {
+	ev := fifoEventOf(t, event)
+	f.logEvent(&ev)
+	for sub := range f.subscribers {
+		select {
+		case sub <- ev:
+		default:
+			f.log.Warn("dropping event for slow subscriber", "event", event)
+		}
+	}
+	f.notifyWebhooks(event, &ev)
+}
+
+// notifyWebhooks sends the event to the server-wide webhooks and the webhook
+// of the fifo. ev is nil for events of the fifo itself.
+func (f *fifo) notifyWebhooks(event string, ev *api.FifoEvent) {
+	payload := api.FifoWebhook{
+		Type:      event,
+		Namespace: f.namespace,
+		UUID:      f.uuid,
+		Event:     ev,
+		Time:      time.Now(),
+	}
+	payload.Text = webhookText(payload)
+	f.sendWebhook(payload)
+}
+
+// sendWebhook sends the payload to the server-wide webhooks and the webhook
+// of the fifo.
+func (f *fifo) sendWebhook(payload api.FifoWebhook) {
+	if f.webhooks == nil {
+		return
+	}
+	var extra []webhook
+	if f.webhookURL != "" {
+		hook := webhook{url: f.webhookURL, secret: f.webhookSecret, events: f.webhookEvents}
+		if hook.secret == "" {
+			hook.secret = f.ownerSecret
+		}
+		extra = append(extra, hook)
+	}
+	f.webhooks.send(payload, extra...)
+}
+
+func fifoEventOf(t *ticket, event string) api.FifoEvent {
+	return api.FifoEvent{
+		Type:       event,
+		TicketID:   t.TicketID,
+		Identity:   t.identity,
+		Renotified: t.renotified,
+		TraceID:    t.traceID,
+		Time:       time.Now(),
+	}
+}
+
+// position returns the number of tickets queued before the ticket, or -1 if
+// the ticket isn't queued.
+func (f *fifo) position(t *ticket) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return slices.Index(f.queue, t)
+}
+
+type fifoManager struct {
+	fifos    *memstore.Store[string, *fifo]
+	cfg      FifoConfig
+	webhooks *webhookSender
+	log      *slog.Logger
+	fifoLog  *slog.Logger
+	// shutdownC is closed when the server shuts down.
+	shutdownC    chan struct{}
+	shutdownOnce sync.Once
+	// waiters is the number of running wait requests on all fifos.
+	waiters atomic.Int64
+	// quotas counts the resources held by clients and namespaces.
+	quotas *quotaTracker
+	// waitTimes records the time tickets of all fifos wait for their turn.
+	waitTimes *histogram
+	// names holds the named fifos by namespace and name. namesMux
+	// serializes getting or creating named fifos.
+	names    *memstore.Store[string, *fifo]
+	namesMux sync.Mutex
+
+	// pipelines holds the pipelines by namespace and UUID.
+	pipelines *memstore.Store[string, *pipeline]
+	// queues holds the work queues by namespace and UUID.
+	queues *memstore.Store[string, *workQueue]
+
+	// deleted holds the deleted fifos that can still be undeleted.
+	deleted *memstore.Store[string, *deletedFifo]
+	// retireMux serializes moving fifos between fifos and deleted.
+	retireMux sync.Mutex
+	// cfgMux guards cfg, which is replaced on reload.
+	cfgMux sync.RWMutex
+}
+
+// config returns the current fifo config.
+func (s *fifoManager) config() FifoConfig {
+	s.cfgMux.RLock()
+	defer s.cfgMux.RUnlock()
+	return s.cfg
+}
+
+// setConfig replaces the fifo config. Running fifos keep their timeouts.
+func (s *fifoManager) setConfig(cfg FifoConfig) {
+	s.cfgMux.Lock()
+	defer s.cfgMux.Unlock()
+	s.cfg = cfg
+}
+
+func newFifoManager(cfg FifoConfig, webhooks *webhookSender, log *slog.Logger) *fifoManager {
+	return &fifoManager{
+		fifos:     memstore.New[string, *fifo](),
+		pipelines: memstore.New[string, *pipeline](),
+		queues:    memstore.New[string, *workQueue](),
+		names:     memstore.New[string, *fifo](),
+		deleted:   memstore.New[string, *deletedFifo](),
+		quotas:    newQuotaTracker(),
+		waitTimes: newHistogram(waitBuckets),
+		cfg:       cfg,
+		webhooks:  webhooks,
+		log:       log.WithGroup("fifoManager"),
+		fifoLog:   log,
+		shutdownC: make(chan struct{}),
+	}
+}
+
+// shutdown releases all blocked waiters with a retriable error and rejects
+// new tickets. The fifos keep running until stopAll is called.
+func (s *fifoManager) shutdown() {
+	s.shutdownOnce.Do(func() {
+		s.log.Info("shutting down, releasing waiters")
+		close(s.shutdownC)
+	})
+}
+
+// run starts the fifo and makes it available under key. Once the fifo stops,
+// it is retired.
+func (s *fifoManager) run(key string, f *fifo) {
+	f.start(func() {
+		s.retire(key, f)
+		if f.name != "" {
+			s.forgetName(f)
+		}
+		if f.releaseQuota != nil {
+			f.releaseQuota()
+		}
+	})
+	s.fifos.Put(key, f)
+}
+
+// stopAll stops the run loops of all fifos and the queues.
+func (s *fifoManager) stopAll() {
+	for _, fifo := range s.fifos.GetAll() {
+		fifo.stop()
+	}
+	for _, q := range s.queues.GetAll() {
+		q.stop()
+	}
+}
+
+// registerHandlers registers the fifo API under the prefix.
+func (s *fifoManager) registerHandlers(mux *http.ServeMux, prefix string) {
+	for _, rt := range s.routes() {
+		mux.HandleFunc(rt.method+" "+prefix+rt.path, validIDs(rt.handler))
+	}
+}
+
+// registerAdminHandlers registers the admin API under the prefix.
+func (s *fifoManager) registerAdminHandlers(mux *http.ServeMux, prefix string, wrap func(http.Handler) http.Handler) {
+	for _, rt := range s.adminRoutes() {
+		mux.Handle(rt.method+" "+prefix+rt.path, wrap(rt.handler))
+	}
+}
+
+// registerLegacyHandlers registers the unversioned API of earlier releases
+// under the prefix. It takes all parameters from the query and any method.
+func (s *fifoManager) registerLegacyHandlers(mux *http.ServeMux, prefix string) {
+	for path, handler := range s.legacyRoutes() {
+		mux.HandleFunc(prefix+path, validIDs(queryAsBody(handler)))
+	}
+}
+
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// routes returns the handlers of the fifo API with their path relative to
+// the prefix they are registered under. Keep openapi.yaml in sync.
+func (s *fifoManager) routes() []route {
+	return []route{
+		{http.MethodPost, "/new", s.new},
+		{http.MethodPost, "/acquire", s.acquire},
+		{http.MethodPost, "/wait", s.waitAll},
+		{http.MethodPost, "/{uuid}/ticket", s.ticket},
+		{http.MethodGet, "/{uuid}/wait/{ticket}", s.wait},
+		{http.MethodGet, "/{uuid}/wait/{ticket}/stream", s.waitStream},
+		{http.MethodGet, "/{uuid}/ticket/{ticket}/state", s.pollState},
+		{http.MethodGet, "/{uuid}/events", s.events},
+		{http.MethodGet, "/{uuid}/session", s.session},
+		{http.MethodPost, "/{uuid}/done/{ticket}", s.done},
+		{http.MethodPost, "/{uuid}/heartbeat/{ticket}", s.heartbeat},
+		{http.MethodPost, "/{uuid}/cancel/{ticket}", s.cancel},
+		{http.MethodPost, "/{uuid}/transfer/{ticket}", s.transfer},
+		{http.MethodDelete, "/{uuid}", s.delete},
+		{http.MethodPost, "/{uuid}/undelete", s.undelete},
+		{http.MethodPost, "/{uuid}/clone", s.clone},
+		{http.MethodGet, "/{uuid}/status", gzipped(s.status)},
+		{http.MethodGet, "/{uuid}/history", gzipped(s.history)},
+		{http.MethodPost, "/{uuid}/admin/cancel/{ticket}", s.adminCancel},
+		{http.MethodPost, "/{uuid}/admin/bump/{ticket}", s.adminBump},
+		{http.MethodPost, "/{uuid}/admin/complete", s.adminComplete},
+		{http.MethodGet, "/list", gzipped(s.list)},
+		{http.MethodGet, "/quota", s.quota},
+	}
+}
+
+// adminRoutes returns the handlers of the admin API with their path relative
+// to the prefix they are registered under. Keep openapi.yaml in sync.
+func (s *fifoManager) adminRoutes() []route {
+	return []route{
+		{http.MethodGet, "/backup", s.backupHandler},
+		{http.MethodPost, "/restore", s.restoreHandler},
+		{http.MethodPost, "/gc", s.gcHandler},
+		{http.MethodGet, "/deadlocks", s.deadlocksHandler},
+		{http.MethodGet, "/quotas", s.quotasHandler},
+	}
+}
+
+// legacyRoutes returns the handlers by the paths of the unversioned API.
+func (s *fifoManager) legacyRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/new":                         s.new,
+		"/{uuid}/ticket":               s.ticket,
+		"/{uuid}/wait/{ticket}":        s.wait,
+		"/{uuid}/wait/{ticket}/stream": s.waitStream,
+		"/{uuid}/events":               s.events,
+		"/{uuid}/done/{ticket}":        s.done,
+		"/{uuid}/heartbeat/{ticket}":   s.heartbeat,
+		"/{uuid}/delete":               s.delete,
+		"/{uuid}/status":               gzipped(s.status),
+		"/list":                        gzipped(s.list),
+	}
+}
+
+func (s *fifoManager) new(w http.ResponseWriter, r *http.Request) {
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoNewRequest](w, r)
+	if !ok {
+		return
+	}
+	cfg, err := s.config().withOverrides(req)
+	if err != nil {
+		s.log.Warn("invalid fifo config", "err", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateFifoWebhook(req); err != nil {
+		s.log.Warn("invalid webhook", "err", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateWaiterPolicy(req.WaiterPolicy); err != nil {
+		s.log.Warn("invalid waiter policy", "err", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name != "" {
+		if !validName(req.Name) {
+			s.log.Warn("invalid fifo name", "name", req.Name)
+			writeError(w, http.StatusBadRequest, "invalid fifo name")
+			return
+		}
+		s.namesMux.Lock()
+		defer s.namesMux.Unlock()
+		if existing, ok := s.names.Get(fifoKey(ns, req.Name)); ok && !existing.stopped() {
+			s.log.Info("named fifo exists", "namespace", ns, "name", req.Name, "uuid", existing.uuid)
+			encode(w, 200, api.FifoNewResponse{UUID: existing.uuid, Existing: true})
+			return
+		}
+	}
+	fifo := newFifo(ns, cfg, s.webhooks, req.Webhook, s.fifoLog)
+	fifo.name = req.Name
+	fifo.waitTimes = s.waitTimes
+	fifo.webhookSecret = req.WebhookSecret
+	if len(req.WebhookEvents) > 0 {
+		fifo.webhookEvents = req.WebhookEvents
+	}
+	if req.WaiterPolicy != "" {
+		fifo.waiterPolicy = req.WaiterPolicy
+	}
+	key := fifoKey(ns, fifo.uuid.String())
+	log := s.log.With("call", "new", "namespace", ns, "uuid", fifo.uuid.String())
+	log.Info("called")
+	fifo.releaseQuota, ok = s.acquireQuota(w, r, log, ns, quotaFifos)
+	if !ok {
+		return
+	}
+	s.run(key, fifo)
+	if fifo.name != "" {
+		s.names.Put(fifoKey(ns, fifo.name), fifo)
+	}
+	encode(w, 200, api.FifoNewResponse{UUID: fifo.uuid, OwnerSecret: fifo.ownerSecret})
+}
+
+func (s *fifoManager) ticket(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "ticket", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoTicketRequest](w, r)
+	if !ok {
+		return
+	}
+
+	select {
+	case <-fifo.stopC:
+		log.Warn("fifo deleted")
+		writeError(w, http.StatusGone, "fifo deleted")
+		return
+	case <-s.shutdownC:
+		log.Warn("server shutting down")
+		unavailable(w, "server shutting down")
+		return
+	default:
+	}
+
+	key := r.Header.Get(api.IdempotencyKeyHeader)
+	if key != "" {
+		fifo.keyMux.Lock()
+		defer fifo.keyMux.Unlock()
+	}
+	if tick, ok := fifo.ticketsByKey.Get(key); ok && key != "" {
+		// The client retried a request it didn't get the response for.
+		log.Info("ticket request repeated", "ticket", tick.TicketID)
+		fifo.mux.Lock()
+		resp := tick.FifoTicketResponse
+		fifo.mux.Unlock()
+		encode(w, 200, resp)
+		return
+	}
+
+	after, err := resolveAfter(s.fifos.Get, fifo.namespace, req.After)
+	if err != nil {
+		log.Warn("invalid dependencies", "err", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tick := newTicket(clientIdentity(r, req.Identity))
+	tick.idempotencyKey = key
+	tick.traceID = traceIDOf(r)
+	tick.after = after
+	if !s.acquireTicketQuota(w, r, log, fifo, tick) {
+		return
+	}
+	log.Info("ticket created", "ticket", tick.TicketID, "identity", tick.identity, "after", len(after), "trace", tick.traceID)
+	resp := tick.FifoTicketResponse
+	fifo.enqueue(tick)
+
+	encode(w, 200, resp)
+}
+
+func (s *fifoManager) wait(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "wait", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	tick, ok := s.getTicket(w, r, log, fifo, ticketSecret(r))
+	if !ok {
+		return
+	}
+	waitToken := r.URL.Query().Get("wait_token")
+	if err := fifo.checkWaitToken(waitToken); err != nil {
+		log.Warn("missing wait token")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.URL.Query().Get("async") == "true" {
+		// The client polls the state instead of holding the connection.
+		s.pollTurn(w, r, log, fifo, tick, waitToken, stateURL(r))
+		return
+	}
+	release, ok := s.acquireWaiter(w, r, log, fifo)
+	if !ok {
+		return
+	}
+	defer release()
+
+	keepalive, err := parseKeepalive(r.URL.Query().Get("keepalive"))
+	if err != nil {
+		log.Warn("invalid keepalive", "err", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := &waitResponse{w: w}
+	var keepaliveC <-chan time.Time
+	if keepalive > 0 {
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		keepaliveC = ticker.C
+	}
+
+	// Waiting is idempotent, a client that lost the connection can call wait
+	// again and returns immediately if it already had its turn. Clients that
+	// won't come back can ask to give up their place on disconnect.
+	cancelOnDisconnect := r.URL.Query().Get("cancel_on_disconnect") == "true"
+	log.Info("found ticket, waiting")
+	for waiting := true; waiting; {
+		select {
+		case <-tick.waitC:
+			waiting = false
+		case <-tick.abortC:
+			log.Warn("ticket aborted")
+			resp.fail(http.StatusGone, "ticket aborted by fifo owner")
+			return
+		case <-keepaliveC:
+			if err := resp.keepalive(); err != nil {
+				log.Debug("writing keepalive", "err", err)
+			}
+		case <-r.Context().Done():
+			log.Info("client disconnected")
+			if cancelOnDisconnect && fifo.cancel(tick) {
+				log.Info("ticket canceled")
+			}
+			return
+		case <-fifo.stopC:
+			log.Warn("fifo deleted")
+			resp.fail(http.StatusGone, "fifo deleted")
+			return
+		case <-s.shutdownC:
+			log.Warn("server shutting down")
+			resp.fail(http.StatusServiceUnavailable, "server shutting down")
+			return
+		}
+	}
+	if !fifo.claim(tick, waitToken) {
+		log.Warn("turn claimed by another wait")
+		resp.fail(http.StatusConflict, "turn claimed by another wait")
+		return
+	}
+	info := fifo.accept(tick)
+	log.Info("my turn")
+	resp.ok(info)
+}
+
+// minKeepalive and maxKeepalive bound the keepalive interval clients may
+// request.
+const (
+	minKeepalive = time.Second
+	maxKeepalive = 10 * time.Minute
+)
+
+func parseKeepalive(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("parsing keepalive: %w", err)
+	}
+	if d < minKeepalive || d > maxKeepalive {
+		return 0, fmt.Errorf("keepalive must be between %s and %s", minKeepalive, maxKeepalive)
+	}
+	return d, nil
+}
+
+// waitResponse writes the response of a wait call. Keepalive newlines keep
+// idle connections open through proxies. Once one is written, the status is
+// sent, so failures are reported in the body instead.
+type waitResponse struct {
+	w         http.ResponseWriter
+	committed bool
+}
+
+func (wr *waitResponse) keepalive() error {
+	if !wr.committed {
+		wr.w.Header().Set("Content-Type", "application/json")
+		wr.w.WriteHeader(http.StatusOK)
+		wr.committed = true
+	}
+	if _, err := io.WriteString(wr.w, "\n"); err != nil {
+		return err
+	}
+	return http.NewResponseController(wr.w).Flush()
+}
+
+func (wr *waitResponse) ok(info api.FifoTicketInfo) {
+	if !wr.committed {
+		encode(wr.w, 200, api.FifoWaitResponse{FifoTicketInfo: info})
+		return
+	}
+	_ = json.NewEncoder(wr.w).Encode(api.FifoWaitResponse{FifoTicketInfo: info})
+}
+
+func (wr *waitResponse) fail(status int, msg string) {
+	switch {
+	case wr.committed:
+		_ = json.NewEncoder(wr.w).Encode(api.FifoWaitResponse{Error: msg, Status: status})
+	case status == http.StatusServiceUnavailable:
+		unavailable(wr.w, msg)
+	default:
+		writeError(wr.w, status, msg)
+	}
+}
+
+// waitStream is like wait, but streams the position of the ticket in the
+// queue as server-sent events until it's the ticket's turn.
+func (s *fifoManager) waitStream(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "waitStream", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	tick, ok := s.getTicket(w, r, log, fifo, ticketSecret(r))
+	if !ok {
+		return
+	}
+	waitToken := r.URL.Query().Get("wait_token")
+	if err := fifo.checkWaitToken(waitToken); err != nil {
+		log.Warn("missing wait token")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	release, ok := s.acquireWaiter(w, r, log, fifo)
+	if !ok {
+		return
+	}
+	defer release()
+
+	events, unsubscribe := fifo.subscribe()
+	defer unsubscribe()
+	stream := newEventStream(w)
+	lastPosition := -1
+	for {
+		// The position is only reported while the ticket is queued.
+		if pos := fifo.position(tick); pos >= 0 && pos != lastPosition {
+			if err := stream.send(api.EventPosition, api.FifoPositionEvent{Position: pos}); err != nil {
+				log.Debug("writing event", "err", err)
+				return
+			}
+			lastPosition = pos
+		}
+		select {
+		case <-tick.waitC:
+			if !fifo.claim(tick, waitToken) {
+				log.Warn("turn claimed by another wait")
+				_ = stream.send(api.EventTurnClaimed, fifoEventOf(tick, api.EventTurnClaimed))
+				return
+			}
+			info := fifo.accept(tick)
+			log.Info("my turn")
+			if err := stream.send(api.EventReady, info); err != nil {
+				log.Debug("writing event", "err", err)
+			}
+			return
+		case <-events:
+		case <-tick.abortC:
+			log.Warn("ticket aborted")
+			_ = stream.send(api.EventTicketCanceled, fifoEventOf(tick, api.EventTicketCanceled))
+			return
+		case <-r.Context().Done():
+			log.Info("client disconnected")
+			return
+		case <-fifo.stopC:
+			log.Warn("fifo deleted")
+			_ = stream.send(api.EventFifoDeleted, fifoDeletedEvent)
+			return
+		case <-s.shutdownC:
+			log.Warn("server shutting down")
+			return
+		}
+	}
+}
+
+// events streams the events of the fifo as server-sent events.
+func (s *fifoManager) events(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "events", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Has("since") {
+		s.listEvents(w, r, log, fifo)
+		return
+	}
+
+	// A client reconnecting with the ID of the last event it got first gets
+	// the events it missed from the log.
+	lastEventID := r.Header.Get("Last-Event-ID")
+	var lastSent uint64
+	if lastEventID != "" {
+		var err error
+		lastSent, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			log.Warn("invalid last event ID", "err", err)
+			writeError(w, http.StatusBadRequest, "invalid Last-Event-ID: not an event ID")
+			return
+		}
+	}
+
+	events, unsubscribe := fifo.subscribe()
+	defer unsubscribe()
+	stream := newEventStream(w)
+	if err := stream.flush(); err != nil {
+		log.Debug("starting stream", "err", err)
+		return
+	}
+	if lastEventID != "" {
+		missed, _, _ := fifo.eventsSince(lastSent, maxEventLog)
+		for _, ev := range missed {
+			if err := stream.sendID(ev.ID, ev.Type, ev); err != nil {
+				log.Debug("writing event", "err", err)
+				return
+			}
+		}
+		if len(missed) > 0 {
+			lastSent = missed[len(missed)-1].ID
+		}
+	}
+	for {
+		select {
+		case ev := <-events:
+			if ev.ID <= lastSent {
+				// Already sent from the log.
+				continue
+			}
+			if err := stream.sendID(ev.ID, ev.Type, ev); err != nil {
+				log.Debug("writing event", "err", err)
+				return
+			}
+		case <-r.Context().Done():
+			log.Info("client disconnected")
+			return
+		case <-fifo.stopC:
+			log.Info("fifo deleted")
+			_ = stream.send(api.EventFifoDeleted, fifoDeletedEvent)
+			return
+		case <-s.shutdownC:
+			log.Info("server shutting down")
+			return
+		}
+	}
+}
+
+func (s *fifoManager) done(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "done", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return
+	}
+	tick, ok := s.getTicket(w, r, log, fifo, req.Secret)
+	if !ok {
+		return
+	}
+
+	select {
+	case tick.doneC <- struct{}{}:
+	case <-tick.abortC:
+		log.Warn("ticket aborted")
+		writeError(w, http.StatusGone, "ticket aborted by fifo owner")
+		return
+	case <-tick.endC:
+		log.Warn("ticket already ended")
+		writeError(w, http.StatusConflict, "ticket already ended")
+		return
+	case <-fifo.stopC:
+		log.Warn("fifo deleted")
+		writeError(w, http.StatusGone, "fifo deleted")
+		return
+	case <-r.Context().Done():
+		log.Info("client disconnected")
+		return
+	}
+	// Wait for the fifo to release the ticket, so the client sees the
+	// effects of done, like the ticket queued in the next pipeline stage.
+	select {
+	case <-tick.endC:
+	case <-fifo.stopC:
+	case <-r.Context().Done():
+	}
+	log.Info("ticket done")
+}
+
+func (s *fifoManager) heartbeat(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "heartbeat", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Debug("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return
+	}
+	tick, ok := s.getTicket(w, r, log, fifo, req.Secret)
+	if !ok {
+		return
+	}
+
+	// Heartbeats are coalesced, a pending one is as good as a new one.
+	select {
+	case tick.heartbeatC <- struct{}{}:
+	default:
+	}
+}
+
+// cancel gives up the ticket on behalf of its owner. A queued ticket is
+// removed from the queue, an active one ends its turn like with done.
+func (s *fifoManager) cancel(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "cancel", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return
+	}
+	tick, ok := s.getTicket(w, r, log, fifo, req.Secret)
+	if !ok {
+		return
+	}
+	if !fifo.abort(tick, api.OutcomeCanceled) {
+		writeError(w, http.StatusConflict, "ticket is neither queued nor active")
+		return
+	}
+	log.Info("ticket canceled")
+}
+
+func (s *fifoManager) delete(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "delete", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return
+	}
+	if !fifo.checkOwnerSecret(req.Secret) {
+		log.Warn("invalid owner secret")
+		writeError(w, http.StatusForbidden, "invalid owner secret")
+		return
+	}
+
+	s.retire(fifoKey(namespaceOf(r), r.PathValue("uuid")), fifo)
+	fifo.stop()
+	fifo.notifyWebhooks(api.EventFifoDeleted, nil)
+	log.Info("fifo deleted")
+}
+
+// adminCancel removes a ticket from the queue, or ends its turn if it is
+// active. Requires the owner secret.
+func (s *fifoManager) adminCancel(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "adminCancel", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Info("called")
+
+	fifo, tick, ok := s.getFifoAsOwner(w, r, log)
+	if !ok {
+		return
+	}
+	if !fifo.abort(tick, api.OutcomeCanceledByOwner) {
+		writeError(w, http.StatusConflict, "ticket is neither queued nor active")
+		return
+	}
+	log.Info("ticket canceled by owner")
+}
+
+// transfer hands a ticket over to another client, like the replacement of a
+// restarted job, which keeps the place of the ticket in the queue or its
+// turn. Requires the ticket secret or the owner secret.
+func (s *fifoManager) transfer(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "transfer", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoTransferRequest](w, r)
+	if !ok {
+		return
+	}
+	tick, ok := fifo.ticketLookup.Get(r.PathValue("ticket"))
+	if !ok {
+		log.Warn("ticket not found")
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return
+	}
+	identity := clientIdentity(r, req.Identity)
+	resp, ok := fifo.transfer(tick, req.Secret, identity)
+	if !ok {
+		log.Warn("invalid secret")
+		writeError(w, http.StatusForbidden, "invalid ticket or owner secret")
+		return
+	}
+	log.Info("ticket transferred", "identity", identity)
+	encode(w, 200, resp)
+}
+
+// adminBump moves a queued ticket to the front of the queue. Requires the
+// owner secret.
+func (s *fifoManager) adminBump(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "adminBump", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Info("called")
+
+	fifo, tick, ok := s.getFifoAsOwner(w, r, log)
+	if !ok {
+		return
+	}
+	if !fifo.bump(tick) {
+		writeError(w, http.StatusConflict, "ticket is not queued")
+		return
+	}
+	log.Info("ticket bumped by owner")
+}
+
+// adminComplete ends the turn of the active ticket, as if it called done.
+// Requires the owner secret.
+func (s *fifoManager) adminComplete(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "adminComplete", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	fifo, _, ok := s.getFifoAsOwner(w, r, log)
+	if !ok {
+		return
+	}
+	tick, ok := fifo.activeTicket()
+	if !ok || !fifo.abort(tick, api.OutcomeCompletedByOwner) {
+		writeError(w, http.StatusConflict, "no active ticket")
+		return
+	}
+	log.Info("ticket completed by owner", "ticket", tick.TicketID)
+}
+
+// getFifoAsOwner returns the fifo of the request and the ticket, if the path
+// names one. It writes an error response if the request doesn't carry the
+// owner secret.
+func (s *fifoManager) getFifoAsOwner(w http.ResponseWriter, r *http.Request, log *slog.Logger) (*fifo, *ticket, bool) {
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return nil, nil, false
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if !fifo.checkOwnerSecret(req.Secret) {
+		log.Warn("invalid owner secret")
+		writeError(w, http.StatusForbidden, "invalid owner secret")
+		return nil, nil, false
+	}
+	if r.PathValue("ticket") == "" {
+		return fifo, nil, true
+	}
+	tick, ok := fifo.ticketLookup.Get(r.PathValue("ticket"))
+	if !ok {
+		log.Warn("ticket not found")
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return nil, nil, false
+	}
+	return fifo, tick, true
+}
+
+func (s *fifoManager) status(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "status", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Debug("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	encodeWithETag(w, r, 200, fifo.status())
+}
+
+func (s *fifoManager) history(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "history", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Debug("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	encode(w, 200, api.FifoHistoryResponse{UUID: fifo.uuid, Tickets: fifo.recentHistory()})
+}
+
+func (s *fifoManager) list(w http.ResponseWriter, r *http.Request) {
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return
+	}
+	log := s.log.With("call", "list", "namespace", ns)
+	log.Debug("called")
+
+	resp := api.FifoListResponse{Fifos: []api.FifoStatusResponse{}}
+	for _, fifo := range s.fifos.GetAll() {
+		if fifo.namespace == ns {
+			resp.Fifos = append(resp.Fifos, fifo.status())
+		}
+	}
+	slices.SortFunc(resp.Fifos, func(a, b api.FifoStatusResponse) int {
+		return strings.Compare(a.UUID.String(), b.UUID.String())
+	})
+	encode(w, 200, resp)
+}
+
+// authorizeNamespace checks that the namespace of the request is valid and
+// the client may access it. It writes an error response otherwise.
+func (s *fifoManager) authorizeNamespace(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ns := namespaceOf(r)
+	if !validNamespace(ns) {
+		writeError(w, http.StatusBadRequest, "invalid namespace")
+		return "", false
+	}
+	if !principalFrom(r.Context()).mayAccess(ns) {
+		s.log.Warn("namespace access denied", "namespace", ns, "identity", principalFrom(r.Context()).identity)
+		writeError(w, http.StatusForbidden, "access to namespace denied")
+		return "", false
+	}
+	return ns, true
+}
+
+// getFifo returns the fifo of the request. It writes an error response if
+// the fifo doesn't exist or the client may not access it.
+func (s *fifoManager) getFifo(w http.ResponseWriter, r *http.Request, log *slog.Logger) (*fifo, bool) {
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return nil, false
+	}
+	fifo, ok := s.fifos.Get(fifoKey(ns, r.PathValue("uuid")))
+	if !ok {
+		log.Warn("fifo not found")
+		writeError(w, http.StatusNotFound, "fifo not found")
+		return nil, false
+	}
+	return fifo, true
+}
+
+// ticketSecret returns the ticket secret of a request without a body, from
+// the header or else the query of earlier clients.
+func ticketSecret(r *http.Request) string {
+	if secret := r.Header.Get(api.TicketSecretHeader); secret != "" {
+		return secret
+	}
+	return r.URL.Query().Get("secret")
+}
+
+// getTicket returns the ticket of the request. It writes an error response if
+// the ticket doesn't exist or secret isn't the ticket secret.
+func (s *fifoManager) getTicket(w http.ResponseWriter, r *http.Request, log *slog.Logger, fifo *fifo, secret string) (*ticket, bool) {
+	tick, ok := fifo.ticketLookup.Get(r.PathValue("ticket"))
+	if !ok {
+		log.Warn("ticket not found")
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return nil, false
+	}
+	if !fifo.checkTicketSecret(tick, secret) {
+		log.Warn("invalid secret")
+		writeError(w, http.StatusForbidden, "invalid ticket secret")
+		return nil, false
+	}
+	return tick, true
+}
+
+// acquireWaiter reserves a slot for a wait request on the fifo and the
+// server and takes a wait of the quotas. It writes a retriable error if a
+// limit is reached, or 429 if a quota is exhausted. The returned function
+// releases the slot.
+func (s *fifoManager) acquireWaiter(w http.ResponseWriter, r *http.Request, log *slog.Logger, fifo *fifo) (func(), bool) {
+	releaseQuota, ok := s.acquireQuota(w, r, log, fifo.namespace, quotaWaits)
+	if !ok {
+		return nil, false
+	}
+	fifoWaiters := fifo.waiters.Add(1)
+	totalWaiters := s.waiters.Add(1)
+	release := func() {
+		fifo.waiters.Add(-1)
+		s.waiters.Add(-1)
+		releaseQuota()
+	}
+	cfg := s.config()
+	if cfg.MaxWaiters > 0 && fifoWaiters > int64(cfg.MaxWaiters) {
+		release()
+		log.Warn("too many waiters on fifo", "limit", cfg.MaxWaiters)
+		unavailable(w, "too many waiters on fifo")
+		return nil, false
+	}
+	if cfg.MaxTotalWaiters > 0 && totalWaiters > int64(cfg.MaxTotalWaiters) {
+		release()
+		log.Warn("too many waiters on server", "limit", cfg.MaxTotalWaiters)
+		unavailable(w, "too many waiters on server")
+		return nil, false
+	}
+	return release, true
+}
+
+// clientIdentity returns the identity of the client. An identity derived
+// from authentication takes precedence over one provided by the client
+// through the header or the request.
+func clientIdentity(r *http.Request, requested string) string {
+	if identity := principalFrom(r.Context()).identity; identity != "" {
+		return identity
+	}
+	if identity := r.Header.Get(api.IdentityHeader); identity != "" {
+		return identity
+	}
+	return requested
+}
+
+// traceparentRegexp matches the traceparent header of the W3C Trace Context,
+// capturing the trace ID.
+var traceparentRegexp = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// traceIDOf returns the trace ID of the traceparent header of the request,
+// or an empty string if there is no valid one.
+func traceIDOf(r *http.Request) string {
+	m := traceparentRegexp.FindStringSubmatch(r.Header.Get(api.TraceparentHeader))
+	if m == nil || m[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	return m[1]
+}
+
+// defaultNamespace is used for requests on the paths without namespace.
+const defaultNamespace = "default"
+
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+func validNamespace(ns string) bool {
+	return namespaceRegexp.MatchString(ns)
+}
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([-_.a-zA-Z0-9]{0,126}[a-zA-Z0-9])?$`)
+
+// validName reports whether name is a valid name of a fifo. Names are safe
+// to use in file names.
+func validName(name string) bool {
+	return nameRegexp.MatchString(name)
+}
+
+// forgetName drops the name of the stopped fifo, unless it was taken over by
+// another fifo meanwhile.
+func (s *fifoManager) forgetName(f *fifo) {
+	s.namesMux.Lock()
+	defer s.namesMux.Unlock()
+	key := fifoKey(f.namespace, f.name)
+	if cur, ok := s.names.Get(key); ok && cur == f {
+		s.names.Delete(key)
+	}
+}
+
+func namespaceOf(r *http.Request) string {
+	if ns := r.PathValue("namespace"); ns != "" {
+		return ns
+	}
+	return defaultNamespace
+}
+
+func fifoKey(namespace, uuid string) string {
+	return namespace + "/" + uuid
+}
+
+// newSecret returns a random hex encoded secret.
+func newSecret() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+var fifoDeletedEvent = struct {
+	Type string `json:"type"`
+}{api.EventFifoDeleted}
+
+// maxRequestBody limits the size of request bodies, see limitBody.
+const maxRequestBody = 1 << 20
+
+// decodeRequest decodes the JSON body of the request. An empty body decodes
+// to the zero value. It writes an error response on failure.
+func decodeRequest[T any](w http.ResponseWriter, r *http.Request) (T, bool) {
+	var req T
+	err := json.NewDecoder(r.Body).Decode(&req)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+		return req, false
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return req, false
+	}
+	return req, true
+}
+
+// queryAsBody passes the query parameters of legacy requests to the handler
+// as JSON body, as if they were made against the current API.
+func queryAsBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]string{}
+		for key, values := range r.URL.Query() {
+			params[key] = values[0]
+		}
+		body, err := json.Marshal(params)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next(w, r)
+	}
+}
+
+// eventStream writes server-sent events.
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	return &eventStream{w: w, rc: http.NewResponseController(w)}
+}
+
+func (s *eventStream) send(event string, data any) error {
+	return s.sendID(0, event, data)
+}
+
+// sendID sends an event with the ID, so clients can resume the stream after
+// it. Events with ID 0 are sent without.
+func (s *eventStream) sendID(id uint64, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encode json: %w", err)
+	}
+	if id != 0 {
+		if _, err := fmt.Fprintf(s.w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *eventStream) flush() error {
+	return s.rc.Flush()
+}
+
+// unavailable tells the client to retry the request later.
+func unavailable(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", "5")
+	writeError(w, http.StatusServiceUnavailable, msg)
+}
+
+func encode[T any](w http.ResponseWriter, status int, v T) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return fmt.Errorf("encode json: %w", err)
+	}
+	return nil
+}
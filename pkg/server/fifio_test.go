@@ -0,0 +1,436 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaiterLimits(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	cfg.MaxWaiters = 1
+	cfg.MaxTotalWaiters = 2
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Two fifos with an active ticket and one queued ticket each.
+	var queued []*ticket
+	var fifos []*fifo
+	for range 2 {
+		fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+		fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+		fifo.start(func() {})
+		fifo.enqueue(newTicket(""))
+		tick := newTicket("")
+		fifo.enqueue(tick)
+		fifos = append(fifos, fifo)
+		queued = append(queued, tick)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wait := func(f *fifo, tick *ticket) (*http.Response, error) {
+		u := srv.URL + "/v1/fifo/" + f.uuid.String() + "/wait/" + tick.TicketID.String() + "?" + url.Values{"secret": {tick.Secret}}.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+		if err != nil {
+			return nil, err
+		}
+		return http.DefaultClient.Do(req)
+	}
+	blockingWait := func(f *fifo, tick *ticket) {
+		go func() {
+			if resp, err := wait(f, tick); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	rejected := func(f *fifo, tick *ticket) {
+		resp, err := wait(f, tick)
+		require.NoError(err)
+		resp.Body.Close()
+		require.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+		require.NotEmpty(resp.Header.Get("Retry-After"))
+	}
+
+	blockingWait(fifos[0], queued[0])
+	require.Eventually(func() bool { return fifos[0].waiters.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// The fifo is at its limit.
+	rejected(fifos[0], queued[0])
+
+	// The server reaches its limit with the waiter on the second fifo.
+	blockingWait(fifos[1], queued[1])
+	require.Eventually(func() bool { return fm.waiters.Load() == 2 }, time.Second, 10*time.Millisecond)
+	third := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(third.namespace, third.uuid.String()), third)
+	tick := newTicket("")
+	third.enqueue(tick)
+	rejected(third, tick)
+
+	// Slots are released when waiters leave.
+	cancel()
+	require.Eventually(func() bool { return fm.waiters.Load() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestNamedFifo(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+	newNamed := func(name string) (api.FifoNewResponse, int) {
+		b, err := json.Marshal(api.FifoNewRequest{Name: name})
+		require.NoError(err)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/fifo/new", strings.NewReader(string(b))))
+		var resp api.FifoNewResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return resp, rec.Code
+	}
+
+	_, code := newNamed("../deploy")
+	require.Equal(http.StatusBadRequest, code)
+
+	// The fifo is created once, later requests get it without owner secret.
+	created, code := newNamed("deploy")
+	require.Equal(http.StatusOK, code)
+	require.False(created.Existing)
+	require.NotEmpty(created.OwnerSecret)
+	existing, _ := newNamed("deploy")
+	require.True(existing.Existing)
+	require.Equal(created.UUID, existing.UUID)
+	require.Empty(existing.OwnerSecret)
+	other, _ := newNamed("other")
+	require.NotEqual(created.UUID, other.UUID)
+
+	// The name is free again once the fifo is deleted.
+	fifo, ok := fm.fifos.Get(fifoKey(defaultNamespace, created.UUID.String()))
+	require.True(ok)
+	fifo.stop()
+	require.Eventually(func() bool {
+		_, ok := fm.names.Get(fifoKey(defaultNamespace, "deploy"))
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	recreated, _ := newNamed("deploy")
+	require.False(recreated.Existing)
+	require.NotEqual(created.UUID, recreated.UUID)
+}
+
+func TestTicketIdempotencyKey(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	fifo.start(func() {})
+
+	ticket := func(key string) api.FifoTicketResponse {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/fifo/"+fifo.uuid.String()+"/ticket", strings.NewReader("{}"))
+		require.NoError(err)
+		if key != "" {
+			req.Header.Set(api.IdempotencyKeyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer resp.Body.Close()
+		require.Equal(http.StatusOK, resp.StatusCode)
+		var ticket api.FifoTicketResponse
+		require.NoError(json.NewDecoder(resp.Body).Decode(&ticket))
+		return ticket
+	}
+
+	first := ticket("key-1")
+	require.Equal(first, ticket("key-1"))
+	require.NotEqual(first.TicketID, ticket("key-2").TicketID)
+	require.NotEqual(ticket("").TicketID, ticket("").TicketID)
+	require.Len(fifo.ticketLookup.GetAll(), 4)
+
+	// Concurrent retries get the same ticket.
+	startC := make(chan struct{})
+	respC := make(chan *httptest.ResponseRecorder)
+	for range 50 {
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/v1/fifo/"+fifo.uuid.String()+"/ticket", strings.NewReader("{}"))
+			req.Header.Set(api.IdempotencyKeyHeader, "key-3")
+			rec := httptest.NewRecorder()
+			<-startC
+			mux.ServeHTTP(rec, req)
+			respC <- rec
+		}()
+	}
+	close(startC)
+	var retried []string
+	for range 50 {
+		rec := <-respC
+		require.Equal(http.StatusOK, rec.Code)
+		retried = append(retried, rec.Body.String())
+	}
+	require.Len(slices.Compact(retried), 1)
+	require.Len(fifo.ticketLookup.GetAll(), 5)
+
+	// Keys are forgotten when the ticket ends.
+	tick, ok := fifo.ticketLookup.Get(first.TicketID.String())
+	require.True(ok)
+	require.True(fifo.abort(tick, api.OutcomeCanceledByOwner))
+	require.Eventually(func() bool {
+		_, ok := fifo.ticketsByKey.Get("key-1")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	require.NotEqual(first.TicketID, ticket("key-1").TicketID)
+}
+
+func TestTicketTrace(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+
+	testCases := map[string]string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-01":                  "",
+		"":                                                        "",
+	}
+	for traceparent, wantTraceID := range testCases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/fifo/"+fifo.uuid.String()+"/ticket", strings.NewReader("{}"))
+		req.Header.Set(api.TraceparentHeader, traceparent)
+		mux.ServeHTTP(rec, req)
+		require.Equal(http.StatusOK, rec.Code)
+		var resp api.FifoTicketResponse
+		require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		tick, ok := fifo.ticketLookup.Get(resp.TicketID.String())
+		require.True(ok)
+		require.Equal(wantTraceID, fifoEventOf(tick, api.EventTicketNotified).TraceID, traceparent)
+	}
+}
+
+func TestTicketTransfer(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	fifo.start(func() {})
+
+	do := func(path string, body any) *httptest.ResponseRecorder {
+		b, err := json.Marshal(body)
+		require.NoError(err)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/fifo/"+fifo.uuid.String()+path, strings.NewReader(string(b))))
+		return rec
+	}
+	transfer := func(ticket api.FifoTicketResponse, req api.FifoTransferRequest) api.FifoTicketResponse {
+		rec := do("/transfer/"+ticket.TicketID.String(), req)
+		require.Equal(http.StatusOK, rec.Code)
+		var resp api.FifoTicketResponse
+		require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		require.Equal(ticket.TicketID, resp.TicketID)
+		require.NotEqual(ticket.Secret, resp.Secret)
+		return resp
+	}
+
+	rec := do("/ticket", api.FifoTicketRequest{Identity: "job-1"})
+	require.Equal(http.StatusOK, rec.Code)
+	var first api.FifoTicketResponse
+	require.NoError(json.NewDecoder(rec.Body).Decode(&first))
+
+	require.Equal(http.StatusForbidden, do("/transfer/"+first.TicketID.String(), api.FifoTransferRequest{Secret: "wrong"}).Code)
+	require.Equal(http.StatusNotFound, do("/transfer/"+fifo.uuid.String(), api.FifoTransferRequest{Secret: first.Secret}).Code)
+
+	second := transfer(first, api.FifoTransferRequest{Secret: first.Secret, Identity: "job-2"})
+	tick, ok := fifo.ticketLookup.Get(first.TicketID.String())
+	require.True(ok)
+	fifo.mux.Lock()
+	require.Equal("job-2", tick.identity)
+	fifo.mux.Unlock()
+
+	// The secret of the previous owner is no longer valid.
+	require.Equal(http.StatusForbidden, do("/heartbeat/"+first.TicketID.String(), api.FifoSecretRequest{Secret: first.Secret}).Code)
+
+	third := transfer(second, api.FifoTransferRequest{Secret: fifo.ownerSecret})
+	require.Equal(http.StatusForbidden, do("/heartbeat/"+first.TicketID.String(), api.FifoSecretRequest{Secret: second.Secret}).Code)
+	require.Equal(http.StatusOK, do("/heartbeat/"+first.TicketID.String(), api.FifoSecretRequest{Secret: third.Secret}).Code)
+}
+
+func TestDoneEndedTicket(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	cfg.WaitTimeout = 200 * time.Millisecond
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	fifo.start(func() {})
+
+	do := func(ctx context.Context, path string, body any) *httptest.ResponseRecorder {
+		b, err := json.Marshal(body)
+		require.NoError(err)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/fifo/"+fifo.uuid.String()+path, strings.NewReader(string(b)))
+		mux.ServeHTTP(rec, req.WithContext(ctx))
+		return rec
+	}
+	ticket := func() api.FifoTicketResponse {
+		rec := do(context.Background(), "/ticket", api.FifoTicketRequest{})
+		require.Equal(http.StatusOK, rec.Code)
+		var resp api.FifoTicketResponse
+		require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+
+	// The owner never calls wait, so done blocks until the client
+	// disconnects or the ticket expires.
+	resp := ticket()
+	done := "/done/" + resp.TicketID.String()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	do(ctx, done, api.FifoSecretRequest{Secret: resp.Secret})
+	require.Error(ctx.Err())
+	require.Equal(http.StatusConflict, do(context.Background(), done, api.FifoSecretRequest{Secret: resp.Secret}).Code)
+}
+
+func TestAcceptGrace(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	cfg.WaitTimeout = 20 * time.Millisecond
+	cfg.AcceptRetries = 2
+	cfg.AcceptGrace = 20 * time.Millisecond
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	events, unsubscribe := fifo.subscribe()
+	defer unsubscribe()
+	fifo.start(func() {})
+	defer fifo.stop()
+
+	next := func() api.FifoEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			require.FailNow("no event")
+			return api.FifoEvent{}
+		}
+	}
+
+	// A slow owner is re-notified until the retries are used up.
+	slow := newTicket("")
+	fifo.enqueue(slow)
+	require.Equal(api.EventTicketCreated, next().Type)
+	for i := range 3 {
+		ev := next()
+		require.Equal(api.EventTicketNotified, ev.Type)
+		require.Equal(i, ev.Renotified)
+	}
+	require.Equal(api.EventTicketExpired, next().Type)
+
+	// An owner calling wait within the grace window keeps its turn.
+	late := newTicket("")
+	fifo.enqueue(late)
+	require.Equal(api.EventTicketCreated, next().Type)
+	require.Equal(api.EventTicketNotified, next().Type)
+	require.Equal(1, next().Renotified)
+	fifo.accept(late)
+	require.Equal(api.EventTicketAccepted, next().Type)
+}
+
+func TestWaiterPolicy(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+
+	post := func(t *testing.T, path, body string, resp any) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/fifo"+path, strings.NewReader(body)))
+		if resp != nil && rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(resp))
+		}
+		return rec.Code
+	}
+	// newTicket creates a fifo with the waiter policy and returns a wait
+	// for its first ticket, which is its turn right away.
+	newTicket := func(t *testing.T, policy string) func(token string) int {
+		var created api.FifoNewResponse
+		require.Equal(t, http.StatusOK, post(t, "/new", `{"waiter_policy": "`+policy+`"}`, &created))
+		var tick api.FifoTicketResponse
+		require.Equal(t, http.StatusOK, post(t, "/"+created.UUID.String()+"/ticket", "{}", &tick))
+		return func(token string) int {
+			query := url.Values{"secret": {tick.Secret}, "wait_token": {token}}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/fifo/"+created.UUID.String()+"/wait/"+tick.TicketID.String()+"?"+query.Encode(), http.NoBody))
+			return rec.Code
+		}
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, post(t, "/new", `{"waiter_policy": "some"}`, nil))
+	})
+	t.Run("all", func(t *testing.T) {
+		wait := newTicket(t, api.WaiterPolicyAll)
+		require.Equal(t, http.StatusOK, wait(""))
+		require.Equal(t, http.StatusOK, wait(""))
+	})
+	t.Run("first", func(t *testing.T) {
+		wait := newTicket(t, api.WaiterPolicyFirst)
+		require.Equal(t, http.StatusOK, wait("a"))
+		require.Equal(t, http.StatusConflict, wait("a"))
+	})
+	t.Run("token", func(t *testing.T) {
+		wait := newTicket(t, api.WaiterPolicyToken)
+		require.Equal(t, http.StatusBadRequest, wait(""))
+		require.Equal(t, http.StatusOK, wait("a"))
+		require.Equal(t, http.StatusOK, wait("a"))
+		require.Equal(t, http.StatusConflict, wait("b"))
+	})
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// gc drops the expired history entries and logged events of all fifos. Unused fifos and
+// deleted fifos past their retention are removed by their own timers.
+func (s *fifoManager) gc(now time.Time) api.GCResponse {
+	var resp api.GCResponse
+	for _, fifo := range s.fifos.GetAll() {
+		fifo.mux.Lock()
+		resp.HistoryEntries += fifo.pruneHistory(now)
+		resp.Events += fifo.pruneEvents(now)
+		fifo.mux.Unlock()
+		resp.Fifos++
+	}
+	return resp
+}
+
+// runGC sweeps the fifos every interval until the context is done.
+func (s *fifoManager) runGC(ctx context.Context, interval time.Duration) {
+	log := s.log.With("call", "gc")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			resp := s.gc(now)
+			log.Debug("garbage collected", "fifos", resp.Fifos, "historyEntries", resp.HistoryEntries, "events", resp.Events)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// gcHandler sweeps the fifos on demand.
+func (s *fifoManager) gcHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "gc")
+	log.Info("called")
+	resp := s.gc(time.Now())
+	log.Info("garbage collected", "fifos", resp.Fifos, "historyEntries", resp.HistoryEntries, "events", resp.Events)
+	encode(w, 200, resp)
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	fifo := newFifo("", fm.cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	now := time.Now()
+	for _, age := range []time.Duration{48 * time.Hour, 25 * time.Hour, time.Hour} {
+		fifo.history = append(fifo.history, api.FifoHistoryEntry{EndedAt: now.Add(-age)})
+	}
+
+	require.Equal(api.GCResponse{Fifos: 1, HistoryEntries: 2}, fm.gc(now))
+	require.Len(fifo.history, 1)
+	require.Equal(api.GCResponse{Fifos: 1}, fm.gc(now))
+	require.Equal(api.GCResponse{Fifos: 1, HistoryEntries: 1}, fm.gc(now.Add(24*time.Hour)))
+}
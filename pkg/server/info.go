@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// Version is the version of the server, set at build time.
+var Version = "0.0.0-dev"
+
+// serverInfo serves the version and status of the server, so clients can
+// check their configuration before relying on it.
+type serverInfo struct {
+	started time.Time
+	fifos   *fifoManager
+	now     func() time.Time
+}
+
+func newServerInfo(fifos *fifoManager) *serverInfo {
+	return &serverInfo{started: time.Now(), fifos: fifos, now: time.Now}
+}
+
+// registerHandlers registers the server info API under the prefix.
+func (i *serverInfo) registerHandlers(mux *http.ServeMux, prefix string) {
+	for _, rt := range i.routes() {
+		mux.HandleFunc(rt.method+" "+prefix+rt.path, rt.handler)
+	}
+}
+
+// routes returns the handlers of the server info API with their path
+// relative to the prefix they are registered under. Keep openapi.yaml in
+// sync.
+func (i *serverInfo) routes() []route {
+	return []route{
+		{http.MethodGet, "/version", i.version},
+		{http.MethodGet, "/status", i.status},
+	}
+}
+
+func (i *serverInfo) version(w http.ResponseWriter, r *http.Request) {
+	encode(w, 200, api.VersionResponse{Version: Version, APIVersion: api.Version})
+}
+
+func (i *serverInfo) status(w http.ResponseWriter, r *http.Request) {
+	encode(w, 200, api.ServerStatusResponse{
+		Backend:   "memory",
+		StartedAt: i.started,
+		Uptime:    i.now().Sub(i.started).Round(time.Second).String(),
+		Fifos:     len(i.fifos.fifos.GetAll()),
+		Waiters:   i.fifos.waiters.Load(),
+		Deadlocks: len(i.fifos.findDeadlocks()),
+	})
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerInfoStatus(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	fifo := newFifo(defaultNamespace, DefaultConfig().Fifo, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	info := newServerInfo(fm)
+	info.now = func() time.Time { return info.started.Add(90 * time.Minute) }
+	mux := http.NewServeMux()
+	info.registerHandlers(mux, "/v1")
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/status", http.NoBody))
+	require.Equal(http.StatusOK, rec.Code)
+	var status api.ServerStatusResponse
+	require.NoError(json.NewDecoder(rec.Body).Decode(&status))
+	require.Equal("memory", status.Backend)
+	require.Equal("1h30m0s", status.Uptime)
+	require.Equal(1, status.Fifos)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/katexochen/sync/api"
+)
+
+// logLevel serves the level of the server log, so it can be raised to debug
+// a running server without a restart.
+type logLevel struct {
+	level *slog.LevelVar
+	log   *slog.Logger
+}
+
+func newLogLevel(level *slog.LevelVar, log *slog.Logger) *logLevel {
+	return &logLevel{level: level, log: log}
+}
+
+// routes returns the handlers of the log level API with their path relative
+// to the prefix they are registered under. Keep openapi.yaml in sync.
+func (l *logLevel) routes() []route {
+	return []route{
+		{http.MethodGet, "/log-level", l.get},
+		{http.MethodPut, "/log-level", l.set},
+	}
+}
+
+func (l *logLevel) get(w http.ResponseWriter, r *http.Request) {
+	encode(w, 200, api.LogLevelResponse{Level: strings.ToLower(l.level.Level().String())})
+}
+
+func (l *logLevel) set(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRequest[api.LogLevelRequest](w, r)
+	if !ok {
+		return
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Log at warn, so the change is visible at any level.
+	l.log.Warn("log level changed", "call", "setLogLevel", "from", l.level.Level(), "to", level)
+	l.level.Set(level)
+	l.get(w, r)
+}
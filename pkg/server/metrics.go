@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics serves gauges of all fifos in the Prometheus text format, so
+// head-of-line blocking can be detected by standard alerting, see
+// server/alerts.yml for example rules. Scrapers accepting the
+// OpenMetrics format also get the trace IDs of tickets as exemplars of the
+// wait time histogram.
+type metrics struct {
+	fifos *fifoManager
+	now   func() time.Time
+}
+
+func newMetrics(fifos *fifoManager) *metrics {
+	return &metrics{fifos: fifos, now: time.Now}
+}
+
+// registerHandlers serves the metrics under /metrics, wrapped with the
+// handed middleware.
+func (m *metrics) registerHandlers(mux *http.ServeMux, wrap func(http.Handler) http.Handler) {
+	mux.Handle("GET /metrics", wrap(http.HandlerFunc(m.serve)))
+}
+
+// fifoGauge is a gauge with a sample per fifo.
+type fifoGauge struct {
+	name  string
+	help  string
+	value func(s fifoSample) float64
+}
+
+var fifoGauges = []fifoGauge{
+	{
+		name:  "sync_fifo_active_seconds",
+		help:  "Time the active ticket holds the fifo since it was notified, 0 if none is active.",
+		value: func(s fifoSample) float64 { return s.active.Seconds() },
+	},
+	{
+		name:  "sync_fifo_oldest_queued_seconds",
+		help:  "Age of the oldest queued ticket, 0 if none is queued.",
+		value: func(s fifoSample) float64 { return s.oldestQueued.Seconds() },
+	},
+	{
+		name:  "sync_fifo_queued_tickets",
+		help:  "Number of queued tickets.",
+		value: func(s fifoSample) float64 { return float64(s.queued) },
+	},
+}
+
+// fifoSample is the state of a fifo the gauges are taken from.
+type fifoSample struct {
+	namespace    string
+	uuid         string
+	active       time.Duration
+	oldestQueued time.Duration
+	queued       int
+}
+
+func (m *metrics) serve(w http.ResponseWriter, r *http.Request) {
+	now := m.now()
+	var samples []fifoSample
+	for _, fifo := range m.fifos.fifos.GetAll() {
+		samples = append(samples, fifo.sample(now))
+	}
+	// Sort for a stable output, the store has no order.
+	slices.SortFunc(samples, func(a, b fifoSample) int {
+		return strings.Compare(fifoKey(a.namespace, a.uuid), fifoKey(b.namespace, b.uuid))
+	})
+
+	// Exemplars are only part of the OpenMetrics format.
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	for _, g := range fifoGauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, s := range samples {
+			fmt.Fprintf(w, "%s{namespace=%q,fifo=%q} %g\n", g.name, s.namespace, s.uuid, g.value(s))
+		}
+	}
+	m.fifos.waitTimes.write(w, "sync_fifo_wait_seconds", "Time tickets waited from their creation until their turn.", openMetrics)
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+// sample returns the state of the fifo at now.
+func (f *fifo) sample(now time.Time) fifoSample {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	s := fifoSample{namespace: f.namespace, uuid: f.uuid.String(), queued: len(f.queue)}
+	if f.active != nil {
+		s.active = now.Sub(f.active.notifiedAt)
+	}
+	for _, t := range f.queue {
+		s.oldestQueued = max(s.oldestQueued, now.Sub(t.createdAt))
+	}
+	return s
+}
+
+// waitBuckets are the upper bounds of the buckets of the wait time
+// histogram, in seconds.
+var waitBuckets = []float64{1, 5, 15, 60, 300, 900, 3600, 4 * 3600}
+
+// histogram counts observations in buckets. Each bucket keeps its last
+// observation that was made in a trace as exemplar, so a latency spike can
+// be followed to the trace of a ticket.
+type histogram struct {
+	bounds []float64
+
+	mux sync.Mutex
+	// counts and exemplars have a bucket per bound and one for +Inf.
+	counts    []uint64
+	exemplars []exemplar
+	sum       float64
+	count     uint64
+}
+
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds:    bounds,
+		counts:    make([]uint64, len(bounds)+1),
+		exemplars: make([]exemplar, len(bounds)+1),
+	}
+}
+
+// observe records the value, with the trace ID if it was made in a trace.
+// Observations on a nil histogram are dropped.
+func (h *histogram) observe(v float64, traceID string) {
+	if h == nil {
+		return
+	}
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	if traceID != "" {
+		h.exemplars[i] = exemplar{traceID: traceID, value: v, time: time.Now()}
+	}
+}
+
+// write writes the histogram in the Prometheus text format, or with
+// exemplars in the OpenMetrics format.
+func (h *histogram) write(w io.Writer, name, help string, openMetrics bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'f', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d", name, le, cumulative)
+		if ex := h.exemplars[i]; openMetrics && ex.traceID != "" {
+			fmt.Fprintf(w, " # {trace_id=%q} %g %.3f", ex.traceID, ex.value, float64(ex.time.UnixMilli())/1000)
+		}
+		fmt.Fprint(w, "\n")
+	}
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
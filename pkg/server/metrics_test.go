@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	fifo := newFifo("default", fm.cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	fifo.waitTimes = fm.waitTimes
+	for range 3 {
+		fifo.enqueue(newTicket(""))
+	}
+	fifo.queue[0].traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	active, ok := fifo.next()
+	require.True(ok)
+
+	m := newMetrics(fm)
+	m.now = func() time.Time { return active.notifiedAt.Add(90 * time.Second) }
+	mux := http.NewServeMux()
+	m.registerHandlers(mux, func(h http.Handler) http.Handler { return h })
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	require.Equal(http.StatusOK, rec.Code)
+	labels := `{namespace="default",fifo="` + fifo.uuid.String() + `"}`
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE sync_fifo_active_seconds gauge\n")
+	assert.Contains(t, body, "sync_fifo_active_seconds"+labels+" 90\n")
+	assert.Contains(t, body, "sync_fifo_queued_tickets"+labels+" 2\n")
+	// The queued tickets were created before the active one was notified.
+	assert.Regexp(t, regexp.QuoteMeta("sync_fifo_oldest_queued_seconds"+labels+" 90")+`(\.\d+)?\n`, body)
+	assert.Contains(t, body, "sync_fifo_wait_seconds_bucket{le=\"1\"} 1\n")
+	assert.Contains(t, body, "sync_fifo_wait_seconds_count 1\n")
+	assert.NotContains(t, body, "trace_id")
+
+	// Exemplars link the wait time to the trace of the ticket.
+	req := httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	body = rec.Body.String()
+	assert.Contains(t, body, `sync_fifo_wait_seconds_bucket{le="1"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} `)
+	assert.True(t, strings.HasSuffix(body, "# EOF\n"))
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+)
+
+// recoverPanics answers requests whose handler panicked with an internal
+// server error, instead of dropping the connection.
+func recoverPanics(log *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Error("handler panicked", "path", r.URL.Path, "err", err, "stack", string(debug.Stack()))
+			writeError(w, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody limits the size of request bodies to maxRequestBody. Requests
+// announcing a larger body are rejected before they reach the handler.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxRequestBody {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxRequestBody))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeError responds with the error as api.ErrorResponse.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	encode(w, status, api.ErrorResponse{Error: msg, Status: status})
+}
+
+// validIDs rejects requests whose uuid, ticket or item path parameters aren't
+// UUIDs.
+func validIDs(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, param := range []string{"uuid", "ticket", "item"} {
+			v := r.PathValue(param)
+			if v == "" {
+				continue
+			}
+			if _, err := uuidlib.Parse(v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s %q: not a UUID", param, v))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// gzipped compresses the response if the client accepts it. Only use it for
+// handlers writing their response at once, not for streams.
+func gzipped(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gw := &gzipResponseWriter{ResponseWriter: w, w: gz}
+		next(gw, r)
+		// Responses without a body don't get the gzip header and footer.
+		if gw.status != http.StatusNotModified {
+			gz.Close()
+		}
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if name, _, _ := strings.Cut(strings.TrimSpace(enc), ";"); name == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	w      io.Writer
+	status int
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.status = status
+	if status == http.StatusNotModified {
+		w.Header().Del("Content-Encoding")
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
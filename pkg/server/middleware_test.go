@@ -0,0 +1,124 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := recoverPanics(log, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestValidIDs(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{uuid}/wait/{ticket}", validIDs(func(w http.ResponseWriter, r *http.Request) {}))
+
+	testCases := map[string]int{
+		"/7b4e3f43-2fd3-4a4c-9d1f-1a3b0d1e6f52/wait/0c0b8f1e-5a43-4f7e-bd1c-0f35f0b6a8c1": http.StatusOK,
+		"/not-a-uuid/wait/0c0b8f1e-5a43-4f7e-bd1c-0f35f0b6a8c1":                           http.StatusBadRequest,
+		"/7b4e3f43-2fd3-4a4c-9d1f-1a3b0d1e6f52/wait/42":                                   http.StatusBadRequest,
+	}
+	for path, want := range testCases {
+		t.Run(path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, http.NoBody))
+			assert.Equal(t, want, rec.Code)
+			if want == http.StatusBadRequest {
+				assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	handler := limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decodeRequest[api.FifoTicketRequest](w, r)
+	}))
+
+	body := `{"identity": "` + strings.Repeat("a", maxRequestBody) + `"}`
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	var resp api.ErrorResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, api.ErrorResponse{Error: "request body exceeds 1048576 bytes", Status: http.StatusRequestEntityTooLarge}, resp)
+
+	// Bodies of unknown length are cut off while decoding.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestGzipped(t *testing.T) {
+	testCases := map[string]struct {
+		handler        http.HandlerFunc
+		acceptEncoding string
+		wantGzip       bool
+		wantStatus     int
+		wantBody       string
+	}{
+		"compressed": {
+			handler:        func(w http.ResponseWriter, r *http.Request) { encode(w, 200, "ok") },
+			acceptEncoding: "deflate, gzip;q=0.9",
+			wantGzip:       true,
+			wantStatus:     http.StatusOK,
+			wantBody:       "\"ok\"\n",
+		},
+		"compressed error": {
+			handler:        func(w http.ResponseWriter, r *http.Request) { writeError(w, http.StatusNotFound, "fifo not found") },
+			acceptEncoding: "gzip",
+			wantGzip:       true,
+			wantStatus:     http.StatusNotFound,
+			wantBody:       "{\"error\":\"fifo not found\",\"status\":404}\n",
+		},
+		"not accepted": {
+			handler:    func(w http.ResponseWriter, r *http.Request) { encode(w, 200, "ok") },
+			wantStatus: http.StatusOK,
+			wantBody:   "\"ok\"\n",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			rec := httptest.NewRecorder()
+			gzipped(tc.handler)(rec, r)
+
+			assert.Equal(tc.wantStatus, rec.Code)
+			var body io.Reader = rec.Body
+			if tc.wantGzip {
+				assert.Equal("gzip", rec.Header().Get("Content-Encoding"))
+				gz, err := gzip.NewReader(rec.Body)
+				if !assert.NoError(err) {
+					return
+				}
+				body = gz
+			} else {
+				assert.Empty(rec.Header().Get("Content-Encoding"))
+			}
+			got, err := io.ReadAll(body)
+			assert.NoError(err)
+			assert.Equal(tc.wantBody, string(got))
+		})
+	}
+}
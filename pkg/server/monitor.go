@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// monitor periodically checks all fifos and raises alerts for tickets that
+// are active too long, queues that grow too long and deadlocks. An alert is raised once
+// when its condition starts to hold and is resolved when it stops.
+type monitor struct {
+	cfg   AlertConfig
+	fifos *fifoManager
+	log   *slog.Logger
+	// firing holds the raised alerts.
+	firing map[alertID]bool
+}
+
+// alertID identifies an alert. Alerts about a ticket are raised again for
+// the next ticket.
+type alertID struct {
+	fifo   string
+	alert  string
+	ticket string
+}
+
+func newMonitor(cfg AlertConfig, fifos *fifoManager, log *slog.Logger) *monitor {
+	return &monitor{
+		cfg:    cfg,
+		fifos:  fifos,
+		log:    log.WithGroup("monitor"),
+		firing: map[alertID]bool{},
+	}
+}
+
+// enabled reports whether any alert is configured.
+func (m *monitor) enabled() bool {
+	return m.cfg.ActiveThreshold > 0 || m.cfg.QueueLimit > 0 || m.cfg.Deadlocks
+}
+
+// run checks the fifos every interval until the context is done.
+func (m *monitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.check(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check raises the alerts whose condition started to hold and returns them.
+func (m *monitor) check(now time.Time) []api.FifoWebhook {
+	var raised []api.FifoWebhook
+	seen := map[alertID]bool{}
+	for _, fifo := range m.fifos.fifos.GetAll() {
+		key := fifoKey(fifo.namespace, fifo.uuid.String())
+		active, since, queued := fifo.load()
+
+		var alerts []api.FifoWebhook
+		if m.cfg.ActiveThreshold > 0 && active != nil && now.Sub(since) > m.cfg.ActiveThreshold {
+			ev := fifoEventOf(active, api.EventFifoAlert)
+			alerts = append(alerts, api.FifoWebhook{
+				Alert: api.AlertTicketStuck,
+				Event: &ev,
+				Text: fmt.Sprintf("fifo %s: ticket %s is active for %s, longer than %s",
+					key, active.TicketID, now.Sub(since).Round(time.Second), m.cfg.ActiveThreshold),
+			})
+		}
+		if m.cfg.QueueLimit > 0 && queued > m.cfg.QueueLimit {
+			alerts = append(alerts, api.FifoWebhook{
+				Alert: api.AlertQueueTooLong,
+				Text:  fmt.Sprintf("fifo %s: %d tickets queued, more than %d", key, queued, m.cfg.QueueLimit),
+			})
+		}
+
+		for _, alert := range alerts {
+			if alert, ok := m.raise(fifo, alert, now, seen); ok {
+				raised = append(raised, alert)
+			}
+		}
+	}
+	if m.cfg.Deadlocks {
+		raised = append(raised, m.checkDeadlocks(now, seen)...)
+	}
+	for id := range m.firing {
+		if !seen[id] {
+			m.log.Info("alert resolved", "alert", id.alert, "fifo", id.fifo, "ticket", id.ticket)
+			delete(m.firing, id)
+		}
+	}
+	return raised
+}
+
+// raise raises the alert about the fifo, unless it is already firing, and
+// marks it as seen. It returns the sent alert and true if it was raised.
+func (m *monitor) raise(fifo *fifo, alert api.FifoWebhook, now time.Time, seen map[alertID]bool) (api.FifoWebhook, bool) {
+	id := alertID{fifo: fifoKey(fifo.namespace, fifo.uuid.String()), alert: alert.Alert}
+	if alert.Event != nil {
+		id.ticket = alert.Event.TicketID.String()
+	}
+	seen[id] = true
+	if m.firing[id] {
+		return alert, false
+	}
+	m.firing[id] = true
+	alert.Type = api.EventFifoAlert
+	alert.Namespace = fifo.namespace
+	alert.UUID = fifo.uuid
+	alert.Time = now
+	m.log.Warn("alert raised", "alert", alert.Alert, "namespace", fifo.namespace, "uuid", fifo.uuid.String(), "text", alert.Text)
+	fifo.sendWebhook(alert)
+	return alert, true
+}
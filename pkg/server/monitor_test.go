@@ -0,0 +1,50 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitorCheck(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	fifo := newFifo("default", fm.cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	for range 3 {
+		fifo.enqueue(newTicket(""))
+	}
+	active, ok := fifo.next()
+	require.True(ok)
+
+	mon := newMonitor(AlertConfig{ActiveThreshold: time.Minute, QueueLimit: 1, Interval: time.Second}, fm, log)
+	require.True(mon.enabled())
+
+	now := time.Now()
+	alerts := mon.check(now)
+	require.Len(alerts, 1)
+	require.Equal(api.AlertQueueTooLong, alerts[0].Alert)
+	require.Equal(fifo.uuid, alerts[0].UUID)
+
+	// Raised alerts aren't raised again while they hold.
+	alerts = mon.check(now.Add(2 * time.Minute))
+	require.Len(alerts, 1)
+	require.Equal(api.AlertTicketStuck, alerts[0].Alert)
+	require.Equal(active.TicketID, alerts[0].Event.TicketID)
+	require.Empty(mon.check(now.Add(3 * time.Minute)))
+
+	// The queue alert resolves, the alert for the next ticket is raised anew.
+	fifo.finish(active, api.OutcomeDone)
+	next, ok := fifo.next()
+	require.True(ok)
+	alerts = mon.check(now.Add(4 * time.Minute))
+	require.Len(alerts, 1)
+	require.Equal(next.TicketID, alerts[0].Event.TicketID)
+	require.Len(mon.firing, 1)
+}
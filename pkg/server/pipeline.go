@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+)
+
+// maxPipelineStages bounds the number of fifos of a pipeline.
+const maxPipelineStages = 16
+
+// pipeline is an ordered list of fifos in a namespace. A ticket that is done
+// in a stage is queued in the next stage with the same ID and secret.
+type pipeline struct {
+	namespace   string
+	uuid        uuidlib.UUID
+	stages      []uuidlib.UUID
+	ownerSecret string
+}
+
+// checkOwnerSecret reports whether secret is the owner secret of the
+// pipeline.
+func (p *pipeline) checkOwnerSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(p.ownerSecret)) == 1
+}
+
+// registerPipelineHandlers registers the pipeline API under the prefix.
+func (s *fifoManager) registerPipelineHandlers(mux *http.ServeMux, prefix string) {
+	for _, rt := range s.pipelineRoutes() {
+		mux.HandleFunc(rt.method+" "+prefix+rt.path, validIDs(rt.handler))
+	}
+}
+
+// pipelineRoutes returns the handlers of the pipeline API with their path
+// relative to the prefix they are registered under. Keep openapi.yaml in
+// sync.
+func (s *fifoManager) pipelineRoutes() []route {
+	return []route{
+		{http.MethodPost, "/new", s.newPipeline},
+		{http.MethodPost, "/{uuid}/ticket", s.pipelineTicket},
+		{http.MethodGet, "/{uuid}/status", s.pipelineStatus},
+		{http.MethodDelete, "/{uuid}", s.deletePipeline},
+	}
+}
+
+func (s *fifoManager) newPipeline(w http.ResponseWriter, r *http.Request) {
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.PipelineNewRequest](w, r)
+	if !ok {
+		return
+	}
+	if len(req.Stages) < 2 || len(req.Stages) > maxPipelineStages {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("between 2 and %d stages must be given", maxPipelineStages))
+		return
+	}
+	for i, uuid := range req.Stages {
+		if slices.Contains(req.Stages[:i], uuid) {
+			writeError(w, http.StatusBadRequest, "stages must not be given twice")
+			return
+		}
+		if _, ok := s.fifos.Get(fifoKey(ns, uuid.String())); !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("fifo %s not found", uuid))
+			return
+		}
+	}
+	p := &pipeline{
+		namespace:   ns,
+		uuid:        uuidlib.New(),
+		stages:      req.Stages,
+		ownerSecret: newSecret(),
+	}
+	log := s.log.With("call", "newPipeline", "namespace", ns, "uuid", p.uuid.String())
+	log.Info("called", "stages", len(p.stages))
+	s.pipelines.Put(fifoKey(ns, p.uuid.String()), p)
+	encode(w, 200, api.PipelineNewResponse{UUID: p.uuid, OwnerSecret: p.ownerSecret})
+}
+
+// pipelineTicket queues a ticket in the first stage of the pipeline.
+func (s *fifoManager) pipelineTicket(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "pipelineTicket", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	p, ok := s.getPipeline(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoTicketRequest](w, r)
+	if !ok {
+		return
+	}
+	fifo, ok := s.fifos.Get(fifoKey(p.namespace, p.stages[0].String()))
+	if !ok {
+		log.Warn("first stage not found", "stage", p.stages[0])
+		writeError(w, http.StatusGone, fmt.Sprintf("fifo %s of the first stage is gone", p.stages[0]))
+		return
+	}
+	select {
+	case <-fifo.stopC:
+		log.Warn("first stage deleted", "stage", p.stages[0])
+		writeError(w, http.StatusGone, fmt.Sprintf("fifo %s of the first stage is gone", p.stages[0]))
+		return
+	case <-s.shutdownC:
+		log.Warn("server shutting down")
+		unavailable(w, "server shutting down")
+		return
+	default:
+	}
+	after, err := resolveAfter(s.fifos.Get, p.namespace, req.After)
+	if err != nil {
+		log.Warn("invalid dependencies", "err", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tick := newTicket(clientIdentity(r, req.Identity))
+	tick.after = after
+	tick.onDone = s.advancePipeline(p, 1)
+	if !s.acquireTicketQuota(w, r, log, fifo, tick) {
+		return
+	}
+	log.Info("ticket created", "ticket", tick.TicketID, "identity", tick.identity)
+	resp := api.PipelineTicketResponse{FifoTicketResponse: tick.FifoTicketResponse, Stages: p.stages}
+	fifo.enqueue(tick)
+	encode(w, 200, resp)
+}
+
+// advancePipeline returns the function that queues a ticket that is done in
+// the stage before the given one in that stage. Nothing is queued after the
+// last stage or once the pipeline is deleted.
+func (s *fifoManager) advancePipeline(p *pipeline, stage int) func(api.FifoTicketResponse, string) {
+	if stage >= len(p.stages) {
+		return nil
+	}
+	return func(prev api.FifoTicketResponse, identity string) {
+		log := s.log.With("namespace", p.namespace, "pipeline", p.uuid.String(), "ticket", prev.TicketID, "stage", stage)
+		if cur, ok := s.pipelines.Get(fifoKey(p.namespace, p.uuid.String())); !ok || cur != p {
+			log.Info("pipeline deleted, ticket not advanced")
+			return
+		}
+		fifo, ok := s.fifos.Get(fifoKey(p.namespace, p.stages[stage].String()))
+		if !ok {
+			log.Warn("stage not found, ticket not advanced", "uuid", p.stages[stage])
+			return
+		}
+		tick := newTicket(identity)
+		tick.FifoTicketResponse = prev
+		tick.onDone = s.advancePipeline(p, stage+1)
+		fifo.enqueue(tick)
+		log.Info("ticket advanced", "uuid", p.stages[stage])
+	}
+}
+
+func (s *fifoManager) pipelineStatus(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "pipelineStatus", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Debug("called")
+
+	p, ok := s.getPipeline(w, r, log)
+	if !ok {
+		return
+	}
+	encode(w, 200, api.PipelineStatusResponse{UUID: p.uuid, Stages: p.stages})
+}
+
+// deletePipeline deletes the pipeline. Tickets in its stages stay queued,
+// but aren't advanced anymore. Requires the owner secret.
+func (s *fifoManager) deletePipeline(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "deletePipeline", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	p, ok := s.getPipeline(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return
+	}
+	if !p.checkOwnerSecret(req.Secret) {
+		log.Warn("invalid owner secret")
+		writeError(w, http.StatusForbidden, "invalid owner secret")
+		return
+	}
+	s.pipelines.Delete(fifoKey(p.namespace, p.uuid.String()))
+	log.Info("pipeline deleted")
+}
+
+// getPipeline returns the pipeline of the request. It writes an error
+// response if the pipeline doesn't exist or the client may not access it.
+func (s *fifoManager) getPipeline(w http.ResponseWriter, r *http.Request, log *slog.Logger) (*pipeline, bool) {
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return nil, false
+	}
+	p, ok := s.pipelines.Get(fifoKey(ns, r.PathValue("uuid")))
+	if !ok {
+		log.Warn("pipeline not found")
+		writeError(w, http.StatusNotFound, "pipeline not found")
+		return nil, false
+	}
+	return p, true
+}
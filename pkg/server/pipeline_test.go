@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerPipelineHandlers(mux, "/v1/pipeline")
+
+	var stages []*fifo
+	var uuids []uuidlib.UUID
+	for range 3 {
+		fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+		fm.run(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+		stages = append(stages, fifo)
+		uuids = append(uuids, fifo.uuid)
+	}
+	// request sends the body to the pipeline API and decodes the response.
+	request := func(method, path string, body, resp any) int {
+		b, err := json.Marshal(body)
+		require.NoError(err)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/v1/pipeline"+path, strings.NewReader(string(b))))
+		if resp != nil && rec.Code == http.StatusOK {
+			require.NoError(json.NewDecoder(rec.Body).Decode(resp))
+		}
+		return rec.Code
+	}
+
+	require.Equal(http.StatusBadRequest, request(http.MethodPost, "/new", api.PipelineNewRequest{Stages: uuids[:1]}, nil))
+	require.Equal(http.StatusBadRequest, request(http.MethodPost, "/new", api.PipelineNewRequest{Stages: []uuidlib.UUID{uuids[0], uuids[0]}}, nil))
+	require.Equal(http.StatusNotFound, request(http.MethodPost, "/new", api.PipelineNewRequest{Stages: []uuidlib.UUID{uuids[0], uuidlib.New()}}, nil))
+
+	var created api.PipelineNewResponse
+	require.Equal(http.StatusOK, request(http.MethodPost, "/new", api.PipelineNewRequest{Stages: uuids}, &created))
+	var status api.PipelineStatusResponse
+	require.Equal(http.StatusOK, request(http.MethodGet, "/"+created.UUID.String()+"/status", nil, &status))
+	require.Equal(uuids, status.Stages)
+
+	var resp api.PipelineTicketResponse
+	require.Equal(http.StatusOK, request(http.MethodPost, "/"+created.UUID.String()+"/ticket", api.FifoTicketRequest{Identity: "job"}, &resp))
+	require.Equal(uuids, resp.Stages)
+
+	// The ticket moves through the stages with the same ID and secret.
+	for i, fifo := range stages {
+		tick, ok := fifo.ticketLookup.Get(resp.TicketID.String())
+		require.True(ok, "stage %d", i)
+		require.True(tick.checkSecret(resp.Secret))
+		require.Equal("job", tick.identity)
+		<-tick.waitC
+		fifo.accept(tick)
+		tick.doneC <- struct{}{}
+		<-tick.endC
+	}
+	for _, fifo := range stages {
+		require.Equal(resp.TicketID, fifo.recentHistory()[0].TicketID)
+	}
+
+	// Tickets aren't advanced once the pipeline is deleted.
+	require.Equal(http.StatusOK, request(http.MethodPost, "/"+created.UUID.String()+"/ticket", nil, &resp))
+	require.Equal(http.StatusForbidden, request(http.MethodDelete, "/"+created.UUID.String(), api.FifoSecretRequest{Secret: "wrong"}, nil))
+	require.Equal(http.StatusOK, request(http.MethodDelete, "/"+created.UUID.String(), api.FifoSecretRequest{Secret: created.OwnerSecret}, nil))
+	require.Equal(http.StatusNotFound, request(http.MethodGet, "/"+created.UUID.String()+"/status", nil, nil))
+	tick, ok := stages[0].ticketLookup.Get(resp.TicketID.String())
+	require.True(ok)
+	<-tick.waitC
+	stages[0].accept(tick)
+	tick.doneC <- struct{}{}
+	<-tick.endC
+	require.Empty(stages[1].ticketLookup.GetAll())
+}
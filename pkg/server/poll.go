@@ -0,0 +1,92 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// maxPollInterval bounds the delay between polls the server asks for.
+const maxPollInterval = 5 * time.Second
+
+// pollState polls for the turn of a ticket without blocking, for clients
+// that can't hold a connection open until then. Once it's the ticket's
+// turn, it is accepted like by wait.
+func (s *fifoManager) pollState(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "pollState", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "ticket", r.PathValue("ticket"))
+	log.Debug("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	tick, ok := s.getTicket(w, r, log, fifo, ticketSecret(r))
+	if !ok {
+		return
+	}
+	waitToken := r.URL.Query().Get("wait_token")
+	if err := fifo.checkWaitToken(waitToken); err != nil {
+		log.Warn("missing wait token")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.pollTurn(w, r, log, fifo, tick, waitToken, r.URL.Path)
+}
+
+// pollTurn responds like wait if it's the turn of the ticket. Otherwise, it
+// responds with 202 Accepted, the URL to poll and when to poll it next.
+func (s *fifoManager) pollTurn(w http.ResponseWriter, r *http.Request, log *slog.Logger, fifo *fifo, tick *ticket, waitToken, statusURL string) {
+	select {
+	case <-tick.waitC:
+	case <-tick.abortC:
+		log.Warn("ticket aborted")
+		writeError(w, http.StatusGone, "ticket aborted by fifo owner")
+		return
+	case <-fifo.stopC:
+		log.Warn("fifo deleted")
+		writeError(w, http.StatusGone, "fifo deleted")
+		return
+	case <-s.shutdownC:
+		log.Warn("server shutting down")
+		unavailable(w, "server shutting down")
+		return
+	default:
+		fifo.mux.Lock()
+		state := tick.state
+		fifo.mux.Unlock()
+		interval := fifo.pollInterval()
+		w.Header().Set("Location", statusURL)
+		w.Header().Set("Retry-After", strconv.Itoa(int(interval/time.Second)))
+		encodeWithETag(w, r, http.StatusAccepted, api.FifoWaitPendingResponse{
+			State:     state,
+			Position:  fifo.position(tick),
+			StatusURL: statusURL,
+		})
+		return
+	}
+	if !fifo.claim(tick, waitToken) {
+		log.Warn("turn claimed by another wait")
+		writeError(w, http.StatusConflict, "turn claimed by another wait")
+		return
+	}
+	info := fifo.accept(tick)
+	log.Info("my turn")
+	encode(w, 200, api.FifoWaitResponse{FifoTicketInfo: info})
+}
+
+// pollInterval is the delay between polls the server asks for. Polls must
+// come well within the wait timeout, otherwise the ticket expires once it's
+// its turn.
+func (f *fifo) pollInterval() time.Duration {
+	return max(time.Second, min(maxPollInterval, f.waitTimeout/4).Truncate(time.Second))
+}
+
+// stateURL returns the URL to poll the state of the ticket of a wait request.
+func stateURL(r *http.Request) string {
+	ticket := r.PathValue("ticket")
+	return strings.TrimSuffix(r.URL.Path, "/wait/"+ticket) + "/ticket/" + ticket + "/state"
+}
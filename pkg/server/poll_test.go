@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollState(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	cfg.WaitTimeout = 8 * time.Second
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/ns/{namespace}/fifo")
+
+	fifo := newFifo("team", cfg, nil, "", log)
+	fm.run(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	blocker, tick := newTicket(""), newTicket("")
+	fifo.enqueue(blocker)
+	fifo.enqueue(tick)
+	<-blocker.waitC
+	fifo.accept(blocker)
+
+	get := func(path string, resp any) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		query := url.Values{"secret": {tick.Secret}, "async": {"true"}}.Encode()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?"+query, http.NoBody))
+		if resp != nil && rec.Code < 300 {
+			require.NoError(json.NewDecoder(rec.Body).Decode(resp))
+		}
+		return rec
+	}
+	prefix := "/v1/ns/team/fifo/" + fifo.uuid.String()
+	statePath := prefix + "/ticket/" + tick.TicketID.String() + "/state"
+
+	// An async wait points to the state, which is pending until the turn.
+	var pending api.FifoWaitPendingResponse
+	rec := get(prefix+"/wait/"+tick.TicketID.String(), &pending)
+	require.Equal(http.StatusAccepted, rec.Code)
+	require.Equal(statePath, rec.Header().Get("Location"))
+	require.Equal(statePath, pending.StatusURL)
+	require.Equal("2", rec.Header().Get("Retry-After"))
+	require.Equal(api.TicketQueued, pending.State)
+	require.Equal(0, pending.Position)
+
+	rec = get(statePath, &pending)
+	require.Equal(http.StatusAccepted, rec.Code)
+	require.Equal(api.TicketQueued, pending.State)
+
+	// Unchanged polls can be conditional. The secret can also be sent in a
+	// header.
+	req := httptest.NewRequest(http.MethodGet, statePath, http.NoBody)
+	req.Header.Set(api.TicketSecretHeader, tick.Secret)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(http.StatusNotModified, rec.Code)
+	require.Equal("2", rec.Header().Get("Retry-After"))
+
+	// Once it's the ticket's turn, the poll accepts it.
+	blocker.doneC <- struct{}{}
+	<-tick.waitC
+	var resp api.FifoWaitResponse
+	rec = get(statePath, &resp)
+	require.Equal(http.StatusOK, rec.Code)
+	require.Equal(tick.TicketID, resp.TicketID)
+	require.Equal(api.TicketAccepted, resp.State)
+	select {
+	case <-tick.waitAckC:
+	default:
+		require.Fail("ticket not accepted")
+	}
+}
@@ -0,0 +1,538 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+)
+
+// maxQueueItems bounds the number of items in a work queue.
+const maxQueueItems = 10000
+
+// workQueue holds the items pushed by producers until a worker claims and
+// acks them. A claimed item is leased to the worker and redelivered if the
+// worker nacks it or the lease ends, until it exceeds the max attempts and
+// is moved to the dead-letter list.
+type workQueue struct {
+	namespace    string
+	uuid         uuidlib.UUID
+	ownerSecret  string
+	leaseTimeout time.Duration
+	maxAttempts  int
+	log          *slog.Logger
+	// stopC is closed when the queue is deleted.
+	stopC    chan struct{}
+	stopOnce sync.Once
+
+	mux sync.Mutex
+	// pending holds the items waiting to be claimed, the head is next.
+	pending []*queueItem
+	// leased holds the claimed items by ID.
+	leased map[uuidlib.UUID]*queueItem
+	// dead holds the items that exceeded the max attempts, oldest first.
+	dead []api.QueueDeadItem
+	// pushedC is closed and replaced when an item becomes pending.
+	pushedC chan struct{}
+}
+
+type queueItem struct {
+	api.QueueItem
+	// secret authorizes the worker holding the lease, which ends when the
+	// lease timer fires. generation identifies the timer of the current
+	// lease, as a stopped timer may fire anyway. All are guarded by the
+	// mutex of the queue.
+	secret     string
+	lease      *time.Timer
+	generation uint64
+}
+
+func newWorkQueue(namespace string, leaseTimeout time.Duration, maxAttempts int, log *slog.Logger) *workQueue {
+	uuid := uuidlib.New()
+	return &workQueue{
+		namespace:    namespace,
+		uuid:         uuid,
+		ownerSecret:  newSecret(),
+		leaseTimeout: leaseTimeout,
+		maxAttempts:  maxAttempts,
+		log:          log.WithGroup("queue").With("namespace", namespace, "uuid", uuid.String()),
+		stopC:        make(chan struct{}),
+		leased:       map[uuidlib.UUID]*queueItem{},
+		pushedC:      make(chan struct{}),
+	}
+}
+
+// push adds an item with the payload to the end of the queue. It returns
+// false if the queue is full.
+func (q *workQueue) push(payload []byte) (*queueItem, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if len(q.pending)+len(q.leased)+len(q.dead) >= maxQueueItems {
+		return nil, false
+	}
+	item := &queueItem{QueueItem: api.QueueItem{
+		ItemID:    uuidlib.New(),
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	}}
+	q.pending = append(q.pending, item)
+	q.signalPushed()
+	return item, true
+}
+
+// claim leases the next pending item. If there is none, it returns a channel
+// that is closed once an item is pushed.
+func (q *workQueue) claim() (api.QueueClaimResponse, <-chan struct{}, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if len(q.pending) == 0 {
+		return api.QueueClaimResponse{}, q.pushedC, false
+	}
+	item := q.pending[0]
+	q.pending = q.pending[1:]
+	item.Attempts++
+	item.secret = newSecret()
+	q.leased[item.ItemID] = item
+	return api.QueueClaimResponse{
+		QueueItem:   item.QueueItem,
+		Secret:      item.secret,
+		LeasedUntil: q.startLease(item, q.leaseTimeout),
+	}, nil, true
+}
+
+// startLease (re)starts the lease timer of the item and returns the end of
+// the lease. Must be called with the mutex of the queue held.
+func (q *workQueue) startLease(item *queueItem, d time.Duration) time.Time {
+	if item.lease != nil {
+		item.lease.Stop()
+	}
+	item.generation++
+	generation := item.generation
+	item.lease = time.AfterFunc(d, func() { q.expire(item, generation) })
+	return time.Now().Add(d)
+}
+
+// extend restarts the lease of the item with the duration. It returns the
+// end of the lease, or the status of the failure.
+func (q *workQueue) extend(id uuidlib.UUID, secret string, d time.Duration) (time.Time, int, string) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	item, status, msg := q.leasedItem(id, secret)
+	if item == nil {
+		return time.Time{}, status, msg
+	}
+	return q.startLease(item, d), 0, ""
+}
+
+// settle ends the lease of the item, it is redelivered if requeue is set.
+// It returns the status of the failure, or zero.
+func (q *workQueue) settle(id uuidlib.UUID, secret string, requeue bool) (int, string) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	item, status, msg := q.leasedItem(id, secret)
+	if item == nil {
+		return status, msg
+	}
+	if requeue {
+		q.redeliver(item, api.DeadReasonNacked)
+	} else {
+		q.release(item)
+	}
+	return 0, ""
+}
+
+// leasedItem returns the item if it is leased with the secret, or the status
+// of the failure. Must be called with the mutex of the queue held.
+func (q *workQueue) leasedItem(id uuidlib.UUID, secret string) (*queueItem, int, string) {
+	item, ok := q.leased[id]
+	if !ok {
+		return nil, http.StatusConflict, "item is not leased"
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(item.secret)) != 1 {
+		return nil, http.StatusForbidden, "invalid lease secret"
+	}
+	return item, 0, ""
+}
+
+// expire redelivers the item if the lease of the generation is still
+// running.
+func (q *workQueue) expire(item *queueItem, generation uint64) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.leased[item.ItemID] != item || item.generation != generation {
+		return
+	}
+	q.log.Warn("lease expired", "item", item.ItemID, "attempts", item.Attempts)
+	q.redeliver(item, api.DeadReasonLeaseExpired)
+}
+
+// redeliver ends the lease of the item and puts it back at the front of the
+// queue, or on the dead-letter list if it exceeded the max attempts. Must be
+// called with the mutex of the queue held.
+func (q *workQueue) redeliver(item *queueItem, reason string) {
+	q.release(item)
+	if q.maxAttempts > 0 && item.Attempts >= q.maxAttempts {
+		q.log.Warn("item exceeded max attempts", "item", item.ItemID, "reason", reason)
+		q.dead = append(q.dead, api.QueueDeadItem{QueueItem: item.QueueItem, Reason: reason, DeadAt: time.Now()})
+		return
+	}
+	// Redelivered items are next, they were pushed before the others.
+	q.pending = slices.Insert(q.pending, 0, item)
+	q.signalPushed()
+}
+
+// release ends the lease of the item. Must be called with the mutex of the
+// queue held.
+func (q *workQueue) release(item *queueItem) {
+	delete(q.leased, item.ItemID)
+	item.lease.Stop()
+	item.secret = ""
+}
+
+// requeueDead moves the item from the dead-letter list to the end of the
+// queue, with its attempts reset. It returns false if the item isn't dead.
+func (q *workQueue) requeueDead(id uuidlib.UUID) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	i := slices.IndexFunc(q.dead, func(d api.QueueDeadItem) bool { return d.ItemID == id })
+	if i < 0 {
+		return false
+	}
+	item := &queueItem{QueueItem: q.dead[i].QueueItem}
+	item.Attempts = 0
+	q.dead = slices.Delete(q.dead, i, i+1)
+	q.pending = append(q.pending, item)
+	q.signalPushed()
+	return true
+}
+
+func (q *workQueue) deadItems() []api.QueueDeadItem {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return append([]api.QueueDeadItem{}, q.dead...)
+}
+
+// signalPushed wakes claims waiting for an item. Must be called with the
+// mutex of the queue held.
+func (q *workQueue) signalPushed() {
+	close(q.pushedC)
+	q.pushedC = make(chan struct{})
+}
+
+func (q *workQueue) status() api.QueueStatusResponse {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return api.QueueStatusResponse{UUID: q.uuid, Pending: len(q.pending), Leased: len(q.leased), Dead: len(q.dead)}
+}
+
+// stop releases waiting claims and the lease timers.
+func (q *workQueue) stop() {
+	q.stopOnce.Do(func() {
+		close(q.stopC)
+	})
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, item := range q.leased {
+		item.lease.Stop()
+	}
+}
+
+// checkOwnerSecret reports whether secret is the owner secret of the queue.
+func (q *workQueue) checkOwnerSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(q.ownerSecret)) == 1
+}
+
+// registerQueueHandlers registers the work queue API under the prefix.
+func (s *fifoManager) registerQueueHandlers(mux *http.ServeMux, prefix string) {
+	for _, rt := range s.queueRoutes() {
+		mux.HandleFunc(rt.method+" "+prefix+rt.path, validIDs(rt.handler))
+	}
+}
+
+// queueRoutes returns the handlers of the work queue API with their path
+// relative to the prefix they are registered under. Keep openapi.yaml in
+// sync.
+func (s *fifoManager) queueRoutes() []route {
+	return []route{
+		{http.MethodPost, "/new", s.newQueue},
+		{http.MethodPost, "/{uuid}/push", s.queuePush},
+		{http.MethodPost, "/{uuid}/claim", s.queueClaim},
+		{http.MethodPost, "/{uuid}/ack/{item}", s.queueAck},
+		{http.MethodPost, "/{uuid}/nack/{item}", s.queueNack},
+		{http.MethodPost, "/{uuid}/extend/{item}", s.queueExtend},
+		{http.MethodGet, "/{uuid}/status", s.queueStatus},
+		{http.MethodGet, "/{uuid}/dead", s.queueDead},
+		{http.MethodPost, "/{uuid}/admin/requeue/{item}", s.queueRequeue},
+		{http.MethodDelete, "/{uuid}", s.deleteQueue},
+	}
+}
+
+func (s *fifoManager) newQueue(w http.ResponseWriter, r *http.Request) {
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.QueueNewRequest](w, r)
+	if !ok {
+		return
+	}
+	cfg := s.config()
+	leaseTimeout := cfg.DoneTimeout
+	if req.LeaseTimeout != "" {
+		d, err := time.ParseDuration(req.LeaseTimeout)
+		if err != nil || d <= 0 || d > cfg.MaxDoneTimeout {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("lease_timeout must be a positive duration up to %s", cfg.MaxDoneTimeout))
+			return
+		}
+		leaseTimeout = d
+	}
+	if req.MaxAttempts < 0 {
+		writeError(w, http.StatusBadRequest, "max_attempts must not be negative")
+		return
+	}
+	q := newWorkQueue(ns, leaseTimeout, req.MaxAttempts, s.fifoLog)
+	log := s.log.With("call", "newQueue", "namespace", ns, "uuid", q.uuid.String())
+	log.Info("called")
+	s.queues.Put(fifoKey(ns, q.uuid.String()), q)
+	encode(w, 200, api.QueueNewResponse{UUID: q.uuid, OwnerSecret: q.ownerSecret})
+}
+
+func (s *fifoManager) queuePush(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "queuePush", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Debug("called")
+
+	q, ok := s.getQueue(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.QueuePushRequest](w, r)
+	if !ok {
+		return
+	}
+	if len(req.Payload) > api.MaxQueuePayload {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("payload exceeds %d bytes", api.MaxQueuePayload))
+		return
+	}
+	item, ok := q.push(req.Payload)
+	if !ok {
+		log.Warn("queue full", "limit", maxQueueItems)
+		unavailable(w, "queue is full")
+		return
+	}
+	log.Info("item pushed", "item", item.ItemID)
+	encode(w, 200, api.QueuePushResponse{ItemID: item.ItemID})
+}
+
+// queueClaim leases the next item to the worker. If the queue is empty, it
+// waits for an item up to the timeout of the request and responds with 204
+// if none was pushed.
+func (s *fifoManager) queueClaim(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "queueClaim", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Debug("called")
+
+	q, ok := s.getQueue(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.QueueClaimRequest](w, r)
+	if !ok {
+		return
+	}
+	var timeout time.Duration
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d < 0 || d > maxKeepalive {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("timeout must be a duration up to %s", maxKeepalive))
+			return
+		}
+		timeout = d
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		resp, pushedC, ok := q.claim()
+		if ok {
+			log.Info("item claimed", "item", resp.ItemID)
+			encode(w, 200, resp)
+			return
+		}
+		select {
+		case <-pushedC:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			log.Info("client disconnected")
+			return
+		case <-q.stopC:
+			log.Warn("queue deleted")
+			writeError(w, http.StatusGone, "queue deleted")
+			return
+		case <-s.shutdownC:
+			log.Warn("server shutting down")
+			unavailable(w, "server shutting down")
+			return
+		}
+	}
+}
+
+// queueAck removes the item the worker handled from the queue.
+func (s *fifoManager) queueAck(w http.ResponseWriter, r *http.Request) {
+	s.settleItem(w, r, "queueAck", false)
+}
+
+// queueNack puts the item the worker didn't handle back at the front of the
+// queue.
+func (s *fifoManager) queueNack(w http.ResponseWriter, r *http.Request) {
+	s.settleItem(w, r, "queueNack", true)
+}
+
+func (s *fifoManager) settleItem(w http.ResponseWriter, r *http.Request, call string, requeue bool) {
+	log := s.log.With("call", call, "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "item", r.PathValue("item"))
+	log.Debug("called")
+
+	q, ok := s.getQueue(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return
+	}
+	if status, msg := q.settle(uuidlib.MustParse(r.PathValue("item")), req.Secret, requeue); status != 0 {
+		log.Warn("settling item failed", "err", msg)
+		writeError(w, status, msg)
+		return
+	}
+	log.Info("item settled", "requeued", requeue)
+}
+
+// queueExtend extends the lease of a claimed item, so the worker can take
+// longer to handle it.
+func (s *fifoManager) queueExtend(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "queueExtend", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "item", r.PathValue("item"))
+	log.Debug("called")
+
+	q, ok := s.getQueue(w, r, log)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.QueueExtendRequest](w, r)
+	if !ok {
+		return
+	}
+	leaseTimeout := q.leaseTimeout
+	if req.LeaseTimeout != "" {
+		maxTimeout := s.config().MaxDoneTimeout
+		d, err := time.ParseDuration(req.LeaseTimeout)
+		if err != nil || d <= 0 || d > maxTimeout {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("lease_timeout must be a positive duration up to %s", maxTimeout))
+			return
+		}
+		leaseTimeout = d
+	}
+	until, status, msg := q.extend(uuidlib.MustParse(r.PathValue("item")), req.Secret, leaseTimeout)
+	if status != 0 {
+		log.Warn("extending lease failed", "err", msg)
+		writeError(w, status, msg)
+		return
+	}
+	log.Info("lease extended", "until", until)
+	encode(w, 200, api.QueueExtendResponse{LeasedUntil: until})
+}
+
+func (s *fifoManager) queueStatus(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "queueStatus", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Debug("called")
+
+	q, ok := s.getQueue(w, r, log)
+	if !ok {
+		return
+	}
+	encode(w, 200, q.status())
+}
+
+// queueDead lists the items on the dead-letter list of the queue.
+func (s *fifoManager) queueDead(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "queueDead", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Debug("called")
+
+	q, ok := s.getQueue(w, r, log)
+	if !ok {
+		return
+	}
+	encode(w, 200, api.QueueDeadResponse{Items: q.deadItems()})
+}
+
+// queueRequeue moves a dead item back to the end of the queue. Requires the
+// owner secret.
+func (s *fifoManager) queueRequeue(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "queueRequeue", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"), "item", r.PathValue("item"))
+	log.Info("called")
+
+	q, ok := s.getQueueAsOwner(w, r, log)
+	if !ok {
+		return
+	}
+	if !q.requeueDead(uuidlib.MustParse(r.PathValue("item"))) {
+		log.Warn("item not dead")
+		writeError(w, http.StatusNotFound, "item not found on the dead-letter list")
+		return
+	}
+	log.Info("item requeued")
+}
+
+// deleteQueue deletes the queue with its items. Requires the owner secret.
+func (s *fifoManager) deleteQueue(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "deleteQueue", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	q, ok := s.getQueueAsOwner(w, r, log)
+	if !ok {
+		return
+	}
+	s.queues.Delete(fifoKey(q.namespace, q.uuid.String()))
+	q.stop()
+	log.Info("queue deleted")
+}
+
+// getQueue returns the work queue of the request. It writes an error
+// response if the queue doesn't exist or the client may not access it.
+func (s *fifoManager) getQueue(w http.ResponseWriter, r *http.Request, log *slog.Logger) (*workQueue, bool) {
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return nil, false
+	}
+	q, ok := s.queues.Get(fifoKey(ns, r.PathValue("uuid")))
+	if !ok {
+		log.Warn("queue not found")
+		writeError(w, http.StatusNotFound, "queue not found")
+		return nil, false
+	}
+	return q, true
+}
+
+// getQueueAsOwner returns the work queue of the request if the request
+// carries its owner secret. It writes an error response otherwise.
+func (s *fifoManager) getQueueAsOwner(w http.ResponseWriter, r *http.Request, log *slog.Logger) (*workQueue, bool) {
+	q, ok := s.getQueue(w, r, log)
+	if !ok {
+		return nil, false
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return nil, false
+	}
+	if !q.checkOwnerSecret(req.Secret) {
+		log.Warn("invalid owner secret")
+		writeError(w, http.StatusForbidden, "invalid owner secret")
+		return nil, false
+	}
+	return q, true
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkQueue(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerQueueHandlers(mux, "/v1/queue")
+
+	request := queueRequester(t, mux)
+
+	require.Equal(http.StatusBadRequest, request(http.MethodPost, "/new", api.QueueNewRequest{LeaseTimeout: "-1s"}, nil))
+	var created api.QueueNewResponse
+	require.Equal(http.StatusOK, request(http.MethodPost, "/new", api.QueueNewRequest{LeaseTimeout: "50ms"}, &created))
+	path := "/" + created.UUID.String()
+
+	// Claims on an empty queue return without an item.
+	require.Equal(http.StatusNoContent, request(http.MethodPost, path+"/claim", nil, nil))
+	require.Equal(http.StatusNoContent, request(http.MethodPost, path+"/claim", api.QueueClaimRequest{Timeout: "10ms"}, nil))
+	require.Equal(http.StatusRequestEntityTooLarge, request(http.MethodPost, path+"/push",
+		api.QueuePushRequest{Payload: json.RawMessage(`"` + strings.Repeat("x", api.MaxQueuePayload) + `"`)}, nil))
+
+	// A waiting claim gets the item pushed meanwhile.
+	claimC := make(chan api.QueueClaimResponse)
+	go func() {
+		var claimed api.QueueClaimResponse
+		request(http.MethodPost, path+"/claim", api.QueueClaimRequest{Timeout: "10s"}, &claimed)
+		claimC <- claimed
+	}()
+	var first, second api.QueuePushResponse
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/push", api.QueuePushRequest{Payload: json.RawMessage(`{"n":1}`)}, &first))
+	claimed := <-claimC
+	require.Equal(first.ItemID, claimed.ItemID)
+	require.JSONEq(`{"n":1}`, string(claimed.Payload))
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/push", api.QueuePushRequest{Payload: json.RawMessage(`{"n":2}`)}, &second))
+
+	var status api.QueueStatusResponse
+	require.Equal(http.StatusOK, request(http.MethodGet, path+"/status", nil, &status))
+	require.Equal(1, status.Pending)
+	require.Equal(1, status.Leased)
+
+	// A nacked item is redelivered before the others.
+	ackPath := path + "/ack/" + first.ItemID.String()
+	require.Equal(http.StatusForbidden, request(http.MethodPost, ackPath, api.FifoSecretRequest{Secret: "wrong"}, nil))
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/nack/"+first.ItemID.String(), api.FifoSecretRequest{Secret: claimed.Secret}, nil))
+	require.Equal(http.StatusConflict, request(http.MethodPost, ackPath, api.FifoSecretRequest{Secret: claimed.Secret}, nil))
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/claim", nil, &claimed))
+	require.Equal(first.ItemID, claimed.ItemID)
+	require.Equal(http.StatusOK, request(http.MethodPost, ackPath, api.FifoSecretRequest{Secret: claimed.Secret}, nil))
+
+	// An item whose lease ends is redelivered.
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/claim", nil, &claimed))
+	require.Equal(second.ItemID, claimed.ItemID)
+	require.Eventually(func() bool {
+		request(http.MethodGet, path+"/status", nil, &status)
+		return status.Pending == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(http.StatusConflict, request(http.MethodPost, path+"/ack/"+second.ItemID.String(), api.FifoSecretRequest{Secret: claimed.Secret}, nil))
+
+	require.Equal(http.StatusForbidden, request(http.MethodDelete, path, api.FifoSecretRequest{Secret: "wrong"}, nil))
+	require.Equal(http.StatusOK, request(http.MethodDelete, path, api.FifoSecretRequest{Secret: created.OwnerSecret}, nil))
+	require.Equal(http.StatusNotFound, request(http.MethodPost, path+"/claim", nil, nil))
+}
+
+func TestWorkQueueDeadLetter(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerQueueHandlers(mux, "/v1/queue")
+	request := queueRequester(t, mux)
+
+	require.Equal(http.StatusBadRequest, request(http.MethodPost, "/new", api.QueueNewRequest{MaxAttempts: -1}, nil))
+	var created api.QueueNewResponse
+	require.Equal(http.StatusOK, request(http.MethodPost, "/new", api.QueueNewRequest{LeaseTimeout: "50ms", MaxAttempts: 2}, &created))
+	path := "/" + created.UUID.String()
+	var pushed api.QueuePushResponse
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/push", api.QueuePushRequest{Payload: json.RawMessage(`1`)}, &pushed))
+	itemPath := "/" + pushed.ItemID.String()
+
+	// An extended lease outlives the lease timeout.
+	var claimed api.QueueClaimResponse
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/claim", nil, &claimed))
+	require.Equal(1, claimed.Attempts)
+	require.Equal(http.StatusForbidden, request(http.MethodPost, path+"/extend"+itemPath, api.QueueExtendRequest{Secret: "wrong"}, nil))
+	require.Equal(http.StatusBadRequest, request(http.MethodPost, path+"/extend"+itemPath, api.QueueExtendRequest{Secret: claimed.Secret, LeaseTimeout: "1000h"}, nil))
+	var extended api.QueueExtendResponse
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/extend"+itemPath, api.QueueExtendRequest{Secret: claimed.Secret, LeaseTimeout: "10s"}, &extended))
+	require.True(extended.LeasedUntil.After(claimed.LeasedUntil))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/nack"+itemPath, api.FifoSecretRequest{Secret: claimed.Secret}, nil))
+
+	// The second delivery is the last, the item is dead once its lease ends.
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/claim", nil, &claimed))
+	require.Equal(2, claimed.Attempts)
+	var dead api.QueueDeadResponse
+	require.Eventually(func() bool {
+		request(http.MethodGet, path+"/dead", nil, &dead)
+		return len(dead.Items) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(pushed.ItemID, dead.Items[0].ItemID)
+	require.Equal(api.DeadReasonLeaseExpired, dead.Items[0].Reason)
+	require.Equal(2, dead.Items[0].Attempts)
+	require.Equal(http.StatusNoContent, request(http.MethodPost, path+"/claim", nil, nil))
+
+	// Requeued items get their attempts back.
+	require.Equal(http.StatusForbidden, request(http.MethodPost, path+"/admin/requeue"+itemPath, api.FifoSecretRequest{Secret: "wrong"}, nil))
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/admin/requeue"+itemPath, api.FifoSecretRequest{Secret: created.OwnerSecret}, nil))
+	require.Equal(http.StatusNotFound, request(http.MethodPost, path+"/admin/requeue"+itemPath, api.FifoSecretRequest{Secret: created.OwnerSecret}, nil))
+	require.Equal(http.StatusOK, request(http.MethodPost, path+"/claim", nil, &claimed))
+	require.Equal(1, claimed.Attempts)
+	require.JSONEq(`1`, string(claimed.Payload))
+}
+
+// queueRequester returns a function sending the body to the queue API
+// registered under /v1/queue and decoding the response.
+func queueRequester(t *testing.T, mux *http.ServeMux) func(method, path string, body, resp any) int {
+	return func(method, path string, body, resp any) int {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/v1/queue"+path, strings.NewReader(string(b))))
+		if resp != nil && rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(resp))
+		}
+		return rec.Code
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/katexochen/sync/api"
+)
+
+// quotaKind is a resource limited by quotas.
+type quotaKind int
+
+const (
+	quotaFifos quotaKind = iota
+	quotaTickets
+	quotaWaits
+)
+
+func (k quotaKind) String() string {
+	switch k {
+	case quotaFifos:
+		return "fifos"
+	case quotaTickets:
+		return "tickets"
+	default:
+		return "waits"
+	}
+}
+
+// count returns the counter of the kind in the usage.
+func (k quotaKind) count(u *api.QuotaUsage) *int {
+	switch k {
+	case quotaFifos:
+		return &u.Fifos
+	case quotaTickets:
+		return &u.Tickets
+	default:
+		return &u.Waits
+	}
+}
+
+// limits returns the limits of the quota as usage.
+func (q QuotaConfig) limits() api.QuotaUsage {
+	return api.QuotaUsage{Fifos: q.Fifos, Tickets: q.Tickets, Waits: q.Waits}
+}
+
+// limit returns the limit of the kind, zero means unlimited.
+func (q QuotaConfig) limit(kind quotaKind) int {
+	limits := q.limits()
+	return *kind.count(&limits)
+}
+
+// quotaTracker counts the resources held by each client and namespace.
+// Clients and namespaces holding nothing aren't tracked.
+type quotaTracker struct {
+	mux        sync.Mutex
+	clients    map[string]api.QuotaUsage
+	namespaces map[string]api.QuotaUsage
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		clients:    map[string]api.QuotaUsage{},
+		namespaces: map[string]api.QuotaUsage{},
+	}
+}
+
+// take takes a resource of the kind for the client in the namespace. It
+// fails if the quota of the client or the namespace is exhausted. The
+// returned function gives the resource back, only its first call counts.
+func (t *quotaTracker) take(cfg FifoConfig, client, namespace string, kind quotaKind) (func(), error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	cu, nu := t.clients[client], t.namespaces[namespace]
+	if limit := cfg.ClientQuota.limit(kind); limit > 0 && *kind.count(&cu) >= limit {
+		return nil, fmt.Errorf("client quota of %d %s exhausted", limit, kind)
+	}
+	if limit := cfg.NamespaceQuota.limit(kind); limit > 0 && *kind.count(&nu) >= limit {
+		return nil, fmt.Errorf("namespace quota of %d %s exhausted", limit, kind)
+	}
+	*kind.count(&cu)++
+	*kind.count(&nu)++
+	t.clients[client], t.namespaces[namespace] = cu, nu
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.give(client, namespace, kind) })
+	}, nil
+}
+
+// give gives a resource of the kind taken by the client in the namespace
+// back.
+func (t *quotaTracker) give(client, namespace string, kind quotaKind) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, entry := range []struct {
+		usages map[string]api.QuotaUsage
+		key    string
+	}{{t.clients, client}, {t.namespaces, namespace}} {
+		u := entry.usages[entry.key]
+		*kind.count(&u)--
+		if u == (api.QuotaUsage{}) {
+			delete(entry.usages, entry.key)
+		} else {
+			entry.usages[entry.key] = u
+		}
+	}
+}
+
+// usage returns the usage of the client and the namespace.
+func (t *quotaTracker) usage(client, namespace string) (api.QuotaUsage, api.QuotaUsage) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.clients[client], t.namespaces[namespace]
+}
+
+// all returns the usage of all clients and namespaces holding resources.
+func (t *quotaTracker) all() api.QuotasResponse {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	resp := api.QuotasResponse{
+		Clients:    make(map[string]api.QuotaUsage, len(t.clients)),
+		Namespaces: make(map[string]api.QuotaUsage, len(t.namespaces)),
+	}
+	for k, u := range t.clients {
+		resp.Clients[k] = u
+	}
+	for k, u := range t.namespaces {
+		resp.Namespaces[k] = u
+	}
+	return resp
+}
+
+// acquireQuota takes a resource of the kind for the client of the request in
+// the namespace. It writes 429 if a quota is exhausted. The returned
+// function gives the resource back.
+func (s *fifoManager) acquireQuota(w http.ResponseWriter, r *http.Request, log *slog.Logger, namespace string, kind quotaKind) (func(), bool) {
+	client := clientKey(r)
+	release, err := s.quotas.take(s.config(), client, namespace, kind)
+	if err != nil {
+		log.Warn("quota exhausted", "client", client, "err", err)
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return nil, false
+	}
+	return release, true
+}
+
+// acquireTicketQuota takes a ticket of the quotas for the ticket, which is
+// given back once the ticket ends or the fifo is stopped. It writes 429 if a
+// quota is exhausted.
+func (s *fifoManager) acquireTicketQuota(w http.ResponseWriter, r *http.Request, log *slog.Logger, fifo *fifo, tick *ticket) bool {
+	release, ok := s.acquireQuota(w, r, log, fifo.namespace, quotaTickets)
+	if !ok {
+		return false
+	}
+	go func() {
+		select {
+		case <-tick.endC:
+		case <-fifo.stopC:
+		}
+		release()
+	}()
+	return true
+}
+
+// quota reports the quota of the calling client and of the namespace.
+func (s *fifoManager) quota(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "quota", "namespace", namespaceOf(r))
+	log.Debug("called")
+
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return
+	}
+	cfg := s.config()
+	client := clientKey(r)
+	clientUsage, nsUsage := s.quotas.usage(client, ns)
+	encode(w, 200, api.QuotaResponse{
+		Client:         client,
+		ClientQuota:    api.Quota{Used: clientUsage, Limits: cfg.ClientQuota.limits()},
+		Namespace:      ns,
+		NamespaceQuota: api.Quota{Used: nsUsage, Limits: cfg.NamespaceQuota.limits()},
+	})
+}
+
+// quotasHandler reports the usage of all clients and namespaces.
+func (s *fifoManager) quotasHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "quotas")
+	log.Debug("called")
+	encode(w, 200, s.quotas.all())
+}
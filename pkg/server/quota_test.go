@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotas(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	cfg.ClientQuota = QuotaConfig{Fifos: 1, Tickets: 2}
+	cfg.NamespaceQuota = QuotaConfig{Tickets: 3}
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+
+	var created api.FifoNewResponse
+	// request sends the request as the client with the address and decodes
+	// the response.
+	request := func(addr, method, path string, resp any) int {
+		body := "{}"
+		if method == http.MethodDelete {
+			body = `{"secret": "` + created.OwnerSecret + `"}`
+		}
+		req := httptest.NewRequest(method, "/v1/fifo"+path, strings.NewReader(body))
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if resp != nil && rec.Code == http.StatusOK {
+			require.NoError(json.NewDecoder(rec.Body).Decode(resp))
+		}
+		return rec.Code
+	}
+	const alice, bob = "192.0.2.1:1234", "192.0.2.2:1234"
+
+	require.Equal(http.StatusOK, request(alice, http.MethodPost, "/new", &created))
+	require.Equal(http.StatusTooManyRequests, request(alice, http.MethodPost, "/new", nil))
+	require.Equal(http.StatusOK, request(bob, http.MethodPost, "/new", nil))
+
+	// Tickets count against the quota of the client and the namespace.
+	ticketPath := "/" + created.UUID.String() + "/ticket"
+	var tickets []api.FifoTicketResponse
+	for range 2 {
+		var resp api.FifoTicketResponse
+		require.Equal(http.StatusOK, request(alice, http.MethodPost, ticketPath, &resp))
+		tickets = append(tickets, resp)
+	}
+	require.Equal(http.StatusTooManyRequests, request(alice, http.MethodPost, ticketPath, nil))
+	require.Equal(http.StatusOK, request(bob, http.MethodPost, ticketPath, nil))
+	require.Equal(http.StatusTooManyRequests, request(bob, http.MethodPost, ticketPath, nil))
+
+	var quota api.QuotaResponse
+	require.Equal(http.StatusOK, request(alice, http.MethodGet, "/quota", &quota))
+	require.Equal("ip:192.0.2.1", quota.Client)
+	require.Equal(api.Quota{Used: api.QuotaUsage{Fifos: 1, Tickets: 2}, Limits: api.QuotaUsage{Fifos: 1, Tickets: 2}}, quota.ClientQuota)
+	require.Equal(defaultNamespace, quota.Namespace)
+	require.Equal(api.Quota{Used: api.QuotaUsage{Fifos: 2, Tickets: 3}, Limits: api.QuotaUsage{Tickets: 3}}, quota.NamespaceQuota)
+
+	// Ended tickets are given back.
+	fifo, ok := fm.fifos.Get(fifoKey(defaultNamespace, created.UUID.String()))
+	require.True(ok)
+	tick, ok := fifo.ticketLookup.Get(tickets[1].TicketID.String())
+	require.True(ok)
+	require.True(fifo.abort(tick, api.OutcomeCanceled))
+	<-tick.endC
+	require.Eventually(func() bool {
+		return request(alice, http.MethodPost, ticketPath, nil) == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	// Deleted fifos are given back with their tickets.
+	require.Equal(http.StatusOK, request(alice, http.MethodDelete, "/"+created.UUID.String(), nil))
+	require.Eventually(func() bool {
+		return fm.quotas.all().Clients["ip:192.0.2.1"] == api.QuotaUsage{}
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(http.StatusOK, request(alice, http.MethodPost, "/new", nil))
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the request rate per client with a token bucket. Clients
+// are identified by their authenticated identity, or else their IP address.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	log   *slog.Logger
+	now   func() time.Time
+
+	mux       sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiterSweepInterval is the interval in which idle buckets are removed.
+const rateLimiterSweepInterval = time.Minute
+
+func newRateLimiter(rate float64, burst int, log *slog.Logger) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		log:     log.WithGroup("rateLimiter"),
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// allow takes a token from the bucket of the key. If none is left, it returns
+// the time until the next token is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets that are full again. Must be called with the
+// mutex held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientKey(r)
+		if ok, retryAfter := l.allow(key); !ok {
+			l.log.Warn("rate limit exceeded", "client", key, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies the client of the request for the rate limit and
+// quotas.
+func clientKey(r *http.Request) string {
+	if identity := principalFrom(r.Context()).identity; identity != "" {
+		return "identity:" + identity
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Unix socket clients have no address.
+		return "addr:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
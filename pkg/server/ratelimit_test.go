@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	l := newRateLimiter(2, 3, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	l.now = func() time.Time { return now }
+
+	for range 3 {
+		ok, _ := l.allow("a")
+		require.True(ok)
+	}
+	ok, retryAfter := l.allow("a")
+	require.False(ok)
+	require.Equal(500*time.Millisecond, retryAfter)
+
+	// Other clients have their own bucket.
+	ok, _ = l.allow("b")
+	require.True(ok)
+
+	// Tokens are refilled at the rate.
+	now = now.Add(time.Second)
+	for range 2 {
+		ok, _ := l.allow("a")
+		require.True(ok)
+	}
+	ok, _ = l.allow("a")
+	require.False(ok)
+
+	// Full buckets are swept.
+	now = now.Add(time.Hour)
+	l.allow("c")
+	require.Len(l.buckets, 1)
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newRateLimiter(1, 1, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	handler := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(remoteAddr, identity string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		r.RemoteAddr = remoteAddr
+		if identity != "" {
+			r = r.WithContext(withPrincipal(context.Background(), principal{identity: identity}))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	assert.Equal(http.StatusOK, request("192.0.2.1:1234", "").Code)
+	rec := request("192.0.2.1:5678", "")
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.Equal("1", rec.Header().Get("Retry-After"))
+
+	// Authenticated clients are limited by identity, not address.
+	assert.Equal(http.StatusOK, request("192.0.2.1:1234", "alice").Code)
+	assert.Equal(http.StatusTooManyRequests, request("192.0.2.2:1234", "alice").Code)
+}
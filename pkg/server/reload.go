@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// apiHandler returns the handler of the API with the authentication and the
+// rate limit of the config.
+func (s *Server) apiHandler(cfg *Config) (http.Handler, error) {
+	tokens := parseTokens(s.tokens)
+	if cfg.Auth.TokenFile != "" {
+		fileTokens, err := readTokenFile(cfg.Auth.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+
+	var handler http.Handler = limitBody(s.apiMux)
+	if cfg.RateLimit.Rate > 0 {
+		s.log.Info("rate limit enabled", "rate", cfg.RateLimit.Rate, "burst", cfg.RateLimit.Burst)
+		handler = newRateLimiter(cfg.RateLimit.Rate, cfg.RateLimit.Burst, s.log).middleware(handler)
+	}
+	if len(tokens) > 0 || cfg.Auth.OIDC.Issuer != "" {
+		auth := newAuthenticator(tokens, s.log)
+		if oidc := cfg.Auth.OIDC; oidc.Issuer != "" {
+			auth = auth.withOIDC(oidc.Issuer, oidc.Audience, oidc.IdentityClaim)
+		}
+		s.log.Info("authentication enabled", "tokens", len(tokens), "oidcIssuer", cfg.Auth.OIDC.Issuer)
+		handler = auth.middleware(handler)
+	} else {
+		s.log.Warn("authentication disabled, no tokens configured")
+	}
+	return handler, nil
+}
+
+// config returns the config in effect.
+func (s *Server) config() *Config {
+	s.cfgMux.Lock()
+	defer s.cfgMux.Unlock()
+	return s.cfg
+}
+
+// Reload applies the config to the running server without dropping
+// connections. It reloads the tokens, the OIDC settings, the rate limit, the
+// fifo defaults and limits, the server-wide webhooks and the log level.
+// Running fifos keep their timeouts and the rate limits of clients start
+// anew. Other settings need a restart, changes to them are logged once and
+// ignored. Nothing is applied if the config is invalid.
+func (s *Server) Reload(cfg *Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	s.cfgMux.Lock()
+	defer s.cfgMux.Unlock()
+	handler, err := s.apiHandler(cfg)
+	if err != nil {
+		return err
+	}
+
+	// The settings that need a restart keep their values in effect. Changes
+	// to them are only logged by the first reload requesting them.
+	applied := *cfg
+	for name, setting := range restartSettings {
+		if setting.changed(cfg, s.cfg) && setting.changed(cfg, s.requested) {
+			s.log.Warn("config change needs a restart, ignored", "setting", name)
+		}
+		setting.keep(&applied, s.cfg)
+	}
+	s.cfg = &applied
+	s.requested = cfg
+
+	s.api.Store(&handler)
+	s.fifos.setConfig(applied.Fifo)
+	s.fifos.webhooks.configure(applied.Webhooks)
+	if s.logLevel != nil {
+		level, _ := parseLogLevel(applied.Log.Level)
+		s.logLevel.Set(level)
+	}
+	s.log.Info("config reloaded")
+	return nil
+}
+
+// restartSetting is a setting of the config that needs a restart.
+type restartSetting struct {
+	changed func(a, b *Config) bool
+	// keep sets the setting of dst to the one of src.
+	keep func(dst, src *Config)
+}
+
+// setting returns the restartSetting of the field.
+func setting[T comparable](field func(c *Config) *T) restartSetting {
+	return restartSetting{
+		changed: func(a, b *Config) bool { return *field(a) != *field(b) },
+		keep:    func(dst, src *Config) { *field(dst) = *field(src) },
+	}
+}
+
+// restartSettings are the settings Reload doesn't apply, by name.
+var restartSettings = map[string]restartSetting{
+	"listen":       setting(func(c *Config) *string { return &c.Listen }),
+	"unix socket":  setting(func(c *Config) *string { return &c.UnixSocket }),
+	"admin listen": setting(func(c *Config) *string { return &c.AdminListen }),
+	"log format":   setting(func(c *Config) *string { return &c.Log.Format }),
+	"tls":          setting(func(c *Config) *TLSConfig { return &c.TLS }),
+	"admin token":  setting(func(c *Config) *string { return &c.Auth.AdminToken }),
+	"alerts":       setting(func(c *Config) *AlertConfig { return &c.Alerts }),
+	"docs":         setting(func(c *Config) *bool { return &c.Docs }),
+	"metrics":      setting(func(c *Config) *bool { return &c.Metrics }),
+	"restore":      setting(func(c *Config) *string { return &c.Restore }),
+	"gc interval":  setting(func(c *Config) *time.Duration { return &c.Fifo.GCInterval }),
+}
+
+// ReloadOnSIGHUP reloads the config returned by load whenever the process
+// receives SIGHUP, until the context is done. Failed reloads are logged and
+// keep the current config.
+func (s *Server) ReloadOnSIGHUP(ctx context.Context, load func() (*Config, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+			case <-ctx.Done():
+				return
+			}
+			s.log.Info("reloading config")
+			cfg, err := load()
+			if err == nil {
+				err = s.Reload(cfg)
+			}
+			if err != nil {
+				s.log.Error("reloading config", "err", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	require := require.New(t)
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(os.WriteFile(tokenFile, []byte("old\n"), 0o600))
+	cfg := DefaultConfig()
+	cfg.Auth.TokenFile = tokenFile
+	log, level := cfg.NewLogger(io.Discard)
+	s, err := New(Options{Config: cfg, Tokens: []string{"static"}, Logger: log, LogLevel: level})
+	require.NoError(err)
+	defer s.Shutdown(context.Background())
+
+	status := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/fifo/list", http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(http.StatusOK, status("old"))
+	require.Equal(http.StatusUnauthorized, status("new"))
+
+	require.NoError(os.WriteFile(tokenFile, []byte("new\n"), 0o600))
+	reloaded := *cfg
+	reloaded.Fifo.MaxWaitTimeout = 2 * time.Hour
+	reloaded.Log.Level = "debug"
+	require.NoError(s.Reload(&reloaded))
+	require.Equal(http.StatusUnauthorized, status("old"))
+	require.Equal(http.StatusOK, status("new"))
+	require.Equal(http.StatusOK, status("static"))
+	require.Equal(2*time.Hour, s.fifos.config().MaxWaitTimeout)
+	require.Equal("DEBUG", level.Level().String())
+
+	// An invalid config is not applied.
+	invalid := reloaded
+	invalid.Fifo.MaxWaitTimeout = time.Hour
+	invalid.Auth.TokenFile = filepath.Join(t.TempDir(), "missing")
+	require.Error(s.Reload(&invalid))
+	require.Equal(http.StatusOK, status("new"))
+	require.Equal(2*time.Hour, s.fifos.config().MaxWaitTimeout)
+}
+
+func TestReloadRestartSetting(t *testing.T) {
+	require := require.New(t)
+	cfg := DefaultConfig()
+	var logs bytes.Buffer
+	log, level := cfg.NewLogger(&logs)
+	s, err := New(Options{Config: cfg, Logger: log, LogLevel: level})
+	require.NoError(err)
+	defer s.Shutdown(context.Background())
+
+	reloaded := *cfg
+	reloaded.Listen = ":9999"
+	reloaded.Fifo.MaxWaitTimeout = 2 * time.Hour
+	require.NoError(s.Reload(&reloaded))
+	require.Equal(cfg.Listen, s.config().Listen)
+	require.Equal(2*time.Hour, s.config().Fifo.MaxWaitTimeout)
+
+	// The change is only logged by the first reload requesting it.
+	again := reloaded
+	again.Fifo.MaxWaitTimeout = 3 * time.Hour
+	require.NoError(s.Reload(&again))
+	require.Equal(1, strings.Count(logs.String(), "needs a restart"))
+	require.Equal(cfg.Listen, s.config().Listen)
+	require.Equal(3*time.Hour, s.config().Fifo.MaxWaitTimeout)
+
+	// Reverting the change needs no restart.
+	require.NoError(s.Reload(cfg))
+	require.Equal(1, strings.Count(logs.String(), "needs a restart"))
+}
@@ -0,0 +1,421 @@
+// Package server implements the sync server. The server can be embedded in
+// other binaries and tests, either as an http.Handler or listening on the
+// addresses of its Config.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Options configure a Server.
+type Options struct {
+	// Config configures the server. If nil, DefaultConfig is used.
+	Config *Config
+	// Tokens are static tokens that may access all namespaces, in addition
+	// to the tokens of Config.Auth.TokenFile.
+	Tokens []string
+	// Logger receives the logs of the server. If nil, logs are discarded.
+	Logger *slog.Logger
+	// LogLevel is the level of Logger. If set, the admin API can change it.
+	LogLevel *slog.LevelVar
+}
+
+// Server is a sync server.
+type Server struct {
+	log         *slog.Logger
+	fifos       *fifoManager
+	handler     http.Handler
+	srv         *http.Server
+	stopMonitor context.CancelFunc
+	errs        chan error
+
+	mux       sync.Mutex
+	listeners []net.Listener
+
+	// cfg is the config in effect and requested the config of the last
+	// reload, they differ in the settings that need a restart. cfgMux
+	// guards both, see Reload.
+	cfgMux    sync.Mutex
+	cfg       *Config
+	requested *Config
+
+	// tokens and logLevel are taken from the Options, api handles the
+	// requests to apiMux with the authentication and rate limit of the
+	// current config. See Reload.
+	tokens   []string
+	logLevel *slog.LevelVar
+	apiMux   *http.ServeMux
+	api      atomic.Pointer[http.Handler]
+
+	// adminSrv serves the admin API on its own listener, if configured.
+	adminSrv *http.Server
+}
+
+// New returns a server configured by the options. The server handles
+// requests right away, Start is only needed to serve on the listen
+// addresses of the Config. Shutdown must be called to release the server
+// in any case.
+func New(opts Options) (*Server, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	log := opts.Logger
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	s := &Server{
+		cfg:       cfg,
+		requested: cfg,
+		log:       log,
+		tokens:    opts.Tokens,
+		logLevel:  opts.LogLevel,
+		apiMux:    http.NewServeMux(),
+	}
+	handler, err := s.apiHandler(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.api.Store(&handler)
+
+	mux := s.apiMux
+	fm := newFifoManager(cfg.Fifo, newWebhookSender(cfg.Webhooks, log), log)
+	s.fifos = fm
+	if cfg.Restore != "" {
+		if err := fm.restoreFile(cfg.Restore); err != nil {
+			fm.stopAll()
+			return nil, err
+		}
+	}
+	fm.registerHandlers(mux, "/v1/fifo")
+	fm.registerHandlers(mux, "/v1/ns/{namespace}/fifo")
+	fm.registerPipelineHandlers(mux, "/v1/pipeline")
+	fm.registerPipelineHandlers(mux, "/v1/ns/{namespace}/pipeline")
+	fm.registerQueueHandlers(mux, "/v1/queue")
+	fm.registerQueueHandlers(mux, "/v1/ns/{namespace}/queue")
+	newServerInfo(fm).registerHandlers(mux, "/v1")
+	// The unversioned paths of earlier releases are kept as aliases.
+	legacy := http.NewServeMux()
+	fm.registerLegacyHandlers(legacy, "/fifo")
+	fm.registerLegacyHandlers(legacy, "/ns/{namespace}/fifo")
+	mux.Handle("/fifo/", deprecated(legacy))
+	mux.Handle("/ns/", deprecated(legacy))
+
+	// The API documentation is public, the admin API and the metrics, which
+	// list the fifos of all namespaces, require the admin token.
+	root := http.NewServeMux()
+	root.Handle("/", versioned(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(*s.api.Load()).ServeHTTP(w, r)
+	})))
+	registerDocs(root, cfg.Docs)
+	if cfg.Auth.AdminToken != "" {
+		adminMux := root
+		if cfg.AdminListen != "" {
+			adminMux = http.NewServeMux()
+			s.adminSrv = &http.Server{Handler: recoverPanics(log, adminMux)}
+		}
+		admin := requireAdmin(cfg.Auth.AdminToken, log.WithGroup("auth"))
+		wrap := func(h http.Handler) http.Handler {
+			return versioned(admin(h))
+		}
+		fm.registerAdminHandlers(adminMux, "/v1/admin", wrap)
+		if cfg.Metrics {
+			newMetrics(fm).registerHandlers(adminMux, admin)
+		}
+		if opts.LogLevel != nil {
+			for _, rt := range newLogLevel(opts.LogLevel, log).routes() {
+				adminMux.Handle(rt.method+" /v1/admin"+rt.path, wrap(rt.handler))
+			}
+		}
+		log.Info("admin API enabled", "listen", cfg.AdminListen)
+	}
+
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	if mon := newMonitor(cfg.Alerts, fm, log); mon.enabled() {
+		log.Info("alerts enabled", "activeThreshold", cfg.Alerts.ActiveThreshold, "queueLimit", cfg.Alerts.QueueLimit,
+			"deadlocks", cfg.Alerts.Deadlocks, "breakDeadlocks", cfg.Alerts.BreakDeadlocks)
+		go mon.run(monitorCtx)
+	}
+	// The garbage collection stops with the monitor.
+	if cfg.Fifo.GCInterval > 0 {
+		go fm.runGC(monitorCtx, cfg.Fifo.GCInterval)
+	}
+
+	s.handler = recoverPanics(log, root)
+	s.stopMonitor = stopMonitor
+	s.srv = &http.Server{Handler: s.handler}
+	// Release blocked waiters once the server stops accepting connections,
+	// so they don't hold up the shutdown.
+	s.srv.RegisterOnShutdown(fm.shutdown)
+	return s, nil
+}
+
+// ServeHTTP handles a request to the sync API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Start listens on the TCP address and the unix socket of the Config and
+// serves requests in the background. If the process was started by systemd
+// socket activation, it serves on the passed sockets instead. The admin API
+// is served on its own address, if configured. Errors that stop serving are
+// reported on Err.
+func (s *Server) Start() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.errs != nil {
+		return errors.New("server already started")
+	}
+	cfg := s.config()
+
+	useTLS := cfg.TLS.Cert != ""
+	if useTLS {
+		tlsCfg, err := serverTLSConfig(cfg.TLS.ClientCA)
+		if err != nil {
+			return err
+		}
+		s.srv.TLSConfig = tlsCfg
+		if s.adminSrv != nil {
+			s.adminSrv.TLSConfig = tlsCfg
+		}
+		s.log.Info("serving HTTPS", "mutualTLS", cfg.TLS.ClientCA != "")
+	}
+	if err := enableHTTP2(s.srv, useTLS); err != nil {
+		return err
+	}
+	if s.adminSrv != nil {
+		if err := enableHTTP2(s.adminSrv, useTLS); err != nil {
+			return err
+		}
+	}
+
+	listeners, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	if listeners != nil {
+		s.log.Info("using systemd socket activation", "sockets", len(listeners))
+	} else if listeners, err = listenAll(cfg.Listen, cfg.UnixSocket); err != nil {
+		return err
+	}
+	servers := make([]*http.Server, len(listeners))
+	for i := range servers {
+		servers[i] = s.srv
+	}
+	if s.adminSrv != nil {
+		l, err := net.Listen("tcp", cfg.AdminListen)
+		if err != nil {
+			closeAll(listeners)
+			return fmt.Errorf("listening on admin address %s: %w", cfg.AdminListen, err)
+		}
+		listeners = append(listeners, l)
+		servers = append(servers, s.adminSrv)
+	}
+	s.listeners = listeners
+	s.errs = make(chan error, len(listeners))
+	for i, l := range listeners {
+		s.log.Info("listening", "network", l.Addr().Network(), "address", l.Addr().String(), "admin", servers[i] == s.adminSrv)
+		go func() {
+			var err error
+			if useTLS {
+				err = servers[i].ServeTLS(l, cfg.TLS.Cert, cfg.TLS.Key)
+			} else {
+				err = servers[i].Serve(l)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				s.errs <- err
+			}
+		}()
+	}
+	return nil
+}
+
+// shutdownTimeout bounds how long in-flight requests may take on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// Run starts the server and serves until the context is done or serving
+// fails, then shuts the server down. In-flight requests may take 30 seconds
+// to finish. Under systemd, Run reports readiness and shutdown and keeps the
+// watchdog alive.
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		s.log.Warn("reporting readiness", "err", err)
+	}
+	watchdogCtx, stopWatchdog := context.WithCancel(ctx)
+	defer stopWatchdog()
+	go s.keepWatchdogAlive(watchdogCtx)
+	var err error
+	select {
+	case err = <-s.Err():
+	case <-ctx.Done():
+	}
+
+	_ = sdNotify("STOPPING=1")
+	s.log.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		s.log.Error("shutdown", "err", err)
+	}
+	s.log.Info("shutdown complete")
+	return err
+}
+
+// Addrs returns the addresses the server listens on since Start.
+func (s *Server) Addrs() []net.Addr {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var addrs []net.Addr
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Err returns a channel that receives the errors that stop serving after
+// Start. The channel is nil before Start.
+func (s *Server) Err() <-chan error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.errs
+}
+
+// Shutdown stops the server. Blocked waiters are released, in-flight
+// requests may finish until the context is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mux.Lock()
+	started := s.errs != nil
+	s.mux.Unlock()
+
+	var err error
+	if started {
+		err = s.srv.Shutdown(ctx)
+		if s.adminSrv != nil {
+			err = errors.Join(err, s.adminSrv.Shutdown(ctx))
+		}
+	} else {
+		s.fifos.shutdown()
+	}
+	s.stopMonitor()
+	s.fifos.stopAll()
+	return err
+}
+
+// versioned announces the API version on every response and rejects requests
+// asking for a version the server doesn't speak.
+func versioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(api.VersionHeader, api.Version)
+		if v := r.Header.Get(api.VersionHeader); v != "" && v != api.Version {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported API version %q, supported: %s", v, api.Version))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecated marks responses of the unversioned legacy paths as deprecated
+// and points to their successor.
+func deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("</v1%s>; rel=\"successor-version\"", r.URL.Path))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenAll opens the TCP listener on addr and the unix socket listener on
+// socketPath. Empty arguments are skipped.
+func listenAll(addr, socketPath string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	if addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("listening on %s: %w", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+	if socketPath != "" {
+		// Remove a stale socket of a previous run, but don't take over the
+		// socket of a running server.
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			closeAll(listeners)
+			return nil, fmt.Errorf("unix socket %s is in use", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			closeAll(listeners)
+			return nil, fmt.Errorf("removing stale unix socket: %w", err)
+		}
+		l, err := net.Listen("unix", socketPath)
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("listening on unix socket %s: %w", socketPath, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// enableHTTP2 serves HTTP/2 on the server, over TLS or else as h2c, so
+// clients can multiplex many waits over few connections. Plain HTTP clients
+// may use prior knowledge or upgrade from HTTP/1.1. Must be called after the
+// TLS config of the server is set.
+func enableHTTP2(srv *http.Server, useTLS bool) error {
+	h2s := &http2.Server{}
+	// Configuring the server also shuts down the HTTP/2 connections, which
+	// are hijacked for h2c, with the server.
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return fmt.Errorf("configuring HTTP/2: %w", err)
+	}
+	if !useTLS {
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	}
+	return nil
+}
+
+// serverTLSConfig returns the TLS configuration of the server. If clientCAFile
+// is set, clients must present a certificate signed by one of its CAs.
+func serverTLSConfig(clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in client CA file")
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestServer(t *testing.T) {
+	t.Run("handler", func(t *testing.T) {
+		require := require.New(t)
+		s, err := New(Options{})
+		require.NoError(err)
+		defer s.Shutdown(context.Background())
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/version", http.NoBody))
+		require.Equal(http.StatusOK, rec.Code)
+		require.Equal(api.Version, rec.Header().Get(api.VersionHeader))
+		var version api.VersionResponse
+		require.NoError(json.NewDecoder(rec.Body).Decode(&version))
+		require.Equal(Version, version.Version)
+	})
+
+	t.Run("start and shutdown", func(t *testing.T) {
+		require := require.New(t)
+		cfg := DefaultConfig()
+		cfg.Listen = "127.0.0.1:0"
+		s, err := New(Options{Config: cfg, Tokens: []string{"secret"}})
+		require.NoError(err)
+		require.NoError(s.Start())
+		require.Error(s.Start())
+		require.Len(s.Addrs(), 1)
+
+		url := "http://" + s.Addrs()[0].String() + "/v1/fifo/new"
+		resp, err := http.Post(url, "application/json", http.NoBody)
+		require.NoError(err)
+		resp.Body.Close()
+		require.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+		require.NoError(s.Shutdown(context.Background()))
+		_, err = http.Post(url, "application/json", http.NoBody)
+		require.Error(err)
+	})
+
+	t.Run("h2c", func(t *testing.T) {
+		require := require.New(t)
+		cfg := DefaultConfig()
+		cfg.Listen = "127.0.0.1:0"
+		s, err := New(Options{Config: cfg})
+		require.NoError(err)
+		require.NoError(s.Start())
+
+		// The client speaks HTTP/2 right away, without upgrading.
+		client := &http.Client{Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}}
+		resp, err := client.Get("http://" + s.Addrs()[0].String() + "/v1/version")
+		require.NoError(err)
+		resp.Body.Close()
+		require.Equal(http.StatusOK, resp.StatusCode)
+		require.Equal(2, resp.ProtoMajor)
+
+		// The HTTP/2 connection is closed with the server.
+		require.NoError(s.Shutdown(context.Background()))
+		_, err = client.Get("http://" + s.Addrs()[0].String() + "/v1/version")
+		require.Error(err)
+	})
+
+	t.Run("admin listener", func(t *testing.T) {
+		require := require.New(t)
+		cfg := DefaultConfig()
+		cfg.Listen = "127.0.0.1:0"
+		cfg.AdminListen = "127.0.0.1:0"
+		cfg.Auth.AdminToken = "admin"
+		cfg.Metrics = true
+		s, err := New(Options{Config: cfg})
+		require.NoError(err)
+		require.NoError(s.Start())
+		defer s.Shutdown(context.Background())
+		require.Len(s.Addrs(), 2)
+
+		status := func(addr net.Addr, path string) int {
+			req, err := http.NewRequest(http.MethodGet, "http://"+addr.String()+path, http.NoBody)
+			require.NoError(err)
+			req.Header.Set("Authorization", "Bearer admin")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(err)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		public, admin := s.Addrs()[0], s.Addrs()[1]
+		require.Equal(http.StatusNotFound, status(public, "/v1/admin/backup"))
+		require.Equal(http.StatusOK, status(admin, "/v1/admin/backup"))
+		require.Equal(http.StatusNotFound, status(public, "/metrics"))
+		require.Equal(http.StatusOK, status(admin, "/metrics"))
+		require.Equal(http.StatusOK, status(public, "/v1/version"))
+
+		// The metrics require the admin token.
+		resp, err := http.Get("http://" + admin.String() + "/metrics")
+		require.NoError(err)
+		resp.Body.Close()
+		require.Equal(http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("log level", func(t *testing.T) {
+		require := require.New(t)
+		cfg := DefaultConfig()
+		cfg.Auth.AdminToken = "admin"
+		log, level := cfg.NewLogger(io.Discard)
+		s, err := New(Options{Config: cfg, Logger: log, LogLevel: level})
+		require.NoError(err)
+		defer s.Shutdown(context.Background())
+
+		do := func(method, body string) (int, string) {
+			req := httptest.NewRequest(method, "/v1/admin/log-level", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer admin")
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			var resp api.LogLevelResponse
+			_ = json.NewDecoder(rec.Body).Decode(&resp)
+			return rec.Code, resp.Level
+		}
+		code, got := do(http.MethodGet, "")
+		require.Equal(http.StatusOK, code)
+		require.Equal("info", got)
+		code, got = do(http.MethodPut, `{"level": "debug"}`)
+		require.Equal(http.StatusOK, code)
+		require.Equal("debug", got)
+		require.Equal(slog.LevelDebug, level.Level())
+		code, _ = do(http.MethodPut, `{"level": "verbose"}`)
+		require.Equal(http.StatusBadRequest, code)
+		require.Equal(slog.LevelDebug, level.Level())
+	})
+}
+
+func TestListenAllUnixSocket(t *testing.T) {
+	require := require.New(t)
+	socket := filepath.Join(t.TempDir(), "sync.sock")
+
+	listeners, err := listenAll("", socket)
+	require.NoError(err)
+	require.Len(listeners, 1)
+
+	// The socket of a running server isn't taken over.
+	_, err = listenAll("", socket)
+	require.Error(err)
+
+	// A stale socket is replaced.
+	listeners[0].(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(listeners[0].Close())
+	listeners, err = listenAll("", socket)
+	require.NoError(err)
+	closeAll(listeners)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"golang.org/x/net/websocket"
+)
+
+// sessionWriteTimeout bounds sending a message to the client of a session,
+// so a client that stopped reading can't hold the ticket.
+const sessionWriteTimeout = 10 * time.Second
+
+// maxSessionMessage bounds the size of the messages of the client of a
+// session.
+const maxSessionMessage = 1 << 10
+
+// session takes a ticket and holds it while the client stays connected over a
+// WebSocket. The client gets the events of the ticket and sends heartbeats,
+// done and cancel over the same connection. The ticket is canceled if the
+// connection closes before it ended.
+func (s *fifoManager) session(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "session", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	fifo, ok := s.getFifo(w, r, log)
+	if !ok {
+		return
+	}
+	// Only connections of HTTP/1.1 can be taken over.
+	if _, ok := w.(http.Hijacker); !ok || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		log.Warn("not a WebSocket request")
+		writeError(w, http.StatusBadRequest, "session requires a WebSocket over HTTP/1.1")
+		return
+	}
+	waitToken := r.URL.Query().Get("wait_token")
+	if err := fifo.checkWaitToken(waitToken); err != nil {
+		log.Warn("missing wait token")
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	select {
+	case <-fifo.stopC:
+		log.Warn("fifo deleted")
+		writeError(w, http.StatusGone, "fifo deleted")
+		return
+	case <-s.shutdownC:
+		log.Warn("server shutting down")
+		unavailable(w, "server shutting down")
+		return
+	default:
+	}
+	release, ok := s.acquireWaiter(w, r, log, fifo)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tick := newTicket(clientIdentity(r, r.URL.Query().Get("identity")))
+	tick.traceID = traceIDOf(r)
+	if !s.acquireTicketQuota(w, r, log, fifo, tick) {
+		return
+	}
+	log = log.With("ticket", tick.TicketID)
+	log.Info("ticket created", "identity", tick.identity, "trace", tick.traceID)
+	resp := tick.FifoTicketResponse
+	fifo.enqueue(tick)
+
+	// The ticket is released with the connection, also if the handshake
+	// fails, unless its turn went to another wait.
+	keep := false
+	defer func() {
+		if !keep && fifo.abort(tick, api.OutcomeDisconnected) {
+			log.Info("ticket canceled")
+		}
+	}()
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.MaxPayloadBytes = maxSessionMessage
+		keep = !s.runSession(ws, log, fifo, tick, resp, waitToken)
+	}}.ServeHTTP(w, r)
+}
+
+// runSession sends the events of the ticket to the client of the session and
+// handles its messages until the ticket ended or the session fails. It
+// returns false if the turn of the ticket went to another wait.
+func (s *fifoManager) runSession(ws *websocket.Conn, log *slog.Logger, fifo *fifo, tick *ticket, resp api.FifoTicketResponse, waitToken string) bool {
+	send := func(event string, data any) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if err := ws.SetWriteDeadline(time.Now().Add(sessionWriteTimeout)); err != nil {
+			return err
+		}
+		return websocket.JSON.Send(ws, api.FifoSessionMessage{Type: event, Data: raw})
+	}
+	fail := func(status int, msg string) error {
+		return send(api.SessionError, api.ErrorResponse{Error: msg, Status: status})
+	}
+
+	messages := make(chan []byte)
+	closedC := make(chan struct{})
+	stopC := make(chan struct{})
+	defer close(stopC)
+	go func() {
+		defer close(closedC)
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				log.Debug("reading message", "err", err)
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-stopC:
+				return
+			}
+		}
+	}()
+
+	if err := send(api.EventTicketCreated, resp); err != nil {
+		log.Debug("writing message", "err", err)
+		return true
+	}
+	events, unsubscribe := fifo.subscribe()
+	defer unsubscribe()
+	lastPosition := -1
+	waitC := tick.waitC
+	for {
+		// The position is only reported while the ticket is queued.
+		if pos := fifo.position(tick); pos >= 0 && pos != lastPosition {
+			if err := send(api.EventPosition, api.FifoPositionEvent{Position: pos}); err != nil {
+				log.Debug("writing message", "err", err)
+				return true
+			}
+			lastPosition = pos
+		}
+		var err error
+		select {
+		case <-waitC:
+			waitC = nil
+			if !fifo.claim(tick, waitToken) {
+				log.Warn("turn claimed by another wait")
+				_ = send(api.EventTurnClaimed, fifoEventOf(tick, api.EventTurnClaimed))
+				return false
+			}
+			info := fifo.accept(tick)
+			log.Info("my turn")
+			err = send(api.EventReady, info)
+		case <-events:
+		case raw := <-messages:
+			var msg api.FifoSessionMessage
+			if decodeErr := json.Unmarshal(raw, &msg); decodeErr != nil {
+				log.Warn("invalid message", "err", decodeErr)
+				err = fail(http.StatusBadRequest, fmt.Sprintf("invalid message: %v", decodeErr))
+				break
+			}
+			switch msg.Type {
+			case api.SessionHeartbeat:
+				// Heartbeats are coalesced, a pending one is as good as a
+				// new one.
+				select {
+				case tick.heartbeatC <- struct{}{}:
+				default:
+				}
+			case api.SessionDone:
+				if waitC != nil {
+					err = fail(http.StatusConflict, "ticket is not active")
+					break
+				}
+				select {
+				case tick.doneC <- struct{}{}:
+				case <-tick.endC:
+				case <-fifo.stopC:
+				}
+			case api.SessionCancel:
+				fifo.abort(tick, api.OutcomeCanceled)
+			default:
+				log.Warn("unknown message", "type", msg.Type)
+				err = fail(http.StatusBadRequest, fmt.Sprintf("unknown message type %q", msg.Type))
+			}
+		case <-tick.endC:
+			fifo.mux.Lock()
+			outcome := tick.outcome
+			fifo.mux.Unlock()
+			log.Info("ticket ended", "outcome", outcome)
+			_ = send(outcomeEvents[outcome], fifoEventOf(tick, outcomeEvents[outcome]))
+			return true
+		case <-closedC:
+			log.Info("client disconnected")
+			return true
+		case <-fifo.stopC:
+			log.Warn("fifo deleted")
+			_ = send(api.EventFifoDeleted, fifoDeletedEvent)
+			return true
+		case <-s.shutdownC:
+			log.Warn("server shutting down")
+			_ = fail(http.StatusServiceUnavailable, "server shutting down")
+			return true
+		}
+		if err != nil {
+			log.Debug("writing message", "err", err)
+			return true
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestSession(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+	fm.fifos.Put(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+	fifo.start(func() {})
+	sessionURL := srv.URL + "/v1/fifo/" + fifo.uuid.String() + "/session"
+
+	connect := func() *websocket.Conn {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(sessionURL, "http"), "", srv.URL)
+		require.NoError(err)
+		return ws
+	}
+	send := func(ws *websocket.Conn, typ string) {
+		require.NoError(websocket.JSON.Send(ws, api.FifoSessionMessage{Type: typ}))
+	}
+	// next returns the type of the next message other than a position and
+	// decodes its data into v, if given.
+	next := func(ws *websocket.Conn, v any) string {
+		require.NoError(ws.SetReadDeadline(time.Now().Add(5 * time.Second)))
+		for {
+			var msg api.FifoSessionMessage
+			require.NoError(websocket.JSON.Receive(ws, &msg))
+			if msg.Type == api.EventPosition {
+				continue
+			}
+			if v != nil {
+				require.NoError(json.Unmarshal(msg.Data, v))
+			}
+			return msg.Type
+		}
+	}
+
+	// Plain requests are rejected without taking a ticket.
+	resp, err := http.Get(sessionURL)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+	require.Empty(fifo.ticketLookup.GetAll())
+
+	first := connect()
+	defer first.Close()
+	var ticket api.FifoTicketResponse
+	require.Equal(api.EventTicketCreated, next(first, &ticket))
+	require.NotEmpty(ticket.Secret)
+	var info api.FifoTicketInfo
+	require.Equal(api.EventReady, next(first, &info))
+	require.Equal(ticket.TicketID, info.TicketID)
+
+	second := connect()
+	defer second.Close()
+	require.Equal(api.EventTicketCreated, next(second, nil))
+	send(second, api.SessionDone)
+	var failure api.ErrorResponse
+	require.Equal(api.SessionError, next(second, &failure))
+	require.Equal(http.StatusConflict, failure.Status)
+
+	// Done passes the fifo on.
+	send(first, api.SessionHeartbeat)
+	send(first, api.SessionDone)
+	require.Equal(api.EventTicketDone, next(first, nil))
+	require.Equal(api.EventReady, next(second, nil))
+
+	// The ticket is released with the connection.
+	third := connect()
+	defer third.Close()
+	require.Equal(api.EventTicketCreated, next(third, nil))
+	second.Close()
+	require.Equal(api.EventReady, next(third, nil))
+	send(third, api.SessionCancel)
+	require.Equal(api.EventTicketCanceled, next(third, nil))
+
+	var outcomes []string
+	for _, entry := range fifo.recentHistory() {
+		outcomes = append(outcomes, entry.Outcome)
+	}
+	require.Equal([]string{api.OutcomeDone, api.OutcomeDisconnected, api.OutcomeCanceled}, outcomes)
+}
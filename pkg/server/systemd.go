@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by socket activation.
+const listenFdsStart = 3
+
+// systemdListeners returns the listeners passed by systemd socket
+// activation, see sd_listen_fds(3), or nil if the server wasn't activated.
+// The variables of the protocol are removed from the environment, so child
+// processes don't take them for their own.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		// The listener uses a duplicate of the file descriptor.
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("using socket activation file descriptor %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends the state to the service manager, see sd_notify(3). It does
+// nothing if the server wasn't started by systemd with a notify socket.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ denotes a socket in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("notifying systemd: %w", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns the interval in which the watchdog of the
+// service manager expects a keep-alive, see sd_watchdog_enabled(3). Keep-alives
+// are sent twice as often. It returns zero if the watchdog isn't enabled for
+// the server.
+func watchdogInterval() (time.Duration, error) {
+	raw := os.Getenv("WATCHDOG_USEC")
+	if raw == "" {
+		return 0, nil
+	}
+	if rawPID := os.Getenv("WATCHDOG_PID"); rawPID != "" {
+		if pid, err := strconv.Atoi(rawPID); err != nil || pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC")
+	}
+	return time.Duration(usec) * time.Microsecond / 2, nil
+}
+
+// keepWatchdogAlive sends keep-alives to the watchdog of the service manager
+// until the context is done.
+func (s *Server) keepWatchdogAlive(ctx context.Context) {
+	interval, err := watchdogInterval()
+	if err != nil {
+		s.log.Warn("watchdog disabled", "err", err)
+		return
+	} else if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				s.log.Warn("keeping watchdog alive", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
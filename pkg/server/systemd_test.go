@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSdNotify(t *testing.T) {
+	require := require.New(t)
+	t.Setenv("NOTIFY_SOCKET", "")
+	require.NoError(sdNotify("READY=1"))
+
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(err)
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+	require.NoError(sdNotify("READY=1"))
+	buf := make([]byte, 64)
+	require.NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(err)
+	require.Equal("READY=1", string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	require := require.New(t)
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	interval, err := watchdogInterval()
+	require.NoError(err)
+	require.Zero(interval)
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	interval, err = watchdogInterval()
+	require.NoError(err)
+	require.Equal(15*time.Second, interval)
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	interval, err = watchdogInterval()
+	require.NoError(err)
+	require.Zero(interval)
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("WATCHDOG_USEC", "soon")
+	_, err = watchdogInterval()
+	require.Error(err)
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := systemdListeners()
+	require.NoError(t, err)
+	require.Nil(t, listeners)
+	require.Equal(t, "1", os.Getenv("LISTEN_FDS"))
+}
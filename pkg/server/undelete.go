@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// deletedFifo is a deleted fifo that can be undeleted by its owner until the
+// deleted retention ends.
+type deletedFifo struct {
+	// backup holds the settings and the history of the fifo. Its tickets
+	// were released on deletion and aren't restored.
+	backup    api.FifoBackup
+	deletedAt time.Time
+}
+
+// checkOwnerSecret reports whether the secret is the owner secret of the
+// deleted fifo.
+func (d *deletedFifo) checkOwnerSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(d.backup.OwnerSecret)) == 1
+}
+
+// retire removes the fifo from key, unless another fifo took its place, and
+// keeps it for undeletion for the deleted retention. Fifos stopped by a
+// server shutdown aren't kept.
+func (s *fifoManager) retire(key string, f *fifo) {
+	s.retireMux.Lock()
+	defer s.retireMux.Unlock()
+	if cur, ok := s.fifos.Get(key); !ok || cur != f {
+		return
+	}
+	s.fifos.Delete(key)
+	select {
+	case <-s.shutdownC:
+		return
+	default:
+	}
+	retention := s.config().DeletedRetention
+	if retention <= 0 {
+		return
+	}
+
+	backup := f.backup()
+	backup.Tickets = nil
+	deleted := &deletedFifo{backup: backup, deletedAt: time.Now()}
+	s.deleted.Put(key, deleted)
+	time.AfterFunc(retention, func() {
+		s.retireMux.Lock()
+		defer s.retireMux.Unlock()
+		// The fifo may have been undeleted and deleted again since.
+		if cur, ok := s.deleted.Get(key); ok && cur == deleted {
+			s.deleted.Delete(key)
+		}
+	})
+}
+
+// undelete revives a deleted fifo with its settings and history. Its queue
+// starts empty, as the tickets were released on deletion. Requires the owner
+// secret.
+func (s *fifoManager) undelete(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "undelete", "namespace", namespaceOf(r), "uuid", r.PathValue("uuid"))
+	log.Info("called")
+
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoSecretRequest](w, r)
+	if !ok {
+		return
+	}
+
+	key := fifoKey(ns, r.PathValue("uuid"))
+	s.retireMux.Lock()
+	defer s.retireMux.Unlock()
+	deleted, ok := s.deleted.Get(key)
+	if !ok {
+		log.Warn("deleted fifo not found")
+		writeError(w, http.StatusNotFound, "deleted fifo not found")
+		return
+	}
+	if !deleted.checkOwnerSecret(req.Secret) {
+		log.Warn("invalid owner secret")
+		writeError(w, http.StatusForbidden, "invalid owner secret")
+		return
+	}
+	if name := deleted.backup.Name; name != "" {
+		// Another fifo may have taken the name since the deletion.
+		s.namesMux.Lock()
+		defer s.namesMux.Unlock()
+		if existing, ok := s.names.Get(fifoKey(ns, name)); ok && !existing.stopped() {
+			log.Warn("fifo name is taken", "name", name, "existing", existing.uuid)
+			writeError(w, http.StatusConflict, "fifo name is taken")
+			return
+		}
+	}
+	fifo, err := s.restoreFifo(deleted.backup)
+	if err != nil {
+		log.Error("restoring fifo", "err", err)
+		writeError(w, http.StatusInternalServerError, "restoring fifo failed")
+		return
+	}
+
+	s.deleted.Delete(key)
+	s.run(key, fifo)
+	if fifo.name != "" {
+		s.names.Put(fifoKey(ns, fifo.name), fifo)
+	}
+	log.Info("fifo undeleted", "deletedAt", deleted.deletedAt)
+}
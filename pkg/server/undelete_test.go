@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUndelete(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// create creates a fifo on a new fifo manager. It returns a function that
+	// sends a request to the fifo and returns the status code, and the body of
+	// requests authorized by the owner secret.
+	create := func(t *testing.T, cfg FifoConfig) (func(method, path, body string) int, string) {
+		fm := newFifoManager(cfg, nil, log)
+		t.Cleanup(fm.stopAll)
+		mux := http.NewServeMux()
+		fm.registerHandlers(mux, "/v1/fifo")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/fifo/new", strings.NewReader("{}")))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp api.FifoNewResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		do := func(method, path, body string) int {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(method, "/v1/fifo/"+resp.UUID.String()+path, strings.NewReader(body)))
+			return rec.Code
+		}
+		return do, `{"secret": "` + resp.OwnerSecret + `"}`
+	}
+
+	t.Run("deleted manually", func(t *testing.T) {
+		require := require.New(t)
+		do, secret := create(t, DefaultConfig().Fifo)
+
+		require.Equal(http.StatusNotFound, do(http.MethodPost, "/undelete", secret))
+		require.Equal(http.StatusOK, do(http.MethodDelete, "", secret))
+		require.Equal(http.StatusNotFound, do(http.MethodGet, "/status", ""))
+		require.Equal(http.StatusForbidden, do(http.MethodPost, "/undelete", `{"secret": "wrong"}`))
+		require.Equal(http.StatusOK, do(http.MethodPost, "/undelete", secret))
+		require.Equal(http.StatusOK, do(http.MethodGet, "/status", ""))
+		require.Equal(http.StatusOK, do(http.MethodPost, "/ticket", "{}"))
+		require.Equal(http.StatusNotFound, do(http.MethodPost, "/undelete", secret))
+	})
+
+	t.Run("deleted when unused", func(t *testing.T) {
+		require := require.New(t)
+		cfg := DefaultConfig().Fifo
+		cfg.UnusedDestroyTimeout = 50 * time.Millisecond
+		do, secret := create(t, cfg)
+
+		require.Eventually(func() bool {
+			return do(http.MethodGet, "/status", "") == http.StatusNotFound
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(http.StatusOK, do(http.MethodPost, "/undelete", secret))
+		require.Equal(http.StatusOK, do(http.MethodGet, "/status", ""))
+	})
+
+	t.Run("retention ended", func(t *testing.T) {
+		require := require.New(t)
+		cfg := DefaultConfig().Fifo
+		cfg.DeletedRetention = 50 * time.Millisecond
+		do, secret := create(t, cfg)
+
+		require.Equal(http.StatusOK, do(http.MethodDelete, "", secret))
+		require.Eventually(func() bool {
+			return do(http.MethodPost, "/undelete", secret) == http.StatusNotFound
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		require := require.New(t)
+		cfg := DefaultConfig().Fifo
+		cfg.DeletedRetention = 0
+		do, secret := create(t, cfg)
+
+		require.Equal(http.StatusOK, do(http.MethodDelete, "", secret))
+		require.Equal(http.StatusNotFound, do(http.MethodPost, "/undelete", secret))
+	})
+	t.Run("name taken", func(t *testing.T) {
+		require := require.New(t)
+		fm := newFifoManager(DefaultConfig().Fifo, nil, log)
+		t.Cleanup(fm.stopAll)
+		mux := http.NewServeMux()
+		fm.registerHandlers(mux, "/v1/fifo")
+		do := func(method, path, body string) (int, api.FifoNewResponse) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(method, "/v1/fifo/"+path, strings.NewReader(body)))
+			var resp api.FifoNewResponse
+			if path == "new" && rec.Code == http.StatusOK {
+				require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+			}
+			return rec.Code, resp
+		}
+		named := `{"name": "deploy"}`
+		_, first := do(http.MethodPost, "new", named)
+		firstSecret := `{"secret": "` + first.OwnerSecret + `"}`
+		code, _ := do(http.MethodDelete, first.UUID.String(), firstSecret)
+		require.Equal(http.StatusOK, code)
+
+		// Another fifo takes the name, the deleted one can't get it back.
+		var second api.FifoNewResponse
+		require.Eventually(func() bool {
+			_, second = do(http.MethodPost, "new", named)
+			return !second.Existing
+		}, time.Second, 10*time.Millisecond)
+		code, _ = do(http.MethodPost, first.UUID.String()+"/undelete", firstSecret)
+		require.Equal(http.StatusConflict, code)
+
+		code, _ = do(http.MethodDelete, second.UUID.String(), `{"secret": "`+second.OwnerSecret+`"}`)
+		require.Equal(http.StatusOK, code)
+		require.Eventually(func() bool {
+			code, _ := do(http.MethodPost, first.UUID.String()+"/undelete", firstSecret)
+			return code == http.StatusOK
+		}, time.Second, 10*time.Millisecond)
+		_, got := do(http.MethodPost, "new", named)
+		require.True(got.Existing)
+		require.Equal(first.UUID, got.UUID)
+	})
+}
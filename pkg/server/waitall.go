@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// maxWaitAllTickets bounds the number of tickets waited for by one request.
+const maxWaitAllTickets = 16
+
+// waitAllResult is the turn or failure of the ticket at index i.
+type waitAllResult struct {
+	i       int
+	failure *acquireFailure
+}
+
+// waitAll waits for the turn of multiple tickets, all of them or any one,
+// and reports which are ready, still waiting or failed. Ready tickets are
+// accepted, like by wait, and the server sends heartbeats for them until it
+// responds.
+func (s *fifoManager) waitAll(w http.ResponseWriter, r *http.Request) {
+	log := s.log.With("call", "waitAll", "namespace", namespaceOf(r))
+	log.Info("called")
+
+	ns, ok := s.authorizeNamespace(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeRequest[api.FifoWaitAllRequest](w, r)
+	if !ok {
+		return
+	}
+	if len(req.Tickets) == 0 || len(req.Tickets) > maxWaitAllTickets {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("between 1 and %d tickets must be given", maxWaitAllTickets))
+		return
+	}
+	mode := req.Mode
+	if mode == "" {
+		mode = api.WaitAll
+	}
+	if mode != api.WaitAll && mode != api.WaitAny {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("mode must be %q or %q", api.WaitAll, api.WaitAny))
+		return
+	}
+	var timeoutC <-chan time.Time
+	if req.Timeout != "" {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil || timeout <= 0 {
+			writeError(w, http.StatusBadRequest, "timeout must be a positive duration")
+			return
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	fifos := make([]*fifo, len(req.Tickets))
+	tickets := make([]*ticket, len(req.Tickets))
+	for i, t := range req.Tickets {
+		fifo, ok := s.fifos.Get(fifoKey(ns, t.UUID.String()))
+		if !ok {
+			log.Warn("fifo not found", "uuid", t.UUID)
+			writeError(w, http.StatusNotFound, fmt.Sprintf("fifo %s not found", t.UUID))
+			return
+		}
+		tick, ok := fifo.ticketLookup.Get(t.TicketID.String())
+		if !ok {
+			log.Warn("ticket not found", "uuid", t.UUID, "ticket", t.TicketID)
+			writeError(w, http.StatusNotFound, fmt.Sprintf("ticket %s not found", t.TicketID))
+			return
+		}
+		for j := range i {
+			if tickets[j] == tick {
+				writeError(w, http.StatusBadRequest, "tickets must not be given twice")
+				return
+			}
+		}
+		if !fifo.checkTicketSecret(tick, t.Secret) {
+			log.Warn("invalid secret", "uuid", t.UUID, "ticket", t.TicketID)
+			writeError(w, http.StatusForbidden, fmt.Sprintf("invalid secret of ticket %s", t.TicketID))
+			return
+		}
+		if err := fifo.checkWaitToken(t.WaitToken); err != nil {
+			log.Warn("missing wait token", "uuid", t.UUID, "ticket", t.TicketID)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("ticket %s: %s", t.TicketID, err))
+			return
+		}
+		fifos[i], tickets[i] = fifo, tick
+	}
+	for _, fifo := range fifos {
+		release, ok := s.acquireWaiter(w, r, log, fifo)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	results := make(chan waitAllResult, len(tickets))
+	for i := range tickets {
+		go s.waitTurn(ctx, fifos[i], tickets[i], i, results)
+	}
+
+	ready := make([]*api.FifoTicketInfo, len(tickets))
+	failed := make([]*acquireFailure, len(tickets))
+	// record accepts the ticket if its turn came. It returns whether the
+	// wait is over.
+	record := func(res waitAllResult) bool {
+		if res.failure == nil && !fifos[res.i].claim(tickets[res.i], req.Tickets[res.i].WaitToken) {
+			res.failure = &acquireFailure{http.StatusConflict, "turn claimed by another wait"}
+		}
+		if res.failure != nil {
+			failed[res.i] = res.failure
+			return mode == api.WaitAll
+		}
+		info := fifos[res.i].accept(tickets[res.i])
+		ready[res.i] = &info
+		go sendHeartbeats(ctx, fifos[res.i], tickets[res.i])
+		return mode == api.WaitAny
+	}
+	for resolved, done := 0, false; resolved < len(tickets) && !done; resolved++ {
+		select {
+		case res := <-results:
+			done = record(res)
+		case <-timeoutC:
+			log.Info("timeout reached")
+			done = true
+		case <-r.Context().Done():
+			log.Info("client disconnected")
+			return
+		}
+	}
+	// Tickets whose turn came meanwhile are reported as well, so they don't
+	// expire unnoticed.
+	for drained := false; !drained; {
+		select {
+		case res := <-results:
+			record(res)
+		default:
+			drained = true
+		}
+	}
+
+	resp := api.FifoWaitAllResponse{
+		Ready:   []api.FifoWaitAllReady{},
+		Waiting: []api.FifoTicketRef{},
+		Failed:  []api.FifoWaitAllFailure{},
+	}
+	for i, t := range req.Tickets {
+		ref := api.FifoTicketRef{UUID: t.UUID, TicketID: t.TicketID}
+		switch {
+		case ready[i] != nil:
+			resp.Ready = append(resp.Ready, api.FifoWaitAllReady{UUID: t.UUID, FifoTicketInfo: *ready[i]})
+		case failed[i] != nil:
+			resp.Failed = append(resp.Failed, api.FifoWaitAllFailure{FifoTicketRef: ref, Error: failed[i].msg, Status: failed[i].status})
+		default:
+			resp.Waiting = append(resp.Waiting, ref)
+		}
+	}
+	log.Info("wait over", "mode", mode, "ready", len(resp.Ready), "waiting", len(resp.Waiting), "failed", len(resp.Failed))
+	encode(w, 200, resp)
+}
+
+// waitTurn sends the result of waiting for the turn of the ticket at index i,
+// unless the context is done first.
+func (s *fifoManager) waitTurn(ctx context.Context, fifo *fifo, tick *ticket, i int, results chan<- waitAllResult) {
+	res := waitAllResult{i: i}
+	select {
+	case <-tick.waitC:
+	case <-tick.abortC:
+		res.failure = &acquireFailure{http.StatusGone, "ticket aborted by fifo owner"}
+	case <-fifo.stopC:
+		res.failure = &acquireFailure{http.StatusGone, "fifo deleted"}
+	case <-s.shutdownC:
+		res.failure = &acquireFailure{http.StatusServiceUnavailable, "server shutting down"}
+	case <-ctx.Done():
+		return
+	}
+	results <- res
+}
+
+// sendHeartbeats sends heartbeats for the active ticket until the context is
+// done.
+func sendHeartbeats(ctx context.Context, fifo *fifo, tick *ticket) {
+	ticker := time.NewTicker(fifo.heartbeatInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case tick.heartbeatC <- struct{}{}:
+			default:
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitAll(t *testing.T) {
+	require := require.New(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cfg := DefaultConfig().Fifo
+	fm := newFifoManager(cfg, nil, log)
+	defer fm.stopAll()
+	mux := http.NewServeMux()
+	fm.registerHandlers(mux, "/v1/fifo")
+
+	// Both fifos are held by a blocker, a ticket is queued behind it.
+	var fifos []*fifo
+	var blockers, tickets []*ticket
+	for range 2 {
+		fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+		fm.run(fifoKey(fifo.namespace, fifo.uuid.String()), fifo)
+		blocker, tick := newTicket(""), newTicket("")
+		fifo.enqueue(blocker)
+		fifo.enqueue(tick)
+		<-blocker.waitC
+		fifo.accept(blocker)
+		fifos = append(fifos, fifo)
+		blockers = append(blockers, blocker)
+		tickets = append(tickets, tick)
+	}
+	ref := func(i int, tick *ticket) api.FifoWaitAllTicket {
+		return api.FifoWaitAllTicket{UUID: fifos[i].uuid, TicketID: tick.TicketID, Secret: tick.Secret}
+	}
+	waitAll := func(req api.FifoWaitAllRequest) (api.FifoWaitAllResponse, int) {
+		b, err := json.Marshal(req)
+		require.NoError(err)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/fifo/wait", strings.NewReader(string(b))))
+		var resp api.FifoWaitAllResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return resp, rec.Code
+	}
+	both := []api.FifoWaitAllTicket{ref(0, tickets[0]), ref(1, tickets[1])}
+
+	// Invalid requests.
+	_, code := waitAll(api.FifoWaitAllRequest{})
+	require.Equal(http.StatusBadRequest, code)
+	_, code = waitAll(api.FifoWaitAllRequest{Tickets: both, Mode: "some"})
+	require.Equal(http.StatusBadRequest, code)
+	_, code = waitAll(api.FifoWaitAllRequest{Tickets: both, Timeout: "-1s"})
+	require.Equal(http.StatusBadRequest, code)
+	_, code = waitAll(api.FifoWaitAllRequest{Tickets: []api.FifoWaitAllTicket{both[0], both[0]}})
+	require.Equal(http.StatusBadRequest, code)
+	_, code = waitAll(api.FifoWaitAllRequest{Tickets: []api.FifoWaitAllTicket{{UUID: fifos[0].uuid, TicketID: uuidlib.New()}}})
+	require.Equal(http.StatusNotFound, code)
+	_, code = waitAll(api.FifoWaitAllRequest{Tickets: []api.FifoWaitAllTicket{{UUID: fifos[0].uuid, TicketID: tickets[0].TicketID}}})
+	require.Equal(http.StatusForbidden, code)
+
+	// The partial result is returned once the timeout is reached.
+	resp, code := waitAll(api.FifoWaitAllRequest{Tickets: both, Timeout: "10ms"})
+	require.Equal(http.StatusOK, code)
+	require.Empty(resp.Ready)
+	require.Len(resp.Waiting, 2)
+	require.Empty(resp.Failed)
+
+	// Waiting for any ticket returns once the second fifo is released.
+	respC := make(chan api.FifoWaitAllResponse)
+	go func() {
+		resp, _ := waitAll(api.FifoWaitAllRequest{Tickets: both, Mode: api.WaitAny})
+		respC <- resp
+	}()
+	blockers[1].doneC <- struct{}{}
+	resp = <-respC
+	require.Len(resp.Ready, 1)
+	require.Equal(tickets[1].TicketID, resp.Ready[0].TicketID)
+	require.Equal(api.TicketAccepted, resp.Ready[0].State)
+	require.Equal([]api.FifoTicketRef{{UUID: fifos[0].uuid, TicketID: tickets[0].TicketID}}, resp.Waiting)
+
+	// Waiting for all tickets returns once the first fifo is released too.
+	go func() {
+		resp, _ := waitAll(api.FifoWaitAllRequest{Tickets: both})
+		respC <- resp
+	}()
+	blockers[0].doneC <- struct{}{}
+	resp = <-respC
+	require.Len(resp.Ready, 2)
+	require.Empty(resp.Waiting)
+
+	// A failed ticket ends the wait for all tickets.
+	queued := newTicket("")
+	fifos[0].enqueue(queued)
+	go func() {
+		resp, _ := waitAll(api.FifoWaitAllRequest{Tickets: []api.FifoWaitAllTicket{ref(0, queued), ref(1, tickets[1])}})
+		respC <- resp
+	}()
+	require.Eventually(func() bool { return fifos[0].waiters.Load() == 1 }, time.Second, 10*time.Millisecond)
+	fifos[0].abort(queued, api.OutcomeCanceledByOwner)
+	resp = <-respC
+	require.Len(resp.Ready, 1)
+	require.Len(resp.Failed, 1)
+	require.Equal(queued.TicketID, resp.Failed[0].TicketID)
+	require.Equal(http.StatusGone, resp.Failed[0].Status)
+}
+
+func TestSendHeartbeatsShortDoneTimeout(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := DefaultConfig().Fifo
+	cfg.DoneTimeout = time.Nanosecond
+	fifo := newFifo(defaultNamespace, cfg, nil, "", log)
+
+	// Sending heartbeats must not panic on the tiny done timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sendHeartbeats(ctx, fifo, newTicket(""))
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/katexochen/sync/api"
+)
+
+// webhookEvents are the events delivered to webhooks.
+var webhookEvents = map[string]bool{
+	api.EventTicketNotified: true,
+	api.EventTicketExpired:  true,
+	api.EventFifoDeleted:    true,
+	api.EventFifoAlert:      true,
+}
+
+const (
+	// webhookTimeout bounds a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+	// webhookAttempts is the number of delivery attempts per webhook.
+	webhookAttempts = 3
+)
+
+// webhook is a URL that receives events, signed with the secret. If events
+// is set, only those events are delivered.
+type webhook struct {
+	url    string
+	secret string
+	events []string
+}
+
+// webhookSender delivers events to the server-wide webhooks and the webhooks
+// of single fifos. Deliveries are asynchronous and not ordered.
+type webhookSender struct {
+	client *http.Client
+	log    *slog.Logger
+	// backoff is the delay before the first retry, doubled on each retry.
+	backoff time.Duration
+
+	mux   sync.Mutex
+	hooks []webhook
+}
+
+func newWebhookSender(cfg WebhookConfig, log *slog.Logger) *webhookSender {
+	s := &webhookSender{
+		client:  &http.Client{Timeout: webhookTimeout},
+		log:     log.WithGroup("webhook"),
+		backoff: time.Second,
+	}
+	s.configure(cfg)
+	return s
+}
+
+// configure replaces the server-wide webhooks.
+func (s *webhookSender) configure(cfg WebhookConfig) {
+	var hooks []webhook
+	for _, u := range cfg.URLs {
+		hooks = append(hooks, webhook{url: u, secret: cfg.Secret})
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.hooks = hooks
+}
+
+// send delivers the payload to the server-wide webhooks and to extra.
+func (s *webhookSender) send(payload api.FifoWebhook, extra ...webhook) {
+	if !webhookEvents[payload.Type] {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		s.log.Error("encoding payload", "err", err)
+		return
+	}
+	s.mux.Lock()
+	hooks := append(extra, s.hooks...)
+	s.mux.Unlock()
+	for _, hook := range hooks {
+		if hook.events != nil && !slices.Contains(hook.events, payload.Type) {
+			continue
+		}
+		go s.deliver(hook, body)
+	}
+}
+
+// deliver posts the body to the webhook, retrying failed attempts.
+func (s *webhookSender) deliver(hook webhook, body []byte) {
+	log := s.log.With("url", redactURL(hook.url))
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := s.post(hook, body)
+		if err == nil {
+			log.Debug("delivered")
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Warn("delivery failed, giving up", "err", err, "attempts", attempt)
+			return
+		}
+		log.Info("delivery failed, retrying", "err", err, "attempt", attempt)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *webhookSender) post(hook webhook, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(api.WebhookSignatureHeader, signWebhook(hook.secret, body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook returns the value of the signature header for the body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateFifoWebhook checks the webhook settings of a new fifo.
+func validateFifoWebhook(req api.FifoNewRequest) error {
+	if req.Webhook == "" {
+		if req.WebhookSecret != "" || len(req.WebhookEvents) > 0 {
+			return errors.New("webhook secret and events require a webhook")
+		}
+		return nil
+	}
+	for _, ev := range req.WebhookEvents {
+		if !webhookEvents[ev] {
+			return fmt.Errorf("event %q isn't delivered to webhooks", ev)
+		}
+	}
+	return validateWebhookURL(req.Webhook)
+}
+
+// validateWebhookURL checks that raw is an absolute HTTP(S) URL.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("parsing webhook URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q must be an absolute http or https URL", redactURL(raw))
+	}
+	return nil
+}
+
+// redactURL strips the path and query of a webhook URL for logging, as they
+// often contain credentials, like the token of a Slack webhook.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "invalid URL"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// webhookText summarizes the webhook for humans.
+func webhookText(payload api.FifoWebhook) string {
+	name := payload.UUID.String()
+	if payload.Namespace != "" {
+		name = payload.Namespace + "/" + name
+	}
+	var ticket string
+	if payload.Event != nil {
+		ticket = payload.Event.TicketID.String()
+		if payload.Event.Identity != "" {
+			ticket += " of " + payload.Event.Identity
+		}
+	}
+	switch payload.Type {
+	case api.EventTicketNotified:
+		if payload.Event != nil && payload.Event.Renotified > 0 {
+			return fmt.Sprintf("fifo %s: ticket %s is next, reminder %d", name, ticket, payload.Event.Renotified)
+		}
+		return fmt.Sprintf("fifo %s: ticket %s is next", name, ticket)
+	case api.EventTicketExpired:
+		return fmt.Sprintf("fifo %s: ticket %s expired", name, ticket)
+	case api.EventFifoDeleted:
+		return fmt.Sprintf("fifo %s was deleted", name)
+	}
+	return fmt.Sprintf("fifo %s: %s", name, payload.Type)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	uuidlib "github.com/google/uuid"
+	"github.com/katexochen/sync/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSender(t *testing.T) {
+	require := require.New(t)
+
+	type delivery struct {
+		signature string
+		payload   api.FifoWebhook
+		valid     bool
+	}
+	deliveries := make(chan delivery, 10)
+	var failures atomic.Int32
+	failures.Store(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt fails and is retried.
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d := delivery{signature: r.Header.Get(api.WebhookSignatureHeader)}
+		d.valid = d.signature == signWebhook("server-secret", body) || d.signature == signWebhook("owner-secret", body)
+		d.valid = d.valid && json.Unmarshal(body, &d.payload) == nil
+		deliveries <- d
+	}))
+	defer srv.Close()
+
+	sender := newWebhookSender(WebhookConfig{URLs: []string{srv.URL}, Secret: "server-secret"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	sender.backoff = time.Millisecond
+
+	payload := api.FifoWebhook{
+		Type:  api.EventTicketExpired,
+		UUID:  uuidlib.New(),
+		Event: &api.FifoEvent{Type: api.EventTicketExpired, TicketID: uuidlib.New()},
+	}
+	sender.send(payload, webhook{url: srv.URL, secret: "owner-secret"})
+
+	var signatures []string
+	for range 2 {
+		select {
+		case d := <-deliveries:
+			require.True(d.valid)
+			require.Equal(payload.UUID, d.payload.UUID)
+			require.Equal(payload.Event.TicketID, d.payload.Event.TicketID)
+			signatures = append(signatures, d.signature)
+		case <-time.After(5 * time.Second):
+			require.FailNow("webhook not delivered")
+		}
+	}
+	require.NotEqual(signatures[0], signatures[1])
+
+	// Events not meant for webhooks are dropped.
+	sender.send(api.FifoWebhook{Type: api.EventTicketCreated, UUID: uuidlib.New()})
+	select {
+	case <-deliveries:
+		require.FailNow("unexpected delivery")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Webhooks with events only receive those.
+	sender.configure(WebhookConfig{})
+	sender.send(payload, webhook{url: srv.URL, secret: "owner-secret", events: []string{api.EventFifoDeleted}})
+	deleted := api.FifoWebhook{Type: api.EventFifoDeleted, UUID: uuidlib.New()}
+	sender.send(deleted, webhook{url: srv.URL, secret: "owner-secret", events: []string{api.EventFifoDeleted}})
+	select {
+	case d := <-deliveries:
+		require.True(d.valid)
+		require.Equal(deleted.UUID, d.payload.UUID)
+	case <-time.After(5 * time.Second):
+		require.FailNow("webhook not delivered")
+	}
+	select {
+	case <-deliveries:
+		require.FailNow("unexpected delivery")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestValidateFifoWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateFifoWebhook(api.FifoNewRequest{}))
+	assert.NoError(validateFifoWebhook(api.FifoNewRequest{
+		Webhook:       "https://example.com/hook",
+		WebhookSecret: "secret",
+		WebhookEvents: []string{api.EventTicketExpired},
+	}))
+	assert.Error(validateFifoWebhook(api.FifoNewRequest{WebhookSecret: "secret"}))
+	assert.Error(validateFifoWebhook(api.FifoNewRequest{
+		Webhook:       "https://example.com/hook",
+		WebhookEvents: []string{api.EventTicketCreated},
+	}))
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateWebhookURL("https://hooks.slack.com/services/T/B/X"))
+	assert.NoError(validateWebhookURL("http://localhost:9000/hook"))
+	assert.Error(validateWebhookURL("ftp://example.com"))
+	assert.Error(validateWebhookURL("/relative"))
+	assert.Error(validateWebhookURL("://"))
+}
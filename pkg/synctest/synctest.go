@@ -0,0 +1,103 @@
+// Package synctest runs an in-process sync server for tests of code that
+// uses the Go client, so no separate server process or container is needed.
+package synctest
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/katexochen/sync/api/client"
+	"github.com/katexochen/sync/pkg/server"
+)
+
+// Server is a sync server that keeps its state in memory and serves on a
+// local httptest listener. It is shut down when the test ends.
+type Server struct {
+	// URL is the endpoint of the server.
+	URL string
+
+	t          testing.TB
+	clientOpts []client.Option
+}
+
+// Option configures a Server.
+type Option func(*options)
+
+type options struct {
+	cfg    *server.Config
+	tokens []string
+}
+
+// WithConfig configures the server. Listen addresses of the config are
+// ignored, the server always serves on a local httptest listener.
+func WithConfig(cfg *server.Config) Option {
+	return func(o *options) {
+		o.cfg = cfg
+	}
+}
+
+// WithToken makes the server require the token. The clients returned by the
+// Server authenticate with it.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.tokens = append(o.tokens, token)
+	}
+}
+
+// NewServer starts a server for the test.
+func NewServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	srv, err := server.New(server.Options{Config: o.cfg, Tokens: o.tokens})
+	if err != nil {
+		t.Fatalf("creating sync server: %v", err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		// Shutdown releases blocked waiters, so closing the listener doesn't
+		// wait for them.
+		if err := srv.Shutdown(context.Background()); err != nil {
+			t.Errorf("shutting down sync server: %v", err)
+		}
+		ts.Close()
+	})
+
+	s := &Server{
+		URL: ts.URL,
+		t:   t,
+		// Failures should surface right away rather than after retries.
+		clientOpts: []client.Option{client.WithHTTPClient(ts.Client()), client.WithRetries(0, 0)},
+	}
+	if len(o.tokens) > 0 {
+		s.clientOpts = append(s.clientOpts, client.WithToken(o.tokens[0]))
+	}
+	return s
+}
+
+// ClientOptions returns the options that connect a client to the server.
+func (s *Server) ClientOptions() []client.Option {
+	return append([]client.Option(nil), s.clientOpts...)
+}
+
+// NewFifo creates a fifo on the server and returns a client for it. Options
+// are applied after those that connect the client to the server. The test
+// fails if the fifo can't be created.
+func (s *Server) NewFifo(opts ...client.Option) *client.Fifo {
+	s.t.Helper()
+	f, err := client.NewFifo(context.Background(), s.URL, append(s.ClientOptions(), opts...)...)
+	if err != nil {
+		s.t.Fatalf("creating fifo: %v", err)
+	}
+	return f
+}
+
+// FifoFromUUID returns a client for an existing fifo on the server, for
+// example to act as another process sharing the fifo.
+func (s *Server) FifoFromUUID(uuid string, opts ...client.Option) *client.Fifo {
+	return client.FifoFromUUID(s.URL, uuid, append(s.ClientOptions(), opts...)...)
+}
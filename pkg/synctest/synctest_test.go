@@ -0,0 +1,42 @@
+package synctest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katexochen/sync/api/client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	s := NewServer(t, WithToken("secret"))
+
+	owner := s.NewFifo()
+	// Two processes sharing the fifo take turns.
+	var wg sync.WaitGroup
+	var running atomic.Int32
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f := s.FifoFromUUID(owner.FifoUUID())
+			err := f.WithTicket(ctx, func(ctx context.Context) error {
+				require.Equal(int32(1), running.Add(1))
+				defer running.Add(-1)
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+			require.NoError(err)
+		}()
+	}
+	wg.Wait()
+
+	// Clients without the token are rejected.
+	_, err := client.NewFifo(ctx, s.URL)
+	require.Error(err)
+}
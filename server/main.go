@@ -1,20 +1,56 @@
 package main
 
 import (
-	"log/slog"
-	"net/http"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/katexochen/sync/pkg/server"
 )
 
 func main() {
-	log := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	cfg, err := server.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+
+	if cfg.Check {
+		if err := server.CheckRestore(cfg, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	log, level := cfg.NewLogger(os.Stderr)
 	log.Info("started")
 
-	mux := http.NewServeMux()
-	fm := newFifoManager(log)
-	fm.registerHandlers(mux, "/fifo")
+	srv, err := server.New(server.Options{
+		Config: cfg,
+		// Tokens in SYNC_TOKENS are separated by commas.
+		Tokens:   strings.Split(os.Getenv("SYNC_TOKENS"), ","),
+		Logger:   log,
+		LogLevel: level,
+	})
+	if err != nil {
+		log.Error("fatal", "err", err)
+		os.Exit(1)
+	}
 
-	if err := http.ListenAndServe(":8080", mux); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv.ReloadOnSIGHUP(ctx, func() (*server.Config, error) {
+		return server.LoadConfig(os.Args[1:])
+	})
+	if err := srv.Run(ctx); err != nil {
 		log.Error("fatal", "err", err)
 		os.Exit(1)
 	}
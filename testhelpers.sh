@@ -3,19 +3,31 @@
 export URL="http://localhost:8080"
 
 function newFifo() {
-    UUID=$(curl -fsS $URL/fifo/new | jq -r '.uuid')
-    export UUID
+    RESP=$(curl -fsS -X POST $URL/v1/fifo/new)
+    UUID=$(jq -r '.uuid' <<< "$RESP")
+    OWNER_SECRET=$(jq -r '.owner_secret' <<< "$RESP")
+    export UUID OWNER_SECRET
 }
 
 function ticketFifo() {
-    TICKET=$(curl -fsS "$URL/fifo/$UUID/ticket" | jq -r '.ticket')
-    export TICKET
+    RESP=$(curl -fsS -X POST "$URL/v1/fifo/$UUID/ticket")
+    TICKET=$(jq -r '.ticket' <<< "$RESP")
+    SECRET=$(jq -r '.secret' <<< "$RESP")
+    export TICKET SECRET
 }
 
 function waitFifo() {
-    curl -fsSL "$URL/fifo/$UUID/wait/$TICKET"
+    curl -fsSL -H "Sync-Ticket-Secret: $SECRET" "$URL/v1/fifo/$UUID/wait/$TICKET"
 }
 
 function doneFifo() {
-    curl -fsSL "$URL/fifo/$UUID/done/$TICKET"
+    curl -fsSL -X POST -d "{\"secret\":\"$SECRET\"}" "$URL/v1/fifo/$UUID/done/$TICKET"
+}
+
+function heartbeatFifo() {
+    curl -fsSL -X POST -d "{\"secret\":\"$SECRET\"}" "$URL/v1/fifo/$UUID/heartbeat/$TICKET"
+}
+
+function deleteFifo() {
+    curl -fsSL -X DELETE -d "{\"secret\":\"$OWNER_SECRET\"}" "$URL/v1/fifo/$UUID"
 }